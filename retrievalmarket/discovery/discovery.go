@@ -1,14 +1,68 @@
 package discovery
 
 import (
-	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"sync"
+
+	"github.com/ipfs/go-cid"
 	cbor "github.com/ipfs/go-ipld-cbor"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 )
 
 func init() {
 	cbor.RegisterCborType(retrievalmarket.RetrievalPeer{})
+	cbor.RegisterCborType(peerEntry{})
 }
 
-func Multi(r retrievalmarket.PeerResolver) retrievalmarket.PeerResolver { // TODO: actually support multiple mechanisms
-	return r
+type multiResolver []retrievalmarket.PeerResolver
+
+// Multi returns a peer resolver that looks up peers with all of the given
+// resolvers at once and merges their results, dropping duplicates
+func Multi(resolvers ...retrievalmarket.PeerResolver) retrievalmarket.PeerResolver {
+	if len(resolvers) == 1 {
+		return resolvers[0]
+	}
+	return multiResolver(resolvers)
+}
+
+// GetPeers returns the peers found by every resolver, in resolver order. It
+// only fails if every resolver fails
+func (mr multiResolver) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	results := make([][]retrievalmarket.RetrievalPeer, len(mr))
+	errs := make([]error, len(mr))
+
+	var wg sync.WaitGroup
+	for i, resolver := range mr {
+		wg.Add(1)
+		go func(i int, resolver retrievalmarket.PeerResolver) {
+			defer wg.Done()
+			results[i], errs[i] = resolver.GetPeers(payloadCID)
+		}(i, resolver)
+	}
+	wg.Wait()
+
+	var lastErr error
+	failed := 0
+	seen := make(map[retrievalmarket.RetrievalPeer]struct{})
+	peers := []retrievalmarket.RetrievalPeer{}
+	for i, result := range results {
+		if errs[i] != nil {
+			log.Warnf("resolving peers: %s", errs[i])
+			lastErr = errs[i]
+			failed++
+			continue
+		}
+		for _, peer := range result {
+			if _, ok := seen[peer]; ok {
+				continue
+			}
+			seen[peer] = struct{}{}
+			peers = append(peers, peer)
+		}
+	}
+	if len(mr) > 0 && failed == len(mr) {
+		return nil, xerrors.Errorf("all peer resolvers failed: %w", lastErr)
+	}
+	return peers, nil
 }
@@ -0,0 +1,66 @@
+package discovery_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-data-transfer/testutil"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/discovery"
+)
+
+type testResolver struct {
+	peers []retrievalmarket.RetrievalPeer
+	err   error
+}
+
+func (tr testResolver) GetPeers(cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	return tr.peers, tr.err
+}
+
+func TestMulti(t *testing.T) {
+	peer1 := retrievalmarket.RetrievalPeer{Address: address.TestAddress, ID: peer.ID("peer1")}
+	peer2 := retrievalmarket.RetrievalPeer{Address: address.TestAddress2, ID: peer.ID("peer2")}
+	peer3 := retrievalmarket.RetrievalPeer{Address: address.TestAddress2, ID: peer.ID("peer3")}
+	payloadCID := testutil.GenerateCids(1)[0]
+
+	t.Run("merges peers from all resolvers", func(t *testing.T) {
+		r := discovery.Multi(
+			testResolver{peers: []retrievalmarket.RetrievalPeer{peer1, peer2}},
+			testResolver{peers: []retrievalmarket.RetrievalPeer{peer2, peer3}},
+		)
+		peers, err := r.GetPeers(payloadCID)
+		require.NoError(t, err)
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer1, peer2, peer3}, peers)
+	})
+
+	t.Run("ignores failed resolvers", func(t *testing.T) {
+		r := discovery.Multi(
+			testResolver{err: errors.New("something went wrong")},
+			testResolver{peers: []retrievalmarket.RetrievalPeer{peer3}},
+		)
+		peers, err := r.GetPeers(payloadCID)
+		require.NoError(t, err)
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer3}, peers)
+	})
+
+	t.Run("fails when all resolvers fail", func(t *testing.T) {
+		r := discovery.Multi(
+			testResolver{err: errors.New("something went wrong")},
+			testResolver{err: errors.New("something else went wrong")},
+		)
+		_, err := r.GetPeers(payloadCID)
+		require.EqualError(t, err, "all peer resolvers failed: something else went wrong")
+	})
+
+	t.Run("finds no peers without resolvers", func(t *testing.T) {
+		peers, err := discovery.Multi().GetPeers(payloadCID)
+		require.NoError(t, err)
+		require.Empty(t, peers)
+	})
+}
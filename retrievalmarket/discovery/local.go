@@ -1,54 +1,201 @@
 package discovery
 
 import (
+	"sync"
+	"time"
+
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
 	dshelp "github.com/ipfs/go-ipfs-ds-help"
 	cbor "github.com/ipfs/go-ipld-cbor"
 	logging "github.com/ipfs/go-log/v2"
+	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 )
 
 var log = logging.Logger("ret-discovery")
 
+// peerEntry is a retrieval peer tracked for a CID, along with when it was
+// last added
+type peerEntry struct {
+	Peer      retrievalmarket.RetrievalPeer
+	LastAdded int64 // unix seconds
+}
+
+// Local tracks the retrieval peers known to have a CID, in a datastore
 type Local struct {
 	ds datastore.Datastore
+	lk sync.Mutex
 }
 
+// NewLocal returns a peer resolver that tracks peers in the given datastore
 func NewLocal(ds datastore.Batching) *Local {
 	return &Local{ds: namespace.Wrap(ds, datastore.NewKey("/deals/local"))}
 }
 
+// AddPeer records that the peer has the given CID. Adding a peer that is
+// already tracked for the CID refreshes it rather than duplicating it
 func (l *Local) AddPeer(cid cid.Cid, peer retrievalmarket.RetrievalPeer) error {
-	// TODO: allow multiple peers here
-	//  (implement an util for tracking map[thing][]otherThing, use in sectorBlockstore too)
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	key := dshelp.CidToDsKey(cid)
+	entries, err := l.getEntries(key)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for i := range entries {
+		if entries[i].Peer == peer {
+			entries[i].LastAdded = now
+			return l.putEntries(key, entries)
+		}
+	}
+	return l.putEntries(key, append(entries, peerEntry{Peer: peer, LastAdded: now}))
+}
 
-	log.Warn("Tracking multiple retrieval peers not implemented")
+// RemovePeer stops tracking the peer for the given CID
+func (l *Local) RemovePeer(cid cid.Cid, peer retrievalmarket.RetrievalPeer) error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
 
-	entry, err := cbor.DumpObject(peer)
+	key := dshelp.CidToDsKey(cid)
+	entries, err := l.getEntries(key)
 	if err != nil {
 		return err
 	}
 
-	return l.ds.Put(dshelp.CidToDsKey(cid), entry)
+	kept := entries[:0]
+	for _, entry := range entries {
+		if entry.Peer != peer {
+			kept = append(kept, entry)
+		}
+	}
+	return l.putEntries(key, kept)
+}
+
+// ExpirePeers stops tracking every peer that was last added before the
+// given time, for all CIDs
+func (l *Local) ExpirePeers(before time.Time) error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	results, err := l.ds.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		return xerrors.Errorf("listing tracked CIDs: %w", err)
+	}
+	keys, err := results.Rest()
+	if err != nil {
+		return xerrors.Errorf("listing tracked CIDs: %w", err)
+	}
+
+	cutoff := before.Unix()
+	for _, result := range keys {
+		key := datastore.NewKey(result.Key)
+		entries, err := l.getEntries(key)
+		if err != nil {
+			return err
+		}
+		kept := entries[:0]
+		for _, entry := range entries {
+			if entry.LastAdded >= cutoff {
+				kept = append(kept, entry)
+			}
+		}
+		if len(kept) == len(entries) {
+			continue
+		}
+		if err := l.putEntries(key, kept); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPeers returns the peers tracked for a payload or piece CID
+func (l *Local) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	entries, err := l.getEntries(dshelp.CidToDsKey(payloadCID))
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]retrievalmarket.RetrievalPeer, 0, len(entries))
+	for _, entry := range entries {
+		peers = append(peers, entry.Peer)
+	}
+	return peers, nil
+}
+
+// Migrate rewrites entries left by earlier versions, which held a single peer,
+// as peer lists. It is safe to run more than once
+func (l *Local) Migrate() error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	results, err := l.ds.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		return xerrors.Errorf("listing tracked CIDs: %w", err)
+	}
+	keys, err := results.Rest()
+	if err != nil {
+		return xerrors.Errorf("listing tracked CIDs: %w", err)
+	}
+
+	for _, result := range keys {
+		key := datastore.NewKey(result.Key)
+		if _, err := dshelp.DsKeyToCid(key); err != nil {
+			log.Warnf("skipping peers under %s, which is not a CID", key)
+			continue
+		}
+		entries, err := l.getEntries(key)
+		if err != nil {
+			return err
+		}
+		if err := l.putEntries(key, entries); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (l *Local) GetPeers(pieceCID []byte) ([]retrievalmarket.RetrievalPeer, error) {
-	key := string(pieceCID[:])
-	entry, err := l.ds.Get(datastore.NewKey(key))
+func (l *Local) getEntries(key datastore.Key) ([]peerEntry, error) {
+	data, err := l.ds.Get(key)
 	if err == datastore.ErrNotFound {
-		return []retrievalmarket.RetrievalPeer{}, nil
+		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
+
+	var entries []peerEntry
+	if err := cbor.DecodeInto(data, &entries); err == nil {
+		return entries, nil
+	}
+
+	// entries used to hold a single peer, with no record of when it was added
 	var peer retrievalmarket.RetrievalPeer
-	if err := cbor.DecodeInto(entry, &peer); err != nil {
-		return nil, err
+	if err := cbor.DecodeInto(data, &peer); err != nil {
+		return nil, xerrors.Errorf("decoding peers for %s: %w", key, err)
+	}
+	log.Debugf("upgrading single peer entry for %s", key)
+	return []peerEntry{{Peer: peer, LastAdded: time.Now().Unix()}}, nil
+}
+
+func (l *Local) putEntries(key datastore.Key, entries []peerEntry) error {
+	if len(entries) == 0 {
+		return l.ds.Delete(key)
+	}
+	data, err := cbor.DumpObject(entries)
+	if err != nil {
+		return err
 	}
-	return []retrievalmarket.RetrievalPeer{peer}, nil
+	return l.ds.Put(key, data)
 }
 
 var _ retrievalmarket.PeerResolver = &Local{}
@@ -0,0 +1,114 @@
+package discovery_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-data-transfer/testutil"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dss "github.com/ipfs/go-datastore/sync"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/discovery"
+)
+
+func getPeers(t *testing.T, l *discovery.Local, c cid.Cid) []retrievalmarket.RetrievalPeer {
+	peers, err := l.GetPeers(c)
+	require.NoError(t, err)
+	return peers
+}
+
+func TestLocal(t *testing.T) {
+	cids := testutil.GenerateCids(2)
+	peer1 := retrievalmarket.RetrievalPeer{Address: address.TestAddress, ID: peer.ID("peer1")}
+	peer2 := retrievalmarket.RetrievalPeer{Address: address.TestAddress2, ID: peer.ID("peer2")}
+
+	t.Run("tracks many peers per cid without duplicates", func(t *testing.T) {
+		l := discovery.NewLocal(dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, l.AddPeer(cids[0], peer1))
+		require.NoError(t, l.AddPeer(cids[0], peer2))
+		require.NoError(t, l.AddPeer(cids[0], peer1))
+		require.NoError(t, l.AddPeer(cids[1], peer2))
+
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer1, peer2}, getPeers(t, l, cids[0]))
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer2}, getPeers(t, l, cids[1]))
+	})
+
+	t.Run("returns no peers for an unknown cid", func(t *testing.T) {
+		l := discovery.NewLocal(dss.MutexWrap(datastore.NewMapDatastore()))
+		require.Empty(t, getPeers(t, l, cids[0]))
+	})
+
+	t.Run("removes peers", func(t *testing.T) {
+		l := discovery.NewLocal(dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, l.AddPeer(cids[0], peer1))
+		require.NoError(t, l.AddPeer(cids[0], peer2))
+
+		require.NoError(t, l.RemovePeer(cids[0], peer1))
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer2}, getPeers(t, l, cids[0]))
+		require.NoError(t, l.RemovePeer(cids[0], peer2))
+		require.Empty(t, getPeers(t, l, cids[0]))
+		require.NoError(t, l.RemovePeer(cids[1], peer1))
+	})
+
+	t.Run("expires peers", func(t *testing.T) {
+		l := discovery.NewLocal(dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, l.AddPeer(cids[0], peer1))
+		require.NoError(t, l.AddPeer(cids[1], peer2))
+
+		require.NoError(t, l.ExpirePeers(time.Now().Add(-time.Hour)))
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer1}, getPeers(t, l, cids[0]))
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer2}, getPeers(t, l, cids[1]))
+
+		require.NoError(t, l.ExpirePeers(time.Now().Add(time.Hour)))
+		require.Empty(t, getPeers(t, l, cids[0]))
+		require.Empty(t, getPeers(t, l, cids[1]))
+	})
+
+	t.Run("reads entries holding a single peer", func(t *testing.T) {
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		entry, err := cbor.DumpObject(peer1)
+		require.NoError(t, err)
+		key := datastore.NewKey("/deals/local").Child(dshelp.CidToDsKey(cids[0]))
+		require.NoError(t, ds.Put(key, entry))
+
+		l := discovery.NewLocal(ds)
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer1}, getPeers(t, l, cids[0]))
+		require.NoError(t, l.AddPeer(cids[0], peer2))
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer1, peer2}, getPeers(t, l, cids[0]))
+	})
+	t.Run("migrates old entries", func(t *testing.T) {
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		prefix := datastore.NewKey("/deals/local")
+		key := prefix.Child(dshelp.CidToDsKey(cids[0]))
+		single, err := cbor.DumpObject(peer1)
+		require.NoError(t, err)
+		require.NoError(t, ds.Put(key, single))
+
+		l := discovery.NewLocal(ds)
+		require.NoError(t, l.AddPeer(cids[1], peer2))
+		require.NoError(t, l.Migrate())
+		migrated, err := ds.Get(key)
+		require.NoError(t, err)
+		require.NotEqual(t, single, migrated, "a single peer entry is rewritten as a list")
+		require.NoError(t, l.Migrate())
+
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer1}, getPeers(t, l, cids[0]))
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer2}, getPeers(t, l, cids[1]))
+		results, err := ds.Query(query.Query{KeysOnly: true})
+		require.NoError(t, err)
+		keys, err := results.Rest()
+		require.NoError(t, err)
+		require.Len(t, keys, 2)
+
+		require.NoError(t, l.ExpirePeers(time.Now().Add(-time.Hour)))
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer1}, getPeers(t, l, cids[0]))
+	})
+}
@@ -0,0 +1,116 @@
+package blockio
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+type readResult struct {
+	block retrievalmarket.Block
+	err   error
+	// end is set once the traversal has finished
+	end bool
+}
+
+// SelectorBlockReader reads the blocks of the DAG under a root that a selector
+// reaches, in traversal order. The traversal runs in the background, one block
+// ahead of the reader, so the last block can be reported as such
+type SelectorBlockReader struct {
+	results chan readResult
+	next    *readResult
+}
+
+var _ BlockReader = (*SelectorBlockReader)(nil)
+
+// NewSelectorBlockReader starts reading the DAG under root matching the given
+// selector spec from the store. The traversal stops when ctx is cancelled
+func NewSelectorBlockReader(ctx context.Context, store ReadStore, root cid.Cid, sel ipld.Node) (*SelectorBlockReader, error) {
+	parsed, err := selector.ParseSelector(sel)
+	if err != nil {
+		return nil, err
+	}
+
+	sbr := &SelectorBlockReader{results: make(chan readResult)}
+
+	// the traversal flattens the errors it returns, so a failure to get a
+	// block from the store is kept to be reported as is
+	var getErr error
+	loader := func(lnk ipld.Link, lnkCtx ipld.LinkContext) (io.Reader, error) {
+		c, err := linkCid(lnk)
+		if err != nil {
+			return nil, err
+		}
+		blk, err := store.Get(c)
+		if err != nil {
+			getErr = err
+			return nil, err
+		}
+		block := retrievalmarket.Block{
+			Prefix: c.Prefix().Bytes(),
+			Data:   blk.RawData(),
+		}
+		select {
+		case sbr.results <- readResult{block: block}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return bytes.NewReader(blk.RawData()), nil
+	}
+
+	go func() {
+		err := traverse(ctx, root, parsed, loader)
+		if getErr != nil {
+			err = getErr
+		}
+		select {
+		case sbr.results <- readResult{err: err, end: err == nil}:
+		case <-ctx.Done():
+		}
+	}()
+
+	return sbr, nil
+}
+
+// ReadBlock returns the next block, and whether it is the last one. Once the
+// last block has been read, io.EOF is returned
+func (sbr *SelectorBlockReader) ReadBlock(ctx context.Context) (retrievalmarket.Block, bool, error) {
+	current := sbr.next
+	if current == nil {
+		var err error
+		current, err = sbr.receive(ctx)
+		if err != nil {
+			return retrievalmarket.Block{}, false, err
+		}
+	}
+	if current.err != nil || current.end {
+		// the traversal is over, keep reporting how it ended
+		sbr.next = current
+		if current.end {
+			return retrievalmarket.Block{}, false, io.EOF
+		}
+		return retrievalmarket.Block{}, false, current.err
+	}
+
+	next, err := sbr.receive(ctx)
+	if err != nil {
+		return retrievalmarket.Block{}, false, err
+	}
+	sbr.next = next
+	return current.block, next.end, nil
+}
+
+func (sbr *SelectorBlockReader) receive(ctx context.Context) (*readResult, error) {
+	select {
+	case res := <-sbr.results:
+		return &res, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,173 @@
+package blockio_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipfs/go-merkledag"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/ipld/go-ipld-prime"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/blockio"
+)
+
+// testDAG is a root with a raw leaf and a child holding two more leaves, with
+// its blocks in the order a whole DAG traversal loads them
+type testDAG struct {
+	bs     bstore.Blockstore
+	root   cid.Cid
+	blocks []blocks.Block
+	// secondChild selects everything under the second child of the root
+	secondChild ipld.Node
+}
+
+func storeDAG(t *testing.T, ordered []blocks.Block, secondChild ipld.Node) testDAG {
+	bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	for _, blk := range ordered {
+		require.NoError(t, bs.Put(blk))
+	}
+	return testDAG{bs, ordered[0].Cid(), ordered, secondChild}
+}
+
+// selectUnder selects everything under the second element of a list field
+func selectUnder(field string) ipld.Node {
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	return ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+		efsb.Insert(field, ssb.ExploreIndex(1,
+			ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge()))))
+	}).Node()
+}
+
+// newUnixFSDAG builds a UnixFS directory holding a file and a subdirectory
+func newUnixFSDAG(ctx context.Context, t *testing.T) testDAG {
+	dserv := merkledag.NewDAGService(blockservice.New(bstore.NewBlockstore(datastore.NewMapDatastore()), offline.Exchange(nil)))
+	leafA := merkledag.NewRawNode([]byte("apples"))
+	leafB := merkledag.NewRawNode([]byte("bananas"))
+	leafC := merkledag.NewRawNode([]byte("cherries"))
+
+	subdir := uio.NewDirectory(dserv)
+	require.NoError(t, subdir.AddChild(ctx, "b", leafB))
+	require.NoError(t, subdir.AddChild(ctx, "c", leafC))
+	subdirNd, err := subdir.GetNode()
+	require.NoError(t, err)
+
+	dir := uio.NewDirectory(dserv)
+	require.NoError(t, dir.AddChild(ctx, "a", leafA))
+	require.NoError(t, dir.AddChild(ctx, "dir", subdirNd))
+	dirNd, err := dir.GetNode()
+	require.NoError(t, err)
+
+	return storeDAG(t, []blocks.Block{dirNd, leafA, subdirNd, leafB, leafC}, selectUnder("Links"))
+}
+
+// newCborDAG builds a dag-cbor DAG with a raw leaf
+func newCborDAG(t *testing.T) testDAG {
+	wrap := func(obj map[string]interface{}) blocks.Block {
+		nd, err := cbornode.WrapObject(obj, mh.SHA2_256, -1)
+		require.NoError(t, err)
+		return nd
+	}
+	leafA := merkledag.NewRawNode([]byte("apples"))
+	leafB := wrap(map[string]interface{}{"name": "bananas"})
+	leafC := wrap(map[string]interface{}{"name": "cherries"})
+	child := wrap(map[string]interface{}{"children": []cid.Cid{leafB.Cid(), leafC.Cid()}})
+	root := wrap(map[string]interface{}{"children": []cid.Cid{leafA.Cid(), child.Cid()}})
+
+	return storeDAG(t, []blocks.Block{root, leafA, child, leafB, leafC}, selectUnder("children"))
+}
+
+func testDAGs(ctx context.Context, t *testing.T) map[string]testDAG {
+	return map[string]testDAG{
+		"UnixFS directory": newUnixFSDAG(ctx, t),
+		"dag-cbor":         newCborDAG(t),
+	}
+}
+
+func mustCid(t *testing.T, prefix []byte, data []byte) cid.Cid {
+	p, err := cid.PrefixFromBytes(prefix)
+	require.NoError(t, err)
+	c, err := p.Sum(data)
+	require.NoError(t, err)
+	return c
+}
+
+func readAll(ctx context.Context, t *testing.T, reader blockio.BlockReader) []cid.Cid {
+	var read []cid.Cid
+	for {
+		block, done, err := reader.ReadBlock(ctx)
+		require.NoError(t, err)
+		read = append(read, mustCid(t, block.Prefix, block.Data))
+		if done {
+			return read
+		}
+	}
+}
+
+func TestSelectorBlockReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for name, dag := range testDAGs(ctx, t) {
+		dag := dag
+		t.Run(name, func(t *testing.T) {
+			t.Run("whole DAG", func(t *testing.T) {
+				reader, err := blockio.NewSelectorBlockReader(ctx, dag.bs, dag.root, blockio.AllSelector())
+				require.NoError(t, err)
+
+				read := readAll(ctx, t, reader)
+				require.Len(t, read, len(dag.blocks))
+				for i, blk := range dag.blocks {
+					require.Equal(t, blk.Cid(), read[i])
+				}
+
+				_, _, err = reader.ReadBlock(ctx)
+				require.Equal(t, io.EOF, err)
+			})
+
+			t.Run("part of the DAG", func(t *testing.T) {
+				reader, err := blockio.NewSelectorBlockReader(ctx, dag.bs, dag.root, dag.secondChild)
+				require.NoError(t, err)
+
+				read := readAll(ctx, t, reader)
+				require.Equal(t, []cid.Cid{dag.blocks[0].Cid(), dag.blocks[2].Cid(), dag.blocks[3].Cid(), dag.blocks[4].Cid()}, read)
+			})
+
+			t.Run("missing block", func(t *testing.T) {
+				require.NoError(t, dag.bs.DeleteBlock(dag.blocks[3].Cid()))
+				defer func() {
+					require.NoError(t, dag.bs.Put(dag.blocks[3]))
+				}()
+
+				reader, err := blockio.NewSelectorBlockReader(ctx, dag.bs, dag.root, blockio.AllSelector())
+				require.NoError(t, err)
+				for i := 0; i < 3; i++ {
+					_, done, err := reader.ReadBlock(ctx)
+					require.NoError(t, err)
+					require.False(t, done)
+				}
+				_, _, err = reader.ReadBlock(ctx)
+				require.Equal(t, bstore.ErrNotFound, err)
+			})
+		})
+	}
+
+	t.Run("invalid selector", func(t *testing.T) {
+		dag := newCborDAG(t)
+		_, err := blockio.NewSelectorBlockReader(ctx, dag.bs, dag.root, ipldfree.String("not a selector"))
+		require.Error(t, err)
+	})
+}
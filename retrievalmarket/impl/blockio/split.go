@@ -0,0 +1,193 @@
+package blockio
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+)
+
+// RootSelector returns the selector spec for the root block of a DAG alone
+func RootSelector() ipld.Node {
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	return ssb.Matcher().Node()
+}
+
+// SplitSelectors splits the DAG under root into at most n parts, and returns a
+// selector spec for each. The links in the root block are shared out between
+// the parts in order, and each part matches the root and the whole DAG under
+// each of its links. A link that appears more than once is only in the first
+// part that has it, and links whose whole DAG the store already holds are left
+// out, so their blocks are not retrieved again. The root block must be in the
+// store
+func SplitSelectors(ctx context.Context, store ReadStore, root cid.Cid, n int) ([]ipld.Node, error) {
+	loader := storeLoader(store)
+	nd, err := loadNode(ctx, root, loader)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []linkPath
+	seen := make(map[cid.Cid]struct{})
+	err = collectLinks(nd, nil, func(path linkPath) error {
+		if _, ok := seen[path.link]; ok {
+			return nil
+		}
+		seen[path.link] = struct{}{}
+		if heldInFull(ctx, path.link, loader) {
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if n > len(paths) {
+		n = len(paths)
+	}
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	sels := make([]ipld.Node, 0, n)
+	for i := 0; i < n; i++ {
+		part := &selectorTrie{}
+		for _, path := range paths[i*len(paths)/n : (i+1)*len(paths)/n] {
+			part.add(path.steps)
+		}
+		sels = append(sels, part.spec(ssb).Node())
+	}
+	return sels, nil
+}
+
+// pathStep is a map key or list index on the way to a link in a block
+type pathStep struct {
+	inList bool
+	key    string
+	index  int
+}
+
+// linkPath is where a link sits in a block
+type linkPath struct {
+	steps []pathStep
+	link  cid.Cid
+}
+
+// collectLinks calls visit for each link in a node, in iteration order
+func collectLinks(nd ipld.Node, steps []pathStep, visit func(linkPath) error) error {
+	switch nd.ReprKind() {
+	case ipld.ReprKind_Link:
+		lnk, err := nd.AsLink()
+		if err != nil {
+			return err
+		}
+		c, err := linkCid(lnk)
+		if err != nil {
+			return err
+		}
+		return visit(linkPath{append([]pathStep(nil), steps...), c})
+	case ipld.ReprKind_Map:
+		it := nd.MapIterator()
+		for !it.Done() {
+			k, v, err := it.Next()
+			if err != nil {
+				return err
+			}
+			key, err := k.AsString()
+			if err != nil {
+				return err
+			}
+			if err := collectLinks(v, append(steps, pathStep{key: key}), visit); err != nil {
+				return err
+			}
+		}
+	case ipld.ReprKind_List:
+		it := nd.ListIterator()
+		for !it.Done() {
+			i, v, err := it.Next()
+			if err != nil {
+				return err
+			}
+			if err := collectLinks(v, append(steps, pathStep{inList: true, index: i}), visit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// selectorTrie merges the paths to a part's links, so each map or list on the
+// way is explored once
+type selectorTrie struct {
+	link     bool
+	list     bool
+	order    []pathStep
+	children map[pathStep]*selectorTrie
+}
+
+func (st *selectorTrie) add(steps []pathStep) {
+	if len(steps) == 0 {
+		st.link = true
+		return
+	}
+	if st.children == nil {
+		st.children = make(map[pathStep]*selectorTrie)
+	}
+	st.list = steps[0].inList
+	child, ok := st.children[steps[0]]
+	if !ok {
+		child = &selectorTrie{}
+		st.children[steps[0]] = child
+		st.order = append(st.order, steps[0])
+	}
+	child.add(steps[1:])
+}
+
+func (st *selectorTrie) spec(ssb builder.SelectorSpecBuilder) builder.SelectorSpec {
+	if st.link {
+		return allSpec(ssb)
+	}
+	if st.list {
+		members := make([]builder.SelectorSpec, 0, len(st.order))
+		for _, step := range st.order {
+			members = append(members, ssb.ExploreIndex(step.index, st.children[step].spec(ssb)))
+		}
+		if len(members) == 1 {
+			return members[0]
+		}
+		return ssb.ExploreUnion(members...)
+	}
+	return ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+		for _, step := range st.order {
+			efsb.Insert(step.key, st.children[step].spec(ssb))
+		}
+	})
+}
+
+// heldInFull returns true if every block of the DAG under root can be loaded
+func heldInFull(ctx context.Context, root cid.Cid, loader ipld.Loader) bool {
+	sel, err := selector.ParseSelector(AllSelector())
+	if err != nil {
+		return false
+	}
+	return traverse(ctx, root, sel, loader) == nil
+}
+
+// storeLoader loads blocks from a store
+func storeLoader(store ReadStore) ipld.Loader {
+	return func(lnk ipld.Link, _ ipld.LinkContext) (io.Reader, error) {
+		c, err := linkCid(lnk)
+		if err != nil {
+			return nil, err
+		}
+		blk, err := store.Get(c)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(blk.RawData()), nil
+	}
+}
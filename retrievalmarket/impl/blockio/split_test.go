@@ -0,0 +1,97 @@
+package blockio_test
+
+import (
+	"context"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-ipld-prime"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/blockio"
+)
+
+func TestSplitSelectors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	readPart := func(t *testing.T, bs bstore.Blockstore, root cid.Cid, sel ipld.Node) []cid.Cid {
+		reader, err := blockio.NewSelectorBlockReader(ctx, bs, root, sel)
+		require.NoError(t, err)
+		return readAll(ctx, t, reader)
+	}
+	// holding is a client's store, holding the given blocks
+	holding := func(t *testing.T, blks ...blocks.Block) bstore.Blockstore {
+		bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, bs.PutMany(blks))
+		return bs
+	}
+	cids := func(blks ...blocks.Block) []cid.Cid {
+		var cids []cid.Cid
+		for _, blk := range blks {
+			cids = append(cids, blk.Cid())
+		}
+		return cids
+	}
+
+	for name, dag := range testDAGs(ctx, t) {
+		dag := dag
+		t.Run(name, func(t *testing.T) {
+			root, leafA, child, leafB, leafC := dag.blocks[0], dag.blocks[1], dag.blocks[2], dag.blocks[3], dag.blocks[4]
+
+			t.Run("root alone", func(t *testing.T) {
+				require.Equal(t, cids(root), readPart(t, dag.bs, dag.root, blockio.RootSelector()))
+			})
+
+			t.Run("shares the root's links between parts", func(t *testing.T) {
+				sels, err := blockio.SplitSelectors(ctx, holding(t, root), dag.root, 2)
+				require.NoError(t, err)
+				require.Len(t, sels, 2)
+				require.Equal(t, cids(root, leafA), readPart(t, dag.bs, dag.root, sels[0]))
+				require.Equal(t, cids(root, child, leafB, leafC), readPart(t, dag.bs, dag.root, sels[1]))
+			})
+
+			t.Run("makes no more parts than there are links", func(t *testing.T) {
+				sels, err := blockio.SplitSelectors(ctx, holding(t, root), dag.root, 5)
+				require.NoError(t, err)
+				require.Len(t, sels, 2)
+			})
+
+			t.Run("leaves out links already held", func(t *testing.T) {
+				sels, err := blockio.SplitSelectors(ctx, holding(t, root, leafA, child, leafC), dag.root, 2)
+				require.NoError(t, err)
+				require.Len(t, sels, 1)
+				require.Equal(t, cids(root, child, leafB, leafC), readPart(t, dag.bs, dag.root, sels[0]))
+			})
+
+			t.Run("fails without the root", func(t *testing.T) {
+				_, err := blockio.SplitSelectors(ctx, holding(t), dag.root, 2)
+				require.Error(t, err)
+			})
+		})
+	}
+
+	t.Run("links to the same block are in one part", func(t *testing.T) {
+		leaf := merkledag.NewRawNode([]byte("apples"))
+		other := merkledag.NewRawNode([]byte("bananas"))
+		root, err := cbornode.WrapObject(map[string]interface{}{
+			"children": []cid.Cid{leaf.Cid(), other.Cid(), leaf.Cid()},
+		}, mh.SHA2_256, -1)
+		require.NoError(t, err)
+		bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, bs.PutMany([]blocks.Block{root, leaf, other}))
+
+		sels, err := blockio.SplitSelectors(ctx, holding(t, root), root.Cid(), 3)
+		require.NoError(t, err)
+		require.Len(t, sels, 2)
+		require.Equal(t, cids(root, leaf), readPart(t, bs, root.Cid(), sels[0]))
+		require.Equal(t, cids(root, other), readPart(t, bs, root.Cid(), sels[1]))
+	})
+}
@@ -0,0 +1,91 @@
+// Package blockio reads and verifies the blocks of a retrieval payload by
+// walking the payload DAG with an IPLD selector
+package blockio
+
+import (
+	"context"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	dagpb "github.com/ipld/go-ipld-prime-proto"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// ReadStore is the block source a payload is read from
+type ReadStore interface {
+	Get(cid.Cid) (blocks.Block, error)
+}
+
+// BlockReader reads the blocks of a payload in the order they are sent to a client
+type BlockReader interface {
+	// ReadBlock returns the next block, and whether it is the last one
+	ReadBlock(context.Context) (retrievalmarket.Block, bool, error)
+}
+
+// AllSelector returns the selector spec for the whole DAG under a root
+func AllSelector() ipld.Node {
+	return allSpec(builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())).Node()
+}
+
+func allSpec(ssb builder.SelectorSpecBuilder) builder.SelectorSpec {
+	return ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge()))
+}
+
+// PayloadSelector returns the selector spec for the part of the payload
+// requested in the params, or for the whole DAG if no selector was given
+func PayloadSelector(params retrievalmarket.Params) (ipld.Node, error) {
+	sel, err := params.SelectorSpec()
+	if err != nil {
+		return nil, err
+	}
+	if sel == nil {
+		return AllSelector(), nil
+	}
+	return sel, nil
+}
+
+// traverse walks the DAG under root, loading each block the selector reaches
+// through the loader in traversal order. UnixFS (dag-pb and raw) blocks are
+// decoded with their own node builders, everything else as generic IPLD data
+func traverse(ctx context.Context, root cid.Cid, sel selector.Selector, loader ipld.Loader) error {
+	nd, err := loadNode(ctx, root, loader)
+	if err != nil {
+		return err
+	}
+
+	return traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                    ctx,
+			LinkLoader:             loader,
+			LinkNodeBuilderChooser: nodeBuilderChooser,
+		},
+	}.WalkAdv(nd, sel, func(traversal.Progress, ipld.Node, traversal.VisitReason) error { return nil })
+}
+
+// nodeBuilderChooser picks the node builder each block is decoded with
+var nodeBuilderChooser = dagpb.AddDagPBSupportToChooser(func(ipld.Link, ipld.LinkContext) ipld.NodeBuilder {
+	return ipldfree.NodeBuilder()
+})
+
+// loadNode loads and decodes the block with the given CID
+func loadNode(ctx context.Context, c cid.Cid, loader ipld.Loader) (ipld.Node, error) {
+	lnk := cidlink.Link{Cid: c}
+	return lnk.Load(ctx, ipld.LinkContext{}, nodeBuilderChooser(lnk, ipld.LinkContext{}), loader)
+}
+
+// linkCid returns the CID a traversal link points to
+func linkCid(lnk ipld.Link) (cid.Cid, error) {
+	cl, ok := lnk.(cidlink.Link)
+	if !ok {
+		return cid.Undef, xerrors.Errorf("unsupported link type %T", lnk)
+	}
+	return cl.Cid, nil
+}
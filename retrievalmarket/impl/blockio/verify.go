@@ -0,0 +1,108 @@
+package blockio
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"golang.org/x/xerrors"
+)
+
+type verifyResult struct {
+	done bool
+	err  error
+}
+
+// SelectorVerifier checks that received blocks are exactly the blocks a
+// traversal of the DAG under a root with a selector loads, in the same order.
+// Each block must be linked from a block received before it (or be the root),
+// so nothing outside the requested part of the DAG is accepted
+type SelectorVerifier struct {
+	incoming chan blocks.Block
+	results  chan verifyResult
+	finished bool
+}
+
+// NewSelectorVerifier starts a traversal of the DAG under root matching the
+// given selector spec, fed by the blocks passed to Verify. The traversal stops
+// when ctx is cancelled
+func NewSelectorVerifier(ctx context.Context, root cid.Cid, sel ipld.Node) (*SelectorVerifier, error) {
+	parsed, err := selector.ParseSelector(sel)
+	if err != nil {
+		return nil, err
+	}
+
+	sv := &SelectorVerifier{
+		incoming: make(chan blocks.Block),
+		results:  make(chan verifyResult),
+	}
+
+	// pending is set while a block handed to the traversal is waiting to learn
+	// whether it was the last one
+	pending := false
+	loader := func(lnk ipld.Link, lnkCtx ipld.LinkContext) (io.Reader, error) {
+		expected, err := linkCid(lnk)
+		if err != nil {
+			return nil, err
+		}
+		if pending {
+			select {
+			case sv.results <- verifyResult{}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		var blk blocks.Block
+		select {
+		case blk = <-sv.incoming:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		pending = true
+		if !blk.Cid().Equals(expected) {
+			return nil, xerrors.Errorf("selector verifier: unexpected block: expected %s, got %s", expected, blk.Cid())
+		}
+		return bytes.NewReader(blk.RawData()), nil
+	}
+
+	go func() {
+		err := traverse(ctx, root, parsed, loader)
+		if !pending {
+			return
+		}
+		select {
+		case sv.results <- verifyResult{done: err == nil, err: err}:
+		case <-ctx.Done():
+		}
+	}()
+
+	return sv, nil
+}
+
+// Verify checks the next block received, returning true if it completes the
+// requested part of the DAG
+func (sv *SelectorVerifier) Verify(ctx context.Context, blk blocks.Block) (bool, error) {
+	if sv.finished {
+		return false, xerrors.New("selector verifier: received block after all blocks were verified")
+	}
+
+	select {
+	case sv.incoming <- blk:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+
+	select {
+	case res := <-sv.results:
+		if res.done || res.err != nil {
+			sv.finished = true
+		}
+		return res.done, res.err
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
@@ -0,0 +1,88 @@
+package blockio_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/blockio"
+)
+
+func TestSelectorVerifier(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for name, dag := range testDAGs(ctx, t) {
+		dag := dag
+		t.Run(name, func(t *testing.T) {
+			t.Run("whole DAG", func(t *testing.T) {
+				verifier, err := blockio.NewSelectorVerifier(ctx, dag.root, blockio.AllSelector())
+				require.NoError(t, err)
+
+				for i, blk := range dag.blocks {
+					done, err := verifier.Verify(ctx, blk)
+					require.NoError(t, err)
+					require.Equal(t, i == len(dag.blocks)-1, done)
+				}
+
+				_, err = verifier.Verify(ctx, dag.blocks[0])
+				require.Error(t, err)
+			})
+
+			t.Run("part of the DAG", func(t *testing.T) {
+				verifier, err := blockio.NewSelectorVerifier(ctx, dag.root, dag.secondChild)
+				require.NoError(t, err)
+
+				done, err := verifier.Verify(ctx, dag.blocks[0])
+				require.NoError(t, err)
+				require.False(t, done)
+
+				// the first leaf is outside the selection
+				_, err = verifier.Verify(ctx, dag.blocks[1])
+				require.Error(t, err)
+			})
+
+			t.Run("block not linked from the DAG", func(t *testing.T) {
+				verifier, err := blockio.NewSelectorVerifier(ctx, dag.root, blockio.AllSelector())
+				require.NoError(t, err)
+
+				done, err := verifier.Verify(ctx, dag.blocks[0])
+				require.NoError(t, err)
+				require.False(t, done)
+
+				_, err = verifier.Verify(ctx, merkledag.NewRawNode([]byte("durian")))
+				require.Error(t, err)
+			})
+
+			t.Run("wrong root", func(t *testing.T) {
+				verifier, err := blockio.NewSelectorVerifier(ctx, dag.root, blockio.AllSelector())
+				require.NoError(t, err)
+
+				_, err = verifier.Verify(ctx, dag.blocks[2])
+				require.Error(t, err)
+			})
+
+			t.Run("reads back what the reader sends", func(t *testing.T) {
+				reader, err := blockio.NewSelectorBlockReader(ctx, dag.bs, dag.root, dag.secondChild)
+				require.NoError(t, err)
+				verifier, err := blockio.NewSelectorVerifier(ctx, dag.root, dag.secondChild)
+				require.NoError(t, err)
+
+				for {
+					block, last, err := reader.ReadBlock(ctx)
+					require.NoError(t, err)
+					blk, err := dag.bs.Get(mustCid(t, block.Prefix, block.Data))
+					require.NoError(t, err)
+					done, err := verifier.Verify(ctx, blk)
+					require.NoError(t, err)
+					require.Equal(t, last, done)
+					if last {
+						break
+					}
+				}
+			})
+		})
+	}
+}
@@ -6,14 +6,19 @@ import (
 	"sync"
 
 	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-statestore"
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	logging "github.com/ipfs/go-log"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/blockio"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/clientstates"
 	rmnet "github.com/filecoin-project/go-fil-markets/retrievalmarket/network"
 	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
@@ -21,15 +26,25 @@ import (
 
 var log = logging.Logger("retrieval")
 
+// ClientDsPrefix is the datastore namespace under which retrieval client deals are tracked
+var ClientDsPrefix = "/retrievals/client"
+
 type client struct {
 	network rmnet.RetrievalMarketNetwork
 	bs      blockstore.Blockstore
 	node    retrievalmarket.RetrievalClientNode
 	// The parameters should be replaced by RetrievalClientNode
 
+	// deals tracks the state of every deal this client has made, keyed by DealID
+	deals *statestore.StateStore
+
 	nextDealLk sync.RWMutex
 	nextDealID retrievalmarket.DealID
 
+	// active holds the controls for deals that are currently in progress
+	activeLk sync.Mutex
+	active   map[retrievalmarket.DealID]*clientDeal
+
 	subscribersLk sync.RWMutex
 	subscribers   []retrievalmarket.ClientSubscriber
 	resolver      retrievalmarket.PeerResolver
@@ -40,21 +55,59 @@ func NewClient(
 	network rmnet.RetrievalMarketNetwork,
 	bs blockstore.Blockstore,
 	node retrievalmarket.RetrievalClientNode,
-	resolver retrievalmarket.PeerResolver) retrievalmarket.RetrievalClient {
-	return &client{
+	resolver retrievalmarket.PeerResolver,
+	ds datastore.Batching) (retrievalmarket.RetrievalClient, error) {
+	c := &client{
 		network:  network,
 		bs:       bs,
 		node:     node,
 		resolver: resolver,
+		deals:    statestore.New(namespace.Wrap(ds, datastore.NewKey(ClientDsPrefix))),
+		active:   make(map[retrievalmarket.DealID]*clientDeal),
+	}
+
+	// pick up deal ids where a previous run left off, so new deals never
+	// collide with ones that are already tracked
+	var deals []retrievalmarket.ClientDealState
+	if err := c.deals.List(&deals); err != nil {
+		return nil, err
 	}
+	for _, deal := range deals {
+		if deal.ID > c.nextDealID {
+			c.nextDealID = deal.ID
+		}
+	}
+
+	return c, nil
+}
+
+// RestartDeals resumes the deals that were in progress when the client last
+// stopped, from the blocks they had already received. Deals that can't be
+// resumed fail. The deals stop when ctx is cancelled
+func (c *client) RestartDeals(ctx context.Context) error {
+	var deals []retrievalmarket.ClientDealState
+	if err := c.deals.List(&deals); err != nil {
+		return xerrors.Errorf("listing deals to restart: %w", err)
+	}
+	for _, deal := range deals {
+		if retrievalmarket.IsTerminalStatus(deal.Status) {
+			continue
+		}
+		if err := c.ResumeDeal(ctx, deal.ID); err != nil {
+			log.Errorf("resuming retrieval deal %d: %s", deal.ID, err)
+			deal := deal
+			c.failDeal(&deal, err)
+		}
+	}
+	return nil
 }
 
 // V0
 
 // TODO: Implement for retrieval provider V0 epic
 // https://github.com/filecoin-project/go-retrieval-market-project/issues/12
-func (c *client) FindProviders(pieceCID []byte) []retrievalmarket.RetrievalPeer {
-	peers, err := c.resolver.GetPeers(pieceCID)
+func (c *client) FindProviders(payloadCID cid.Cid) []retrievalmarket.RetrievalPeer {
+	peers, err := c.resolver.GetPeers(payloadCID)
 	if err != nil {
 		log.Error(err)
 		return []retrievalmarket.RetrievalPeer{}
@@ -72,9 +125,7 @@ func (c *client) Query(ctx context.Context, p retrievalmarket.RetrievalPeer, pie
 	}
 	defer s.Close()
 
-	err = s.WriteQuery(retrievalmarket.Query{
-		PieceCID: pieceCID,
-	})
+	err = s.WriteQuery(retrievalmarket.NewQueryV1(pieceCID, params))
 	if err != nil {
 		log.Warn(err)
 		return retrievalmarket.QueryResponseUndefined, err
@@ -93,12 +144,14 @@ func (c *client) Retrieve(ctx context.Context, pieceCID []byte, params retrieval
 	dealID := c.nextDealID
 	c.nextDealLk.Unlock()
 
+	proposal := retrievalmarket.DealProposal{
+		PieceCID: pieceCID,
+		ID:       dealID,
+		Params:   params,
+	}
+
 	dealState := retrievalmarket.ClientDealState{
-		DealProposal: retrievalmarket.DealProposal{
-			PieceCID: pieceCID,
-			ID:       dealID,
-			Params:   params,
-		},
+		DealProposal:     proposal,
 		TotalFunds:       totalFunds,
 		ClientWallet:     clientWallet,
 		MinerWallet:      minerWallet,
@@ -107,52 +160,249 @@ func (c *client) Retrieve(ctx context.Context, pieceCID []byte, params retrieval
 		BytesPaidFor:     0,
 		PaymentRequested: tokenamount.FromInt(0),
 		FundsSpent:       tokenamount.FromInt(0),
+		UnsealFundsPaid:  tokenamount.FromInt(0),
 		Status:           retrievalmarket.DealStatusNew,
 		Sender:           miner,
 	}
 
-	go c.handleDeal(ctx, dealState)
+	proposalNd, err := cborutil.AsIpld(&proposal)
+	if err != nil {
+		c.failDeal(&dealState, xerrors.Errorf("getting proposal node: %w", err))
+		return dealID
+	}
+	dealState.ProposalCid = proposalNd.Cid()
+
+	// start tracking the deal before any processing so it shows up in ListDeals
+	// even if something goes wrong right away
+	if err := c.deals.Begin(uint64(dealID), &dealState); err != nil {
+		c.failDeal(&dealState, xerrors.Errorf("tracking deal: %w", err))
+		return dealID
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	verifier, err := newVerifier(ctx, params)
+	if err != nil {
+		cancel()
+		c.failDeal(&dealState, xerrors.Errorf("setting up verifier: %w", err))
+		return dealID
+	}
+
+	if err := c.startDeal(ctx, cancel, dealState, verifier); err != nil {
+		c.failDeal(&dealState, err)
+	}
 
 	return dealID
 }
 
+// ResumeDeal restarts a deal that was interrupted before it finished. The blocks
+// of the payload that were received in the deal and are still in the
+// blockstore are replayed through the verifier, and the provider is asked to
+// skip them. The provider charges for what it sent but was not paid for before
+// sending more. RestartDeals resumes the deals that were in progress when the
+// client last stopped
+func (c *client) ResumeDeal(ctx context.Context, id retrievalmarket.DealID) error {
+	var dealState retrievalmarket.ClientDealState
+	if err := c.deals.Get(uint64(id)).Get(&dealState); err != nil {
+		return xerrors.Errorf("deal %d: %w", id, err)
+	}
+	if retrievalmarket.IsTerminalStatus(dealState.Status) {
+		return xerrors.Errorf("deal %d has already finished", id)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	verifier, err := newVerifier(ctx, dealState.Params)
+	if err != nil {
+		cancel()
+		return xerrors.Errorf("deal %d: setting up verifier: %w", id, err)
+	}
+	// the provider only skips what it sent in the deal. The last block is
+	// asked for again unless everything received was paid for, so that the
+	// provider can ask for the last payment
+	paidUp := dealState.BytesPaidFor >= dealState.TotalReceived
+	held, heldBytes, complete, err := replayStoredBlocks(ctx, c.bs, verifier, dealState.Params, dealState.TotalReceived, paidUp)
+	if err != nil {
+		cancel()
+		return xerrors.Errorf("deal %d: checking stored blocks: %w", id, err)
+	}
+
+	// the provider starts payment intervals afresh. Unsealing is only paid
+	// for once in a deal
+	dealState.SkipBlocks = held
+	dealState.TotalReceived = heldBytes
+	dealState.PaymentRequested = tokenamount.FromInt(0)
+	dealState.CurrentInterval = dealState.PaymentInterval
+	dealState.Message = ""
+	dealState.Status = retrievalmarket.DealStatusNew
+
+	if complete {
+		cancel()
+		dealState.Status = retrievalmarket.DealStatusCompleted
+		c.saveDeal(&dealState)
+		c.notifySubscribers(retrievalmarket.ClientEventComplete, dealState)
+		return nil
+	}
+
+	proposalNd, err := cborutil.AsIpld(&dealState.DealProposal)
+	if err != nil {
+		cancel()
+		return xerrors.Errorf("getting proposal node: %w", err)
+	}
+	dealState.ProposalCid = proposalNd.Cid()
+
+	return c.startDeal(ctx, cancel, dealState, verifier)
+}
+
+// startDeal begins processing a tracked deal in the background. The deal stops
+// when ctx is cancelled, which cancel does
+func (c *client) startDeal(ctx context.Context, cancel context.CancelFunc, dealState retrievalmarket.ClientDealState, verifier BlockVerifier) error {
+	deal := &clientDeal{
+		cancel:   cancel,
+		done:     ctx.Done(),
+		addFunds: make(chan tokenamount.TokenAmount),
+	}
+
+	c.activeLk.Lock()
+	if _, ok := c.active[dealState.ID]; ok {
+		c.activeLk.Unlock()
+		cancel()
+		return xerrors.Errorf("deal %d is already in progress", dealState.ID)
+	}
+	c.active[dealState.ID] = deal
+	c.activeLk.Unlock()
+
+	c.saveDeal(&dealState)
+	go c.handleDeal(ctx, deal.addFunds, verifier, dealState)
+	return nil
+}
+
+// replayStoredBlocks reads the requested part of the payload DAG in the order a
+// provider sends it, passing blocks that are already in the blockstore to the
+// verifier until the first one that is missing, or that would take the bytes
+// replayed over limit. The last block is only replayed if withLast is set. It
+// returns the number and size of the blocks replayed, and whether they make up
+// the whole of the requested part
+func replayStoredBlocks(ctx context.Context, bs blockstore.Blockstore, verifier BlockVerifier, params retrievalmarket.Params, limit uint64, withLast bool) (uint64, uint64, bool, error) {
+	sel, err := blockio.PayloadSelector(params)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	reader, err := blockio.NewSelectorBlockReader(ctx, bs, params.PayloadCID, sel)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	var held, size uint64
+	for {
+		block, last, err := reader.ReadBlock(ctx)
+		if xerrors.Is(err, blockstore.ErrNotFound) {
+			return held, size, false, nil
+		}
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if size+uint64(len(block.Data)) > limit || last && !withLast {
+			return held, size, false, nil
+		}
+
+		blk, err := blockFromMessage(block)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		done, err := verifier.Verify(ctx, blk)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		held++
+		size += uint64(len(block.Data))
+		if done {
+			return held, size, true, nil
+		}
+	}
+}
+
 func (c *client) failDeal(dealState *retrievalmarket.ClientDealState, err error) {
 	dealState.Message = err.Error()
 	dealState.Status = retrievalmarket.DealStatusFailed
+	c.saveDeal(dealState)
 	c.notifySubscribers(retrievalmarket.ClientEventError, *dealState)
 }
 
-func (c *client) handleDeal(ctx context.Context, dealState retrievalmarket.ClientDealState) {
+// saveDeal writes the current deal state to the deal store. Deals that were
+// never tracked (i.e. failed before Begin) are skipped
+func (c *client) saveDeal(dealState *retrievalmarket.ClientDealState) {
+	has, err := c.deals.Has(uint64(dealState.ID))
+	if err != nil {
+		log.Errorf("retrieval deal %d: checking deal store: %s", dealState.ID, err)
+		return
+	}
+	if !has {
+		return
+	}
+	err = c.deals.Get(uint64(dealState.ID)).Mutate(func(ds *retrievalmarket.ClientDealState) error {
+		*ds = *dealState
+		return nil
+	})
+	if err != nil {
+		log.Errorf("retrieval deal %d: saving deal state: %s", dealState.ID, err)
+	}
+}
+
+// clientDeal holds the controls for a deal while it is being processed
+type clientDeal struct {
+	cancel context.CancelFunc
+	done   <-chan struct{}
+
+	// addFunds passes extra funds to a deal that is waiting for them
+	addFunds chan tokenamount.TokenAmount
+}
+
+func (c *client) handleDeal(ctx context.Context, addFunds <-chan tokenamount.TokenAmount, verifier BlockVerifier, dealState retrievalmarket.ClientDealState) {
+	defer c.finishDeal(dealState.ID)
 
 	c.notifySubscribers(retrievalmarket.ClientEventOpen, dealState)
 
-	s, err := c.network.NewDealStream(dealState.Sender)
+	ns, err := c.network.NewDealStream(dealState.Sender)
 	if err != nil {
 		c.failDeal(&dealState, err)
 		return
 	}
+	s := &clientDealStream{RetrievalDealStream: ns}
 	defer s.Close()
 
-	environment := clientDealEnvironment{c.node, &UnixFs0Verifier{Root: dealState.DealProposal.PayloadCID}, c.bs, s}
+	// the provider may be blocked waiting on us, so send the cancellation as
+	// soon as it happens rather than when the current handler returns
+	go func() {
+		<-ctx.Done()
+		s.cancel(dealState.ID)
+	}()
+
+	environment := clientDealEnvironment{c.node, verifier, c.bs, s}
 
 	for {
-		var handler clientstates.ClientHandlerFunc
-
-		switch dealState.Status {
-		case retrievalmarket.DealStatusNew:
-			handler = clientstates.ProposeDeal
-		case retrievalmarket.DealStatusAccepted:
-			handler = clientstates.SetupPaymentChannel
-		case retrievalmarket.DealStatusPaymentChannelCreated, retrievalmarket.DealStatusOngoing, retrievalmarket.DealStatusUnsealing:
-			handler = clientstates.ProcessNextResponse
-		case retrievalmarket.DealStatusFundsNeeded, retrievalmarket.DealStatusFundsNeededLastPayment:
-			handler = clientstates.ProcessNextResponse
-		default:
+		handler, ok := clientstates.StateEntries[dealState.Status]
+		if !ok {
 			c.failDeal(&dealState, xerrors.New("unexpected deal state"))
 			return
 		}
-		dealModifier := handler(ctx, environment, dealState)
-		dealModifier(&dealState)
+		if awaitingFunds(dealState) {
+			c.notifySubscribers(retrievalmarket.ClientEventFundsExpended, dealState)
+			handler = clientstates.WaitForFunds(addFunds)
+		}
+		update := handler(ctx, environment, dealState)
+		if ctx.Err() != nil {
+			update = update.Cancel(ctx.Err())
+		}
+		if err := update.Apply(&dealState); err != nil {
+			c.failDeal(&dealState, err)
+			return
+		}
+		if dealState.Status == retrievalmarket.DealStatusCancelled {
+			s.cancel(dealState.ID)
+		}
+		c.saveDeal(&dealState)
 		if retrievalmarket.IsTerminalStatus(dealState.Status) {
 			break
 		}
@@ -160,6 +410,8 @@ func (c *client) handleDeal(ctx context.Context, dealState retrievalmarket.Clien
 	}
 	if retrievalmarket.IsTerminalSuccess(dealState.Status) {
 		c.notifySubscribers(retrievalmarket.ClientEventComplete, dealState)
+	} else if dealState.Status == retrievalmarket.DealStatusCancelled {
+		c.notifySubscribers(retrievalmarket.ClientEventCancelled, dealState)
 	} else {
 		c.notifySubscribers(retrievalmarket.ClientEventError, dealState)
 	}
@@ -199,21 +451,126 @@ func (c *client) SubscribeToEvents(subscriber retrievalmarket.ClientSubscriber)
 	return c.unsubscribeAt(subscriber)
 }
 
+// fundsExpended returns true if a deal cannot pay what the provider is asking
+// for without going over its total funds
+func fundsExpended(deal retrievalmarket.ClientDealState) bool {
+	return tokenamount.Add(deal.FundsSpent, deal.PaymentRequested).GreaterThan(deal.TotalFunds)
+}
+
+// awaitingFunds returns whether a deal has been asked for a payment it doesn't
+// have the funds to make
+func awaitingFunds(deal retrievalmarket.ClientDealState) bool {
+	switch deal.Status {
+	case retrievalmarket.DealStatusUnsealing:
+		return deal.PaymentRequested.GreaterThan(tokenamount.FromInt(0)) && fundsExpended(deal)
+	case retrievalmarket.DealStatusFundsNeeded, retrievalmarket.DealStatusFundsNeededLastPayment:
+		return fundsExpended(deal)
+	}
+	return false
+}
+
 // V1
-func (c *client) AddMoreFunds(id retrievalmarket.DealID, amount tokenamount.TokenAmount) error {
-	panic("not implemented")
+
+// AddMoreFunds tops up a deal that has run out of funds. The extra funds are
+// added to the deal's payment channel, and the deal resumes on the same lane
+func (c *client) AddMoreFunds(ctx context.Context, id retrievalmarket.DealID, amount tokenamount.TokenAmount) error {
+	deal, err := c.activeDeal(id)
+	if err != nil {
+		return err
+	}
+
+	state, err := c.RetrievalStatus(id)
+	if err != nil {
+		return err
+	}
+	if state.Status != retrievalmarket.DealStatusFundsNeeded && state.Status != retrievalmarket.DealStatusFundsNeededLastPayment &&
+		state.Status != retrievalmarket.DealStatusUnsealing || !fundsExpended(state) {
+		return xerrors.Errorf("deal %d is not waiting for funds", id)
+	}
+
+	// make sure the payment channel covers everything the deal has left to spend
+	available := tokenamount.Sub(tokenamount.Add(state.TotalFunds, amount), state.FundsSpent)
+	paych, err := c.node.GetOrCreatePaymentChannel(ctx, state.ClientWallet, state.MinerWallet, available)
+	if err != nil {
+		return xerrors.Errorf("adding funds to payment channel: %w", err)
+	}
+	if paych != state.PaymentInfo.PayCh {
+		return xerrors.Errorf("deal %d: expected payment channel %s, got %s", id, state.PaymentInfo.PayCh, paych)
+	}
+
+	select {
+	case deal.addFunds <- amount:
+		return nil
+	case <-deal.done:
+		return xerrors.Errorf("deal %d is not in progress", id)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
+// CancelDeal stops an in progress retrieval deal. The provider is sent a cancellation
+// in place of the next payment, and the deal ends with DealStatusCancelled
 func (c *client) CancelDeal(id retrievalmarket.DealID) error {
-	panic("not implemented")
+	deal, err := c.activeDeal(id)
+	if err != nil {
+		return err
+	}
+	deal.cancel()
+	return nil
 }
 
-func (c *client) RetrievalStatus(id retrievalmarket.DealID) {
-	panic("not implemented")
+// activeDeal returns the controls for a deal that is in progress
+func (c *client) activeDeal(id retrievalmarket.DealID) (*clientDeal, error) {
+	c.activeLk.Lock()
+	deal, ok := c.active[id]
+	c.activeLk.Unlock()
+	if ok {
+		return deal, nil
+	}
+
+	has, err := c.deals.Has(uint64(id))
+	if err != nil {
+		return nil, xerrors.Errorf("deal %d: %w", id, err)
+	}
+	if !has {
+		return nil, xerrors.Errorf("deal %d: %w", id, retrievalmarket.ErrNotFound)
+	}
+	return nil, xerrors.Errorf("deal %d is not in progress", id)
+}
+
+// finishDeal releases the resources held for a deal once it stops processing
+func (c *client) finishDeal(id retrievalmarket.DealID) {
+	c.activeLk.Lock()
+	deal, ok := c.active[id]
+	delete(c.active, id)
+	c.activeLk.Unlock()
+	if ok {
+		deal.cancel()
+	}
+}
+
+// RetrievalStatus returns the current state of the deal with the given id
+func (c *client) RetrievalStatus(id retrievalmarket.DealID) (retrievalmarket.ClientDealState, error) {
+	var out retrievalmarket.ClientDealState
+	if err := c.deals.Get(uint64(id)).Get(&out); err != nil {
+		return retrievalmarket.ClientDealState{}, xerrors.Errorf("deal %d: %w", id, err)
+	}
+	return out, nil
 }
 
+// ListDeals lists all known retrieval deals, both in progress and finished
 func (c *client) ListDeals() map[retrievalmarket.DealID]retrievalmarket.ClientDealState {
-	panic("not implemented")
+	var deals []retrievalmarket.ClientDealState
+	if err := c.deals.List(&deals); err != nil {
+		log.Errorf("listing retrieval deals: %s", err)
+		return nil
+	}
+
+	out := make(map[retrievalmarket.DealID]retrievalmarket.ClientDealState, len(deals))
+	for _, deal := range deals {
+		out[deal.ID] = deal
+	}
+	return out
 }
 
 /*
@@ -431,6 +788,54 @@ func (cst *clientStream) setupPayment(ctx context.Context, toSend tokenamount.To
 }
 */
 
+// clientDealStream serializes writes to a deal stream, so that a cancellation can be
+// sent while a deal handler is blocked reading from it. Once a deal is cancelled or
+// the stream is closed, nothing more is written
+type clientDealStream struct {
+	rmnet.RetrievalDealStream
+	lk     sync.Mutex
+	closed bool
+}
+
+func (cds *clientDealStream) WriteDealProposal(proposal retrievalmarket.DealProposal) error {
+	cds.lk.Lock()
+	defer cds.lk.Unlock()
+	if cds.closed {
+		return retrievalmarket.ErrDealCancelled
+	}
+	return cds.RetrievalDealStream.WriteDealProposal(proposal)
+}
+
+func (cds *clientDealStream) WriteDealPayment(payment retrievalmarket.DealPayment) error {
+	cds.lk.Lock()
+	defer cds.lk.Unlock()
+	if cds.closed {
+		return retrievalmarket.ErrDealCancelled
+	}
+	return cds.RetrievalDealStream.WriteDealPayment(payment)
+}
+
+// cancel tells the provider the deal is cancelled, unless that has already
+// happened or the stream is closed
+func (cds *clientDealStream) cancel(id retrievalmarket.DealID) {
+	cds.lk.Lock()
+	defer cds.lk.Unlock()
+	if cds.closed {
+		return
+	}
+	cds.closed = true
+	if err := cds.RetrievalDealStream.WriteDealCancellation(retrievalmarket.DealCancellation{ID: id}); err != nil {
+		log.Warnf("retrieval deal %d: sending cancellation: %s", id, err)
+	}
+}
+
+func (cds *clientDealStream) Close() error {
+	cds.lk.Lock()
+	defer cds.lk.Unlock()
+	cds.closed = true
+	return cds.RetrievalDealStream.Close()
+}
+
 type clientDealEnvironment struct {
 	node     retrievalmarket.RetrievalClientNode
 	verifier BlockVerifier
@@ -446,18 +851,24 @@ func (cde clientDealEnvironment) DealStream() rmnet.RetrievalDealStream {
 	return cde.stream
 }
 
-func (cde clientDealEnvironment) ConsumeBlock(ctx context.Context, block retrievalmarket.Block) (uint64, bool, error) {
+// blockFromMessage rebuilds a block sent in a deal response, hashing its data
+// to get its CID
+func blockFromMessage(block retrievalmarket.Block) (blocks.Block, error) {
 	prefix, err := cid.PrefixFromBytes(block.Prefix)
 	if err != nil {
-		return 0, false, err
+		return nil, err
 	}
 
 	cid, err := prefix.Sum(block.Data)
 	if err != nil {
-		return 0, false, err
+		return nil, err
 	}
 
-	blk, err := blocks.NewBlockWithCid(block.Data, cid)
+	return blocks.NewBlockWithCid(block.Data, cid)
+}
+
+func (cde clientDealEnvironment) ConsumeBlock(ctx context.Context, block retrievalmarket.Block) (uint64, bool, error) {
+	blk, err := blockFromMessage(block)
 	if err != nil {
 		return 0, false, err
 	}
@@ -1,20 +1,34 @@
 package retrievalimpl_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"math/big"
+	"sync"
 	"testing"
 
 	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-data-transfer/testutil"
+	"github.com/filecoin-project/go-statestore"
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
 	dss "github.com/ipfs/go-datastore/sync"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	unixfs_pb "github.com/ipfs/go-unixfs/pb"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	retrievalimpl "github.com/filecoin-project/go-fil-markets/retrievalmarket/impl"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/blockio"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/network"
 	rmnet "github.com/filecoin-project/go-fil-markets/retrievalmarket/network"
@@ -26,6 +40,7 @@ func TestClient_Query(t *testing.T) {
 	ctx := context.Background()
 
 	bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
 
 	pcid := []byte(string("applesauce"))
 	expectedPeer := peer.ID("somevalue")
@@ -57,7 +72,8 @@ func TestClient_Query(t *testing.T) {
 		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{
 			QueryStreamBuilder: tut.ExpectPeerOnQueryStreamBuilder(t, expectedPeer, qsb, "Peers should match"),
 		})
-		c := retrievalimpl.NewClient(net, bs, testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{}), &testPeerResolver{})
+		c, err := retrievalimpl.NewClient(net, bs, testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{}), &testPeerResolver{}, ds)
+		require.NoError(t, err)
 
 		resp, err := c.Query(ctx, rpeer, pcid, retrievalmarket.QueryParams{})
 		require.NoError(t, err)
@@ -69,10 +85,11 @@ func TestClient_Query(t *testing.T) {
 		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{
 			QueryStreamBuilder: tut.FailNewQueryStream,
 		})
-		c := retrievalimpl.NewClient(net, bs,
-			testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{}), &testPeerResolver{})
+		c, err := retrievalimpl.NewClient(net, bs,
+			testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{}), &testPeerResolver{}, ds)
+		require.NoError(t, err)
 
-		_, err := c.Query(ctx, rpeer, pcid, retrievalmarket.QueryParams{})
+		_, err = c.Query(ctx, rpeer, pcid, retrievalmarket.QueryParams{})
 		assert.EqualError(t, err, "new query stream failed")
 	})
 
@@ -89,8 +106,9 @@ func TestClient_Query(t *testing.T) {
 		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{
 			QueryStreamBuilder: qsbuilder,
 		})
-		c := retrievalimpl.NewClient(net, bs,
-			testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{}), &testPeerResolver{})
+		c, err := retrievalimpl.NewClient(net, bs,
+			testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{}), &testPeerResolver{}, ds)
+		require.NoError(t, err)
 
 		statusCode, err := c.Query(ctx, rpeer, pcid, retrievalmarket.QueryParams{})
 		assert.EqualError(t, err, "write query failed")
@@ -108,11 +126,13 @@ func TestClient_Query(t *testing.T) {
 		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{
 			QueryStreamBuilder: qsbuilder,
 		})
-		c := retrievalimpl.NewClient(
+		c, err := retrievalimpl.NewClient(
 			net,
 			bs,
 			testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{}),
-			&testPeerResolver{})
+			&testPeerResolver{},
+			ds)
+		require.NoError(t, err)
 
 		statusCode, err := c.Query(ctx, rpeer, pcid, retrievalmarket.QueryParams{})
 		assert.EqualError(t, err, "query response failed")
@@ -122,6 +142,7 @@ func TestClient_Query(t *testing.T) {
 
 func TestClient_FindProviders(t *testing.T) {
 	bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
 	expectedPeer := peer.ID("somevalue")
 
 	var qsb tut.QueryStreamBuilder = func(p peer.ID) (rmnet.RetrievalQueryStream, error) {
@@ -138,33 +159,966 @@ func TestClient_FindProviders(t *testing.T) {
 		peers := tut.RequireGenerateRetrievalPeers(t, 3)
 		testResolver := testPeerResolver{peers: peers}
 
-		c := retrievalimpl.NewClient(net, bs, &testnodes.TestRetrievalClientNode{}, &testResolver)
-		testCid := []byte("somePieceCID")
+		c, err := retrievalimpl.NewClient(net, bs, &testnodes.TestRetrievalClientNode{}, &testResolver, ds)
+		require.NoError(t, err)
+		testCid := testutil.GenerateCids(1)[0]
 		assert.Len(t, c.FindProviders(testCid), 3)
 	})
 
 	t.Run("when there is an error, returns empty provider list", func(t *testing.T) {
 		testResolver := testPeerResolver{peers: []retrievalmarket.RetrievalPeer{}, resolverError: errors.New("boom")}
-		c := retrievalimpl.NewClient(net, bs, &testnodes.TestRetrievalClientNode{}, &testResolver)
-		badCid := []byte("doesn't matter")
+		c, err := retrievalimpl.NewClient(net, bs, &testnodes.TestRetrievalClientNode{}, &testResolver, ds)
+		require.NoError(t, err)
+		badCid := testutil.GenerateCids(1)[0]
 		assert.Len(t, c.FindProviders(badCid), 0)
 	})
 
 	t.Run("when there are no providers", func(t *testing.T) {
 		testResolver := testPeerResolver{peers: []retrievalmarket.RetrievalPeer{}}
-		c := retrievalimpl.NewClient(net, bs, &testnodes.TestRetrievalClientNode{}, &testResolver)
-		testCid := []byte("unimportant")
+		c, err := retrievalimpl.NewClient(net, bs, &testnodes.TestRetrievalClientNode{}, &testResolver, ds)
+		require.NoError(t, err)
+		testCid := testutil.GenerateCids(1)[0]
 		assert.Len(t, c.FindProviders(testCid), 0)
 	})
 }
 
 type testPeerResolver struct {
-	peers []retrievalmarket.RetrievalPeer
+	peers         []retrievalmarket.RetrievalPeer
 	resolverError error
 }
 
 var _ retrievalmarket.PeerResolver = &testPeerResolver{}
 
-func (tpr testPeerResolver) GetPeers( []byte) ([]retrievalmarket.RetrievalPeer, error) {
+func (tpr testPeerResolver) GetPeers(cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
 	return tpr.peers, tpr.resolverError
-}
\ No newline at end of file
+}
+
+func TestClient_ListDeals(t *testing.T) {
+	bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{
+		DealStreamBuilder: tut.FailNewDealStream,
+	})
+	node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
+	params := tut.MakeTestDealProposal().Params
+
+	retrieveAndWait := func(t *testing.T, c retrievalmarket.RetrievalClient) retrievalmarket.DealID {
+		done := make(chan struct{})
+		unsub := c.SubscribeToEvents(func(event retrievalmarket.ClientEvent, state retrievalmarket.ClientDealState) {
+			if event == retrievalmarket.ClientEventError {
+				close(done)
+			}
+		})
+		defer unsub()
+		dealID := c.Retrieve(context.Background(), []byte("applesauce"), params, tokenamount.FromInt(1000), peer.ID("somepeer"), address.TestAddress, address.TestAddress2)
+		<-done
+		return dealID
+	}
+
+	c, err := retrievalimpl.NewClient(net, bs, node, &testPeerResolver{}, ds)
+	require.NoError(t, err)
+	dealID := retrieveAndWait(t, c)
+
+	deals := c.ListDeals()
+	require.Len(t, deals, 1)
+	require.Equal(t, retrievalmarket.DealStatusFailed, deals[dealID].Status)
+	require.Equal(t, "new deal stream failed", deals[dealID].Message)
+
+	status, err := c.RetrievalStatus(dealID)
+	require.NoError(t, err)
+	require.Equal(t, deals[dealID], status)
+
+	_, err = c.RetrievalStatus(dealID + 1)
+	require.Error(t, err)
+
+	t.Run("deals survive a restart", func(t *testing.T) {
+		c, err := retrievalimpl.NewClient(net, bs, node, &testPeerResolver{}, ds)
+		require.NoError(t, err)
+		require.Len(t, c.ListDeals(), 1)
+
+		nextDealID := retrieveAndWait(t, c)
+		require.Equal(t, dealID+1, nextDealID)
+		require.Len(t, c.ListDeals(), 2)
+	})
+}
+
+func TestClient_CancelDeal(t *testing.T) {
+	bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
+	params := tut.MakeTestDealProposal().Params
+
+	// the provider never responds to the proposal until the client cancels
+	var cancellation retrievalmarket.DealCancellation
+	cancelled := make(chan struct{})
+	net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{
+		DealStreamBuilder: func(p peer.ID) (rmnet.RetrievalDealStream, error) {
+			return tut.NewTestRetrievalDealStream(tut.TestDealStreamParams{
+				PeerID: p,
+				ResponseReader: func() (retrievalmarket.DealResponse, error) {
+					<-cancelled
+					return retrievalmarket.DealResponseUndefined, errors.New("stream closed")
+				},
+				CancellationWriter: func(dc retrievalmarket.DealCancellation) error {
+					cancellation = dc
+					close(cancelled)
+					return nil
+				},
+			}), nil
+		},
+	})
+
+	c, err := retrievalimpl.NewClient(net, bs, node, &testPeerResolver{}, ds)
+	require.NoError(t, err)
+
+	done := make(chan retrievalmarket.ClientDealState, 1)
+	unsub := c.SubscribeToEvents(func(event retrievalmarket.ClientEvent, state retrievalmarket.ClientDealState) {
+		if event == retrievalmarket.ClientEventCancelled {
+			done <- state
+		}
+	})
+	defer unsub()
+
+	dealID := c.Retrieve(context.Background(), []byte("applesauce"), params, tokenamount.FromInt(1000), peer.ID("somepeer"), address.TestAddress, address.TestAddress2)
+	require.NoError(t, c.CancelDeal(dealID))
+
+	state := <-done
+	require.Equal(t, retrievalmarket.DealStatusCancelled, state.Status)
+	require.Equal(t, dealID, cancellation.ID)
+
+	status, err := c.RetrievalStatus(dealID)
+	require.NoError(t, err)
+	require.Equal(t, retrievalmarket.DealStatusCancelled, status.Status)
+
+	t.Run("cannot cancel a finished deal", func(t *testing.T) {
+		require.Error(t, c.CancelDeal(dealID))
+	})
+
+	t.Run("cannot cancel an unknown deal", func(t *testing.T) {
+		require.Error(t, c.CancelDeal(dealID+1))
+	})
+}
+
+func TestClient_AddMoreFunds(t *testing.T) {
+	ctx := context.Background()
+	bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{
+		PayCh:   address.TestAddress,
+		Lane:    5,
+		Voucher: tut.MakeTestSignedVoucher(),
+	})
+
+	blk := merkledag.NewRawNode([]byte("some retrieved data"))
+	blockSize := uint64(len(blk.RawData()))
+	params := retrievalmarket.Params{
+		PayloadCID:      blk.Cid(),
+		PricePerByte:    tokenamount.FromInt(1),
+		PaymentInterval: blockSize,
+	}
+	// the provider asks for more than the deal was given
+	totalFunds := tokenamount.FromInt(blockSize - 1)
+	paymentOwed := tokenamount.FromInt(blockSize)
+
+	responses := []retrievalmarket.DealResponse{
+		{Status: retrievalmarket.DealStatusAccepted},
+		{
+			Status:      retrievalmarket.DealStatusFundsNeededLastPayment,
+			PaymentOwed: paymentOwed,
+			Blocks: []retrievalmarket.Block{{
+				Prefix: blk.Cid().Prefix().Bytes(),
+				Data:   blk.RawData(),
+			}},
+		},
+	}
+	payments := make(chan retrievalmarket.DealPayment, 1)
+	net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{
+		DealStreamBuilder: scriptedDealStreamBuilder(responses, nil, payments),
+	})
+
+	c, err := retrievalimpl.NewClient(net, bs, node, &testPeerResolver{}, ds)
+	require.NoError(t, err)
+
+	fundsExpended := make(chan retrievalmarket.ClientDealState, 1)
+	finished := make(chan retrievalmarket.ClientDealState, 1)
+	unsub := c.SubscribeToEvents(func(event retrievalmarket.ClientEvent, state retrievalmarket.ClientDealState) {
+		switch event {
+		case retrievalmarket.ClientEventFundsExpended:
+			fundsExpended <- state
+		case retrievalmarket.ClientEventError, retrievalmarket.ClientEventComplete:
+			finished <- state
+		}
+	})
+	defer unsub()
+
+	dealID := c.Retrieve(context.Background(), []byte("applesauce"), params, totalFunds, peer.ID("somepeer"), address.TestAddress, address.TestAddress2)
+
+	state := <-fundsExpended
+	require.Equal(t, retrievalmarket.DealStatusFundsNeededLastPayment, state.Status)
+	require.Equal(t, paymentOwed, state.PaymentRequested)
+	require.Len(t, payments, 0)
+
+	require.NoError(t, c.AddMoreFunds(ctx, dealID, tokenamount.FromInt(10)))
+
+	payment := <-payments
+	require.Equal(t, dealID, payment.ID)
+	require.Equal(t, address.TestAddress, payment.PaymentChannel)
+
+	state = <-finished
+	require.Equal(t, retrievalmarket.DealStatusCompleted, state.Status)
+	require.Equal(t, tokenamount.Add(totalFunds, tokenamount.FromInt(10)), state.TotalFunds)
+	require.Equal(t, paymentOwed, state.FundsSpent)
+	require.Equal(t, uint64(5), state.PaymentInfo.Lane)
+
+	require.Error(t, c.AddMoreFunds(ctx, dealID, tokenamount.FromInt(10)), "deal is no longer in progress")
+}
+
+func TestClient_PaysToUnseal(t *testing.T) {
+	bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{
+		PayCh:   address.TestAddress,
+		Lane:    5,
+		Voucher: tut.MakeTestSignedVoucher(),
+	})
+
+	blk := merkledag.NewRawNode([]byte("some sealed data"))
+	blockSize := uint64(len(blk.RawData()))
+	unsealPrice := tokenamount.FromInt(100)
+	params := retrievalmarket.NewParamsV0(big.NewInt(1), blockSize, 0)
+	params.PayloadCID = blk.Cid()
+	params.UnsealPrice = unsealPrice
+
+	responses := []retrievalmarket.DealResponse{
+		{Status: retrievalmarket.DealStatusAccepted},
+		{Status: retrievalmarket.DealStatusUnsealing, PaymentOwed: unsealPrice},
+		{
+			Status:      retrievalmarket.DealStatusFundsNeededLastPayment,
+			PaymentOwed: tokenamount.FromInt(blockSize),
+			Blocks: []retrievalmarket.Block{{
+				Prefix: blk.Cid().Prefix().Bytes(),
+				Data:   blk.RawData(),
+			}},
+		},
+	}
+	payments := make(chan retrievalmarket.DealPayment, 2)
+	net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{
+		DealStreamBuilder: scriptedDealStreamBuilder(responses, nil, payments),
+	})
+
+	c, err := retrievalimpl.NewClient(net, bs, node, &testPeerResolver{}, ds)
+	require.NoError(t, err)
+
+	finished := make(chan retrievalmarket.ClientDealState, 1)
+	unsub := c.SubscribeToEvents(func(event retrievalmarket.ClientEvent, state retrievalmarket.ClientDealState) {
+		switch event {
+		case retrievalmarket.ClientEventError, retrievalmarket.ClientEventComplete:
+			finished <- state
+		}
+	})
+	defer unsub()
+
+	totalFunds := tokenamount.Add(unsealPrice, tokenamount.FromInt(blockSize))
+	c.Retrieve(context.Background(), []byte("applesauce"), params, totalFunds, peer.ID("somepeer"), address.TestAddress, address.TestAddress2)
+
+	state := <-finished
+	require.Equal(t, retrievalmarket.DealStatusCompleted, state.Status, state.Message)
+	require.Equal(t, totalFunds, state.FundsSpent)
+	require.Equal(t, unsealPrice, state.UnsealFundsPaid)
+	require.Equal(t, blockSize, state.BytesPaidFor)
+	require.Len(t, payments, 2)
+
+	has, err := bs.Has(blk.Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+}
+
+func TestClient_ResumeDeal(t *testing.T) {
+	ctx := context.Background()
+	bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+
+	// a file made of a root node with two leaves
+	leaves := []*merkledag.RawNode{
+		merkledag.NewRawNode([]byte("first part of the file")),
+		merkledag.NewRawNode([]byte("second part of the file")),
+	}
+	fsn := unixfs.NewFSNode(unixfs_pb.Data_File)
+	root := merkledag.NodeWithData(nil)
+	for _, leaf := range leaves {
+		fsn.AddBlockSize(uint64(len(leaf.RawData())))
+		require.NoError(t, root.AddNodeLink("", leaf))
+	}
+	fsnBytes, err := fsn.GetBytes()
+	require.NoError(t, err)
+	root.SetData(fsnBytes)
+
+	toBlock := func(nd ipld.Node) retrievalmarket.Block {
+		return retrievalmarket.Block{Prefix: nd.Cid().Prefix().Bytes(), Data: nd.RawData()}
+	}
+	params := retrievalmarket.Params{
+		PayloadCID:      root.Cid(),
+		PricePerByte:    tokenamount.FromInt(1),
+		PaymentInterval: 1,
+	}
+	firstOwed := tokenamount.FromInt(uint64(len(root.RawData()) + len(leaves[0].RawData())))
+	secondOwed := tokenamount.FromInt(uint64(len(leaves[1].RawData())))
+
+	// the first attempt gets the root and first leaf, then the provider goes away
+	payments := make(chan retrievalmarket.DealPayment, 1)
+	net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{
+		DealStreamBuilder: scriptedDealStreamBuilder([]retrievalmarket.DealResponse{
+			{Status: retrievalmarket.DealStatusAccepted},
+			{
+				Status:      retrievalmarket.DealStatusFundsNeeded,
+				PaymentOwed: firstOwed,
+				Blocks:      []retrievalmarket.Block{toBlock(root), toBlock(leaves[0])},
+			},
+		}, nil, payments),
+	})
+	node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{
+		PayCh:   address.TestAddress,
+		Lane:    5,
+		Voucher: tut.MakeTestSignedVoucher(),
+	})
+	c, err := retrievalimpl.NewClient(net, bs, node, &testPeerResolver{}, ds)
+	require.NoError(t, err)
+	finished := make(chan retrievalmarket.ClientDealState, 1)
+	c.SubscribeToEvents(func(event retrievalmarket.ClientEvent, state retrievalmarket.ClientDealState) {
+		if event == retrievalmarket.ClientEventError || event == retrievalmarket.ClientEventComplete {
+			finished <- state
+		}
+	})
+	dealID := c.Retrieve(ctx, []byte("applesauce"), params, tokenamount.FromInt(1000), peer.ID("somepeer"), address.TestAddress, address.TestAddress2)
+	<-payments
+	state := <-finished
+	require.Equal(t, retrievalmarket.DealStatusFailed, state.Status)
+	require.Equal(t, firstOwed, state.FundsSpent)
+	require.Error(t, c.ResumeDeal(ctx, dealID), "a failed deal cannot be resumed")
+
+	// as if the client had stopped while the deal was in progress
+	deals := statestore.New(namespace.Wrap(ds, datastore.NewKey(retrievalimpl.ClientDsPrefix)))
+	require.NoError(t, deals.Get(uint64(dealID)).Mutate(func(deal *retrievalmarket.ClientDealState) error {
+		deal.Status = retrievalmarket.DealStatusOngoing
+		deal.Message = ""
+		return nil
+	}))
+
+	// when the client starts again and restarts its deals, it resumes the
+	// deal, only asking for the second leaf
+	proposals := make(chan retrievalmarket.DealProposal, 1)
+	net = tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{
+		DealStreamBuilder: scriptedDealStreamBuilder([]retrievalmarket.DealResponse{
+			{Status: retrievalmarket.DealStatusAccepted},
+			{
+				Status:      retrievalmarket.DealStatusFundsNeededLastPayment,
+				PaymentOwed: secondOwed,
+				Blocks:      []retrievalmarket.Block{toBlock(leaves[1])},
+			},
+		}, proposals, payments),
+	})
+	node = testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{
+		PayCh:   address.TestAddress,
+		Lane:    6,
+		Voucher: tut.MakeTestSignedVoucher(),
+	})
+	c, err = retrievalimpl.NewClient(net, bs, node, &testPeerResolver{}, ds)
+	require.NoError(t, err)
+	opened := make(chan retrievalmarket.DealID, 1)
+	c.SubscribeToEvents(func(event retrievalmarket.ClientEvent, state retrievalmarket.ClientDealState) {
+		switch event {
+		case retrievalmarket.ClientEventOpen:
+			opened <- state.ID
+		case retrievalmarket.ClientEventError, retrievalmarket.ClientEventComplete:
+			finished <- state
+		}
+	})
+	require.NoError(t, c.RestartDeals(ctx))
+
+	require.Equal(t, dealID, <-opened)
+	proposal := <-proposals
+	require.Equal(t, dealID, proposal.ID)
+	require.Equal(t, uint64(2), proposal.SkipBlocks)
+	<-payments
+
+	state = <-finished
+	require.Equal(t, retrievalmarket.DealStatusCompleted, state.Status)
+	require.Equal(t, tokenamount.Add(firstOwed, secondOwed), state.FundsSpent)
+	require.Equal(t, uint64(5), state.PaymentInfo.Lane, "the deal keeps its original lane")
+
+	has, err := bs.Has(leaves[1].Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+
+	require.Error(t, c.ResumeDeal(ctx, dealID), "a completed deal cannot be resumed")
+
+	t.Run("the last block is asked for again until it is paid for", func(t *testing.T) {
+		require.NoError(t, deals.Get(uint64(dealID)).Mutate(func(deal *retrievalmarket.ClientDealState) error {
+			deal.Status = retrievalmarket.DealStatusOngoing
+			deal.BytesPaidFor -= uint64(len(leaves[1].RawData()))
+			deal.FundsSpent = firstOwed
+			return nil
+		}))
+
+		proposals := make(chan retrievalmarket.DealProposal, 1)
+		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{
+			DealStreamBuilder: scriptedDealStreamBuilder(nil, proposals, nil),
+		})
+		c, err := retrievalimpl.NewClient(net, bs, node, &testPeerResolver{}, ds)
+		require.NoError(t, err)
+		require.NoError(t, c.RestartDeals(ctx))
+
+		proposal := <-proposals
+		require.Equal(t, uint64(2), proposal.SkipBlocks)
+	})
+}
+
+func TestClient_RetrieveWithSelector(t *testing.T) {
+	ctx := context.Background()
+
+	// a directory holding two files, of which only the second is wanted
+	files := []*merkledag.RawNode{
+		merkledag.NewRawNode([]byte("first file")),
+		merkledag.NewRawNode([]byte("second file")),
+	}
+	dir := &merkledag.ProtoNode{}
+	require.NoError(t, dir.AddNodeLink("first", files[0]))
+	require.NoError(t, dir.AddNodeLink("second", files[1]))
+
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	secondFile := ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+		efsb.Insert("Links", ssb.ExploreIndex(1,
+			ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+				efsb.Insert("Hash", ssb.Matcher())
+			})))
+	}).Node()
+	params, err := retrievalmarket.NewParamsV1(big.NewInt(1), 1000, 0, dir.Cid(), secondFile)
+	require.NoError(t, err)
+
+	toBlock := func(nd ipld.Node) retrievalmarket.Block {
+		return retrievalmarket.Block{Prefix: nd.Cid().Prefix().Bytes(), Data: nd.RawData()}
+	}
+
+	retrieve := func(t *testing.T, bs bstore.Blockstore, sent ...ipld.Node) retrievalmarket.ClientDealState {
+		var blocks []retrievalmarket.Block
+		for _, nd := range sent {
+			blocks = append(blocks, toBlock(nd))
+		}
+		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{
+			DealStreamBuilder: scriptedDealStreamBuilder([]retrievalmarket.DealResponse{
+				{Status: retrievalmarket.DealStatusAccepted},
+				{Status: retrievalmarket.DealStatusCompleted, Blocks: blocks},
+			}, nil, nil),
+		})
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{
+			PayCh: address.TestAddress,
+		})
+		c, err := retrievalimpl.NewClient(net, bs, node, &testPeerResolver{}, dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, err)
+
+		finished := make(chan retrievalmarket.ClientDealState, 1)
+		unsub := c.SubscribeToEvents(func(event retrievalmarket.ClientEvent, state retrievalmarket.ClientDealState) {
+			if event == retrievalmarket.ClientEventError || event == retrievalmarket.ClientEventComplete {
+				finished <- state
+			}
+		})
+		defer unsub()
+		c.Retrieve(ctx, []byte("applesauce"), params, tokenamount.FromInt(1000), peer.ID("somepeer"), address.TestAddress, address.TestAddress2)
+		return <-finished
+	}
+
+	t.Run("only the selected part is retrieved", func(t *testing.T) {
+		bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+		state := retrieve(t, bs, dir, files[1])
+		require.Equal(t, retrievalmarket.DealStatusCompleted, state.Status)
+		require.Equal(t, uint64(len(dir.RawData())+len(files[1].RawData())), state.TotalReceived)
+
+		has, err := bs.Has(files[1].Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+	})
+
+	t.Run("blocks outside the selection are rejected", func(t *testing.T) {
+		bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+		state := retrieve(t, bs, dir, files[0])
+		require.Equal(t, retrievalmarket.DealStatusFailed, state.Status)
+
+		has, err := bs.Has(files[0].Cid())
+		require.NoError(t, err)
+		require.False(t, has)
+	})
+}
+
+func TestClient_RetrieveBest(t *testing.T) {
+	ctx := context.Background()
+	blk := merkledag.NewRawNode([]byte("some data"))
+	blockSize := uint64(len(blk.RawData()))
+	totalFunds := tokenamount.FromInt(10 * blockSize)
+
+	offer := func(pricePerByte uint64, unsealed bool) retrievalmarket.QueryResponse {
+		return retrievalmarket.QueryResponse{
+			Status:             retrievalmarket.QueryResponseAvailable,
+			Items:              []retrievalmarket.QueryItemResponse{{Status: retrievalmarket.QueryItemAvailable, Size: blockSize}},
+			Size:               1 << 20,
+			PaymentAddress:     address.TestAddress2,
+			MinPricePerByte:    tokenamount.FromInt(pricePerByte),
+			MaxPaymentInterval: 1000,
+			UnsealPrice:        tokenamount.FromInt(0),
+			Unsealed:           unsealed,
+		}
+	}
+	unavailable := offer(1, true)
+	unavailable.Status = retrievalmarket.QueryResponseUnavailable
+	missingItem := offer(1, true)
+	missingItem.Items[0].Status = retrievalmarket.QueryItemUnavailable
+	offers := map[peer.ID]retrievalmarket.QueryResponse{
+		"expensive":    offer(5, true),
+		"sealed":       offer(2, false),
+		"unsealed":     offer(2, true),
+		"over budget":  offer(11, true),
+		"unavailable":  unavailable,
+		"missing item": missingItem,
+	}
+	var peers []retrievalmarket.RetrievalPeer
+	for id := range offers {
+		peers = append(peers, retrievalmarket.RetrievalPeer{Address: address.TestAddress2, ID: id})
+	}
+
+	completed := []retrievalmarket.DealResponse{
+		{Status: retrievalmarket.DealStatusAccepted},
+		{Status: retrievalmarket.DealStatusCompleted, Blocks: []retrievalmarket.Block{{
+			Prefix: blk.Cid().Prefix().Bytes(),
+			Data:   blk.RawData(),
+		}}},
+	}
+	rejected := []retrievalmarket.DealResponse{{Status: retrievalmarket.DealStatusRejected, Message: "busy"}}
+
+	retrieveBest := func(t *testing.T, dealResponses map[peer.ID][]retrievalmarket.DealResponse) (retrievalmarket.DealID, []peer.ID, error) {
+		var dealtWith []peer.ID
+		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{
+			QueryStreamBuilder: func(p peer.ID) (rmnet.RetrievalQueryStream, error) {
+				return tut.NewTestRetrievalQueryStream(tut.TestQueryStreamParams{
+					PeerID:     p,
+					Writer:     tut.TrivialQueryWriter,
+					RespReader: tut.StubbedQueryResponseReader(offers[p]),
+				}), nil
+			},
+			DealStreamBuilder: func(p peer.ID) (rmnet.RetrievalDealStream, error) {
+				dealtWith = append(dealtWith, p)
+				return scriptedDealStreamBuilder(dealResponses[p], nil, nil)(p)
+			},
+		})
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{
+			PayCh: address.TestAddress,
+		})
+		c, err := retrievalimpl.NewClient(net, bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore())), node,
+			&testPeerResolver{peers: peers}, dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, err)
+
+		dealID, err := c.RetrieveBest(ctx, []byte("applesauce"), blk.Cid(), nil, totalFunds, address.TestAddress)
+		return dealID, dealtWith, err
+	}
+
+	t.Run("retrieves from the cheapest unsealed offer", func(t *testing.T) {
+		_, dealtWith, err := retrieveBest(t, map[peer.ID][]retrievalmarket.DealResponse{
+			"unsealed": completed,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []peer.ID{"unsealed"}, dealtWith)
+	})
+
+	t.Run("falls back to the next offer", func(t *testing.T) {
+		_, dealtWith, err := retrieveBest(t, map[peer.ID][]retrievalmarket.DealResponse{
+			"unsealed":  rejected,
+			"expensive": completed,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []peer.ID{"unsealed", "sealed", "expensive"}, dealtWith)
+	})
+
+	t.Run("fails when every offer fails", func(t *testing.T) {
+		_, dealtWith, err := retrieveBest(t, map[peer.ID][]retrievalmarket.DealResponse{
+			"unsealed":  rejected,
+			"sealed":    rejected,
+			"expensive": rejected,
+		})
+		require.Error(t, err)
+		require.Equal(t, []peer.ID{"unsealed", "sealed", "expensive"}, dealtWith)
+	})
+
+	t.Run("fails with no providers", func(t *testing.T) {
+		c, err := retrievalimpl.NewClient(tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{}),
+			bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore())), &testnodes.TestRetrievalClientNode{},
+			&testPeerResolver{}, dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, err)
+		_, err = c.RetrieveBest(ctx, []byte("applesauce"), blk.Cid(), nil, totalFunds, address.TestAddress)
+		require.EqualError(t, err, "no providers found for "+blk.Cid().String())
+	})
+}
+
+func TestClient_RetrieveBestOutOfFunds(t *testing.T) {
+	ctx := context.Background()
+	file := merkledag.NewRawNode([]byte("some file"))
+	dir := &merkledag.ProtoNode{}
+	require.NoError(t, dir.AddNodeLink("file", file))
+	toBlock := func(nd ipld.Node) retrievalmarket.Block {
+		return retrievalmarket.Block{Prefix: nd.Cid().Prefix().Bytes(), Data: nd.RawData()}
+	}
+	dirSize := uint64(len(dir.RawData()))
+	size := dirSize + uint64(len(file.RawData()))
+
+	offer := func(pricePerByte uint64) retrievalmarket.QueryResponse {
+		return retrievalmarket.QueryResponse{
+			Status:             retrievalmarket.QueryResponseAvailable,
+			Items:              []retrievalmarket.QueryItemResponse{{Status: retrievalmarket.QueryItemAvailable, Size: size}},
+			Size:               1 << 20,
+			PaymentAddress:     address.TestAddress2,
+			MinPricePerByte:    tokenamount.FromInt(pricePerByte),
+			MaxPaymentInterval: dirSize,
+			UnsealPrice:        tokenamount.FromInt(0),
+		}
+	}
+	offers := map[peer.ID]retrievalmarket.QueryResponse{
+		"cheap":     offer(1),
+		"fallback":  offer(2),
+		"expensive": offer(3),
+	}
+	var peers []retrievalmarket.RetrievalPeer
+	for id := range offers {
+		peers = append(peers, retrievalmarket.RetrievalPeer{Address: address.TestAddress2, ID: id})
+	}
+	// the cheap provider is paid for the first block, then asks for more than
+	// the deal was given
+	spent := tokenamount.FromInt(dirSize)
+	totalFunds := tokenamount.FromInt(3*size + dirSize - 1)
+	outOfFunds := []retrievalmarket.DealResponse{
+		{Status: retrievalmarket.DealStatusAccepted},
+		{Status: retrievalmarket.DealStatusFundsNeeded, PaymentOwed: spent, Blocks: []retrievalmarket.Block{toBlock(dir)}},
+		{Status: retrievalmarket.DealStatusFundsNeeded, PaymentOwed: totalFunds},
+	}
+	completed := []retrievalmarket.DealResponse{
+		{Status: retrievalmarket.DealStatusAccepted},
+		{Status: retrievalmarket.DealStatusCompleted, Blocks: []retrievalmarket.Block{toBlock(dir), toBlock(file)}},
+	}
+	rejected := []retrievalmarket.DealResponse{{Status: retrievalmarket.DealStatusRejected, Message: "busy"}}
+
+	retrieveBest := func(t *testing.T, dealResponses map[peer.ID][]retrievalmarket.DealResponse) (retrievalmarket.RetrievalClient, retrievalmarket.DealID, []peer.ID, error) {
+		var dealtWith []peer.ID
+		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{
+			QueryStreamBuilder: func(p peer.ID) (rmnet.RetrievalQueryStream, error) {
+				return tut.NewTestRetrievalQueryStream(tut.TestQueryStreamParams{
+					PeerID:     p,
+					RespReader: tut.StubbedQueryResponseReader(offers[p]),
+				}), nil
+			},
+			DealStreamBuilder: func(p peer.ID) (rmnet.RetrievalDealStream, error) {
+				dealtWith = append(dealtWith, p)
+				return scriptedDealStreamBuilder(dealResponses[p], nil, nil)(p)
+			},
+		})
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{
+			PayCh:   address.TestAddress,
+			Voucher: tut.MakeTestSignedVoucher(),
+		})
+		c, err := retrievalimpl.NewClient(net, bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore())), node,
+			&testPeerResolver{peers: peers}, dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, err)
+
+		dealID, err := c.RetrieveBest(ctx, []byte("applesauce"), dir.Cid(), nil, totalFunds, address.TestAddress)
+		return c, dealID, dealtWith, err
+	}
+
+	t.Run("cancels the deal and falls back with the funds left", func(t *testing.T) {
+		c, dealID, dealtWith, err := retrieveBest(t, map[peer.ID][]retrievalmarket.DealResponse{
+			"cheap":    outOfFunds,
+			"fallback": completed,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []peer.ID{"cheap", "fallback"}, dealtWith)
+
+		for _, deal := range c.ListDeals() {
+			if deal.ID == dealID {
+				require.Equal(t, retrievalmarket.DealStatusCompleted, deal.Status)
+				require.Equal(t, tokenamount.Sub(totalFunds, spent), deal.TotalFunds)
+			} else {
+				require.Equal(t, retrievalmarket.DealStatusCancelled, deal.Status)
+				require.Equal(t, spent, deal.FundsSpent)
+			}
+		}
+	})
+
+	t.Run("skips offers that no longer fit in the funds left", func(t *testing.T) {
+		_, _, dealtWith, err := retrieveBest(t, map[peer.ID][]retrievalmarket.DealResponse{
+			"cheap":     outOfFunds,
+			"fallback":  rejected,
+			"expensive": completed,
+		})
+		require.Error(t, err)
+		require.Equal(t, []peer.ID{"cheap", "fallback"}, dealtWith)
+	})
+}
+
+func TestClient_RetrieveSwarm(t *testing.T) {
+	ctx := context.Background()
+
+	// a directory holding two files, retrieved as one part each once the
+	// directory itself is retrieved
+	files := []*merkledag.RawNode{
+		merkledag.NewRawNode([]byte("first file")),
+		merkledag.NewRawNode([]byte("second file")),
+	}
+	dir := &merkledag.ProtoNode{}
+	require.NoError(t, dir.AddNodeLink("first", files[0]))
+	require.NoError(t, dir.AddNodeLink("second", files[1]))
+
+	rootItem, err := retrievalmarket.NewQueryItem(dir.Cid(), blockio.RootSelector())
+	require.NoError(t, err)
+	withDir := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	require.NoError(t, withDir.Put(dir))
+	parts, err := blockio.SplitSelectors(ctx, withDir, dir.Cid(), 2)
+	require.NoError(t, err)
+	secondPart, err := retrievalmarket.NewQueryItem(dir.Cid(), parts[1])
+	require.NoError(t, err)
+	dirSize := uint64(len(dir.RawData()))
+	partSize := func(i int) uint64 {
+		return dirSize + uint64(len(files[i].RawData()))
+	}
+	toBlock := func(nd ipld.Node) retrievalmarket.Block {
+		return retrievalmarket.Block{Prefix: nd.Cid().Prefix().Bytes(), Data: nd.RawData()}
+	}
+
+	// providers answer for the root, and for each part with its item
+	available := retrievalmarket.QueryResponse{
+		Status: retrievalmarket.QueryResponseAvailable,
+		Items: []retrievalmarket.QueryItemResponse{
+			{Status: retrievalmarket.QueryItemAvailable, Size: partSize(0)},
+			{Status: retrievalmarket.QueryItemAvailable, Size: partSize(1)},
+		},
+		Size:               1 << 20,
+		PaymentAddress:     address.TestAddress2,
+		MinPricePerByte:    tokenamount.FromInt(1),
+		MaxPaymentInterval: 1000,
+		UnsealPrice:        tokenamount.FromInt(0),
+	}
+	answer := func(response retrievalmarket.QueryResponse, query retrievalmarket.Query) retrievalmarket.QueryResponse {
+		items := make([]retrievalmarket.QueryItemResponse, 0, len(query.Items))
+		for _, item := range query.Items {
+			switch {
+			case bytes.Equal(item.Selector, rootItem.Selector):
+				items = append(items, retrievalmarket.QueryItemResponse{Status: retrievalmarket.QueryItemAvailable, Size: dirSize})
+			case bytes.Equal(item.Selector, secondPart.Selector):
+				items = append(items, response.Items[1])
+			default:
+				items = append(items, response.Items[0])
+			}
+		}
+		response.Items = items
+		return response
+	}
+	totalFunds := tokenamount.FromInt(dirSize + partSize(0) + partSize(1))
+
+	// providers charge for each deal when they complete it. Overcharging
+	// providers ask for more than totalFunds
+	type provider struct {
+		response    retrievalmarket.QueryResponse
+		rejects     bool
+		charges     bool
+		overcharges bool
+	}
+	retrieveSwarm := func(t *testing.T, providers map[peer.ID]provider, held ...ipld.Node) ([]retrievalmarket.DealID, map[peer.ID]int, bstore.Blockstore, error) {
+		var lk sync.Mutex
+		deals := make(map[peer.ID]int)
+		var peers []retrievalmarket.RetrievalPeer
+		for id := range providers {
+			peers = append(peers, retrievalmarket.RetrievalPeer{Address: address.TestAddress2, ID: id})
+		}
+		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{
+			QueryStreamBuilder: func(p peer.ID) (rmnet.RetrievalQueryStream, error) {
+				var query retrievalmarket.Query
+				return tut.NewTestRetrievalQueryStream(tut.TestQueryStreamParams{
+					PeerID: p,
+					Writer: func(q retrievalmarket.Query) error {
+						query = q
+						return nil
+					},
+					RespReader: func() (retrievalmarket.QueryResponse, error) {
+						return answer(providers[p].response, query), nil
+					},
+				}), nil
+			},
+			DealStreamBuilder: func(p peer.ID) (rmnet.RetrievalDealStream, error) {
+				lk.Lock()
+				deals[p]++
+				lk.Unlock()
+				var responses []retrievalmarket.DealResponse
+				return tut.NewTestRetrievalDealStream(tut.TestDealStreamParams{
+					PeerID: p,
+					ProposalWriter: func(proposal retrievalmarket.DealProposal) error {
+						if providers[p].rejects {
+							responses = []retrievalmarket.DealResponse{{Status: retrievalmarket.DealStatusRejected}}
+							return nil
+						}
+						sent := []retrievalmarket.Block{toBlock(dir)}
+						size := dirSize
+						switch {
+						case bytes.Equal(proposal.Selector, rootItem.Selector):
+						case bytes.Equal(proposal.Selector, secondPart.Selector):
+							sent, size = append(sent, toBlock(files[1])), partSize(1)
+						default:
+							sent, size = append(sent, toBlock(files[0])), partSize(0)
+						}
+						completed := retrievalmarket.DealResponse{
+							Status: retrievalmarket.DealStatusCompleted,
+							Blocks: sent,
+						}
+						if providers[p].charges || providers[p].overcharges {
+							completed.Status = retrievalmarket.DealStatusFundsNeededLastPayment
+							completed.PaymentOwed = tokenamount.FromInt(size)
+						}
+						if providers[p].overcharges {
+							completed.PaymentOwed = tokenamount.Add(completed.PaymentOwed, totalFunds)
+						}
+						responses = []retrievalmarket.DealResponse{{Status: retrievalmarket.DealStatusAccepted}, completed}
+						return nil
+					},
+					ResponseReader: func() (retrievalmarket.DealResponse, error) {
+						if len(responses) == 0 {
+							return retrievalmarket.DealResponseUndefined, errors.New("provider went away")
+						}
+						response := responses[0]
+						responses = responses[1:]
+						return response, nil
+					},
+				}), nil
+			},
+		})
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{
+			PayCh:   address.TestAddress,
+			Voucher: tut.MakeTestSignedVoucher(),
+		})
+		bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+		for _, nd := range held {
+			require.NoError(t, bs.Put(nd))
+		}
+		c, err := retrievalimpl.NewClient(net, bs, node, &testPeerResolver{peers: peers}, dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, err)
+
+		dealIDs, err := c.RetrieveSwarm(ctx, []byte("applesauce"), dir.Cid(), 2, totalFunds, address.TestAddress)
+		lk.Lock()
+		defer lk.Unlock()
+		return dealIDs, deals, bs, err
+	}
+	requireAllFiles := func(t *testing.T, bs bstore.Blockstore) {
+		for _, file := range files {
+			has, err := bs.Has(file.Cid())
+			require.NoError(t, err)
+			require.True(t, has)
+		}
+	}
+
+	t.Run("spreads parts across providers", func(t *testing.T) {
+		dealIDs, deals, bs, err := retrieveSwarm(t, map[peer.ID]provider{
+			"provider1": {response: available},
+			"provider2": {response: available},
+		})
+		require.NoError(t, err)
+		require.Len(t, dealIDs, 3)
+		require.Equal(t, 3, deals["provider1"]+deals["provider2"])
+		require.NotZero(t, deals["provider1"])
+		require.NotZero(t, deals["provider2"])
+		requireAllFiles(t, bs)
+	})
+
+	t.Run("falls back to other providers", func(t *testing.T) {
+		dealIDs, deals, bs, err := retrieveSwarm(t, map[peer.ID]provider{
+			"provider1": {response: available, rejects: true},
+			"provider2": {response: available},
+		})
+		require.NoError(t, err)
+		require.Len(t, dealIDs, 3)
+		require.Equal(t, 3, deals["provider2"])
+		requireAllFiles(t, bs)
+	})
+
+	t.Run("funds parts with a share of the funds left over the quotes", func(t *testing.T) {
+		// the provider quotes a byte less than it charges for each part
+		underquoted := available
+		underquoted.MaxPaymentInterval = dirSize
+		underquoted.Items = []retrievalmarket.QueryItemResponse{
+			{Status: retrievalmarket.QueryItemAvailable, Size: partSize(0) - 1},
+			{Status: retrievalmarket.QueryItemAvailable, Size: partSize(1) - 1},
+		}
+		_, deals, bs, err := retrieveSwarm(t, map[peer.ID]provider{
+			"provider1": {response: underquoted, charges: true},
+		})
+		require.NoError(t, err)
+		require.Equal(t, map[peer.ID]int{"provider1": 3}, deals)
+		requireAllFiles(t, bs)
+	})
+
+	t.Run("falls back when a deal runs out of funds", func(t *testing.T) {
+		dealIDs, deals, bs, err := retrieveSwarm(t, map[peer.ID]provider{
+			"provider1": {response: available, overcharges: true},
+			"provider2": {response: available},
+		})
+		require.NoError(t, err)
+		require.Len(t, dealIDs, 3)
+		require.Equal(t, 3, deals["provider2"])
+		requireAllFiles(t, bs)
+	})
+
+	t.Run("does not retrieve what the client already has", func(t *testing.T) {
+		dealIDs, deals, bs, err := retrieveSwarm(t, map[peer.ID]provider{
+			"provider1": {response: available},
+		}, dir, files[0])
+		require.NoError(t, err)
+		require.Len(t, dealIDs, 1)
+		require.Equal(t, map[peer.ID]int{"provider1": 1}, deals)
+		requireAllFiles(t, bs)
+	})
+
+	t.Run("fails when no provider can serve a part", func(t *testing.T) {
+		missingPart := available
+		missingPart.Items = []retrievalmarket.QueryItemResponse{
+			available.Items[0],
+			{Status: retrievalmarket.QueryItemUnavailable},
+		}
+		_, deals, _, err := retrieveSwarm(t, map[peer.ID]provider{
+			"provider1": {response: missingPart},
+		})
+		require.Error(t, err)
+		// only the root was retrieved
+		require.Equal(t, map[peer.ID]int{"provider1": 1}, deals)
+	})
+}
+
+// scriptedDealStreamBuilder builds deal streams that play back the given responses
+// in order and then fail, passing on the proposals and payments the client writes
+// if channels are given for them
+func scriptedDealStreamBuilder(responses []retrievalmarket.DealResponse, proposals chan<- retrievalmarket.DealProposal, payments chan<- retrievalmarket.DealPayment) tut.DealStreamBuilder {
+	return func(p peer.ID) (rmnet.RetrievalDealStream, error) {
+		return tut.NewTestRetrievalDealStream(tut.TestDealStreamParams{
+			PeerID: p,
+			ProposalWriter: func(proposal retrievalmarket.DealProposal) error {
+				if proposals != nil {
+					proposals <- proposal
+				}
+				return nil
+			},
+			ResponseReader: func() (retrievalmarket.DealResponse, error) {
+				if len(responses) == 0 {
+					return retrievalmarket.DealResponseUndefined, errors.New("provider went away")
+				}
+				response := responses[0]
+				responses = responses[1:]
+				return response, nil
+			},
+			PaymentWriter: func(payment retrievalmarket.DealPayment) error {
+				if payments != nil {
+					payments <- payment
+				}
+				return nil
+			},
+		}), nil
+	}
+}
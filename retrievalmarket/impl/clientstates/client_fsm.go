@@ -0,0 +1,144 @@
+package clientstates
+
+import (
+	"context"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared/fsm"
+	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
+)
+
+// events that move client deals between statuses
+const (
+	clientDealDeferred              = "deferred"
+	clientDealRejected              = "rejected"
+	clientDealNotFound              = "notFound"
+	clientDealAccepted              = "accepted"
+	clientDealPaymentChannelCreated = "paymentChannelCreated"
+	clientDealUnsealing             = "unsealing"
+	clientDealBlocksReceived        = "blocksReceived"
+	clientDealFundsNeeded           = "fundsNeeded"
+	clientDealLastPaymentNeeded     = "lastPaymentNeeded"
+	clientDealPaid                  = "paid"
+	clientDealCompleted             = "completed"
+	clientDealCancelled             = "cancelled"
+	clientDealFailed                = "failed"
+
+	// clientDealUnsealPaid keeps a deal unsealing once it has paid, until the
+	// provider starts sending blocks
+	clientDealUnsealPaid = "unsealPaid"
+
+	// clientDealFundsAdded lets a deal that ran out of funds try its payment
+	// again
+	clientDealFundsAdded = "fundsAdded"
+)
+
+// ClientDeals is the lifecycle of a retrieval deal on the client. Handlers send
+// the events that move deals between statuses, mostly from the provider's
+// responses
+var ClientDeals = fsm.MustNewTable(
+	statuses(
+		rm.DealStatusNew,
+		rm.DealStatusDeferred,
+		rm.DealStatusAccepted,
+		rm.DealStatusPaymentChannelCreated,
+		rm.DealStatusUnsealing,
+		rm.DealStatusOngoing,
+		rm.DealStatusFundsNeeded,
+		rm.DealStatusFundsNeededLastPayment,
+		rm.DealStatusCompleted,
+		rm.DealStatusFailed,
+		rm.DealStatusRejected,
+		rm.DealStatusDealNotFound,
+		rm.DealStatusCancelled,
+	),
+	statuses(
+		rm.DealStatusCompleted,
+		rm.DealStatusFailed,
+		rm.DealStatusRejected,
+		rm.DealStatusDealNotFound,
+		rm.DealStatusCancelled,
+	),
+
+	fsm.Event{Name: clientDealDeferred, From: statuses(rm.DealStatusNew, rm.DealStatusDeferred), To: fsm.State(rm.DealStatusDeferred)},
+	fsm.Event{Name: clientDealRejected, From: statuses(rm.DealStatusNew, rm.DealStatusDeferred), To: fsm.State(rm.DealStatusRejected)},
+	fsm.Event{Name: clientDealNotFound, From: statuses(rm.DealStatusNew, rm.DealStatusDeferred), To: fsm.State(rm.DealStatusDealNotFound)},
+	fsm.Event{Name: clientDealAccepted, From: statuses(rm.DealStatusNew, rm.DealStatusDeferred), To: fsm.State(rm.DealStatusAccepted)},
+	fsm.Event{Name: clientDealPaymentChannelCreated, From: statuses(rm.DealStatusAccepted), To: fsm.State(rm.DealStatusPaymentChannelCreated)},
+	fsm.Event{Name: clientDealUnsealing, From: statuses(rm.DealStatusPaymentChannelCreated, rm.DealStatusUnsealing, rm.DealStatusOngoing), To: fsm.State(rm.DealStatusUnsealing)},
+	fsm.Event{Name: clientDealBlocksReceived, From: statuses(rm.DealStatusPaymentChannelCreated, rm.DealStatusUnsealing, rm.DealStatusOngoing), To: fsm.State(rm.DealStatusOngoing)},
+	fsm.Event{Name: clientDealFundsNeeded, From: statuses(rm.DealStatusPaymentChannelCreated, rm.DealStatusUnsealing, rm.DealStatusOngoing), To: fsm.State(rm.DealStatusFundsNeeded)},
+	fsm.Event{Name: clientDealLastPaymentNeeded, From: statuses(rm.DealStatusPaymentChannelCreated, rm.DealStatusUnsealing, rm.DealStatusOngoing), To: fsm.State(rm.DealStatusFundsNeededLastPayment)},
+	fsm.Event{Name: clientDealPaid, From: statuses(rm.DealStatusFundsNeeded), To: fsm.State(rm.DealStatusOngoing)},
+	fsm.Event{Name: clientDealCompleted, From: statuses(rm.DealStatusPaymentChannelCreated, rm.DealStatusUnsealing, rm.DealStatusOngoing, rm.DealStatusFundsNeededLastPayment), To: fsm.State(rm.DealStatusCompleted)},
+	fsm.Event{Name: clientDealCancelled, To: fsm.State(rm.DealStatusCancelled)},
+	fsm.Event{Name: clientDealFailed, To: fsm.State(rm.DealStatusFailed)},
+	fsm.Event{Name: clientDealUnsealPaid, From: statuses(rm.DealStatusUnsealing), NoChange: true},
+	fsm.Event{Name: clientDealFundsAdded, From: statuses(rm.DealStatusUnsealing, rm.DealStatusFundsNeeded, rm.DealStatusFundsNeededLastPayment), NoChange: true},
+)
+
+// ClientDealUpdate is what a handler decides happens to a deal: the event that
+// moves it to its next status, and changes to its other fields
+type ClientDealUpdate struct {
+	Event  string
+	Mutate func(*rm.ClientDealState)
+}
+
+// Apply moves a deal to the status the update's event leads to, then makes
+// the update's other changes. It returns an error wrapping
+// fsm.ErrIllegalTransition if the event can't happen in the deal's status
+func (u ClientDealUpdate) Apply(deal *rm.ClientDealState) error {
+	next, err := ClientDeals.Next(fsm.State(deal.Status), u.Event)
+	if err != nil {
+		return err
+	}
+	deal.Status = rm.DealStatus(next)
+	if u.Mutate != nil {
+		u.Mutate(deal)
+	}
+	return nil
+}
+
+// Cancel turns an update into one that cancels the deal for the given reason,
+// keeping the update's other changes, unless the update completes the deal
+func (u ClientDealUpdate) Cancel(reason error) ClientDealUpdate {
+	if u.Event == clientDealCompleted {
+		return u
+	}
+	return ClientDealUpdate{clientDealCancelled, func(deal *rm.ClientDealState) {
+		if u.Mutate != nil {
+			u.Mutate(deal)
+		}
+		deal.Message = reason.Error()
+	}}
+}
+
+// StateEntries are the handlers run for deals in each status that isn't
+// terminal, while the deal has the funds to continue
+var StateEntries = map[rm.DealStatus]ClientHandlerFunc{
+	rm.DealStatusNew:                    ProposeDeal,
+	rm.DealStatusDeferred:               AwaitDecision,
+	rm.DealStatusAccepted:               SetupPaymentChannel,
+	rm.DealStatusPaymentChannelCreated:  ProcessNextResponse,
+	rm.DealStatusOngoing:                ProcessNextResponse,
+	rm.DealStatusUnsealing:              ProcessUnsealing,
+	rm.DealStatusFundsNeeded:            ProcessPaymentRequested,
+	rm.DealStatusFundsNeededLastPayment: ProcessPaymentRequested,
+}
+
+// ProcessUnsealing pays to unseal the piece once the provider has asked for
+// payment, and otherwise waits for the provider's next response
+func ProcessUnsealing(ctx context.Context, environment ClientDealEnvironment, deal rm.ClientDealState) ClientDealUpdate {
+	if !deal.PaymentRequested.GreaterThan(tokenamount.FromInt(0)) {
+		return ProcessNextResponse(ctx, environment, deal)
+	}
+	return ProcessUnsealPayment(ctx, environment, deal)
+}
+
+func statuses(ss ...rm.DealStatus) []fsm.State {
+	states := make([]fsm.State, 0, len(ss))
+	for _, s := range ss {
+		states = append(states, fsm.State(s))
+	}
+	return states
+}
@@ -18,19 +18,24 @@ type ClientDealEnvironment interface {
 	ConsumeBlock(context.Context, rm.Block) (uint64, bool, error)
 }
 
-func errorFunc(err error) func(*rm.ClientDealState) {
-	return func(deal *rm.ClientDealState) {
-		deal.Status = rm.DealStatusFailed
+func errorFunc(err error) ClientDealUpdate {
+	return ClientDealUpdate{clientDealFailed, func(deal *rm.ClientDealState) {
 		deal.Message = err.Error()
-	}
+	}}
 }
 
 // ClientHandlerFunc is a function that handles a client deal being in a specific state
-// It processes the state and returns a modification function for a deal
-type ClientHandlerFunc func(ctx context.Context, environment ClientDealEnvironment, deal rm.ClientDealState) func(*rm.ClientDealState)
+// It processes the state and returns the update to make to the deal
+type ClientHandlerFunc func(ctx context.Context, environment ClientDealEnvironment, deal rm.ClientDealState) ClientDealUpdate
+
+// SetupPaymentChannel sets up a payment channel for a deal, unless it already has one
+func SetupPaymentChannel(ctx context.Context, environment ClientDealEnvironment, deal rm.ClientDealState) ClientDealUpdate {
+	// a resumed deal keeps paying on the lane it already has, as vouchers on a
+	// lane are for the running total
+	if deal.PaymentInfo != nil {
+		return ClientDealUpdate{Event: clientDealPaymentChannelCreated}
+	}
 
-// SetupPaymentChannel sets up a payment channel for a deal
-func SetupPaymentChannel(ctx context.Context, environment ClientDealEnvironment, deal rm.ClientDealState) func(*rm.ClientDealState) {
 	paych, err := environment.Node().GetOrCreatePaymentChannel(ctx, deal.ClientWallet, deal.MinerWallet, deal.TotalFunds)
 	if err != nil {
 		return errorFunc(xerrors.Errorf("getting payment channel: %w", err))
@@ -39,46 +44,60 @@ func SetupPaymentChannel(ctx context.Context, environment ClientDealEnvironment,
 	if err != nil {
 		return errorFunc(xerrors.Errorf("allocating payment lane: %w", err))
 	}
-	return func(deal *rm.ClientDealState) {
-		deal.Status = rm.DealStatusPaymentChannelCreated
-		deal.PayCh = paych
-		deal.Lane = lane
-	}
+	return ClientDealUpdate{clientDealPaymentChannelCreated, func(deal *rm.ClientDealState) {
+		deal.PaymentInfo = &rm.PaymentInfo{
+			PayCh: paych,
+			Lane:  lane,
+		}
+	}}
 }
 
 // ProposeDeal sends the proposal to the other party
-func ProposeDeal(ctx context.Context, environment ClientDealEnvironment, deal rm.ClientDealState) func(*rm.ClientDealState) {
+func ProposeDeal(ctx context.Context, environment ClientDealEnvironment, deal rm.ClientDealState) ClientDealUpdate {
 	stream := environment.DealStream()
 	err := stream.WriteDealProposal(deal.DealProposal)
 	if err != nil {
 		return errorFunc(xerrors.Errorf("proposing deal: %w", err))
 	}
+	return processDecision(stream)
+}
+
+// AwaitDecision waits for the provider to decide on a deal it deferred
+func AwaitDecision(ctx context.Context, environment ClientDealEnvironment, deal rm.ClientDealState) ClientDealUpdate {
+	return processDecision(environment.DealStream())
+}
+
+// processDecision reads the provider's decision on a proposal
+func processDecision(stream rmnet.RetrievalDealStream) ClientDealUpdate {
 	response, err := stream.ReadDealResponse()
 	if err != nil {
 		return errorFunc(xerrors.Errorf("reading deal reaponse: %w", err))
 	}
 	if response.Status == rm.DealStatusRejected {
-		return func(deal *rm.ClientDealState) {
-			deal.Status = rm.DealStatusRejected
+		return ClientDealUpdate{clientDealRejected, func(deal *rm.ClientDealState) {
 			deal.Message = fmt.Sprintf("deal rejected: %s", response.Message)
-		}
+		}}
 	}
 	if response.Status == rm.DealStatusDealNotFound {
-		return func(deal *rm.ClientDealState) {
-			deal.Status = rm.DealStatusDealNotFound
+		return ClientDealUpdate{clientDealNotFound, func(deal *rm.ClientDealState) {
 			deal.Message = fmt.Sprintf("deal not found: %s", response.Message)
-		}
+		}}
+	}
+	if response.Status == rm.DealStatusDeferred {
+		return ClientDealUpdate{clientDealDeferred, func(deal *rm.ClientDealState) {
+			deal.Message = fmt.Sprintf("deal deferred: %s", response.Message)
+		}}
 	}
 	if response.Status == rm.DealStatusAccepted {
-		return func(deal *rm.ClientDealState) {
-			deal.Status = rm.DealStatusAccepted
-		}
+		return ClientDealUpdate{clientDealAccepted, func(deal *rm.ClientDealState) {
+			deal.Message = ""
+		}}
 	}
 	return errorFunc(xerrors.New("Unexpected deal response status"))
 }
 
 // ProcessPaymentRequested processes a request for payment from the provider
-func ProcessPaymentRequested(ctx context.Context, environment ClientDealEnvironment, deal rm.ClientDealState) func(*rm.ClientDealState) {
+func ProcessPaymentRequested(ctx context.Context, environment ClientDealEnvironment, deal rm.ClientDealState) ClientDealUpdate {
 
 	// check that fundsSpent + paymentRequested <= totalFunds, or fail
 	if tokenamount.Add(deal.FundsSpent, deal.PaymentRequested).GreaterThan(deal.TotalFunds) {
@@ -97,7 +116,7 @@ func ProcessPaymentRequested(ctx context.Context, environment ClientDealEnvironm
 	// create payment voucher with node (or fail) for (fundsSpent + paymentRequested)
 	// use correct payCh + lane
 	// (node will do subtraction back to paymentRequested... slightly odd behavior but... well anyway)
-	voucher, err := environment.Node().CreatePaymentVoucher(ctx, deal.PayCh, tokenamount.Add(deal.FundsSpent, deal.PaymentRequested), deal.Lane)
+	voucher, err := environment.Node().CreatePaymentVoucher(ctx, deal.PaymentInfo.PayCh, tokenamount.Add(deal.FundsSpent, deal.PaymentRequested), deal.PaymentInfo.Lane)
 	if err != nil {
 		return errorFunc(xerrors.Errorf("creating payment voucher: %w", err))
 	}
@@ -105,27 +124,26 @@ func ProcessPaymentRequested(ctx context.Context, environment ClientDealEnvironm
 	// send payment voucher (or fail)
 	err = environment.DealStream().WriteDealPayment(rm.DealPayment{
 		ID:             deal.DealProposal.ID,
-		PaymentChannel: deal.PayCh,
+		PaymentChannel: deal.PaymentInfo.PayCh,
 		PaymentVoucher: voucher,
 	})
 	if err != nil {
 		return errorFunc(xerrors.Errorf("writing deal payment: %w", err))
 	}
 
-	// return modify deal function --
-	// status = DealStatusOngoing
+	// return deal update --
+	// status = DealStatusOngoing, or DealStatusCompleted after the last payment
 	// paymentRequested = 0
 	// fundsSpent = fundsSpent + paymentRequested
 	// if paymentRequested / pricePerByte >= currentInterval
 	// currentInterval = currentInterval + proposal.intervalIncrease
 	// bytesPaidFor = bytesPaidFor + (paymentRequested / pricePerByte)
 
-	return func(deal *rm.ClientDealState) {
-		if deal.Status == rm.DealStatusFundsNeededLastPayment {
-			deal.Status = rm.DealStatusCompleted
-		} else {
-			deal.Status = rm.DealStatusOngoing
-		}
+	event := clientDealPaid
+	if deal.Status == rm.DealStatusFundsNeededLastPayment {
+		event = clientDealCompleted
+	}
+	return ClientDealUpdate{event, func(deal *rm.ClientDealState) {
 		deal.FundsSpent = tokenamount.Add(deal.FundsSpent, deal.PaymentRequested)
 		bytesPaidFor := tokenamount.Div(deal.PaymentRequested, deal.PricePerByte).Uint64()
 		if bytesPaidFor >= deal.CurrentInterval {
@@ -133,11 +151,46 @@ func ProcessPaymentRequested(ctx context.Context, environment ClientDealEnvironm
 		}
 		deal.BytesPaidFor += bytesPaidFor
 		deal.PaymentRequested = tokenamount.FromInt(0)
+	}}
+}
+
+// ProcessUnsealPayment pays the provider to unseal the piece, up to the unseal
+// price agreed in the deal proposal
+func ProcessUnsealPayment(ctx context.Context, environment ClientDealEnvironment, deal rm.ClientDealState) ClientDealUpdate {
+	// check that unsealFundsPaid + paymentRequested <= unsealPrice, or fail
+	if deal.UnsealPrice.Nil() || tokenamount.Add(deal.UnsealFundsPaid, deal.PaymentRequested).GreaterThan(deal.UnsealPrice) {
+		return errorFunc(xerrors.New("too much money requested for unsealing"))
+	}
+
+	// check that fundsSpent + paymentRequested <= totalFunds, or fail
+	if tokenamount.Add(deal.FundsSpent, deal.PaymentRequested).GreaterThan(deal.TotalFunds) {
+		return errorFunc(xerrors.New("not enough funds left"))
+	}
+
+	voucher, err := environment.Node().CreatePaymentVoucher(ctx, deal.PaymentInfo.PayCh, tokenamount.Add(deal.FundsSpent, deal.PaymentRequested), deal.PaymentInfo.Lane)
+	if err != nil {
+		return errorFunc(xerrors.Errorf("creating payment voucher: %w", err))
+	}
+
+	err = environment.DealStream().WriteDealPayment(rm.DealPayment{
+		ID:             deal.DealProposal.ID,
+		PaymentChannel: deal.PaymentInfo.PayCh,
+		PaymentVoucher: voucher,
+	})
+	if err != nil {
+		return errorFunc(xerrors.Errorf("writing deal payment: %w", err))
 	}
+
+	// stay unsealing until the provider starts sending blocks
+	return ClientDealUpdate{clientDealUnsealPaid, func(deal *rm.ClientDealState) {
+		deal.FundsSpent = tokenamount.Add(deal.FundsSpent, deal.PaymentRequested)
+		deal.UnsealFundsPaid = tokenamount.Add(deal.UnsealFundsPaid, deal.PaymentRequested)
+		deal.PaymentRequested = tokenamount.FromInt(0)
+	}}
 }
 
 // ProcessNextResponse reads and processes the next response from the provider
-func ProcessNextResponse(ctx context.Context, environment ClientDealEnvironment, deal rm.ClientDealState) func(*rm.ClientDealState) {
+func ProcessNextResponse(ctx context.Context, environment ClientDealEnvironment, deal rm.ClientDealState) ClientDealUpdate {
 	// Read next response (or fail)
 	response, err := environment.DealStream().ReadDealResponse()
 	if err != nil {
@@ -162,16 +215,14 @@ func ProcessNextResponse(ctx context.Context, environment ClientDealEnvironment,
 	// Check For Complete, set completeness
 	if completed {
 		if response.Status == rm.DealStatusFundsNeededLastPayment {
-			return func(deal *rm.ClientDealState) {
+			return ClientDealUpdate{clientDealLastPaymentNeeded, func(deal *rm.ClientDealState) {
 				deal.TotalReceived += totalProcessed
 				deal.PaymentRequested = response.PaymentOwed
-				deal.Status = rm.DealStatusFundsNeededLastPayment
-			}
+			}}
 		}
-		return func(deal *rm.ClientDealState) {
+		return ClientDealUpdate{clientDealCompleted, func(deal *rm.ClientDealState) {
 			deal.TotalReceived += totalProcessed
-			deal.Status = rm.DealStatusCompleted
-		}
+		}}
 	}
 
 	// Error on complete status, but not all blocks received
@@ -181,21 +232,44 @@ func ProcessNextResponse(ctx context.Context, environment ClientDealEnvironment,
 	}
 	// Set PaymentRequested for funds needed statuses
 	if response.Status == rm.DealStatusFundsNeeded {
-		return func(deal *rm.ClientDealState) {
+		return ClientDealUpdate{clientDealFundsNeeded, func(deal *rm.ClientDealState) {
 			deal.TotalReceived += totalProcessed
 			deal.PaymentRequested = response.PaymentOwed
-			deal.Status = rm.DealStatusFundsNeeded
-		}
+		}}
 	}
 
-	// Pass Through Statuses -- retrievalmarket.DealStatusOngoing, retrievalmarket.DealStatusUnsealing
-	if response.Status == rm.DealStatusOngoing || response.Status == rm.DealStatusUnsealing {
-		return func(deal *rm.ClientDealState) {
+	// Set PaymentRequested for the unseal payment
+	if response.Status == rm.DealStatusUnsealing {
+		return ClientDealUpdate{clientDealUnsealing, func(deal *rm.ClientDealState) {
 			deal.TotalReceived += totalProcessed
-			deal.Status = response.Status
-		}
+			deal.PaymentRequested = response.PaymentOwed
+		}}
+	}
+
+	// Pass Through Statuses -- retrievalmarket.DealStatusOngoing
+	if response.Status == rm.DealStatusOngoing {
+		return ClientDealUpdate{clientDealBlocksReceived, func(deal *rm.ClientDealState) {
+			deal.TotalReceived += totalProcessed
+		}}
 	}
 
 	// Error On All Other Statuses
 	return errorFunc(xerrors.New("Unexpected deal response status"))
 }
+
+// WaitForFunds returns a handler that pauses a deal which has run out of funds
+// until more are added, or the deal is cancelled
+func WaitForFunds(addFunds <-chan tokenamount.TokenAmount) ClientHandlerFunc {
+	return func(ctx context.Context, environment ClientDealEnvironment, deal rm.ClientDealState) ClientDealUpdate {
+		select {
+		case <-ctx.Done():
+			return ClientDealUpdate{clientDealCancelled, func(deal *rm.ClientDealState) {
+				deal.Message = ctx.Err().Error()
+			}}
+		case amount := <-addFunds:
+			return ClientDealUpdate{clientDealFundsAdded, func(deal *rm.ClientDealState) {
+				deal.TotalFunds = tokenamount.Add(deal.TotalFunds, amount)
+			}}
+		}
+	}
+}
@@ -9,12 +9,14 @@ import (
 	"github.com/ipfs/go-cid"
 	mh "github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	clientstates "github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/clientstates"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
 	rmnet "github.com/filecoin-project/go-fil-markets/retrievalmarket/network"
+	"github.com/filecoin-project/go-fil-markets/shared/fsm"
 	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
 	"github.com/filecoin-project/go-fil-markets/shared/types"
 	testnet "github.com/filecoin-project/go-fil-markets/shared_testutil"
@@ -63,34 +65,37 @@ func TestSetupPaymentChannel(t *testing.T) {
 
 	t.Run("it works", func(t *testing.T) {
 		dealState := makeDealState(retrievalmarket.DealStatusAccepted)
+		dealState.PaymentInfo = nil
 
 		fe := environment(testnodes.TestRetrievalClientNodeParams{
 			PayCh: expectedPayCh,
 			Lane:  expectedLane,
 		})
 		f := clientstates.SetupPaymentChannel(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Empty(t, dealState.Message)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusPaymentChannelCreated)
-		require.Equal(t, dealState.PayCh, expectedPayCh)
-		require.Equal(t, dealState.Lane, expectedLane)
+		require.Equal(t, dealState.PaymentInfo.PayCh, expectedPayCh)
+		require.Equal(t, dealState.PaymentInfo.Lane, expectedLane)
 	})
 
 	t.Run("when create payment channel fails", func(t *testing.T) {
 		dealState := makeDealState(retrievalmarket.DealStatusAccepted)
+		dealState.PaymentInfo = nil
 		fe := environment(testnodes.TestRetrievalClientNodeParams{
 			PayCh:    address.Undef,
 			PayChErr: errors.New("Something went wrong"),
 			Lane:     expectedLane,
 		})
 		f := clientstates.SetupPaymentChannel(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
 	})
 
 	t.Run("when allocate lane fails", func(t *testing.T) {
 		dealState := makeDealState(retrievalmarket.DealStatusAccepted)
+		dealState.PaymentInfo = nil
 		fe := environment(testnodes.TestRetrievalClientNodeParams{
 			PayCh:     expectedPayCh,
 			Lane:      expectedLane,
@@ -98,10 +103,24 @@ func TestSetupPaymentChannel(t *testing.T) {
 		})
 
 		f := clientstates.SetupPaymentChannel(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
 	})
+
+	t.Run("resumed deal keeps its payment channel", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusAccepted)
+		paymentInfo := *dealState.PaymentInfo
+		fe := environment(testnodes.TestRetrievalClientNodeParams{
+			PayCh: expectedPayCh,
+			Lane:  expectedLane,
+		})
+		f := clientstates.SetupPaymentChannel(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.Empty(t, dealState.Message)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusPaymentChannelCreated)
+		require.Equal(t, *dealState.PaymentInfo, paymentInfo)
+	})
 }
 
 func TestProposeDeal(t *testing.T) {
@@ -123,7 +142,7 @@ func TestProposeDeal(t *testing.T) {
 			}),
 		})
 		f := clientstates.ProposeDeal(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Empty(t, dealState.Message)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusAccepted)
 	})
@@ -138,7 +157,7 @@ func TestProposeDeal(t *testing.T) {
 			}),
 		})
 		f := clientstates.ProposeDeal(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusRejected)
 	})
@@ -153,7 +172,7 @@ func TestProposeDeal(t *testing.T) {
 			}),
 		})
 		f := clientstates.ProposeDeal(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusDealNotFound)
 	})
@@ -164,7 +183,7 @@ func TestProposeDeal(t *testing.T) {
 			ProposalWriter: testnet.FailDealProposalWriter,
 		})
 		f := clientstates.ProposeDeal(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
 	})
@@ -175,10 +194,65 @@ func TestProposeDeal(t *testing.T) {
 			ResponseReader: testnet.FailDealResponseReader,
 		})
 		f := clientstates.ProposeDeal(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
 	})
+
+	t.Run("deal deferred", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusNew)
+		fe := environment(testnet.TestDealStreamParams{
+			ResponseReader: testnet.StubbedDealResponseReader(retrievalmarket.DealResponse{
+				Status:  retrievalmarket.DealStatusDeferred,
+				ID:      dealState.ID,
+				Message: "waiting for review",
+			}),
+		})
+		f := clientstates.ProposeDeal(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, dealState.Message, "deal deferred: waiting for review")
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusDeferred)
+	})
+}
+
+func TestAwaitDecision(t *testing.T) {
+	ctx := context.Background()
+	node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
+
+	environment := func(params testnet.TestDealStreamParams) clientstates.ClientDealEnvironment {
+		ds := testnet.NewTestRetrievalDealStream(params)
+		return &fakeEnvironment{node, ds, 0, nil}
+	}
+
+	t.Run("deal accepted", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusDeferred)
+		dealState.Message = "deal deferred: waiting for review"
+		fe := environment(testnet.TestDealStreamParams{
+			ResponseReader: testnet.StubbedDealResponseReader(retrievalmarket.DealResponse{
+				Status: retrievalmarket.DealStatusAccepted,
+				ID:     dealState.ID,
+			}),
+		})
+		f := clientstates.AwaitDecision(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.Empty(t, dealState.Message)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusAccepted)
+	})
+
+	t.Run("deal rejected", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusDeferred)
+		fe := environment(testnet.TestDealStreamParams{
+			ResponseReader: testnet.StubbedDealResponseReader(retrievalmarket.DealResponse{
+				Status:  retrievalmarket.DealStatusRejected,
+				ID:      dealState.ID,
+				Message: "not on allowlist",
+			}),
+		})
+		f := clientstates.AwaitDecision(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, dealState.Message, "deal rejected: not on allowlist")
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusRejected)
+	})
 }
 
 func TestProcessPaymentRequested(t *testing.T) {
@@ -199,7 +273,7 @@ func TestProcessPaymentRequested(t *testing.T) {
 			Voucher: testVoucher,
 		})
 		f := clientstates.ProcessPaymentRequested(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Empty(t, dealState.Message)
 		require.Equal(t, dealState.PaymentRequested, tokenamount.FromInt(0))
 		require.Equal(t, dealState.FundsSpent, tokenamount.Add(defaultFundsSpent, defaultPaymentRequested))
@@ -214,7 +288,7 @@ func TestProcessPaymentRequested(t *testing.T) {
 			Voucher: testVoucher,
 		})
 		f := clientstates.ProcessPaymentRequested(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Empty(t, dealState.Message)
 		require.Equal(t, dealState.PaymentRequested, tokenamount.FromInt(0))
 		require.Equal(t, dealState.FundsSpent, tokenamount.Add(defaultFundsSpent, defaultPaymentRequested))
@@ -230,7 +304,7 @@ func TestProcessPaymentRequested(t *testing.T) {
 			Voucher: testVoucher,
 		})
 		f := clientstates.ProcessPaymentRequested(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
 	})
@@ -242,7 +316,7 @@ func TestProcessPaymentRequested(t *testing.T) {
 			Voucher: testVoucher,
 		})
 		f := clientstates.ProcessPaymentRequested(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
 	})
@@ -257,7 +331,7 @@ func TestProcessPaymentRequested(t *testing.T) {
 			Voucher: testVoucher,
 		})
 		f := clientstates.ProcessPaymentRequested(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Empty(t, dealState.Message)
 		require.Equal(t, dealState.PaymentRequested, tokenamount.FromInt(0))
 		require.Equal(t, dealState.FundsSpent, tokenamount.Add(defaultFundsSpent, largerPaymentRequested))
@@ -273,7 +347,7 @@ func TestProcessPaymentRequested(t *testing.T) {
 			Voucher: testVoucher,
 		})
 		f := clientstates.ProcessPaymentRequested(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
 	})
@@ -286,7 +360,7 @@ func TestProcessPaymentRequested(t *testing.T) {
 			Voucher: testVoucher,
 		})
 		f := clientstates.ProcessPaymentRequested(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Empty(t, dealState.Message)
 		require.Equal(t, dealState.PaymentRequested, tokenamount.FromInt(0))
 		require.Equal(t, dealState.FundsSpent, tokenamount.Add(defaultFundsSpent, smallerPaymentRequested))
@@ -303,7 +377,7 @@ func TestProcessPaymentRequested(t *testing.T) {
 			VoucherError: errors.New("Something Went Wrong"),
 		})
 		f := clientstates.ProcessPaymentRequested(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
 	})
@@ -316,7 +390,102 @@ func TestProcessPaymentRequested(t *testing.T) {
 			Voucher: testVoucher,
 		})
 		f := clientstates.ProcessPaymentRequested(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.NotEmpty(t, dealState.Message)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
+	})
+}
+
+func TestProcessUnsealPayment(t *testing.T) {
+	ctx := context.Background()
+
+	environment := func(netParams testnet.TestDealStreamParams,
+		nodeParams testnodes.TestRetrievalClientNodeParams) clientstates.ClientDealEnvironment {
+		ds := testnet.NewTestRetrievalDealStream(netParams)
+		node := testnodes.NewTestRetrievalClientNode(nodeParams)
+		return &fakeEnvironment{node, ds, 0, nil}
+	}
+
+	unsealingDealState := func() *retrievalmarket.ClientDealState {
+		dealState := makeDealState(retrievalmarket.DealStatusUnsealing)
+		dealState.UnsealPrice = defaultUnsealPrice
+		dealState.PaymentRequested = defaultUnsealPrice
+		return dealState
+	}
+
+	testVoucher := &types.SignedVoucher{}
+
+	t.Run("it works", func(t *testing.T) {
+		dealState := unsealingDealState()
+		fe := environment(testnet.TestDealStreamParams{}, testnodes.TestRetrievalClientNodeParams{
+			Voucher: testVoucher,
+		})
+		f := clientstates.ProcessUnsealPayment(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.Empty(t, dealState.Message)
+		require.Equal(t, dealState.PaymentRequested, tokenamount.FromInt(0))
+		require.Equal(t, dealState.FundsSpent, tokenamount.Add(defaultFundsSpent, defaultUnsealPrice))
+		require.Equal(t, dealState.UnsealFundsPaid, defaultUnsealPrice)
+		require.Equal(t, dealState.BytesPaidFor, defaultBytesPaidFor)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusUnsealing)
+	})
+
+	t.Run("more requested than the unseal price", func(t *testing.T) {
+		dealState := unsealingDealState()
+		dealState.UnsealFundsPaid = tokenamount.FromInt(1)
+		fe := environment(testnet.TestDealStreamParams{}, testnodes.TestRetrievalClientNodeParams{
+			Voucher: testVoucher,
+		})
+		f := clientstates.ProcessUnsealPayment(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.NotEmpty(t, dealState.Message)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
+	})
+
+	t.Run("no unseal price agreed", func(t *testing.T) {
+		dealState := unsealingDealState()
+		dealState.UnsealPrice = tokenamount.FromInt(0)
+		fe := environment(testnet.TestDealStreamParams{}, testnodes.TestRetrievalClientNodeParams{
+			Voucher: testVoucher,
+		})
+		f := clientstates.ProcessUnsealPayment(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.NotEmpty(t, dealState.Message)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
+	})
+
+	t.Run("not enough funds left", func(t *testing.T) {
+		dealState := unsealingDealState()
+		dealState.FundsSpent = defaultTotalFunds
+		fe := environment(testnet.TestDealStreamParams{}, testnodes.TestRetrievalClientNodeParams{
+			Voucher: testVoucher,
+		})
+		f := clientstates.ProcessUnsealPayment(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.NotEmpty(t, dealState.Message)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
+	})
+
+	t.Run("voucher create fails", func(t *testing.T) {
+		dealState := unsealingDealState()
+		fe := environment(testnet.TestDealStreamParams{}, testnodes.TestRetrievalClientNodeParams{
+			VoucherError: errors.New("Something Went Wrong"),
+		})
+		f := clientstates.ProcessUnsealPayment(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.NotEmpty(t, dealState.Message)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
+	})
+
+	t.Run("unable to send payment", func(t *testing.T) {
+		dealState := unsealingDealState()
+		fe := environment(testnet.TestDealStreamParams{
+			PaymentWriter: testnet.FailDealPaymentWriter,
+		}, testnodes.TestRetrievalClientNodeParams{
+			Voucher: testVoucher,
+		})
+		f := clientstates.ProcessUnsealPayment(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
 	})
@@ -344,7 +513,7 @@ func TestProcessNextResponse(t *testing.T) {
 			ResponseReader: testnet.StubbedDealResponseReader(response),
 		}, consumeBlockResponses)
 		f := clientstates.ProcessNextResponse(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Empty(t, dealState.Message)
 		require.Equal(t, dealState.TotalReceived, defaultTotalReceived+1000)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusOngoing)
@@ -362,7 +531,7 @@ func TestProcessNextResponse(t *testing.T) {
 			ResponseReader: testnet.StubbedDealResponseReader(response),
 		}, consumeBlockResponses)
 		f := clientstates.ProcessNextResponse(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Empty(t, dealState.Message)
 		require.Equal(t, dealState.TotalReceived, defaultTotalReceived+1000)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusCompleted)
@@ -381,7 +550,7 @@ func TestProcessNextResponse(t *testing.T) {
 			ResponseReader: testnet.StubbedDealResponseReader(response),
 		}, consumeBlockResponses)
 		f := clientstates.ProcessNextResponse(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Empty(t, dealState.Message)
 		require.Equal(t, dealState.TotalReceived, defaultTotalReceived+1000)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFundsNeededLastPayment)
@@ -400,7 +569,7 @@ func TestProcessNextResponse(t *testing.T) {
 			ResponseReader: testnet.StubbedDealResponseReader(response),
 		}, consumeBlockResponses)
 		f := clientstates.ProcessNextResponse(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.TotalReceived, defaultTotalReceived)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
@@ -418,13 +587,31 @@ func TestProcessNextResponse(t *testing.T) {
 			ResponseReader: testnet.StubbedDealResponseReader(response),
 		}, consumeBlockResponses)
 		f := clientstates.ProcessNextResponse(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Empty(t, dealState.Message)
 		require.Equal(t, dealState.TotalReceived, defaultTotalReceived+1000)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFundsNeeded)
 		require.Equal(t, dealState.PaymentRequested, response.PaymentOwed)
 	})
 
+	t.Run("unseal payment requested", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusPaymentChannelCreated)
+		response := retrievalmarket.DealResponse{
+			Status:      retrievalmarket.DealStatusUnsealing,
+			ID:          dealState.ID,
+			PaymentOwed: defaultUnsealPrice,
+		}
+		fe := environment(testnet.TestDealStreamParams{
+			ResponseReader: testnet.StubbedDealResponseReader(response),
+		}, nil)
+		f := clientstates.ProcessNextResponse(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.Empty(t, dealState.Message)
+		require.Equal(t, dealState.TotalReceived, defaultTotalReceived)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusUnsealing)
+		require.Equal(t, dealState.PaymentRequested, response.PaymentOwed)
+	})
+
 	t.Run("unexpected status errors", func(t *testing.T) {
 		dealState := makeDealState(retrievalmarket.DealStatusOngoing)
 		blocks, consumeBlockResponses := generateBlocks(10, 100, false, false)
@@ -437,7 +624,7 @@ func TestProcessNextResponse(t *testing.T) {
 			ResponseReader: testnet.StubbedDealResponseReader(response),
 		}, consumeBlockResponses)
 		f := clientstates.ProcessNextResponse(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.TotalReceived, defaultTotalReceived)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
@@ -455,7 +642,7 @@ func TestProcessNextResponse(t *testing.T) {
 			ResponseReader: testnet.StubbedDealResponseReader(response),
 		}, consumeBlockResponses)
 		f := clientstates.ProcessNextResponse(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.TotalReceived, defaultTotalReceived)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
@@ -467,7 +654,7 @@ func TestProcessNextResponse(t *testing.T) {
 			ResponseReader: testnet.FailDealResponseReader,
 		}, nil)
 		f := clientstates.ProcessNextResponse(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.TotalReceived, defaultTotalReceived)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
@@ -482,25 +669,30 @@ var defaultTotalReceived = uint64(6000)
 var defaultBytesPaidFor = uint64(5000)
 var defaultFundsSpent = tokenamount.FromInt(2500000)
 var defaultPaymentRequested = tokenamount.FromInt(500000)
+var defaultUnsealPrice = tokenamount.FromInt(100000)
 
 func makeDealState(status retrievalmarket.DealStatus) *retrievalmarket.ClientDealState {
 	return &retrievalmarket.ClientDealState{
-		TotalFunds:       defaultTotalFunds,
-		MinerWallet:      address.TestAddress,
-		ClientWallet:     address.TestAddress2,
-		PayCh:            address.TestAddress2,
-		Lane:             uint64(10),
+		TotalFunds:   defaultTotalFunds,
+		MinerWallet:  address.TestAddress,
+		ClientWallet: address.TestAddress2,
+		PaymentInfo: &retrievalmarket.PaymentInfo{
+			PayCh: address.TestAddress2,
+			Lane:  uint64(10),
+		},
 		Status:           status,
 		BytesPaidFor:     defaultBytesPaidFor,
 		TotalReceived:    defaultTotalReceived,
 		CurrentInterval:  defaultCurrentInterval,
 		FundsSpent:       defaultFundsSpent,
 		PaymentRequested: defaultPaymentRequested,
+		UnsealFundsPaid:  tokenamount.FromInt(0),
 		DealProposal: retrievalmarket.DealProposal{
 			ID: retrievalmarket.DealID(10),
 			Params: retrievalmarket.Params{
 				PricePerByte:            defaultPricePerByte,
 				PaymentIntervalIncrease: defaultIntervalIncrease,
+				UnsealPrice:             tokenamount.FromInt(0),
 			},
 		},
 	}
@@ -530,3 +722,73 @@ func generateBlocks(count uint64, blockSize uint64, completeOnLast bool, errorOn
 	}
 	return blocks, responses
 }
+
+func TestStateEntries(t *testing.T) {
+	for _, transition := range clientstates.ClientDeals.Transitions() {
+		if clientstates.ClientDeals.IsFinal(transition.To) {
+			continue
+		}
+		_, ok := clientstates.StateEntries[retrievalmarket.DealStatus(transition.To)]
+		require.True(t, ok, "no handler for status %d, entered by %s", transition.To, transition.Event)
+	}
+}
+
+func TestClientDealUpdate(t *testing.T) {
+	spent := tokenamount.FromInt(10)
+	paid := clientstates.ClientDealUpdate{Event: "paid", Mutate: func(deal *retrievalmarket.ClientDealState) {
+		deal.FundsSpent = spent
+	}}
+
+	t.Run("moves a deal to the status its event leads to", func(t *testing.T) {
+		deal := &retrievalmarket.ClientDealState{Status: retrievalmarket.DealStatusFundsNeeded}
+		require.NoError(t, paid.Apply(deal))
+		require.Equal(t, retrievalmarket.DealStatusOngoing, deal.Status)
+		require.Equal(t, spent, deal.FundsSpent)
+	})
+
+	t.Run("an event that can't happen changes nothing", func(t *testing.T) {
+		deal := &retrievalmarket.ClientDealState{Status: retrievalmarket.DealStatusNew, FundsSpent: tokenamount.FromInt(0)}
+		require.True(t, xerrors.Is(paid.Apply(deal), fsm.ErrIllegalTransition))
+		require.Equal(t, retrievalmarket.DealStatusNew, deal.Status)
+		require.Equal(t, tokenamount.FromInt(0), deal.FundsSpent)
+
+		deal = &retrievalmarket.ClientDealState{Status: retrievalmarket.DealStatusCompleted}
+		require.Error(t, clientstates.ClientDealUpdate{Event: "failed"}.Apply(deal))
+	})
+
+	t.Run("cancelling keeps the update's changes", func(t *testing.T) {
+		deal := &retrievalmarket.ClientDealState{Status: retrievalmarket.DealStatusFundsNeeded}
+		require.NoError(t, paid.Cancel(context.Canceled).Apply(deal))
+		require.Equal(t, retrievalmarket.DealStatusCancelled, deal.Status)
+		require.Equal(t, spent, deal.FundsSpent)
+		require.Equal(t, context.Canceled.Error(), deal.Message)
+	})
+
+	t.Run("a completed deal is not cancelled", func(t *testing.T) {
+		deal := &retrievalmarket.ClientDealState{Status: retrievalmarket.DealStatusFundsNeededLastPayment}
+		completed := clientstates.ClientDealUpdate{Event: "completed"}
+		require.NoError(t, completed.Cancel(context.Canceled).Apply(deal))
+		require.Equal(t, retrievalmarket.DealStatusCompleted, deal.Status)
+	})
+}
+
+func TestWaitForFunds(t *testing.T) {
+	t.Run("adds funds and stays in its status", func(t *testing.T) {
+		addFunds := make(chan tokenamount.TokenAmount, 1)
+		addFunds <- tokenamount.FromInt(50)
+		deal := &retrievalmarket.ClientDealState{Status: retrievalmarket.DealStatusFundsNeeded, TotalFunds: tokenamount.FromInt(100)}
+		f := clientstates.WaitForFunds(addFunds)(context.Background(), nil, *deal)
+		require.NoError(t, f.Apply(deal))
+		require.Equal(t, retrievalmarket.DealStatusFundsNeeded, deal.Status)
+		require.Equal(t, tokenamount.FromInt(150), deal.TotalFunds)
+	})
+
+	t.Run("cancels when the deal ends", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		deal := &retrievalmarket.ClientDealState{Status: retrievalmarket.DealStatusFundsNeeded}
+		f := clientstates.WaitForFunds(nil)(ctx, nil, *deal)
+		require.NoError(t, f.Apply(deal))
+		require.Equal(t, retrievalmarket.DealStatusCancelled, deal.Status)
+	})
+}
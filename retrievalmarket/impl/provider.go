@@ -1,26 +1,33 @@
 package retrievalimpl
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/filecoin-project/go-address"
-	"github.com/ipfs/go-blockservice"
+	"github.com/filecoin-project/go-statestore"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	files "github.com/ipfs/go-ipfs-files"
 	ipld "github.com/ipfs/go-ipld-format"
-	"github.com/ipfs/go-merkledag"
-	unixfile "github.com/ipfs/go-unixfs/file"
 	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/blockio"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/providerstates"
 	rmnet "github.com/filecoin-project/go-fil-markets/retrievalmarket/network"
 	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
 )
 
 // UnixfsReader is a unixfsfile that can read block by block
+//
+// Deprecated: the provider reads payloads with blockio.NewSelectorBlockReader,
+// which implements blockio.BlockReader
 type UnixfsReader interface {
 	files.File
 
@@ -29,6 +36,33 @@ type UnixfsReader interface {
 	ReadBlock(context.Context) (data []byte, offset uint64, nd ipld.Node, err error)
 }
 
+// ProviderDsPrefix is the datastore namespace under which retrieval provider deals are tracked
+var ProviderDsPrefix = "/retrievals/provider"
+
+// defaultDecisionRetryInterval is how often deferred deals are put to the deal
+// decider again if no interval is set
+const defaultDecisionRetryInterval = time.Minute
+
+// maxDecisionWait is how long after a proposal is received the deal decider
+// can keep deferring it, before the deal is rejected
+const maxDecisionWait = time.Hour
+
+const (
+	// queryTimeout is how long the provider spends answering a query, including
+	// reading the items it asks about
+	queryTimeout = 30 * time.Second
+
+	// maxQueryItems is how many of a query's items the provider looks for. The
+	// rest are reported as unknown
+	maxQueryItems = 32
+
+	// maxQueryBlocks and maxQueryBytes limit how much of the blockstore a query
+	// can read, across all its items. Items left when the limit is reached are
+	// reported as unknown
+	maxQueryBlocks = 1 << 14
+	maxQueryBytes  = 256 << 20
+)
+
 type provider struct {
 
 	// TODO: Replace with RetrievalProviderNode for
@@ -39,17 +73,26 @@ type provider struct {
 	paymentIntervalIncrease uint64
 	paymentAddress          address.Address
 	pricePerByte            tokenamount.TokenAmount
+	pricePerUnseal          tokenamount.TokenAmount
+	unsealTime              time.Duration
+	decider                 retrievalmarket.RetrievalDealDecider
+	decisionRetryInterval   time.Duration
 	subscribers             []retrievalmarket.ProviderSubscriber
 	subscribersLk           sync.RWMutex
+
+	deals *statestore.StateStore
 }
 
 // NewProvider returns a new retrieval provider
-func NewProvider(paymentAddress address.Address, node retrievalmarket.RetrievalProviderNode, network rmnet.RetrievalMarketNetwork) retrievalmarket.RetrievalProvider {
+func NewProvider(paymentAddress address.Address, node retrievalmarket.RetrievalProviderNode, network rmnet.RetrievalMarketNetwork, ds datastore.Batching) retrievalmarket.RetrievalProvider {
 	return &provider{
-		node:           node,
-		network:        network,
-		paymentAddress: paymentAddress,
-		pricePerByte:   tokenamount.FromInt(2), // TODO: allow setting
+		node:                  node,
+		network:               network,
+		paymentAddress:        paymentAddress,
+		pricePerByte:          tokenamount.FromInt(2), // TODO: allow setting
+		pricePerUnseal:        tokenamount.FromInt(0),
+		decisionRetryInterval: defaultDecisionRetryInterval,
+		deals:                 statestore.New(namespace.Wrap(ds, datastore.NewKey(ProviderDsPrefix))),
 	}
 }
 
@@ -109,17 +152,58 @@ func (p *provider) SubscribeToEvents(subscriber retrievalmarket.ProviderSubscrib
 }
 
 // V1
+
+// SetPricePerUnseal sets the price a miner charges to unseal the sector holding
+// a piece. Clients pay it before any data is sent
 func (p *provider) SetPricePerUnseal(price tokenamount.TokenAmount) {
-	panic("not implemented")
+	p.pricePerUnseal = price
 }
 
+// SetExpectedUnsealTime sets how long the miner expects to take to unseal a piece,
+// which is reported to clients as the time to first byte for sealed pieces
+func (p *provider) SetExpectedUnsealTime(unsealTime time.Duration) {
+	p.unsealTime = unsealTime
+}
+
+// SetDealDecider sets a policy deciding which deals the provider takes, once
+// they meet its prices and payment intervals. Deals the decider defers are put
+// to it again every retryInterval until it accepts or rejects them
+func (p *provider) SetDealDecider(decider retrievalmarket.RetrievalDealDecider, retryInterval time.Duration) {
+	if retryInterval <= 0 {
+		retryInterval = defaultDecisionRetryInterval
+	}
+	p.decider = decider
+	p.decisionRetryInterval = retryInterval
+}
+
+// ListDeals lists all retrieval deals this provider has received, in progress or finished
 func (p *provider) ListDeals() map[retrievalmarket.ProviderDealID]retrievalmarket.ProviderDealState {
-	panic("not implemented")
+	var deals []retrievalmarket.ProviderDealState
+	if err := p.deals.List(&deals); err != nil {
+		log.Errorf("listing retrieval deals: %s", err)
+		return nil
+	}
+
+	out := make(map[retrievalmarket.ProviderDealID]retrievalmarket.ProviderDealState, len(deals))
+	for _, deal := range deals {
+		out[retrievalmarket.ProviderDealID{From: deal.Receiver, ID: deal.ID}] = deal
+	}
+	return out
 }
 
 // TODO: Update for https://github.com/filecoin-project/go-retrieval-market-project/issues/8
 func (p *provider) HandleQueryStream(stream rmnet.RetrievalQueryStream) {
 	defer stream.Close()
+
+	// the query has to be answered before the stream times out, so reading
+	// items stops at the same deadline
+	deadline := time.Now().Add(queryTimeout)
+	if err := stream.SetDeadline(deadline); err != nil {
+		log.Warnf("Retrieval query: setting stream deadline: %s", err)
+	}
+	ctx, cancel := context.WithDeadline(context.TODO(), deadline)
+	defer cancel()
+
 	query, err := stream.ReadQuery()
 	if err != nil {
 		return
@@ -131,14 +215,28 @@ func (p *provider) HandleQueryStream(stream rmnet.RetrievalQueryStream) {
 		MinPricePerByte:            p.pricePerByte,
 		MaxPaymentInterval:         p.paymentInterval,
 		MaxPaymentIntervalIncrease: p.paymentIntervalIncrease,
+		UnsealPrice:                p.pricePerUnseal,
 	}
 
 	size, err := p.node.GetPieceSize(query.PieceCID)
 
 	if err == nil {
 		answer.Status = retrievalmarket.QueryResponseAvailable
-		// TODO: get price, look for already unsealed ref to reduce work
 		answer.Size = uint64(size) // TODO: verify on intermediate
+
+		// an unsealed copy can be served right away, without paying to unseal it.
+		// If there is no telling, the piece is offered as sealed
+		unsealed, err := p.node.IsUnsealed(query.PieceCID)
+		if err != nil {
+			log.Warnf("Retrieval query: checking for an unsealed copy: %s", err)
+		}
+		answer.Unsealed = unsealed && err == nil
+		if answer.Unsealed {
+			answer.UnsealPrice = tokenamount.FromInt(0)
+		} else {
+			answer.ExpectedTimeToFirstByte = uint64(p.unsealTime / time.Second)
+		}
+		answer.Items = p.queryItems(ctx, query.Items)
 	}
 
 	if err != nil && err != retrievalmarket.ErrNotFound {
@@ -153,106 +251,246 @@ func (p *provider) HandleQueryStream(stream rmnet.RetrievalQueryStream) {
 	}
 }
 
-func (p *provider) failDeal(dealState *retrievalmarket.ProviderDealState, err error) {
+// errNoUnsealForQuery stops a query from unsealing a sector to look for an item
+var errNoUnsealForQuery = errors.New("not unsealing to answer a query")
+
+// queryBudget is how much more of the blockstore a query can read
+type queryBudget struct {
+	blocks int
+	bytes  uint64
+}
+
+// queryItems reports whether each item asked about in a query can be served, and
+// its size. Only unsealed data is read, so items in sealed sectors are unknown,
+// as are items beyond the query's limits
+func (p *provider) queryItems(ctx context.Context, items []retrievalmarket.QueryItem) []retrievalmarket.QueryItemResponse {
+	if len(items) == 0 {
+		return nil
+	}
+	bstore := p.node.SealedBlockstore(func() error {
+		return errNoUnsealForQuery
+	})
+
+	budget := &queryBudget{blocks: maxQueryBlocks, bytes: maxQueryBytes}
+	out := make([]retrievalmarket.QueryItemResponse, 0, len(items))
+	for i, item := range items {
+		if i >= maxQueryItems || ctx.Err() != nil {
+			out = append(out, retrievalmarket.QueryItemResponse{Status: retrievalmarket.QueryItemUnknown})
+			continue
+		}
+		out = append(out, queryItem(ctx, bstore, item, budget))
+	}
+	return out
+}
+
+// queryItem reads the blocks of an item to check they are all there, within
+// what is left of the query's budget
+func queryItem(ctx context.Context, bstore blockstore.Blockstore, item retrievalmarket.QueryItem, budget *queryBudget) retrievalmarket.QueryItemResponse {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	unknown := retrievalmarket.QueryItemResponse{Status: retrievalmarket.QueryItemUnknown}
+	unavailable := retrievalmarket.QueryItemResponse{Status: retrievalmarket.QueryItemUnavailable}
+	sel, err := item.SelectorSpec()
+	if err != nil {
+		return unavailable
+	}
+	if sel == nil {
+		sel = blockio.AllSelector()
+	}
+	reader, err := blockio.NewSelectorBlockReader(ctx, bstore, item.PayloadCID, sel)
+	if err != nil {
+		return unavailable
+	}
+
+	var size uint64
+	for {
+		if budget.blocks <= 0 {
+			return unknown
+		}
+		block, done, err := reader.ReadBlock(ctx)
+		if xerrors.Is(err, errNoUnsealForQuery) || ctx.Err() != nil {
+			return unknown
+		}
+		if err != nil {
+			return unavailable
+		}
+		budget.blocks--
+		if uint64(len(block.Data)) > budget.bytes {
+			budget.bytes = 0
+			return unknown
+		}
+		budget.bytes -= uint64(len(block.Data))
+		size += uint64(len(block.Data))
+		if done {
+			return retrievalmarket.QueryItemResponse{Status: retrievalmarket.QueryItemAvailable, Size: size}
+		}
+	}
+}
+
+func (p *provider) failDeal(environment *providerDealEnvironment, dealState *retrievalmarket.ProviderDealState, err error) {
 	dealState.Message = err.Error()
 	dealState.Status = retrievalmarket.DealStatusFailed
+	p.saveDeal(environment, dealState)
 	p.notifySubscribers(retrievalmarket.ProviderEventError, *dealState)
 }
 
+// saveDeal writes the current deal state to the deal store, keyed by the client
+// peer and its deal ID. Deals whose proposal was never read are skipped, as
+// there is nothing to identify them by. A record is only replaced by the deal
+// that began it or resumed it, so a proposal reusing the ID of another deal
+// leaves that deal's record, and what it was paid, as it was
+func (p *provider) saveDeal(environment *providerDealEnvironment, dealState *retrievalmarket.ProviderDealState) {
+	if dealState.PieceCID == nil {
+		return
+	}
+	dealID := retrievalmarket.ProviderDealID{From: dealState.Receiver, ID: dealState.ID}
+	if environment.tracked {
+		err := p.deals.Get(dealID).Mutate(func(ds *retrievalmarket.ProviderDealState) error {
+			*ds = *dealState
+			return nil
+		})
+		if err != nil {
+			log.Errorf("retrieval deal %s: saving deal state: %s", dealID, err)
+		}
+		return
+	}
+	has, err := p.deals.Has(dealID)
+	if err != nil {
+		log.Errorf("retrieval deal %s: checking deal store: %s", dealID, err)
+		return
+	}
+	if has {
+		log.Warnf("retrieval deal %s: ID belongs to another deal, not saving", dealID)
+		return
+	}
+	if err := p.deals.Begin(dealID, dealState); err != nil {
+		log.Errorf("retrieval deal %s: saving deal state: %s", dealID, err)
+		return
+	}
+	environment.tracked = true
+}
+
 // TODO: Update for https://github.com/filecoin-project/go-retrieval-market-project/issues/7
-func (p *provider) HandleDealStream(stream rmnet.RetrievalDealStream) {
+func (p *provider) HandleDealStream(s rmnet.RetrievalDealStream) {
+	stream := newProviderDealStream(s)
 	defer stream.Close()
 	ctx, cancel := context.WithCancel(context.TODO())
 	defer cancel()
 	dealState := retrievalmarket.ProviderDealState{
 		Status:        retrievalmarket.DealStatusNew,
+		Receiver:      stream.Receiver(),
 		TotalSent:     0,
 		FundsReceived: tokenamount.FromInt(0),
 	}
 	p.notifySubscribers(retrievalmarket.ProviderEventOpen, dealState)
 
-	bstore := p.node.SealedBlockstore(func() error {
-		return nil // TODO: approve unsealing based on amount paid
-	})
-
-	ds := merkledag.NewDAGService(blockservice.New(bstore, nil))
-
-	environment := providerDealEnvironment{p.node, 0, 0, nil, p.pricePerByte, p.paymentInterval, p.paymentIntervalIncrease, stream}
+	environment := &providerDealEnvironment{p.node, nil, p.pricePerByte, p.paymentInterval, p.paymentIntervalIncrease, p.pricePerUnseal, p.decider, p.decisionRetryInterval, time.Now().Add(maxDecisionWait), stream, p.deals, false}
 
 	for {
-		var handler providerstates.ProviderHandlerFunc
-
-		switch dealState.Status {
-		case retrievalmarket.DealStatusNew:
-			handler = providerstates.ReceiveDeal
-		case retrievalmarket.DealStatusAccepted, retrievalmarket.DealStatusOngoing, retrievalmarket.DealStatusUnsealing:
-			handler = providerstates.SendBlocks
-		case retrievalmarket.DealStatusFundsNeeded, retrievalmarket.DealStatusFundsNeededLastPayment:
-			handler = providerstates.ProcessPayment
-		default:
-			p.failDeal(&dealState, errors.New("unexpected deal state"))
+		handler, ok := providerstates.StateEntries[dealState.Status]
+		if !ok {
+			p.failDeal(environment, &dealState, errors.New("unexpected deal state"))
 			return
 		}
-		dealModifier := handler(ctx, environment, dealState)
-		dealModifier(&dealState)
+		update := handler(ctx, environment, dealState)
+		if err := update.Apply(&dealState); err != nil {
+			p.failDeal(environment, &dealState, err)
+			return
+		}
+		p.saveDeal(environment, &dealState)
 		if retrievalmarket.IsTerminalStatus(dealState.Status) {
 			break
 		}
-		if environment.ufsr == nil {
-			rootNd, err := ds.Get(context.TODO(), dealState.PayloadCID)
+		// the payload is only read, and so unsealed, once the client has paid to unseal it
+		if environment.blocks == nil && dealState.Status == retrievalmarket.DealStatusAccepted {
+			blocks, err := payloadReader(ctx, p.sealedBlockstore(dealState), dealState)
 			if err != nil {
-				p.failDeal(&dealState, err)
+				p.failDeal(environment, &dealState, err)
 				return
 			}
+			environment.blocks = blocks
 
-			fsr, err := unixfile.NewUnixfsFile(context.TODO(), ds, rootNd)
+			// a resumed deal skips the blocks the client already has, which
+			// must have been sent, and charged for, in the deal before. Blocks
+			// sent since then are sent again
+			skipped, err := skipBlocks(ctx, environment, dealState)
 			if err != nil {
-				p.failDeal(&dealState, err)
+				p.failDeal(environment, &dealState, xerrors.Errorf("skipping blocks client already has: %w", err))
 				return
 			}
-
-			var ok bool
-			environment.ufsr, ok = fsr.(UnixfsReader)
-			if !ok {
-				p.failDeal(&dealState, xerrors.Errorf("file %s didn't implement UnixfsReader", dealState.PayloadCID))
-				return
-			}
-			size, err := fsr.Size()
-			if err != nil {
-				p.failDeal(&dealState, xerrors.Errorf("file %s didn't implement UnixfsReader", dealState.PayloadCID))
-				return
-			}
-			environment.size = uint64(size)
+			dealState.Resend = dealState.TotalSent - skipped
 		}
 		p.notifySubscribers(retrievalmarket.ProviderEventProgress, dealState)
 	}
 	if retrievalmarket.IsTerminalSuccess(dealState.Status) {
 		p.notifySubscribers(retrievalmarket.ProviderEventComplete, dealState)
+	} else if dealState.Status == retrievalmarket.DealStatusCancelled {
+		p.notifySubscribers(retrievalmarket.ProviderEventCancelled, dealState)
 	} else {
 		p.notifySubscribers(retrievalmarket.ProviderEventError, dealState)
 	}
 }
 
+// skipBlocks reads past the blocks a client resuming a deal already has, and
+// returns their size. It fails if the client has more than it was sent in the
+// deal, or has every block
+func skipBlocks(ctx context.Context, environment *providerDealEnvironment, dealState retrievalmarket.ProviderDealState) (uint64, error) {
+	var skipped uint64
+	for i := uint64(0); i < dealState.SkipBlocks; i++ {
+		block, done, err := environment.NextBlock(ctx)
+		if err != nil {
+			return 0, err
+		}
+		skipped += uint64(len(block.Data))
+		if skipped > dealState.TotalSent {
+			return 0, xerrors.Errorf("only %d bytes were sent in the deal", dealState.TotalSent)
+		}
+		if done {
+			return 0, xerrors.New("no blocks left to send")
+		}
+	}
+	return skipped, nil
+}
+
+// sealedBlockstore returns the blockstore a deal's payload is read from, which
+// only approves unsealing if the deal has paid the unseal price
+func (p *provider) sealedBlockstore(dealState retrievalmarket.ProviderDealState) blockstore.Blockstore {
+	fundsReceived, unsealPrice := dealState.FundsReceived, dealState.UnsealPrice
+	return p.node.SealedBlockstore(func() error {
+		if fundsReceived.LessThan(unsealPrice) {
+			return xerrors.Errorf("unseal price %s not paid, received %s", unsealPrice, fundsReceived)
+		}
+		return nil
+	})
+}
+
 type providerDealEnvironment struct {
 	node                       retrievalmarket.RetrievalProviderNode
-	read                       uint64
-	size                       uint64
-	ufsr                       UnixfsReader
+	blocks                     blockio.BlockReader
 	minPricePerByte            tokenamount.TokenAmount
 	maxPaymentInterval         uint64
 	maxPaymentIntervalIncrease uint64
-	stream                     rmnet.RetrievalDealStream
+	pricePerUnseal             tokenamount.TokenAmount
+	decider                    retrievalmarket.RetrievalDealDecider
+	decisionRetryInterval      time.Duration
+	decisionDeadline           time.Time
+	stream                     *providerDealStream
+	deals                      *statestore.StateStore
+	// tracked is set once the deal has a record of its own in the deal store,
+	// either begun by this stream or resumed from an earlier one
+	tracked bool
 }
 
-func (pde providerDealEnvironment) Node() retrievalmarket.RetrievalProviderNode {
+func (pde *providerDealEnvironment) Node() retrievalmarket.RetrievalProviderNode {
 	return pde.node
 }
 
-func (pde providerDealEnvironment) DealStream() rmnet.RetrievalDealStream {
+func (pde *providerDealEnvironment) DealStream() rmnet.RetrievalDealStream {
 	return pde.stream
 }
 
-func (pde providerDealEnvironment) CheckDealParams(pricePerByte tokenamount.TokenAmount, paymentInterval uint64, paymentIntervalIncrease uint64) error {
+func (pde *providerDealEnvironment) CheckDealParams(pricePerByte tokenamount.TokenAmount, paymentInterval uint64, paymentIntervalIncrease uint64, unsealPrice tokenamount.TokenAmount, unsealed bool) error {
 	if pricePerByte.LessThan(pde.minPricePerByte) {
 		return errors.New("Price per byte too low")
 	}
@@ -262,22 +500,153 @@ func (pde providerDealEnvironment) CheckDealParams(pricePerByte tokenamount.Toke
 	if paymentIntervalIncrease > pde.maxPaymentIntervalIncrease {
 		return errors.New("Payment interval increase too large")
 	}
+	if !unsealed && unsealPrice.LessThan(pde.pricePerUnseal) {
+		return errors.New("Unseal price too low")
+	}
 	return nil
 }
 
-func (pde providerDealEnvironment) NextBlock(ctx context.Context) (retrievalmarket.Block, bool, error) {
-	if pde.ufsr == nil {
+// DecideDeal puts a deal to the provider's deal decider, accepting every deal
+// if there is none
+func (pde *providerDealEnvironment) DecideDeal(ctx context.Context, proposal retrievalmarket.DealProposal) (retrievalmarket.DealDecision, string, error) {
+	if pde.decider == nil {
+		return retrievalmarket.DealDecisionAccept, "", nil
+	}
+	return pde.decider(ctx, proposal, pde.stream.Receiver())
+}
+
+func (pde *providerDealEnvironment) DecisionRetryInterval() time.Duration {
+	return pde.decisionRetryInterval
+}
+
+func (pde *providerDealEnvironment) DecisionDeadline() time.Time {
+	return pde.decisionDeadline
+}
+
+func (pde *providerDealEnvironment) Cancelled() <-chan struct{} {
+	return pde.stream.cancelled
+}
+
+func (pde *providerDealEnvironment) Disconnected() <-chan struct{} {
+	return pde.stream.disconnected
+}
+
+// ResumedDeal returns the record of a deal with the proposal's ID that the
+// client made before, if there is one. It fails if that deal is for other
+// data, or has completed, as the ID cannot be used again
+func (pde *providerDealEnvironment) ResumedDeal(proposal retrievalmarket.DealProposal) (retrievalmarket.ProviderDealState, bool, error) {
+	dealID := retrievalmarket.ProviderDealID{From: pde.stream.Receiver(), ID: proposal.ID}
+	has, err := pde.deals.Has(dealID)
+	if err != nil || !has {
+		return retrievalmarket.ProviderDealState{}, false, err
+	}
+	var previous retrievalmarket.ProviderDealState
+	if err := pde.deals.Get(dealID).Get(&previous); err != nil {
+		return retrievalmarket.ProviderDealState{}, false, err
+	}
+	if !sameDeal(previous.DealProposal, proposal) {
+		return retrievalmarket.ProviderDealState{}, false, xerrors.Errorf("deal ID %d is already in use", proposal.ID)
+	}
+	if retrievalmarket.IsTerminalSuccess(previous.Status) {
+		return retrievalmarket.ProviderDealState{}, false, xerrors.Errorf("deal %d has already completed", proposal.ID)
+	}
+	pde.tracked = true
+	return previous, true, nil
+}
+
+// sameDeal returns true if two proposals are for the same part of the same piece
+func sameDeal(a, b retrievalmarket.DealProposal) bool {
+	return bytes.Equal(a.PieceCID, b.PieceCID) &&
+		a.PayloadCID.Equals(b.PayloadCID) &&
+		bytes.Equal(a.Selector, b.Selector)
+}
+
+func (pde *providerDealEnvironment) NextBlock(ctx context.Context) (retrievalmarket.Block, bool, error) {
+	if pde.blocks == nil {
 		return retrievalmarket.Block{}, false, errors.New("Could not read block")
 	}
-	_, _, nd, err := pde.ufsr.ReadBlock(ctx)
+	return pde.blocks.ReadBlock(ctx)
+}
+
+// payloadReader opens the part of a deal's payload the client asked for: the
+// blocks its selector reaches, or else the whole DAG
+func payloadReader(ctx context.Context, bstore blockstore.Blockstore, dealState retrievalmarket.ProviderDealState) (blockio.BlockReader, error) {
+	sel, err := blockio.PayloadSelector(dealState.Params)
 	if err != nil {
-		return retrievalmarket.Block{}, false, err
+		return nil, xerrors.Errorf("decoding selector: %w", err)
 	}
-	block := retrievalmarket.Block{
-		Prefix: nd.Cid().Prefix().Bytes(),
-		Data:   nd.RawData(),
+	return blockio.NewSelectorBlockReader(ctx, bstore, dealState.PayloadCID, sel)
+}
+
+// providerDealStream reads the client's payments in the background once the
+// proposal is read, so that a cancellation is noticed while blocks are being
+// sent, rather than only when the next payment is due, and that a client
+// going away is noticed while its deal is deferred
+type providerDealStream struct {
+	rmnet.RetrievalDealStream
+	payments     chan paymentRead
+	cancelled    chan struct{}
+	disconnected chan struct{}
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+type paymentRead struct {
+	payment retrievalmarket.DealPayment
+	err     error
+}
+
+func newProviderDealStream(s rmnet.RetrievalDealStream) *providerDealStream {
+	return &providerDealStream{
+		RetrievalDealStream: s,
+		payments:            make(chan paymentRead),
+		cancelled:           make(chan struct{}),
+		disconnected:        make(chan struct{}),
+		closed:              make(chan struct{}),
 	}
-	pde.read += uint64(len(nd.RawData()))
-	done := pde.read >= pde.size
-	return block, done, nil
+}
+
+func (pds *providerDealStream) ReadDealProposal() (retrievalmarket.DealProposal, error) {
+	proposal, err := pds.RetrievalDealStream.ReadDealProposal()
+	if err == nil {
+		go pds.readPayments()
+	}
+	return proposal, err
+}
+
+// readPayments reads what the client sends until the stream fails or the
+// client cancels the deal
+func (pds *providerDealStream) readPayments() {
+	for {
+		payment, err := pds.RetrievalDealStream.ReadDealPayment()
+		if err == retrievalmarket.ErrDealCancelled {
+			close(pds.cancelled)
+		} else if err != nil {
+			close(pds.disconnected)
+		}
+		select {
+		case pds.payments <- paymentRead{payment, err}:
+		case <-pds.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (pds *providerDealStream) ReadDealPayment() (retrievalmarket.DealPayment, error) {
+	select {
+	case read := <-pds.payments:
+		return read.payment, read.err
+	case <-pds.closed:
+		return retrievalmarket.DealPaymentUndefined, xerrors.New("deal stream closed")
+	}
+}
+
+func (pds *providerDealStream) Close() error {
+	pds.closeOnce.Do(func() {
+		close(pds.closed)
+	})
+	return pds.RetrievalDealStream.Close()
 }
@@ -1,10 +1,27 @@
 package retrievalimpl_test
 
 import (
+	"context"
+	"math/big"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/filecoin-project/go-address"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipfs/go-merkledag"
+	uio "github.com/ipfs/go-unixfs/io"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/libp2p/go-libp2p-core/peer"
+	mh "github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
 
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
@@ -24,6 +41,8 @@ func TestHandleQueryStream(t *testing.T) {
 	expectedPricePerByte := tokenamount.FromInt(4321)
 	expectedPaymentInterval := uint64(4567)
 	expectedPaymentIntervalIncrease := uint64(100)
+	expectedUnsealPrice := tokenamount.FromInt(50000)
+	expectedUnsealTime := 2 * time.Hour
 
 	readWriteQueryStream := func() network.RetrievalQueryStream {
 		qRead, qWrite := tut.QueryReadWriter()
@@ -40,9 +59,12 @@ func TestHandleQueryStream(t *testing.T) {
 
 	receiveStreamOnProvider := func(qs network.RetrievalQueryStream, node *testnodes.TestRetrievalProviderNode) {
 		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{})
-		c := retrievalimpl.NewProvider(expectedAddress, node, net)
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		c := retrievalimpl.NewProvider(expectedAddress, node, net, ds)
 		c.SetPricePerByte(expectedPricePerByte)
 		c.SetPaymentInterval(expectedPaymentInterval, expectedPaymentIntervalIncrease)
+		c.SetPricePerUnseal(expectedUnsealPrice)
+		c.SetExpectedUnsealTime(expectedUnsealTime)
 		_ = c.Start()
 		net.ReceiveQueryStream(qs)
 	}
@@ -67,6 +89,111 @@ func TestHandleQueryStream(t *testing.T) {
 		require.Equal(t, response.MinPricePerByte, expectedPricePerByte)
 		require.Equal(t, response.MaxPaymentInterval, expectedPaymentInterval)
 		require.Equal(t, response.MaxPaymentIntervalIncrease, expectedPaymentIntervalIncrease)
+		require.False(t, response.Unsealed)
+		require.Equal(t, response.UnsealPrice, expectedUnsealPrice)
+		require.Equal(t, response.ExpectedTimeToFirstByte, uint64(expectedUnsealTime/time.Second))
+	})
+
+	t.Run("piece already unsealed", func(t *testing.T) {
+		qs := readWriteQueryStream()
+		err := qs.WriteQuery(retrievalmarket.Query{
+			PieceCID: pcid,
+		})
+		require.NoError(t, err)
+		node := testnodes.NewTestRetrievalProviderNode()
+		node.ExpectPiece(pcid, expectedSize)
+		node.MarkUnsealed(pcid)
+
+		receiveStreamOnProvider(qs, node)
+
+		response, err := qs.ReadQueryResponse()
+		node.VerifyExpectations(t)
+		require.NoError(t, err)
+		require.Equal(t, response.Status, retrievalmarket.QueryResponseAvailable)
+		require.True(t, response.Unsealed)
+		require.Equal(t, response.UnsealPrice, tokenamount.FromInt(0))
+		require.Equal(t, response.ExpectedTimeToFirstByte, uint64(0))
+		require.Equal(t, response.PieceRetrievalPrice(), tokenamount.Mul(expectedPricePerByte, tokenamount.FromInt(expectedSize)))
+	})
+
+	t.Run("query items", func(t *testing.T) {
+		unsealedBs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+		sealedBs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+		leaf := merkledag.NewRawNode([]byte("unsealed leaf"))
+		root, err := cbornode.WrapObject(map[string]interface{}{
+			"leaves": []cid.Cid{leaf.Cid()},
+		}, mh.SHA2_256, -1)
+		require.NoError(t, err)
+		require.NoError(t, unsealedBs.PutMany([]blocks.Block{root, leaf}))
+		sealed := merkledag.NewRawNode([]byte("sealed data"))
+		require.NoError(t, sealedBs.Put(sealed))
+		missing := merkledag.NewRawNode([]byte("missing data"))
+
+		ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+		rootOnly, err := retrievalmarket.NewQueryItem(root.Cid(), ssb.Matcher().Node())
+		require.NoError(t, err)
+		items := []retrievalmarket.QueryItem{
+			{PayloadCID: root.Cid()},
+			rootOnly,
+			{PayloadCID: sealed.Cid()},
+			{PayloadCID: missing.Cid()},
+			{PayloadCID: root.Cid(), Selector: []byte("not a selector")},
+		}
+
+		qs := readWriteQueryStream()
+		err = qs.WriteQuery(retrievalmarket.NewQueryV1(pcid, retrievalmarket.QueryParams{Items: items}))
+		require.NoError(t, err)
+		node := testnodes.NewTestRetrievalProviderNode()
+		node.ExpectPiece(pcid, expectedSize)
+		node.SetBlockstore(sealedBs)
+		node.SetUnsealedBlockstore(unsealedBs)
+
+		receiveStreamOnProvider(qs, node)
+
+		response, err := qs.ReadQueryResponse()
+		node.VerifyExpectations(t)
+		require.NoError(t, err)
+		require.Equal(t, response.Status, retrievalmarket.QueryResponseAvailable)
+		require.Equal(t, []retrievalmarket.QueryItemResponse{
+			{Status: retrievalmarket.QueryItemAvailable, Size: uint64(len(root.RawData()) + len(leaf.RawData()))},
+			{Status: retrievalmarket.QueryItemAvailable, Size: uint64(len(root.RawData()))},
+			{Status: retrievalmarket.QueryItemUnknown},
+			// can't rule out blocks that may be in the sealed copy without unsealing it
+			{Status: retrievalmarket.QueryItemUnknown},
+			{Status: retrievalmarket.QueryItemUnavailable},
+		}, response.Items)
+	})
+
+	t.Run("query items beyond the limit are unknown", func(t *testing.T) {
+		unsealedBs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+		leaf := merkledag.NewRawNode([]byte("unsealed leaf"))
+		require.NoError(t, unsealedBs.Put(leaf))
+
+		// the provider looks for at most 32 items
+		items := make([]retrievalmarket.QueryItem, 40)
+		for i := range items {
+			items[i] = retrievalmarket.QueryItem{PayloadCID: leaf.Cid()}
+		}
+
+		qs := readWriteQueryStream()
+		err := qs.WriteQuery(retrievalmarket.NewQueryV1(pcid, retrievalmarket.QueryParams{Items: items}))
+		require.NoError(t, err)
+		node := testnodes.NewTestRetrievalProviderNode()
+		node.ExpectPiece(pcid, expectedSize)
+		node.SetUnsealedBlockstore(unsealedBs)
+
+		receiveStreamOnProvider(qs, node)
+
+		response, err := qs.ReadQueryResponse()
+		require.NoError(t, err)
+		require.Len(t, response.Items, len(items))
+		for i, item := range response.Items {
+			if i < 32 {
+				require.Equal(t, retrievalmarket.QueryItemAvailable, item.Status)
+			} else {
+				require.Equal(t, retrievalmarket.QueryItemUnknown, item.Status)
+			}
+		}
 	})
 
 	t.Run("piece not found", func(t *testing.T) {
@@ -138,3 +265,343 @@ func TestHandleQueryStream(t *testing.T) {
 		node.VerifyExpectations(t)
 	})
 }
+
+func TestProvider_ListDeals(t *testing.T) {
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{})
+	proposal := tut.MakeTestDealProposal()
+	node := testnodes.NewTestRetrievalProviderNode()
+	node.ExpectMissingPiece(proposal.PieceCID)
+
+	p := retrievalimpl.NewProvider(address.TestAddress2, node, net, ds)
+	require.NoError(t, p.Start())
+	require.Len(t, p.ListDeals(), 0)
+
+	receiveProposal := func(from peer.ID) {
+		net.ReceiveDealStream(tut.NewTestRetrievalDealStream(tut.TestDealStreamParams{
+			PeerID:         from,
+			ProposalReader: tut.StubbedDealProposalReader(proposal),
+		}))
+	}
+	receiveProposal(peer.ID("peer1"))
+	receiveProposal(peer.ID("peer2"))
+
+	// a deal whose proposal can't be read has nothing to be tracked by
+	net.ReceiveDealStream(tut.NewTestRetrievalDealStream(tut.TestDealStreamParams{
+		PeerID:         peer.ID("peer3"),
+		ProposalReader: tut.FailDealProposalReader,
+	}))
+
+	deals := p.ListDeals()
+	require.Len(t, deals, 2)
+	for _, from := range []peer.ID{"peer1", "peer2"} {
+		deal, ok := deals[retrievalmarket.ProviderDealID{From: from, ID: proposal.ID}]
+		require.True(t, ok)
+		require.Equal(t, from, deal.Receiver)
+		require.Equal(t, proposal, deal.DealProposal)
+		require.Equal(t, retrievalmarket.DealStatusDealNotFound, deal.Status)
+	}
+	node.VerifyExpectations(t)
+
+	t.Run("deals survive a restart", func(t *testing.T) {
+		p := retrievalimpl.NewProvider(address.TestAddress2, node, net, ds)
+		require.Len(t, p.ListDeals(), 2)
+	})
+}
+
+func TestProvider_HandleDealStream(t *testing.T) {
+	ctx := context.Background()
+	voucher := tut.MakeTestSignedVoucher()
+
+	// sendDeal runs a deal for the given params against a provider holding the
+	// blocks, and returns the blocks sent in the one response it takes after
+	// any unseal payment
+	sendDeal := func(t *testing.T, bs bstore.Blockstore, params retrievalmarket.Params, unsealPrice uint64, totalSize uint64) []retrievalmarket.Block {
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{})
+		node := testnodes.NewTestRetrievalProviderNode()
+		node.SetBlockstore(bs)
+		params.UnsealPrice = tokenamount.FromInt(unsealPrice)
+		proposal := retrievalmarket.DealProposal{
+			PieceCID: []byte("applesauce"),
+			ID:       retrievalmarket.DealID(1),
+			Params:   params,
+		}
+		node.ExpectPiece(proposal.PieceCID, 1000)
+		if unsealPrice > 0 {
+			require.NoError(t, node.ExpectVoucher(address.TestAddress, voucher, nil, tokenamount.FromInt(unsealPrice), tokenamount.FromInt(unsealPrice), nil))
+		}
+		require.NoError(t, node.ExpectVoucher(address.TestAddress, voucher, nil, tokenamount.FromInt(totalSize), tokenamount.FromInt(totalSize), nil))
+
+		p := retrievalimpl.NewProvider(address.TestAddress2, node, net, ds)
+		p.SetPricePerByte(tokenamount.FromInt(1))
+		p.SetPaymentInterval(1000, 0)
+		p.SetPricePerUnseal(tokenamount.FromInt(unsealPrice))
+		require.NoError(t, p.Start())
+
+		var responses []retrievalmarket.DealResponse
+		net.ReceiveDealStream(tut.NewTestRetrievalDealStream(tut.TestDealStreamParams{
+			PeerID:         peer.ID("somepeer"),
+			ProposalReader: tut.StubbedDealProposalReader(proposal),
+			ResponseWriter: func(response retrievalmarket.DealResponse) error {
+				responses = append(responses, response)
+				return nil
+			},
+			PaymentReader: tut.StubbedDealPaymentReader(retrievalmarket.DealPayment{
+				ID:             proposal.ID,
+				PaymentChannel: address.TestAddress,
+				PaymentVoucher: voucher,
+			}),
+		}))
+
+		deal := p.ListDeals()[retrievalmarket.ProviderDealID{From: peer.ID("somepeer"), ID: proposal.ID}]
+		require.Equal(t, retrievalmarket.DealStatusCompleted, deal.Status, deal.Message)
+		require.Equal(t, totalSize, deal.TotalSent)
+		require.Equal(t, tokenamount.FromInt(unsealPrice+totalSize), deal.FundsReceived)
+		node.VerifyExpectations(t)
+
+		require.Equal(t, retrievalmarket.DealStatusAccepted, responses[0].Status)
+		if unsealPrice > 0 {
+			require.Equal(t, retrievalmarket.DealStatusUnsealing, responses[1].Status)
+			require.Equal(t, tokenamount.FromInt(unsealPrice), responses[1].PaymentOwed)
+			responses = responses[1:]
+		}
+		require.Len(t, responses, 2)
+		require.Equal(t, retrievalmarket.DealStatusFundsNeededLastPayment, responses[1].Status)
+		return responses[1].Blocks
+	}
+
+	toBlock := func(nd blocks.Block) retrievalmarket.Block {
+		return retrievalmarket.Block{Prefix: nd.Cid().Prefix().Bytes(), Data: nd.RawData()}
+	}
+
+	t.Run("dag-cbor DAG", func(t *testing.T) {
+		bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+		leaf := merkledag.NewRawNode([]byte("leaf data"))
+		root, err := cbornode.WrapObject(map[string]interface{}{
+			"name":   "structured data",
+			"leaves": []cid.Cid{leaf.Cid()},
+		}, mh.SHA2_256, -1)
+		require.NoError(t, err)
+		require.NoError(t, bs.PutMany([]blocks.Block{root, leaf}))
+
+		params := retrievalmarket.Params{PayloadCID: root.Cid(), PricePerByte: tokenamount.FromInt(1), PaymentInterval: 1000}
+		sent := sendDeal(t, bs, params, 0, uint64(len(root.RawData())+len(leaf.RawData())))
+		require.Equal(t, []retrievalmarket.Block{toBlock(root), toBlock(leaf)}, sent)
+
+		t.Run("after paying to unseal", func(t *testing.T) {
+			sent := sendDeal(t, bs, params, 5000, uint64(len(root.RawData())+len(leaf.RawData())))
+			require.Equal(t, []retrievalmarket.Block{toBlock(root), toBlock(leaf)}, sent)
+		})
+	})
+
+	t.Run("one file in a UnixFS directory", func(t *testing.T) {
+		bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+		dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+		files := []*merkledag.RawNode{
+			merkledag.NewRawNode([]byte("first file")),
+			merkledag.NewRawNode([]byte("second file")),
+		}
+		dir := uio.NewDirectory(dserv)
+		require.NoError(t, dir.AddChild(ctx, "first", files[0]))
+		require.NoError(t, dir.AddChild(ctx, "second", files[1]))
+		dirNd, err := dir.GetNode()
+		require.NoError(t, err)
+		require.NoError(t, bs.PutMany([]blocks.Block{dirNd, files[0], files[1]}))
+
+		ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+		secondFile := ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("Links", ssb.ExploreIndex(1,
+				ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+					efsb.Insert("Hash", ssb.Matcher())
+				})))
+		}).Node()
+		params, err := retrievalmarket.NewParamsV1(big.NewInt(1), 1000, 0, dirNd.Cid(), secondFile)
+		require.NoError(t, err)
+
+		sent := sendDeal(t, bs, params, 0, uint64(len(dirNd.RawData())+len(files[1].RawData())))
+		require.Equal(t, []retrievalmarket.Block{toBlock(dirNd), toBlock(files[1])}, sent)
+	})
+}
+
+func TestProvider_ResumeDeal(t *testing.T) {
+	voucher := tut.MakeTestSignedVoucher()
+	bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	leaves := []*merkledag.RawNode{
+		merkledag.NewRawNode([]byte("first leaf")),
+		merkledag.NewRawNode([]byte("second, longer leaf")),
+	}
+	root, err := cbornode.WrapObject(map[string]interface{}{
+		"leaves": []cid.Cid{leaves[0].Cid(), leaves[1].Cid()},
+	}, mh.SHA2_256, -1)
+	require.NoError(t, err)
+	require.NoError(t, bs.PutMany([]blocks.Block{root, leaves[0], leaves[1]}))
+	firstSize := uint64(len(root.RawData()) + len(leaves[0].RawData()))
+	secondSize := uint64(len(leaves[1].RawData()))
+
+	net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{})
+	node := testnodes.NewTestRetrievalProviderNode()
+	node.SetBlockstore(bs)
+	proposal := retrievalmarket.DealProposal{
+		PieceCID: []byte("applesauce"),
+		ID:       retrievalmarket.DealID(1),
+		Params: retrievalmarket.Params{
+			PayloadCID:      root.Cid(),
+			PricePerByte:    tokenamount.FromInt(1),
+			PaymentInterval: firstSize,
+			UnsealPrice:     tokenamount.FromInt(0),
+		},
+	}
+	node.ExpectPiece(proposal.PieceCID, 1000)
+	p := retrievalimpl.NewProvider(address.TestAddress2, node, net, dss.MutexWrap(datastore.NewMapDatastore()))
+	p.SetPricePerByte(tokenamount.FromInt(1))
+	p.SetPaymentInterval(firstSize, 0)
+	require.NoError(t, p.Start())
+
+	propose := func(proposal retrievalmarket.DealProposal, payments tut.DealPaymentReader) ([]retrievalmarket.DealResponse, retrievalmarket.ProviderDealState) {
+		var responses []retrievalmarket.DealResponse
+		net.ReceiveDealStream(tut.NewTestRetrievalDealStream(tut.TestDealStreamParams{
+			PeerID:         peer.ID("somepeer"),
+			ProposalReader: tut.StubbedDealProposalReader(proposal),
+			ResponseWriter: func(response retrievalmarket.DealResponse) error {
+				responses = append(responses, response)
+				return nil
+			},
+			PaymentReader: payments,
+		}))
+		return responses, p.ListDeals()[retrievalmarket.ProviderDealID{From: peer.ID("somepeer"), ID: proposal.ID}]
+	}
+	toBlock := func(nd blocks.Block) retrievalmarket.Block {
+		return retrievalmarket.Block{Prefix: nd.Cid().Prefix().Bytes(), Data: nd.RawData()}
+	}
+
+	// the client goes away without paying for the first blocks
+	responses, deal := propose(proposal, tut.FailDealPaymentReader)
+	require.Len(t, responses, 2)
+	require.Equal(t, []retrievalmarket.Block{toBlock(root), toBlock(leaves[0])}, responses[1].Blocks)
+	require.Equal(t, retrievalmarket.DealStatusFailed, deal.Status)
+	require.Equal(t, firstSize, deal.TotalSent)
+
+	t.Run("cannot skip blocks it was not sent", func(t *testing.T) {
+		resumed := proposal
+		resumed.SkipBlocks = 3
+		responses, deal := propose(resumed, tut.FailDealPaymentReader)
+		require.Len(t, responses, 1)
+		require.Equal(t, retrievalmarket.DealStatusFailed, deal.Status)
+		require.Equal(t, firstSize, deal.TotalSent)
+	})
+
+	t.Run("another deal cannot reuse the ID", func(t *testing.T) {
+		other := proposal
+		other.PayloadCID = leaves[1].Cid()
+		responses, deal := propose(other, tut.FailDealPaymentReader)
+		require.Equal(t, []retrievalmarket.DealResponse{
+			{Status: retrievalmarket.DealStatusRejected, ID: proposal.ID, Message: "deal ID 1 is already in use"},
+		}, responses)
+		require.Equal(t, root.Cid(), deal.PayloadCID)
+		require.Equal(t, retrievalmarket.DealStatusFailed, deal.Status)
+		require.Equal(t, firstSize, deal.TotalSent)
+	})
+
+	// resuming, the client pays for what it was sent before it is sent more
+	require.NoError(t, node.ExpectVoucher(address.TestAddress, voucher, nil, tokenamount.FromInt(firstSize), tokenamount.FromInt(firstSize), nil))
+	require.NoError(t, node.ExpectVoucher(address.TestAddress, voucher, nil, tokenamount.FromInt(secondSize), tokenamount.FromInt(secondSize), nil))
+	resumed := proposal
+	resumed.SkipBlocks = 2
+	responses, deal = propose(resumed, tut.StubbedDealPaymentReader(retrievalmarket.DealPayment{
+		ID:             proposal.ID,
+		PaymentChannel: address.TestAddress,
+		PaymentVoucher: voucher,
+	}))
+	require.Equal(t, []retrievalmarket.DealResponse{
+		{Status: retrievalmarket.DealStatusAccepted, ID: proposal.ID},
+		{Status: retrievalmarket.DealStatusFundsNeeded, ID: proposal.ID, PaymentOwed: tokenamount.FromInt(firstSize)},
+		{
+			Status:      retrievalmarket.DealStatusFundsNeededLastPayment,
+			ID:          proposal.ID,
+			PaymentOwed: tokenamount.FromInt(secondSize),
+			Blocks:      []retrievalmarket.Block{toBlock(leaves[1])},
+		},
+	}, responses)
+	require.Equal(t, retrievalmarket.DealStatusCompleted, deal.Status, deal.Message)
+	require.Equal(t, firstSize+secondSize, deal.TotalSent)
+	require.Equal(t, tokenamount.FromInt(firstSize+secondSize), deal.FundsReceived)
+	node.VerifyExpectations(t)
+
+	t.Run("a completed deal cannot be proposed again", func(t *testing.T) {
+		responses, deal := propose(proposal, tut.FailDealPaymentReader)
+		require.Equal(t, []retrievalmarket.DealResponse{
+			{Status: retrievalmarket.DealStatusRejected, ID: proposal.ID, Message: "deal 1 has already completed"},
+		}, responses)
+		require.Equal(t, retrievalmarket.DealStatusCompleted, deal.Status)
+		require.Equal(t, tokenamount.FromInt(firstSize+secondSize), deal.FundsReceived)
+	})
+}
+
+func TestProvider_DealDecider(t *testing.T) {
+	proposal := tut.MakeTestDealProposal()
+	proposal.PricePerByte = tokenamount.FromInt(1)
+	proposal.PaymentInterval = 1000
+	proposal.PaymentIntervalIncrease = 0
+	proposal.UnsealPrice = tokenamount.FromInt(0)
+
+	decisions := map[peer.ID][]retrievalmarket.DealDecision{
+		"blocked": {retrievalmarket.DealDecisionReject},
+		"pending": {retrievalmarket.DealDecisionDefer, retrievalmarket.DealDecisionDefer, retrievalmarket.DealDecisionAccept},
+	}
+	var lk sync.Mutex
+	decider := func(_ context.Context, received retrievalmarket.DealProposal, client peer.ID) (retrievalmarket.DealDecision, string, error) {
+		require.Equal(t, proposal, received)
+		lk.Lock()
+		defer lk.Unlock()
+		decision := decisions[client][0]
+		decisions[client] = decisions[client][1:]
+		return decision, "decided for " + string(client), nil
+	}
+
+	propose := func(t *testing.T, from peer.ID) ([]retrievalmarket.DealResponse, retrievalmarket.ProviderDealState) {
+		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{})
+		node := testnodes.NewTestRetrievalProviderNode()
+		node.ExpectPiece(proposal.PieceCID, 1000)
+		p := retrievalimpl.NewProvider(address.TestAddress2, node, net, dss.MutexWrap(datastore.NewMapDatastore()))
+		p.SetPricePerByte(tokenamount.FromInt(1))
+		p.SetPaymentInterval(1000, 0)
+		p.SetDealDecider(decider, time.Millisecond)
+		require.NoError(t, p.Start())
+
+		var responses []retrievalmarket.DealResponse
+		net.ReceiveDealStream(tut.NewTestRetrievalDealStream(tut.TestDealStreamParams{
+			PeerID:         from,
+			ProposalReader: tut.StubbedDealProposalReader(proposal),
+			ResponseWriter: func(response retrievalmarket.DealResponse) error {
+				responses = append(responses, response)
+				return nil
+			},
+		}))
+		return responses, p.ListDeals()[retrievalmarket.ProviderDealID{From: from, ID: proposal.ID}]
+	}
+
+	t.Run("rejection is sent to the client", func(t *testing.T) {
+		responses, deal := propose(t, peer.ID("blocked"))
+		require.Equal(t, []retrievalmarket.DealResponse{{
+			Status:  retrievalmarket.DealStatusRejected,
+			ID:      proposal.ID,
+			Message: "decided for blocked",
+		}}, responses)
+		require.Equal(t, retrievalmarket.DealStatusRejected, deal.Status)
+	})
+
+	t.Run("deferred deal is decided later", func(t *testing.T) {
+		responses, _ := propose(t, peer.ID("pending"))
+		require.True(t, len(responses) >= 2)
+		require.Equal(t, retrievalmarket.DealResponse{
+			Status:  retrievalmarket.DealStatusDeferred,
+			ID:      proposal.ID,
+			Message: "decided for pending",
+		}, responses[0])
+		require.Equal(t, retrievalmarket.DealResponse{
+			Status: retrievalmarket.DealStatusAccepted,
+			ID:     proposal.ID,
+		}, responses[1])
+	})
+}
@@ -0,0 +1,105 @@
+package providerstates
+
+import (
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared/fsm"
+)
+
+// events that move provider deals between statuses
+const (
+	providerDealDeferred          = "deferred"
+	providerDealRejected          = "rejected"
+	providerDealNotFound          = "notFound"
+	providerDealUnsealing         = "unsealing"
+	providerDealAccepted          = "accepted"
+	providerDealFundsNeeded       = "fundsNeeded"
+	providerDealLastPaymentNeeded = "lastPaymentNeeded"
+	providerDealPaid              = "paid"
+	providerDealCompleted         = "completed"
+	providerDealCancelled         = "cancelled"
+	providerDealFailed            = "failed"
+
+	// providerDealPartlyPaid keeps a deal waiting for the rest of a payment
+	providerDealPartlyPaid = "partlyPaid"
+)
+
+// ProviderDeals is the lifecycle of a retrieval deal on the provider. Handlers
+// send the events that move deals between statuses
+var ProviderDeals = fsm.MustNewTable(
+	statuses(
+		rm.DealStatusNew,
+		rm.DealStatusDeferred,
+		rm.DealStatusUnsealing,
+		rm.DealStatusAccepted,
+		rm.DealStatusOngoing,
+		rm.DealStatusFundsNeeded,
+		rm.DealStatusFundsNeededLastPayment,
+		rm.DealStatusCompleted,
+		rm.DealStatusFailed,
+		rm.DealStatusRejected,
+		rm.DealStatusDealNotFound,
+		rm.DealStatusCancelled,
+	),
+	statuses(
+		rm.DealStatusCompleted,
+		rm.DealStatusFailed,
+		rm.DealStatusRejected,
+		rm.DealStatusDealNotFound,
+		rm.DealStatusCancelled,
+	),
+
+	fsm.Event{Name: providerDealDeferred, From: statuses(rm.DealStatusNew, rm.DealStatusDeferred), To: fsm.State(rm.DealStatusDeferred)},
+	fsm.Event{Name: providerDealRejected, From: statuses(rm.DealStatusNew, rm.DealStatusDeferred), To: fsm.State(rm.DealStatusRejected)},
+	fsm.Event{Name: providerDealNotFound, From: statuses(rm.DealStatusNew), To: fsm.State(rm.DealStatusDealNotFound)},
+	fsm.Event{Name: providerDealUnsealing, From: statuses(rm.DealStatusNew, rm.DealStatusDeferred), To: fsm.State(rm.DealStatusUnsealing)},
+	fsm.Event{Name: providerDealAccepted, From: statuses(rm.DealStatusNew, rm.DealStatusDeferred, rm.DealStatusUnsealing), To: fsm.State(rm.DealStatusAccepted)},
+	fsm.Event{Name: providerDealFundsNeeded, From: statuses(rm.DealStatusAccepted, rm.DealStatusOngoing), To: fsm.State(rm.DealStatusFundsNeeded)},
+	fsm.Event{Name: providerDealLastPaymentNeeded, From: statuses(rm.DealStatusAccepted, rm.DealStatusOngoing), To: fsm.State(rm.DealStatusFundsNeededLastPayment)},
+	fsm.Event{Name: providerDealPaid, From: statuses(rm.DealStatusFundsNeeded), To: fsm.State(rm.DealStatusOngoing)},
+	fsm.Event{Name: providerDealCompleted, From: statuses(rm.DealStatusFundsNeededLastPayment), To: fsm.State(rm.DealStatusCompleted)},
+	fsm.Event{Name: providerDealCancelled, To: fsm.State(rm.DealStatusCancelled)},
+	fsm.Event{Name: providerDealFailed, To: fsm.State(rm.DealStatusFailed)},
+	fsm.Event{Name: providerDealPartlyPaid, From: statuses(rm.DealStatusUnsealing, rm.DealStatusFundsNeeded, rm.DealStatusFundsNeededLastPayment), NoChange: true},
+)
+
+// ProviderDealUpdate is what a handler decides happens to a deal: the event
+// that moves it to its next status, and changes to its other fields
+type ProviderDealUpdate struct {
+	Event  string
+	Mutate func(*rm.ProviderDealState)
+}
+
+// Apply moves a deal to the status the update's event leads to, then makes
+// the update's other changes. It returns an error wrapping
+// fsm.ErrIllegalTransition if the event can't happen in the deal's status
+func (u ProviderDealUpdate) Apply(deal *rm.ProviderDealState) error {
+	next, err := ProviderDeals.Next(fsm.State(deal.Status), u.Event)
+	if err != nil {
+		return err
+	}
+	deal.Status = rm.DealStatus(next)
+	if u.Mutate != nil {
+		u.Mutate(deal)
+	}
+	return nil
+}
+
+// StateEntries are the handlers run for deals in each status that isn't
+// terminal
+var StateEntries = map[rm.DealStatus]ProviderHandlerFunc{
+	rm.DealStatusNew:                    ReceiveDeal,
+	rm.DealStatusDeferred:               ReconsiderDeal,
+	rm.DealStatusUnsealing:              ProcessUnsealPayment,
+	rm.DealStatusAccepted:               SendBlocks,
+	rm.DealStatusOngoing:                SendBlocks,
+	rm.DealStatusFundsNeeded:            ProcessPayment,
+	rm.DealStatusFundsNeededLastPayment: ProcessPayment,
+}
+
+func statuses(ss ...rm.DealStatus) []fsm.State {
+	states := make([]fsm.State, 0, len(ss))
+	for _, s := range ss {
+		states = append(states, fsm.State(s))
+	}
+	return states
+}
@@ -2,6 +2,8 @@ package providerstates
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	rmnet "github.com/filecoin-project/go-fil-markets/retrievalmarket/network"
@@ -14,17 +16,37 @@ type ProviderDealEnvironment interface {
 	Node() rm.RetrievalProviderNode
 	DealStream() rmnet.RetrievalDealStream
 	NextBlock(context.Context) (rm.Block, bool, error)
-	CheckDealParams(pricePerByte tokenamount.TokenAmount, paymentInterval uint64, paymentIntervalIncrease uint64) error
+	CheckDealParams(pricePerByte tokenamount.TokenAmount, paymentInterval uint64, paymentIntervalIncrease uint64, unsealPrice tokenamount.TokenAmount, unsealed bool) error
+	DecideDeal(ctx context.Context, proposal rm.DealProposal) (rm.DealDecision, string, error)
+	DecisionRetryInterval() time.Duration
+	// DecisionDeadline is when a deal the decider keeps deferring is rejected
+	DecisionDeadline() time.Time
+	// Cancelled is closed once the client cancels the deal
+	Cancelled() <-chan struct{}
+	// Disconnected is closed once the deal stream fails, and the client can no
+	// longer be reached
+	Disconnected() <-chan struct{}
+	// ResumedDeal returns the record of a deal with the proposal's ID that the
+	// client made before, if there is one. It fails if the ID cannot be used
+	// for this proposal
+	ResumedDeal(proposal rm.DealProposal) (rm.ProviderDealState, bool, error)
 }
 
-func errorFunc(err error) func(*rm.ProviderDealState) {
-	return func(deal *rm.ProviderDealState) {
-		deal.Status = rm.DealStatusFailed
+func errorFunc(err error) ProviderDealUpdate {
+	return ProviderDealUpdate{providerDealFailed, func(deal *rm.ProviderDealState) {
 		deal.Message = err.Error()
-	}
+	}}
+}
+
+// failureEvents are the events for the statuses a deal can fail with, which
+// the client is told about
+var failureEvents = map[rm.DealStatus]string{
+	rm.DealStatusFailed:       providerDealFailed,
+	rm.DealStatusRejected:     providerDealRejected,
+	rm.DealStatusDealNotFound: providerDealNotFound,
 }
 
-func responseFailure(stream rmnet.RetrievalDealStream, status rm.DealStatus, message string, id rm.DealID) func(*rm.ProviderDealState) {
+func responseFailure(stream rmnet.RetrievalDealStream, status rm.DealStatus, message string, id rm.DealID) ProviderDealUpdate {
 	err := stream.WriteDealResponse(rm.DealResponse{
 		Status:  status,
 		Message: message,
@@ -33,73 +55,248 @@ func responseFailure(stream rmnet.RetrievalDealStream, status rm.DealStatus, mes
 	if err != nil {
 		return errorFunc(xerrors.Errorf("writing deal response: %w", err))
 	}
-	return func(deal *rm.ProviderDealState) {
-		deal.Status = status
+	return ProviderDealUpdate{failureEvents[status], func(deal *rm.ProviderDealState) {
 		deal.Message = message
-	}
+	}}
+}
+
+func cancelled() ProviderDealUpdate {
+	return ProviderDealUpdate{providerDealCancelled, func(deal *rm.ProviderDealState) {
+		deal.Message = rm.ErrDealCancelled.Error()
+	}}
 }
 
 // ProviderHandlerFunc is a function that handles a provider deal being in a specific state
-// It processes the state and returns a modification function for a deal
-type ProviderHandlerFunc func(ctx context.Context, environment ProviderDealEnvironment, deal rm.ProviderDealState) func(*rm.ProviderDealState)
+// It processes the state and returns the update to make to the deal
+type ProviderHandlerFunc func(ctx context.Context, environment ProviderDealEnvironment, deal rm.ProviderDealState) ProviderDealUpdate
 
-// ReceiveDeal receives and evaluates a deal proposal
-func ReceiveDeal(ctx context.Context, environment ProviderDealEnvironment, deal rm.ProviderDealState) func(*rm.ProviderDealState) {
+// ReceiveDeal receives and evaluates a deal proposal. A client resuming a deal
+// carries on from what was sent and paid for in the deal before
+func ReceiveDeal(ctx context.Context, environment ProviderDealEnvironment, deal rm.ProviderDealState) ProviderDealUpdate {
 	// read deal proposal (or fail)
 	dealProposal, err := environment.DealStream().ReadDealProposal()
 	if err != nil {
 		return errorFunc(xerrors.Errorf("reading deal proposal: %w", err))
 	}
 
+	// record the proposal even when the deal does not go ahead, so the deal can be tracked
+	fail := func(status rm.DealStatus, message string) ProviderDealUpdate {
+		return withRecord(responseFailure(environment.DealStream(), status, message, dealProposal.ID), deal)
+	}
+
+	deal.DealProposal = dealProposal
+	previous, resumed, err := environment.ResumedDeal(dealProposal)
+	if err != nil {
+		return fail(rm.DealStatusRejected, err.Error())
+	}
+	if resumed {
+		// the unseal price already agreed is kept, as unsealing is paid for
+		// once in a deal
+		dealProposal.UnsealPrice = previous.UnsealPrice
+		deal = previous
+		deal.DealProposal = dealProposal
+	}
+	if !resumed && dealProposal.SkipBlocks > 0 {
+		return fail(rm.DealStatusRejected, fmt.Sprintf("no deal %d to resume", dealProposal.ID))
+	}
+
 	// verify we have the piece
 	_, err = environment.Node().GetPieceSize(dealProposal.PieceCID)
 	if err != nil {
 		if err == rm.ErrNotFound {
-			return responseFailure(environment.DealStream(), rm.DealStatusDealNotFound, rm.ErrNotFound.Error(), dealProposal.ID)
+			return fail(rm.DealStatusDealNotFound, rm.ErrNotFound.Error())
 		}
-		return responseFailure(environment.DealStream(), rm.DealStatusFailed, err.Error(), dealProposal.ID)
+		return fail(rm.DealStatusFailed, err.Error())
+	}
+
+	// an unsealed copy is served without paying to unseal it
+	unsealed, err := environment.Node().IsUnsealed(dealProposal.PieceCID)
+	if err != nil {
+		return fail(rm.DealStatusFailed, err.Error())
 	}
 
 	// check that the deal parameters match our required parameters (or reject)
-	err = environment.CheckDealParams(dealProposal.PricePerByte, dealProposal.PaymentInterval, dealProposal.PaymentIntervalIncrease)
+	err = environment.CheckDealParams(dealProposal.PricePerByte, dealProposal.PaymentInterval, dealProposal.PaymentIntervalIncrease, dealProposal.UnsealPrice, unsealed)
+	if err != nil {
+		return fail(rm.DealStatusRejected, err.Error())
+	}
+
+	return decideDeal(ctx, environment, deal, unsealed, false, fail)
+}
+
+// ReconsiderDeal puts a deal the decider deferred to it again, after waiting
+// for the retry interval. It stops waiting if the client cancels or goes away,
+// and rejects the deal once the decision deadline has passed
+func ReconsiderDeal(ctx context.Context, environment ProviderDealEnvironment, deal rm.ProviderDealState) ProviderDealUpdate {
+	deadline := environment.DecisionDeadline()
+	wait := environment.DecisionRetryInterval()
+	if untilDeadline := time.Until(deadline); untilDeadline < wait {
+		wait = untilDeadline
+	}
+	select {
+	case <-ctx.Done():
+		return errorFunc(ctx.Err())
+	case <-environment.Cancelled():
+		return cancelled()
+	case <-environment.Disconnected():
+		return errorFunc(xerrors.New("client disconnected while deal was deferred"))
+	case <-time.After(wait):
+	}
+
+	fail := func(status rm.DealStatus, message string) ProviderDealUpdate {
+		return responseFailure(environment.DealStream(), status, message, deal.ID)
+	}
+	if !time.Now().Before(deadline) {
+		return fail(rm.DealStatusRejected, "deal was deferred for too long")
+	}
+	unsealed, err := environment.Node().IsUnsealed(deal.PieceCID)
 	if err != nil {
-		return responseFailure(environment.DealStream(), rm.DealStatusRejected, err.Error(), dealProposal.ID)
+		return fail(rm.DealStatusFailed, err.Error())
+	}
+	return decideDeal(ctx, environment, deal, unsealed, true, fail)
+}
+
+// decideDeal asks the decider whether to take a deal, and tells the client.
+// The client is only told a deal is deferred the first time
+func decideDeal(ctx context.Context, environment ProviderDealEnvironment, deal rm.ProviderDealState, unsealed bool, deferred bool, fail func(rm.DealStatus, string) ProviderDealUpdate) ProviderDealUpdate {
+	writeFailed := func(err error) ProviderDealUpdate {
+		return withRecord(errorFunc(xerrors.Errorf("writing deal response: %w", err)), deal)
+	}
+
+	decision, reason, err := environment.DecideDeal(ctx, deal.DealProposal)
+	if err != nil {
+		return fail(rm.DealStatusFailed, err.Error())
+	}
+	switch decision {
+	case rm.DealDecisionAccept:
+	case rm.DealDecisionReject:
+		return fail(rm.DealStatusRejected, reason)
+	case rm.DealDecisionDefer:
+		if !deferred {
+			err := environment.DealStream().WriteDealResponse(rm.DealResponse{
+				Status:  rm.DealStatusDeferred,
+				Message: reason,
+				ID:      deal.ID,
+			})
+			if err != nil {
+				return writeFailed(err)
+			}
+		}
+		return withRecord(ProviderDealUpdate{providerDealDeferred, func(deal *rm.ProviderDealState) {
+			deal.Message = reason
+		}}, deal)
+	default:
+		return fail(rm.DealStatusFailed, fmt.Sprintf("unknown deal decision %d", decision))
 	}
 
 	// accept the deal
 	err = environment.DealStream().WriteDealResponse(rm.DealResponse{
 		Status: rm.DealStatusAccepted,
-		ID:     dealProposal.ID,
+		ID:     deal.ID,
 	})
 	if err != nil {
-		return errorFunc(xerrors.Errorf("writing real response: %w", err))
+		return writeFailed(err)
 	}
 
-	// update that we are ready to start sending blocks
-	return func(deal *rm.ProviderDealState) {
-		deal.Status = rm.DealStatusAccepted
-		deal.CurrentInterval = dealProposal.PaymentInterval
-		deal.DealProposal = dealProposal
+	// update that we are ready to start sending blocks, once unsealing is paid
+	// for. An unsealed copy needs nothing more paid towards unsealing it
+	unsealOwed := deal.UnsealPrice.GreaterThan(deal.FundsReceived)
+	event := providerDealAccepted
+	if !unsealed && unsealOwed {
+		event = providerDealUnsealing
 	}
+	return withRecord(ProviderDealUpdate{event, func(deal *rm.ProviderDealState) {
+		deal.Message = ""
+		deal.CurrentInterval = deal.PaymentInterval
+		if unsealed && unsealOwed {
+			deal.UnsealPrice = deal.FundsReceived
+		}
+	}}, deal)
 }
 
-// SendBlocks sends blocks to the client until funds are needed
-func SendBlocks(ctx context.Context, environment ProviderDealEnvironment, deal rm.ProviderDealState) func(*rm.ProviderDealState) {
-	totalSent := deal.TotalSent
-	totalPaidFor := tokenamount.Div(deal.FundsReceived, deal.PricePerByte).Uint64()
-	returnStatus := rm.DealStatusFundsNeeded
+// withRecord carries a deal's proposal, and what was sent and paid for in it
+// so far, into an update
+func withRecord(update ProviderDealUpdate, record rm.ProviderDealState) ProviderDealUpdate {
+	return ProviderDealUpdate{update.Event, func(deal *rm.ProviderDealState) {
+		deal.DealProposal = record.DealProposal
+		deal.TotalSent = record.TotalSent
+		deal.FundsReceived = record.FundsReceived
+		if update.Mutate != nil {
+			update.Mutate(deal)
+		}
+	}}
+}
+
+// ProcessUnsealPayment requests payment for unsealing from the client, and
+// starts sending blocks once it is paid in full
+func ProcessUnsealPayment(ctx context.Context, environment ProviderDealEnvironment, deal rm.ProviderDealState) ProviderDealUpdate {
+	// request the part of the unseal price not yet paid
+	paymentOwed := tokenamount.Sub(deal.UnsealPrice, deal.FundsReceived)
+	err := environment.DealStream().WriteDealResponse(rm.DealResponse{
+		ID:          deal.ID,
+		Status:      rm.DealStatusUnsealing,
+		PaymentOwed: paymentOwed,
+	})
+	if err != nil {
+		return errorFunc(xerrors.Errorf("writing deal response: %w", err))
+	}
+
+	// read payment, or fail
+	payment, err := environment.DealStream().ReadDealPayment()
+	if err == rm.ErrDealCancelled {
+		return cancelled()
+	}
+	if err != nil {
+		return errorFunc(xerrors.Errorf("reading payment: %w", err))
+	}
+
+	// attempt to redeem voucher
+	received, err := environment.Node().SavePaymentVoucher(ctx, payment.PaymentChannel, payment.PaymentVoucher, nil, paymentOwed)
+	if err != nil {
+		return responseFailure(environment.DealStream(), rm.DealStatusFailed, err.Error(), deal.ID)
+	}
+
+	// ask for the rest if the payment fell short, otherwise unseal and send blocks
+	event := providerDealAccepted
+	if received.LessThan(paymentOwed) {
+		event = providerDealPartlyPaid
+	}
+	return ProviderDealUpdate{event, func(deal *rm.ProviderDealState) {
+		deal.FundsReceived = tokenamount.Add(deal.FundsReceived, received)
+	}}
+}
+
+// SendBlocks sends blocks to the client until funds are needed, or the client
+// cancels the deal
+func SendBlocks(ctx context.Context, environment ProviderDealEnvironment, deal rm.ProviderDealState) ProviderDealUpdate {
+	totalSent, resend := deal.TotalSent, deal.Resend
+	totalPaidFor := tokenamount.Div(tokenamount.Sub(deal.FundsReceived, deal.UnsealPrice), deal.PricePerByte).Uint64()
+	returnStatus, event := rm.DealStatusFundsNeeded, providerDealFundsNeeded
 	var blocks []rm.Block
 
-	// read blocks until we reach current interval
-	for totalSent-totalPaidFor < deal.CurrentInterval {
+	// read blocks until we reach current interval. Blocks sent again to a
+	// client that resumed the deal were charged for when they were first sent,
+	// and anything sent but not yet paid for counts towards the interval
+	for resend > 0 || totalSent-totalPaidFor < deal.CurrentInterval {
+		select {
+		case <-environment.Cancelled():
+			return cancelled()
+		default:
+		}
 		block, done, err := environment.NextBlock(ctx)
 		if err != nil {
 			return responseFailure(environment.DealStream(), rm.DealStatusFailed, err.Error(), deal.ID)
 		}
 		blocks = append(blocks, block)
-		totalSent += uint64(len(block.Data))
+		size := uint64(len(block.Data))
+		if size <= resend {
+			resend -= size
+		} else {
+			totalSent += size - resend
+			resend = 0
+		}
 		if done {
-			returnStatus = rm.DealStatusFundsNeededLastPayment
+			returnStatus, event = rm.DealStatusFundsNeededLastPayment, providerDealLastPaymentNeeded
 			break
 		}
 	}
@@ -115,23 +312,26 @@ func SendBlocks(ctx context.Context, environment ProviderDealEnvironment, deal r
 		return errorFunc(xerrors.Errorf("writing deal response: %w", err))
 	}
 
-	// set status to awaiting funds and update amount sent
-	return func(deal *rm.ProviderDealState) {
-		deal.Status = returnStatus
+	// wait for funds and update amount sent
+	return ProviderDealUpdate{event, func(deal *rm.ProviderDealState) {
 		deal.TotalSent = totalSent
-	}
+		deal.Resend = resend
+	}}
 }
 
 // ProcessPayment processes a payment from the client and resumes the deal if successful
-func ProcessPayment(ctx context.Context, environment ProviderDealEnvironment, deal rm.ProviderDealState) func(*rm.ProviderDealState) {
+func ProcessPayment(ctx context.Context, environment ProviderDealEnvironment, deal rm.ProviderDealState) ProviderDealUpdate {
 	// read payment, or fail
 	payment, err := environment.DealStream().ReadDealPayment()
+	if err == rm.ErrDealCancelled {
+		return cancelled()
+	}
 	if err != nil {
-		return errorFunc(xerrors.Errorf("reading payment: %", err))
+		return errorFunc(xerrors.Errorf("reading payment: %w", err))
 	}
 
 	// attempt to redeem voucher
-	paymentOwed := tokenamount.Sub(tokenamount.Mul(tokenamount.FromInt(deal.TotalSent), deal.PricePerByte), deal.FundsReceived)
+	paymentOwed := tokenamount.Sub(tokenamount.Add(tokenamount.Mul(tokenamount.FromInt(deal.TotalSent), deal.PricePerByte), deal.UnsealPrice), deal.FundsReceived)
 	received, err := environment.Node().SavePaymentVoucher(ctx, payment.PaymentChannel, payment.PaymentVoucher, nil, paymentOwed)
 	if err != nil {
 		return responseFailure(environment.DealStream(), rm.DealStatusFailed, err.Error(), deal.ID)
@@ -147,19 +347,18 @@ func ProcessPayment(ctx context.Context, environment ProviderDealEnvironment, de
 		if err != nil {
 			return errorFunc(xerrors.Errorf("writing deal response", err))
 		}
-		return func(deal *rm.ProviderDealState) {
+		return ProviderDealUpdate{providerDealPartlyPaid, func(deal *rm.ProviderDealState) {
 			deal.FundsReceived = tokenamount.Add(deal.FundsReceived, received)
-		}
+		}}
 	}
 
 	// resume deal
-	return func(deal *rm.ProviderDealState) {
-		if deal.Status == rm.DealStatusFundsNeededLastPayment {
-			deal.Status = rm.DealStatusCompleted
-		} else {
-			deal.Status = rm.DealStatusOngoing
-		}
+	event := providerDealPaid
+	if deal.Status == rm.DealStatusFundsNeededLastPayment {
+		event = providerDealCompleted
+	}
+	return ProviderDealUpdate{event, func(deal *rm.ProviderDealState) {
 		deal.FundsReceived = tokenamount.Add(deal.FundsReceived, received)
 		deal.CurrentInterval += deal.PaymentIntervalIncrease
-	}
+	}}
 }
@@ -5,10 +5,13 @@ import (
 	"crypto/rand"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
 	mh "github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
@@ -16,6 +19,7 @@ import (
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/providerstates"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
 	rmnet "github.com/filecoin-project/go-fil-markets/retrievalmarket/network"
+	"github.com/filecoin-project/go-fil-markets/shared/fsm"
 	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
 	testnet "github.com/filecoin-project/go-fil-markets/shared_testutil"
 )
@@ -44,6 +48,7 @@ func TestReceiveDeal(t *testing.T) {
 			PricePerByte:            defaultPricePerByte,
 			PaymentInterval:         defaultCurrentInterval,
 			PaymentIntervalIncrease: defaultIntervalIncrease,
+			UnsealPrice:             noUnsealPrice,
 		},
 	}
 
@@ -59,17 +64,66 @@ func TestReceiveDeal(t *testing.T) {
 			ProposalReader: testnet.StubbedDealProposalReader(proposal),
 			ResponseWriter: testnet.ExpectDealResponseWriter(t, expectedDealResponse),
 		})
-		fe.ExpectParams(defaultPricePerByte, defaultCurrentInterval, defaultIntervalIncrease, nil)
+		fe.ExpectParams(defaultPricePerByte, defaultCurrentInterval, defaultIntervalIncrease, noUnsealPrice, false, nil)
 		f := providerstates.ReceiveDeal(ctx, fe, *dealState)
 		fe.VerifyExpectations(t)
 		node.VerifyExpectations(t)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusAccepted)
 		require.Equal(t, dealState.DealProposal, proposal)
 		require.Equal(t, dealState.CurrentInterval, defaultCurrentInterval)
 		require.Empty(t, dealState.Message)
 	})
 
+	t.Run("it waits for unseal payment", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		node.ExpectPiece(expectedPiece, 10000)
+		dealState := blankDealState()
+		unsealProposal := proposal
+		unsealProposal.UnsealPrice = defaultUnsealPrice
+		expectedDealResponse := retrievalmarket.DealResponse{
+			Status: retrievalmarket.DealStatusAccepted,
+			ID:     proposal.ID,
+		}
+		fe := environment(node, testnet.TestDealStreamParams{
+			ProposalReader: testnet.StubbedDealProposalReader(unsealProposal),
+			ResponseWriter: testnet.ExpectDealResponseWriter(t, expectedDealResponse),
+		})
+		fe.ExpectParams(defaultPricePerByte, defaultCurrentInterval, defaultIntervalIncrease, defaultUnsealPrice, false, nil)
+		f := providerstates.ReceiveDeal(ctx, fe, *dealState)
+		fe.VerifyExpectations(t)
+		node.VerifyExpectations(t)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusUnsealing)
+		require.Equal(t, dealState.DealProposal, unsealProposal)
+		require.Empty(t, dealState.Message)
+	})
+
+	t.Run("unsealed copy needs no unseal payment", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		node.ExpectPiece(expectedPiece, 10000)
+		node.MarkUnsealed(expectedPiece)
+		dealState := blankDealState()
+		unsealProposal := proposal
+		unsealProposal.UnsealPrice = defaultUnsealPrice
+		expectedDealResponse := retrievalmarket.DealResponse{
+			Status: retrievalmarket.DealStatusAccepted,
+			ID:     proposal.ID,
+		}
+		fe := environment(node, testnet.TestDealStreamParams{
+			ProposalReader: testnet.StubbedDealProposalReader(unsealProposal),
+			ResponseWriter: testnet.ExpectDealResponseWriter(t, expectedDealResponse),
+		})
+		fe.ExpectParams(defaultPricePerByte, defaultCurrentInterval, defaultIntervalIncrease, defaultUnsealPrice, true, nil)
+		f := providerstates.ReceiveDeal(ctx, fe, *dealState)
+		fe.VerifyExpectations(t)
+		node.VerifyExpectations(t)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusAccepted)
+		require.Equal(t, dealState.UnsealPrice, noUnsealPrice)
+		require.Empty(t, dealState.Message)
+	})
+
 	t.Run("missing piece", func(t *testing.T) {
 		node := testnodes.NewTestRetrievalProviderNode()
 		node.ExpectMissingPiece(expectedPiece)
@@ -85,8 +139,9 @@ func TestReceiveDeal(t *testing.T) {
 		})
 		f := providerstates.ReceiveDeal(ctx, fe, *dealState)
 		node.VerifyExpectations(t)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusDealNotFound)
+		require.Equal(t, dealState.DealProposal, proposal)
 		require.NotEmpty(t, dealState.Message)
 	})
 
@@ -104,12 +159,13 @@ func TestReceiveDeal(t *testing.T) {
 			ProposalReader: testnet.StubbedDealProposalReader(proposal),
 			ResponseWriter: testnet.ExpectDealResponseWriter(t, expectedDealResponse),
 		})
-		fe.ExpectParams(defaultPricePerByte, defaultCurrentInterval, defaultIntervalIncrease, errors.New(message))
+		fe.ExpectParams(defaultPricePerByte, defaultCurrentInterval, defaultIntervalIncrease, noUnsealPrice, false, errors.New(message))
 		f := providerstates.ReceiveDeal(ctx, fe, *dealState)
 		fe.VerifyExpectations(t)
 		node.VerifyExpectations(t)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusRejected)
+		require.Equal(t, dealState.DealProposal, proposal)
 		require.NotEmpty(t, dealState.Message)
 	})
 
@@ -120,7 +176,7 @@ func TestReceiveDeal(t *testing.T) {
 			ProposalReader: testnet.FailDealProposalReader,
 		})
 		f := providerstates.ReceiveDeal(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
 		require.NotEmpty(t, dealState.Message)
 	})
@@ -133,15 +189,200 @@ func TestReceiveDeal(t *testing.T) {
 			ProposalReader: testnet.StubbedDealProposalReader(proposal),
 			ResponseWriter: testnet.FailDealResponseWriter,
 		})
-		fe.ExpectParams(defaultPricePerByte, defaultCurrentInterval, defaultIntervalIncrease, nil)
+		fe.ExpectParams(defaultPricePerByte, defaultCurrentInterval, defaultIntervalIncrease, noUnsealPrice, false, nil)
 		f := providerstates.ReceiveDeal(ctx, fe, *dealState)
 		fe.VerifyExpectations(t)
 		node.VerifyExpectations(t)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
 		require.NotEmpty(t, dealState.Message)
 	})
 
+	t.Run("resumes a deal", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		node.ExpectPiece(expectedPiece, 10000)
+		dealState := blankDealState()
+		previous := makeDealState(retrievalmarket.DealStatusFailed)
+		previous.UnsealPrice = defaultUnsealPrice
+		previous.FundsReceived = tokenamount.Add(defaultFundsReceived, defaultUnsealPrice)
+		resumeProposal := proposal
+		resumeProposal.UnsealPrice = defaultUnsealPrice
+		resumeProposal.SkipBlocks = 3
+		fe := environment(node, testnet.TestDealStreamParams{
+			ProposalReader: testnet.StubbedDealProposalReader(resumeProposal),
+			ResponseWriter: testnet.ExpectDealResponseWriter(t, retrievalmarket.DealResponse{
+				Status: retrievalmarket.DealStatusAccepted,
+				ID:     proposal.ID,
+			}),
+		})
+		fe.previous = previous
+		fe.ExpectParams(defaultPricePerByte, defaultCurrentInterval, defaultIntervalIncrease, defaultUnsealPrice, false, nil)
+		f := providerstates.ReceiveDeal(ctx, fe, *dealState)
+		fe.VerifyExpectations(t)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, retrievalmarket.DealStatusAccepted, dealState.Status, "unsealing was paid for before")
+		require.Equal(t, resumeProposal, dealState.DealProposal)
+		require.Equal(t, previous.TotalSent, dealState.TotalSent)
+		require.Equal(t, previous.FundsReceived, dealState.FundsReceived)
+	})
+
+	t.Run("nothing to resume", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		dealState := blankDealState()
+		resumeProposal := proposal
+		resumeProposal.SkipBlocks = 3
+		fe := environment(node, testnet.TestDealStreamParams{
+			ProposalReader: testnet.StubbedDealProposalReader(resumeProposal),
+			ResponseWriter: testnet.ExpectDealResponseWriter(t, retrievalmarket.DealResponse{
+				Status:  retrievalmarket.DealStatusRejected,
+				ID:      proposal.ID,
+				Message: "no deal 10 to resume",
+			}),
+		})
+		f := providerstates.ReceiveDeal(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, retrievalmarket.DealStatusRejected, dealState.Status)
+		require.Equal(t, uint64(0), dealState.TotalSent)
+	})
+
+	decide := func(t *testing.T, decision retrievalmarket.DealDecision, reason string, err error, expectedDealResponse retrievalmarket.DealResponse) *retrievalmarket.ProviderDealState {
+		node := testnodes.NewTestRetrievalProviderNode()
+		node.ExpectPiece(expectedPiece, 10000)
+		dealState := blankDealState()
+		fe := environment(node, testnet.TestDealStreamParams{
+			PeerID:         peer.ID("client"),
+			ProposalReader: testnet.StubbedDealProposalReader(proposal),
+			ResponseWriter: testnet.ExpectDealResponseWriter(t, expectedDealResponse),
+		})
+		fe.ExpectParams(defaultPricePerByte, defaultCurrentInterval, defaultIntervalIncrease, noUnsealPrice, false, nil)
+		fe.decider = func(_ context.Context, received retrievalmarket.DealProposal, client peer.ID) (retrievalmarket.DealDecision, string, error) {
+			require.Equal(t, proposal, received)
+			require.Equal(t, peer.ID("client"), client)
+			return decision, reason, err
+		}
+		f := providerstates.ReceiveDeal(ctx, fe, *dealState)
+		fe.VerifyExpectations(t)
+		node.VerifyExpectations(t)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, dealState.DealProposal, proposal)
+		return dealState
+	}
+
+	t.Run("decider accepts", func(t *testing.T) {
+		dealState := decide(t, retrievalmarket.DealDecisionAccept, "", nil, retrievalmarket.DealResponse{
+			Status: retrievalmarket.DealStatusAccepted,
+			ID:     proposal.ID,
+		})
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusAccepted)
+		require.Empty(t, dealState.Message)
+	})
+
+	t.Run("decider rejects", func(t *testing.T) {
+		dealState := decide(t, retrievalmarket.DealDecisionReject, "not on allowlist", nil, retrievalmarket.DealResponse{
+			Status:  retrievalmarket.DealStatusRejected,
+			ID:      proposal.ID,
+			Message: "not on allowlist",
+		})
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusRejected)
+		require.Equal(t, dealState.Message, "not on allowlist")
+	})
+
+	t.Run("decider defers", func(t *testing.T) {
+		dealState := decide(t, retrievalmarket.DealDecisionDefer, "waiting for review", nil, retrievalmarket.DealResponse{
+			Status:  retrievalmarket.DealStatusDeferred,
+			ID:      proposal.ID,
+			Message: "waiting for review",
+		})
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusDeferred)
+		require.Equal(t, dealState.Message, "waiting for review")
+	})
+
+	t.Run("decider errors", func(t *testing.T) {
+		dealState := decide(t, retrievalmarket.DealDecisionAccept, "", errors.New("policy unavailable"), retrievalmarket.DealResponse{
+			Status:  retrievalmarket.DealStatusFailed,
+			ID:      proposal.ID,
+			Message: "policy unavailable",
+		})
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
+	})
+}
+
+func TestReconsiderDeal(t *testing.T) {
+	ctx := context.Background()
+
+	environment := func(decision retrievalmarket.DealDecision, reason string, responseWriter testnet.DealResponseWriter) *testProviderDealEnvironment {
+		node := testnodes.NewTestRetrievalProviderNode()
+		fe := NewTestProviderDealEnvironment(node, testnet.NewTestRetrievalDealStream(testnet.TestDealStreamParams{
+			ResponseWriter: responseWriter,
+		}), nil)
+		fe.decider = func(context.Context, retrievalmarket.DealProposal, peer.ID) (retrievalmarket.DealDecision, string, error) {
+			return decision, reason, nil
+		}
+		return fe
+	}
+	reconsiderIn := func(t *testing.T, fe *testProviderDealEnvironment) *retrievalmarket.ProviderDealState {
+		dealState := makeDealState(retrievalmarket.DealStatusDeferred)
+		dealState.Message = "waiting for review"
+		f := providerstates.ReconsiderDeal(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
+		return dealState
+	}
+	reconsider := func(t *testing.T, decision retrievalmarket.DealDecision, reason string, responseWriter testnet.DealResponseWriter) *retrievalmarket.ProviderDealState {
+		return reconsiderIn(t, environment(decision, reason, responseWriter))
+	}
+
+	t.Run("accepts", func(t *testing.T) {
+		dealState := reconsider(t, retrievalmarket.DealDecisionAccept, "", testnet.ExpectDealResponseWriter(t, retrievalmarket.DealResponse{
+			Status: retrievalmarket.DealStatusAccepted,
+			ID:     retrievalmarket.DealID(10),
+		}))
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusAccepted)
+		require.Empty(t, dealState.Message)
+	})
+
+	t.Run("rejects", func(t *testing.T) {
+		dealState := reconsider(t, retrievalmarket.DealDecisionReject, "not on allowlist", testnet.ExpectDealResponseWriter(t, retrievalmarket.DealResponse{
+			Status:  retrievalmarket.DealStatusRejected,
+			ID:      retrievalmarket.DealID(10),
+			Message: "not on allowlist",
+		}))
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusRejected)
+		require.Equal(t, dealState.Message, "not on allowlist")
+	})
+
+	t.Run("defers again without telling the client", func(t *testing.T) {
+		dealState := reconsider(t, retrievalmarket.DealDecisionDefer, "still waiting", testnet.FailDealResponseWriter)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusDeferred)
+		require.Equal(t, dealState.Message, "still waiting")
+	})
+
+	t.Run("rejects once the deadline has passed", func(t *testing.T) {
+		fe := environment(retrievalmarket.DealDecisionDefer, "still waiting", testnet.ExpectDealResponseWriter(t, retrievalmarket.DealResponse{
+			Status:  retrievalmarket.DealStatusRejected,
+			ID:      retrievalmarket.DealID(10),
+			Message: "deal was deferred for too long",
+		}))
+		fe.deadline = time.Now()
+		dealState := reconsiderIn(t, fe)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusRejected)
+	})
+
+	t.Run("stops when the client cancels", func(t *testing.T) {
+		fe := environment(retrievalmarket.DealDecisionDefer, "still waiting", testnet.FailDealResponseWriter)
+		fe.cancelled = make(chan struct{})
+		close(fe.cancelled)
+		dealState := reconsiderIn(t, fe)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusCancelled)
+	})
+
+	t.Run("stops when the client disconnects", func(t *testing.T) {
+		fe := environment(retrievalmarket.DealDecisionDefer, "still waiting", testnet.FailDealResponseWriter)
+		fe.disconnected = make(chan struct{})
+		close(fe.disconnected)
+		dealState := reconsiderIn(t, fe)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
+		require.Equal(t, dealState.Message, "client disconnected while deal was deferred")
+	})
 }
 
 func TestSendBlocks(t *testing.T) {
@@ -166,7 +407,7 @@ func TestSendBlocks(t *testing.T) {
 			ResponseWriter: testnet.ExpectDealResponseWriter(t, expectedDealResponse),
 		}, responses)
 		f := providerstates.SendBlocks(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFundsNeeded)
 		require.Equal(t, dealState.TotalSent, defaultTotalSent+defaultCurrentInterval)
 		require.Empty(t, dealState.Message)
@@ -185,12 +426,65 @@ func TestSendBlocks(t *testing.T) {
 			ResponseWriter: testnet.ExpectDealResponseWriter(t, expectedDealResponse),
 		}, responses)
 		f := providerstates.SendBlocks(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFundsNeededLastPayment)
 		require.Equal(t, dealState.TotalSent, defaultTotalSent+defaultCurrentInterval)
 		require.Empty(t, dealState.Message)
 	})
 
+	t.Run("sends blocks the client lost again without charging twice", func(t *testing.T) {
+		blocks, responses := generateResponses(13, 100, false, false)
+		dealState := makeDealState(retrievalmarket.DealStatusAccepted)
+		dealState.Resend = 300
+		expectedDealResponse := retrievalmarket.DealResponse{
+			Status:      retrievalmarket.DealStatusFundsNeeded,
+			PaymentOwed: defaultPaymentPerInterval,
+			Blocks:      blocks,
+			ID:          dealState.ID,
+		}
+		fe := environment(testnet.TestDealStreamParams{
+			ResponseWriter: testnet.ExpectDealResponseWriter(t, expectedDealResponse),
+		}, responses)
+		f := providerstates.SendBlocks(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, defaultTotalSent+defaultCurrentInterval, dealState.TotalSent)
+		require.Equal(t, uint64(0), dealState.Resend)
+	})
+
+	t.Run("charges for what was sent but not paid for first", func(t *testing.T) {
+		_, responses := generateResponses(10, 100, false, false)
+		dealState := makeDealState(retrievalmarket.DealStatusAccepted)
+		dealState.FundsReceived = tokenamount.Sub(defaultFundsReceived, defaultPaymentPerInterval)
+		expectedDealResponse := retrievalmarket.DealResponse{
+			Status:      retrievalmarket.DealStatusFundsNeeded,
+			PaymentOwed: defaultPaymentPerInterval,
+			ID:          dealState.ID,
+		}
+		fe := environment(testnet.TestDealStreamParams{
+			ResponseWriter: testnet.ExpectDealResponseWriter(t, expectedDealResponse),
+		}, responses)
+		f := providerstates.SendBlocks(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, retrievalmarket.DealStatusFundsNeeded, dealState.Status)
+		require.Equal(t, defaultTotalSent, dealState.TotalSent)
+		require.Equal(t, 0, fe.nextResponse)
+	})
+
+	t.Run("stops when the client cancels", func(t *testing.T) {
+		_, responses := generateResponses(10, 100, false, false)
+		dealState := makeDealState(retrievalmarket.DealStatusAccepted)
+		fe := environment(testnet.TestDealStreamParams{
+			ResponseWriter: testnet.FailDealResponseWriter,
+		}, responses)
+		fe.cancelled = make(chan struct{})
+		close(fe.cancelled)
+		f := providerstates.SendBlocks(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, retrievalmarket.DealStatusCancelled, dealState.Status)
+		require.Equal(t, defaultTotalSent, dealState.TotalSent)
+		require.Equal(t, 0, fe.nextResponse)
+	})
+
 	t.Run("error reading a block", func(t *testing.T) {
 		_, responses := generateResponses(10, 100, false, true)
 		dealState := makeDealState(retrievalmarket.DealStatusAccepted)
@@ -203,7 +497,7 @@ func TestSendBlocks(t *testing.T) {
 			ResponseWriter: testnet.ExpectDealResponseWriter(t, expectedDealResponse),
 		}, responses)
 		f := providerstates.SendBlocks(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
 		require.NotEmpty(t, dealState.Message)
 	})
@@ -215,10 +509,133 @@ func TestSendBlocks(t *testing.T) {
 			ResponseWriter: testnet.FailDealResponseWriter,
 		}, responses)
 		f := providerstates.SendBlocks(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
+		require.NotEmpty(t, dealState.Message)
+	})
+}
+
+func TestProcessUnsealPayment(t *testing.T) {
+	ctx := context.Background()
+
+	environment := func(node retrievalmarket.RetrievalProviderNode, params testnet.TestDealStreamParams) *testProviderDealEnvironment {
+		ds := testnet.NewTestRetrievalDealStream(params)
+		return NewTestProviderDealEnvironment(node, ds, nil)
+	}
+
+	unsealingDealState := func() *retrievalmarket.ProviderDealState {
+		dealState := makeDealState(retrievalmarket.DealStatusUnsealing)
+		dealState.TotalSent = 0
+		dealState.FundsReceived = tokenamount.FromInt(0)
+		dealState.UnsealPrice = defaultUnsealPrice
+		return dealState
+	}
+
+	payCh := address.TestAddress
+	voucher := testnet.MakeTestSignedVoucher()
+	t.Run("it works", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		err := node.ExpectVoucher(payCh, voucher, nil, defaultUnsealPrice, defaultUnsealPrice, nil)
+		require.NoError(t, err)
+		dealState := unsealingDealState()
+		fe := environment(node, testnet.TestDealStreamParams{
+			ResponseWriter: testnet.ExpectDealResponseWriter(t, rm.DealResponse{
+				ID:          dealState.ID,
+				Status:      retrievalmarket.DealStatusUnsealing,
+				PaymentOwed: defaultUnsealPrice,
+			}),
+			PaymentReader: testnet.StubbedDealPaymentReader(retrievalmarket.DealPayment{
+				ID:             dealState.ID,
+				PaymentChannel: payCh,
+				PaymentVoucher: voucher,
+			}),
+		})
+		f := providerstates.ProcessUnsealPayment(ctx, fe, *dealState)
+		node.VerifyExpectations(t)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusAccepted)
+		require.Equal(t, dealState.FundsReceived, defaultUnsealPrice)
+		require.Empty(t, dealState.Message)
+	})
+
+	t.Run("not enough funds sent", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		smallerPayment := tokenamount.FromInt(40000)
+		err := node.ExpectVoucher(payCh, voucher, nil, defaultUnsealPrice, smallerPayment, nil)
+		require.NoError(t, err)
+		dealState := unsealingDealState()
+		fe := environment(node, testnet.TestDealStreamParams{
+			ResponseWriter: testnet.ExpectDealResponseWriter(t, rm.DealResponse{
+				ID:          dealState.ID,
+				Status:      retrievalmarket.DealStatusUnsealing,
+				PaymentOwed: defaultUnsealPrice,
+			}),
+			PaymentReader: testnet.StubbedDealPaymentReader(retrievalmarket.DealPayment{
+				ID:             dealState.ID,
+				PaymentChannel: payCh,
+				PaymentVoucher: voucher,
+			}),
+		})
+		f := providerstates.ProcessUnsealPayment(ctx, fe, *dealState)
+		node.VerifyExpectations(t)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusUnsealing)
+		require.Equal(t, dealState.FundsReceived, smallerPayment)
+		require.Empty(t, dealState.Message)
+	})
+
+	t.Run("failure processing payment", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		message := "your money's no good here"
+		err := node.ExpectVoucher(payCh, voucher, nil, defaultUnsealPrice, tokenamount.FromInt(0), errors.New(message))
+		require.NoError(t, err)
+		dealState := unsealingDealState()
+		fe := environment(node, testnet.TestDealStreamParams{
+			ResponseWriter: testnet.ExpectDealResponsesWriter(t, rm.DealResponse{
+				ID:          dealState.ID,
+				Status:      retrievalmarket.DealStatusUnsealing,
+				PaymentOwed: defaultUnsealPrice,
+			}, rm.DealResponse{
+				ID:      dealState.ID,
+				Status:  retrievalmarket.DealStatusFailed,
+				Message: message,
+			}),
+			PaymentReader: testnet.StubbedDealPaymentReader(retrievalmarket.DealPayment{
+				ID:             dealState.ID,
+				PaymentChannel: payCh,
+				PaymentVoucher: voucher,
+			}),
+		})
+		f := providerstates.ProcessUnsealPayment(ctx, fe, *dealState)
+		node.VerifyExpectations(t)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
+		require.NotEmpty(t, dealState.Message)
+	})
+
+	t.Run("failure writing response", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		dealState := unsealingDealState()
+		fe := environment(node, testnet.TestDealStreamParams{
+			ResponseWriter: testnet.FailDealResponseWriter,
+		})
+		f := providerstates.ProcessUnsealPayment(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
 		require.NotEmpty(t, dealState.Message)
 	})
+
+	t.Run("deal cancelled by client", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		dealState := unsealingDealState()
+		fe := environment(node, testnet.TestDealStreamParams{
+			PaymentReader: testnet.CancelledDealPaymentReader,
+		})
+		f := providerstates.ProcessUnsealPayment(ctx, fe, *dealState)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusCancelled)
+		require.NotEmpty(t, dealState.Message)
+	})
 }
 
 func TestProcessPayment(t *testing.T) {
@@ -247,7 +664,7 @@ func TestProcessPayment(t *testing.T) {
 		})
 		f := providerstates.ProcessPayment(ctx, fe, *dealState)
 		node.VerifyExpectations(t)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusOngoing)
 		require.Equal(t, dealState.FundsReceived, tokenamount.Add(defaultFundsReceived, defaultPaymentPerInterval))
 		require.Equal(t, dealState.CurrentInterval, defaultCurrentInterval+defaultIntervalIncrease)
@@ -269,13 +686,36 @@ func TestProcessPayment(t *testing.T) {
 		})
 		f := providerstates.ProcessPayment(ctx, fe, *dealState)
 		node.VerifyExpectations(t)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusCompleted)
 		require.Equal(t, dealState.FundsReceived, tokenamount.Add(defaultFundsReceived, defaultPaymentPerInterval))
 		require.Equal(t, dealState.CurrentInterval, defaultCurrentInterval+defaultIntervalIncrease)
 		require.Empty(t, dealState.Message)
 	})
 
+	t.Run("it excludes the unseal payment", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		err := node.ExpectVoucher(payCh, voucher, nil, defaultPaymentPerInterval, defaultPaymentPerInterval, nil)
+		require.NoError(t, err)
+		dealState := makeDealState(retrievalmarket.DealStatusFundsNeeded)
+		dealState.TotalSent = defaultTotalSent + defaultCurrentInterval
+		dealState.UnsealPrice = defaultUnsealPrice
+		dealState.FundsReceived = tokenamount.Add(defaultFundsReceived, defaultUnsealPrice)
+		dealPayment := retrievalmarket.DealPayment{
+			ID:             dealState.ID,
+			PaymentChannel: payCh,
+			PaymentVoucher: voucher,
+		}
+		fe := environment(node, testnet.TestDealStreamParams{
+			PaymentReader: testnet.StubbedDealPaymentReader(dealPayment),
+		})
+		f := providerstates.ProcessPayment(ctx, fe, *dealState)
+		node.VerifyExpectations(t)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusOngoing)
+		require.Empty(t, dealState.Message)
+	})
+
 	t.Run("not enough funds sent", func(t *testing.T) {
 		node := testnodes.NewTestRetrievalProviderNode()
 		smallerPayment := tokenamount.FromInt(400000)
@@ -298,7 +738,7 @@ func TestProcessPayment(t *testing.T) {
 		})
 		f := providerstates.ProcessPayment(ctx, fe, *dealState)
 		node.VerifyExpectations(t)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFundsNeeded)
 		require.Equal(t, dealState.FundsReceived, tokenamount.Add(defaultFundsReceived, smallerPayment))
 		require.Equal(t, dealState.CurrentInterval, defaultCurrentInterval)
@@ -327,7 +767,7 @@ func TestProcessPayment(t *testing.T) {
 		})
 		f := providerstates.ProcessPayment(ctx, fe, *dealState)
 		node.VerifyExpectations(t)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
 		require.NotEmpty(t, dealState.Message)
 	})
@@ -340,10 +780,25 @@ func TestProcessPayment(t *testing.T) {
 			PaymentReader: testnet.FailDealPaymentReader,
 		})
 		f := providerstates.ProcessPayment(ctx, fe, *dealState)
-		f(dealState)
+		require.NoError(t, f.Apply(dealState))
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailed)
 		require.NotEmpty(t, dealState.Message)
 	})
+
+	t.Run("deal cancelled by client", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		dealState := makeDealState(retrievalmarket.DealStatusFundsNeeded)
+		dealState.TotalSent = defaultTotalSent + defaultCurrentInterval
+		fe := environment(node, testnet.TestDealStreamParams{
+			PaymentReader: testnet.CancelledDealPaymentReader,
+		})
+		f := providerstates.ProcessPayment(ctx, fe, *dealState)
+		node.VerifyExpectations(t)
+		require.NoError(t, f.Apply(dealState))
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusCancelled)
+		require.Equal(t, dealState.FundsReceived, defaultFundsReceived)
+		require.NotEmpty(t, dealState.Message)
+	})
 }
 
 type readBlockResponse struct {
@@ -356,6 +811,8 @@ type dealParamsKey struct {
 	pricePerByte            string
 	paymentInterval         uint64
 	paymentIntervalIncrease uint64
+	unsealPrice             string
+	unsealed                bool
 }
 
 type testProviderDealEnvironment struct {
@@ -365,19 +822,26 @@ type testProviderDealEnvironment struct {
 	responses      []readBlockResponse
 	expectedParams map[dealParamsKey]error
 	receivedParams map[dealParamsKey]struct{}
+	decider        retrievalmarket.RetrievalDealDecider
+	cancelled      chan struct{}
+	disconnected   chan struct{}
+	deadline       time.Time
+	previous       *retrievalmarket.ProviderDealState
 }
 
 func NewTestProviderDealEnvironment(node retrievalmarket.RetrievalProviderNode,
 	ds rmnet.RetrievalDealStream,
 	responses []readBlockResponse) *testProviderDealEnvironment {
-	return &testProviderDealEnvironment{node, ds, 0, responses, make(map[dealParamsKey]error), make(map[dealParamsKey]struct{})}
+	return &testProviderDealEnvironment{node, ds, 0, responses, make(map[dealParamsKey]error), make(map[dealParamsKey]struct{}), nil, nil, nil, time.Now().Add(time.Hour), nil}
 }
 
 func (te *testProviderDealEnvironment) ExpectParams(pricePerByte tokenamount.TokenAmount,
 	paymentInterval uint64,
 	paymentIntervalIncrease uint64,
+	unsealPrice tokenamount.TokenAmount,
+	unsealed bool,
 	response error) {
-	te.expectedParams[dealParamsKey{pricePerByte.String(), paymentInterval, paymentIntervalIncrease}] = response
+	te.expectedParams[dealParamsKey{pricePerByte.String(), paymentInterval, paymentIntervalIncrease, unsealPrice.String(), unsealed}] = response
 }
 
 func (te *testProviderDealEnvironment) VerifyExpectations(t *testing.T) {
@@ -392,8 +856,8 @@ func (te *testProviderDealEnvironment) DealStream() rmnet.RetrievalDealStream {
 	return te.ds
 }
 
-func (te *testProviderDealEnvironment) CheckDealParams(pricePerByte tokenamount.TokenAmount, paymentInterval uint64, paymentIntervalIncrease uint64) error {
-	key := dealParamsKey{pricePerByte.String(), paymentInterval, paymentIntervalIncrease}
+func (te *testProviderDealEnvironment) CheckDealParams(pricePerByte tokenamount.TokenAmount, paymentInterval uint64, paymentIntervalIncrease uint64, unsealPrice tokenamount.TokenAmount, unsealed bool) error {
+	key := dealParamsKey{pricePerByte.String(), paymentInterval, paymentIntervalIncrease, unsealPrice.String(), unsealed}
 	err, ok := te.expectedParams[key]
 	if !ok {
 		return errors.New("Something went wrong")
@@ -402,6 +866,36 @@ func (te *testProviderDealEnvironment) CheckDealParams(pricePerByte tokenamount.
 	return err
 }
 
+func (te *testProviderDealEnvironment) DecideDeal(ctx context.Context, proposal rm.DealProposal) (rm.DealDecision, string, error) {
+	if te.decider == nil {
+		return rm.DealDecisionAccept, "", nil
+	}
+	return te.decider(ctx, proposal, te.ds.Receiver())
+}
+
+func (te *testProviderDealEnvironment) DecisionRetryInterval() time.Duration {
+	return time.Millisecond
+}
+
+func (te *testProviderDealEnvironment) DecisionDeadline() time.Time {
+	return te.deadline
+}
+
+func (te *testProviderDealEnvironment) Cancelled() <-chan struct{} {
+	return te.cancelled
+}
+
+func (te *testProviderDealEnvironment) Disconnected() <-chan struct{} {
+	return te.disconnected
+}
+
+func (te *testProviderDealEnvironment) ResumedDeal(proposal rm.DealProposal) (rm.ProviderDealState, bool, error) {
+	if te.previous == nil {
+		return rm.ProviderDealState{}, false, nil
+	}
+	return *te.previous, true, nil
+}
+
 func (te *testProviderDealEnvironment) NextBlock(_ context.Context) (rm.Block, bool, error) {
 	if te.nextResponse >= len(te.responses) {
 		return rm.EmptyBlock, false, errors.New("Something went wrong")
@@ -417,6 +911,8 @@ var defaultPricePerByte = tokenamount.FromInt(500)
 var defaultPaymentPerInterval = tokenamount.Mul(defaultPricePerByte, tokenamount.FromInt(defaultCurrentInterval))
 var defaultTotalSent = uint64(5000)
 var defaultFundsReceived = tokenamount.FromInt(2500000)
+var noUnsealPrice = tokenamount.FromInt(0)
+var defaultUnsealPrice = tokenamount.FromInt(100000)
 
 func makeDealState(status retrievalmarket.DealStatus) *retrievalmarket.ProviderDealState {
 	return &retrievalmarket.ProviderDealState{
@@ -430,6 +926,7 @@ func makeDealState(status retrievalmarket.DealStatus) *retrievalmarket.ProviderD
 				PricePerByte:            defaultPricePerByte,
 				PaymentInterval:         defaultCurrentInterval,
 				PaymentIntervalIncrease: defaultIntervalIncrease,
+				UnsealPrice:             noUnsealPrice,
 			},
 		},
 	}
@@ -461,3 +958,38 @@ func generateResponses(count uint64, blockSize uint64, completeOnLast bool, erro
 	}
 	return blocks, responses
 }
+
+func TestStateEntries(t *testing.T) {
+	for _, transition := range providerstates.ProviderDeals.Transitions() {
+		if providerstates.ProviderDeals.IsFinal(transition.To) {
+			continue
+		}
+		_, ok := providerstates.StateEntries[rm.DealStatus(transition.To)]
+		require.True(t, ok, "no handler for status %d, entered by %s", transition.To, transition.Event)
+	}
+}
+
+func TestProviderDealUpdate_Apply(t *testing.T) {
+	received := tokenamount.FromInt(10)
+	update := func(event string) providerstates.ProviderDealUpdate {
+		return providerstates.ProviderDealUpdate{Event: event, Mutate: func(deal *rm.ProviderDealState) {
+			deal.FundsReceived = received
+		}}
+	}
+
+	deal := &rm.ProviderDealState{Status: rm.DealStatusFundsNeeded}
+	require.NoError(t, update("partlyPaid").Apply(deal))
+	require.Equal(t, rm.DealStatusFundsNeeded, deal.Status)
+	require.Equal(t, received, deal.FundsReceived)
+
+	require.NoError(t, update("paid").Apply(deal))
+	require.Equal(t, rm.DealStatusOngoing, deal.Status)
+
+	deal = &rm.ProviderDealState{Status: rm.DealStatusNew, FundsReceived: tokenamount.FromInt(0)}
+	require.True(t, xerrors.Is(update("paid").Apply(deal), fsm.ErrIllegalTransition))
+	require.Equal(t, rm.DealStatusNew, deal.Status)
+	require.Equal(t, tokenamount.FromInt(0), deal.FundsReceived, "an update that can't happen changes nothing")
+
+	deal = &rm.ProviderDealState{Status: rm.DealStatusCompleted}
+	require.Error(t, update("failed").Apply(deal))
+}
@@ -0,0 +1,255 @@
+package retrievalimpl
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
+)
+
+// queriedPeer is a provider's answer to a query
+type queriedPeer struct {
+	peer     retrievalmarket.RetrievalPeer
+	response retrievalmarket.QueryResponse
+	latency  time.Duration
+}
+
+// offer is a provider's answer to a query, priced for one of the items queried,
+// as a candidate for a retrieval deal
+type offer struct {
+	queriedPeer
+	price tokenamount.TokenAmount
+}
+
+// RetrieveBest finds the providers of a payload, queries all of them at once and
+// retrieves from the cheapest offer that fits in totalFunds. Ties go to
+// providers with an unsealed copy, then to the ones that answered fastest. If a
+// deal is rejected, fails or runs out of funds, the next offer that fits in
+// what is left of totalFunds is tried. It blocks until a deal completes, and
+// returns the id of that deal
+func (c *client) RetrieveBest(ctx context.Context, pieceCID []byte, payloadCID cid.Cid, sel ipld.Node, totalFunds tokenamount.TokenAmount, clientWallet address.Address) (retrievalmarket.DealID, error) {
+	dealID, _, err := c.retrieveBest(ctx, pieceCID, payloadCID, sel, totalFunds, clientWallet)
+	return dealID, err
+}
+
+// retrieveBest is RetrieveBest, also returning what every deal it made spent
+func (c *client) retrieveBest(ctx context.Context, pieceCID []byte, payloadCID cid.Cid, sel ipld.Node, totalFunds tokenamount.TokenAmount, clientWallet address.Address) (retrievalmarket.DealID, tokenamount.TokenAmount, error) {
+	spent := tokenamount.FromInt(0)
+	item, err := retrievalmarket.NewQueryItem(payloadCID, sel)
+	if err != nil {
+		return 0, spent, err
+	}
+
+	peers := c.FindProviders(payloadCID)
+	if len(peers) == 0 {
+		return 0, spent, xerrors.Errorf("no providers found for %s", payloadCID)
+	}
+	queried := c.queryPeers(ctx, peers, pieceCID, []retrievalmarket.QueryItem{item})
+	offers := offersFor(queried, 0, totalFunds)
+	if len(offers) == 0 {
+		return 0, spent, xerrors.Errorf("none of %d providers can serve %s within %s", len(peers), payloadCID, totalFunds)
+	}
+
+	outcomes := newDealOutcomes()
+	unsubscribe := c.SubscribeToEvents(outcomes.record)
+	defer unsubscribe()
+
+	remaining := totalFunds
+	var lastErr error
+	for _, o := range offers {
+		if o.price.GreaterThan(remaining) {
+			continue
+		}
+		dealID, state, err := c.retrieveOffer(ctx, outcomes, pieceCID, payloadCID, sel, o, remaining, clientWallet)
+		if err != nil {
+			return dealID, spent, err
+		}
+		remaining = tokenamount.Sub(remaining, state.FundsSpent)
+		spent = tokenamount.Sub(totalFunds, remaining)
+		if retrievalmarket.IsTerminalSuccess(state.Status) {
+			return dealID, spent, nil
+		}
+		if state.Status == retrievalmarket.DealStatusCancelled {
+			return dealID, spent, xerrors.Errorf("deal %d was cancelled", dealID)
+		}
+		log.Warnf("retrieving %s from %s failed, trying next provider: %s", payloadCID, o.peer.ID, state.Message)
+		lastErr = xerrors.Errorf("deal %d with %s: %s", dealID, o.peer.ID, state.Message)
+	}
+	if lastErr == nil {
+		return 0, spent, xerrors.Errorf("no offers for %s within %s", payloadCID, totalFunds)
+	}
+	return 0, spent, xerrors.Errorf("no more offers within the funds left, last: %w", lastErr)
+}
+
+// retrieveOffer makes a deal on the terms of an offer and waits for it to
+// finish. A deal that runs out of funds is cancelled, and reported as failed so
+// the caller can fall back to another offer
+func (c *client) retrieveOffer(ctx context.Context, outcomes *dealOutcomes, pieceCID []byte, payloadCID cid.Cid, sel ipld.Node, o offer, totalFunds tokenamount.TokenAmount, clientWallet address.Address) (retrievalmarket.DealID, retrievalmarket.ClientDealState, error) {
+	params, err := retrievalmarket.NewParamsV1(o.response.MinPricePerByte.Int, o.response.MaxPaymentInterval, o.response.MaxPaymentIntervalIncrease, payloadCID, sel)
+	if err != nil {
+		return 0, retrievalmarket.ClientDealState{}, err
+	}
+	params.UnsealPrice = o.response.UnsealPrice
+
+	dealID := c.Retrieve(ctx, pieceCID, params, totalFunds, o.peer.ID, clientWallet, o.response.PaymentAddress)
+	state, err := outcomes.wait(ctx, dealID)
+	if err != nil || retrievalmarket.IsTerminalStatus(state.Status) {
+		return dealID, state, err
+	}
+
+	// the deal is paused waiting for more funds than it was given
+	if err := c.CancelDeal(dealID); err != nil {
+		log.Warnf("cancelling deal %d, which ran out of funds: %s", dealID, err)
+	}
+	state, err = outcomes.wait(ctx, dealID)
+	if err != nil {
+		return dealID, state, err
+	}
+	state.Status = retrievalmarket.DealStatusFailed
+	state.Message = fmt.Sprintf("ran out of funds after spending %s", state.FundsSpent)
+	return dealID, state, nil
+}
+
+// queryPeers queries every peer about the items at once, and returns the
+// answers of the peers that have the piece
+func (c *client) queryPeers(ctx context.Context, peers []retrievalmarket.RetrievalPeer, pieceCID []byte, items []retrievalmarket.QueryItem) []queriedPeer {
+	params := retrievalmarket.QueryParams{Items: items}
+	results := make([]*queriedPeer, len(peers))
+
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p retrievalmarket.RetrievalPeer) {
+			defer wg.Done()
+			start := time.Now()
+			response, err := c.Query(ctx, p, pieceCID, params)
+			if err != nil {
+				log.Warnf("querying %s: %s", p.ID, err)
+				return
+			}
+			if response.Status != retrievalmarket.QueryResponseAvailable {
+				return
+			}
+			results[i] = &queriedPeer{peer: p, response: response, latency: time.Since(start)}
+		}(i, p)
+	}
+	wg.Wait()
+
+	var queried []queriedPeer
+	for _, qp := range results {
+		if qp != nil {
+			queried = append(queried, *qp)
+		}
+	}
+	return queried
+}
+
+// offersFor prices the answers of queried peers for the item at the given
+// index, and returns the offers that can serve it within totalFunds, best first
+func offersFor(queried []queriedPeer, item int, totalFunds tokenamount.TokenAmount) []offer {
+	var offers []offer
+	for _, qp := range queried {
+		price, ok := itemPrice(qp.response, item)
+		if ok && !price.GreaterThan(totalFunds) {
+			offers = append(offers, offer{queriedPeer: qp, price: price})
+		}
+	}
+	sort.SliceStable(offers, func(i, j int) bool {
+		return betterOffer(offers[i], offers[j])
+	})
+	return offers
+}
+
+// betterOffer ranks offers by price, then by whether the provider has an
+// unsealed copy, then by how fast the provider answered
+func betterOffer(a, b offer) bool {
+	if cmp := tokenamount.Cmp(a.price, b.price); cmp != 0 {
+		return cmp < 0
+	}
+	if a.response.Unsealed != b.response.Unsealed {
+		return a.response.Unsealed
+	}
+	return a.latency < b.latency
+}
+
+// itemPrice is the expected price of retrieving the item at the given index, or
+// false if the provider can't serve it. Items the provider can't size are priced
+// as the whole piece
+func itemPrice(response retrievalmarket.QueryResponse, item int) (tokenamount.TokenAmount, bool) {
+	if item >= len(response.Items) {
+		return response.PieceRetrievalPrice(), true
+	}
+	switch response.Items[item].Status {
+	case retrievalmarket.QueryItemUnavailable:
+		return tokenamount.TokenAmount{}, false
+	case retrievalmarket.QueryItemAvailable:
+		return tokenamount.Add(tokenamount.Mul(response.MinPricePerByte, tokenamount.FromInt(response.Items[item].Size)), response.UnsealPrice), true
+	default:
+		return response.PieceRetrievalPrice(), true
+	}
+}
+
+// dealOutcomes collects the final states of deals from client events, so
+// callers can wait for deals to finish. A deal that runs out of funds is
+// reported as it pauses, then again when it finishes
+type dealOutcomes struct {
+	lk       sync.Mutex
+	finished map[retrievalmarket.DealID]retrievalmarket.ClientDealState
+	waiting  map[retrievalmarket.DealID]chan retrievalmarket.ClientDealState
+}
+
+func newDealOutcomes() *dealOutcomes {
+	return &dealOutcomes{
+		finished: make(map[retrievalmarket.DealID]retrievalmarket.ClientDealState),
+		waiting:  make(map[retrievalmarket.DealID]chan retrievalmarket.ClientDealState),
+	}
+}
+
+func (do *dealOutcomes) record(event retrievalmarket.ClientEvent, state retrievalmarket.ClientDealState) {
+	switch event {
+	case retrievalmarket.ClientEventComplete, retrievalmarket.ClientEventError, retrievalmarket.ClientEventCancelled,
+		retrievalmarket.ClientEventFundsExpended:
+	default:
+		return
+	}
+	do.lk.Lock()
+	defer do.lk.Unlock()
+	if waiter, ok := do.waiting[state.ID]; ok {
+		delete(do.waiting, state.ID)
+		waiter <- state
+		return
+	}
+	do.finished[state.ID] = state
+}
+
+// wait returns the final state of a deal once it finishes
+func (do *dealOutcomes) wait(ctx context.Context, id retrievalmarket.DealID) (retrievalmarket.ClientDealState, error) {
+	do.lk.Lock()
+	if state, ok := do.finished[id]; ok {
+		delete(do.finished, id)
+		do.lk.Unlock()
+		return state, nil
+	}
+	waiter := make(chan retrievalmarket.ClientDealState, 1)
+	do.waiting[id] = waiter
+	do.lk.Unlock()
+
+	select {
+	case state := <-waiter:
+		return state, nil
+	case <-ctx.Done():
+		do.lk.Lock()
+		delete(do.waiting, id)
+		do.lk.Unlock()
+		return retrievalmarket.ClientDealState{}, ctx.Err()
+	}
+}
@@ -0,0 +1,191 @@
+package retrievalimpl
+
+import (
+	"context"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/blockio"
+	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
+)
+
+// RetrieveSwarm retrieves a whole payload in parts from several providers at
+// once. Unless the client already has it, the root block is retrieved first, on
+// its own. The links in the root are then shared out between at most parts
+// parts, each retrieved in its own deal: the root, and the whole DAG under each
+// of the part's links. A link another part already has, or whose DAG the client
+// already has, is left out, so only the root is retrieved in more than one deal.
+//
+// Each deal is funded with the price the provider quoted for its part, plus an
+// even share of what totalFunds has left over the quotes, as quotes are only
+// estimates. Parts go to the best provider that can serve them and has the
+// fewest parts so far, and fall back to the other providers if a deal fails or
+// runs out of funds, as long as what is left of totalFunds covers them. It
+// blocks until every part is retrieved or has failed, and returns the ids of
+// the deals that retrieved the root and each part
+func (c *client) RetrieveSwarm(ctx context.Context, pieceCID []byte, payloadCID cid.Cid, parts int, totalFunds tokenamount.TokenAmount, clientWallet address.Address) ([]retrievalmarket.DealID, error) {
+	if parts < 1 {
+		return nil, xerrors.New("no parts to retrieve")
+	}
+
+	var dealIDs []retrievalmarket.DealID
+	has, err := c.bs.Has(payloadCID)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		dealID, spent, err := c.retrieveBest(ctx, pieceCID, payloadCID, blockio.RootSelector(), totalFunds, clientWallet)
+		if err != nil {
+			return nil, xerrors.Errorf("root of %s: %w", payloadCID, err)
+		}
+		dealIDs = append(dealIDs, dealID)
+		totalFunds = tokenamount.Sub(totalFunds, spent)
+	}
+
+	sels, err := blockio.SplitSelectors(ctx, c.bs, payloadCID, parts)
+	if err != nil {
+		return dealIDs, xerrors.Errorf("splitting %s: %w", payloadCID, err)
+	}
+	if len(sels) == 0 {
+		return dealIDs, nil
+	}
+	partIDs, err := c.retrieveParts(ctx, pieceCID, payloadCID, sels, totalFunds, clientWallet)
+	return append(dealIDs, partIDs...), err
+}
+
+// retrieveParts retrieves each part of a payload matching one of the selectors
+// in its own deal, and returns the id of the deal that retrieved each part
+func (c *client) retrieveParts(ctx context.Context, pieceCID []byte, payloadCID cid.Cid, parts []ipld.Node, totalFunds tokenamount.TokenAmount, clientWallet address.Address) ([]retrievalmarket.DealID, error) {
+	items := make([]retrievalmarket.QueryItem, len(parts))
+	for i, part := range parts {
+		item, err := retrievalmarket.NewQueryItem(payloadCID, part)
+		if err != nil {
+			return nil, xerrors.Errorf("part %d: %w", i, err)
+		}
+		items[i] = item
+	}
+
+	peers := c.FindProviders(payloadCID)
+	if len(peers) == 0 {
+		return nil, xerrors.Errorf("no providers found for %s", payloadCID)
+	}
+	queried := c.queryPeers(ctx, peers, pieceCID, items)
+
+	partOffers := make([][]offer, len(parts))
+	assigned := make(map[peer.ID]int)
+	quoted := tokenamount.FromInt(0)
+	for i := range parts {
+		offers := offersFor(queried, i, totalFunds)
+		if len(offers) == 0 {
+			return nil, xerrors.Errorf("none of %d providers can serve part %d of %s within %s", len(peers), i, payloadCID, totalFunds)
+		}
+		spreadOffers(offers, assigned)
+		assigned[offers[0].peer.ID]++
+		quoted = tokenamount.Add(quoted, offers[0].price)
+		partOffers[i] = offers
+	}
+	if quoted.GreaterThan(totalFunds) {
+		return nil, xerrors.Errorf("retrieving %d parts of %s costs %s, more than %s", len(parts), payloadCID, quoted, totalFunds)
+	}
+	slack := tokenamount.Sub(totalFunds, quoted)
+	margin := tokenamount.Div(slack, tokenamount.FromInt(uint64(len(parts))))
+	budget := &swarmBudget{remaining: tokenamount.Sub(slack, tokenamount.Mul(margin, tokenamount.FromInt(uint64(len(parts)))))}
+
+	outcomes := newDealOutcomes()
+	unsubscribe := c.SubscribeToEvents(outcomes.record)
+	defer unsubscribe()
+
+	dealIDs := make([]retrievalmarket.DealID, len(parts))
+	errs := make([]error, len(parts))
+	var wg sync.WaitGroup
+	for i := range parts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dealIDs[i], errs[i] = c.retrievePart(ctx, outcomes, budget, margin, pieceCID, payloadCID, parts[i], partOffers[i], clientWallet)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return dealIDs, xerrors.Errorf("part %d of %s: %w", i, payloadCID, err)
+		}
+	}
+	return dealIDs, nil
+}
+
+// spreadOffers moves the best offer from the provider with the fewest parts
+// assigned to the front, keeping the rest in order as fallbacks
+func spreadOffers(offers []offer, assigned map[peer.ID]int) {
+	best := 0
+	for i, o := range offers {
+		if assigned[o.peer.ID] < assigned[offers[best].peer.ID] {
+			best = i
+		}
+	}
+	chosen := offers[best]
+	copy(offers[1:best+1], offers[:best])
+	offers[0] = chosen
+}
+
+// retrievePart retrieves a part from the first of its offers, which is already
+// paid for from the budget along with the margin, falling back to the others
+// while the budget covers them
+func (c *client) retrievePart(ctx context.Context, outcomes *dealOutcomes, budget *swarmBudget, margin tokenamount.TokenAmount, pieceCID []byte, payloadCID cid.Cid, part ipld.Node, offers []offer, clientWallet address.Address) (retrievalmarket.DealID, error) {
+	var lastErr error
+	for i, o := range offers {
+		funds := tokenamount.Add(o.price, margin)
+		if i > 0 && !budget.reserve(funds) {
+			continue
+		}
+		dealID, state, err := c.retrieveOffer(ctx, outcomes, pieceCID, payloadCID, part, o, funds, clientWallet)
+		if err != nil {
+			return dealID, err
+		}
+		budget.release(tokenamount.Sub(funds, state.FundsSpent))
+		if retrievalmarket.IsTerminalSuccess(state.Status) {
+			return dealID, nil
+		}
+		if state.Status == retrievalmarket.DealStatusCancelled {
+			return dealID, xerrors.Errorf("deal %d was cancelled", dealID)
+		}
+		log.Warnf("retrieving part of %s from %s failed, trying next provider: %s", payloadCID, o.peer.ID, state.Message)
+		lastErr = xerrors.Errorf("deal %d with %s: %s", dealID, o.peer.ID, state.Message)
+	}
+	if lastErr == nil {
+		return 0, xerrors.New("no offers within budget")
+	}
+	return 0, xerrors.Errorf("no more offers within budget, last: %w", lastErr)
+}
+
+// swarmBudget tracks the funds a swarm retrieval has left for falling back to
+// other providers
+type swarmBudget struct {
+	lk        sync.Mutex
+	remaining tokenamount.TokenAmount
+}
+
+// reserve takes amount from the budget, or returns false if there isn't enough
+func (sb *swarmBudget) reserve(amount tokenamount.TokenAmount) bool {
+	sb.lk.Lock()
+	defer sb.lk.Unlock()
+	if amount.GreaterThan(sb.remaining) {
+		return false
+	}
+	sb.remaining = tokenamount.Sub(sb.remaining, amount)
+	return true
+}
+
+// release returns funds a deal did not spend to the budget
+func (sb *swarmBudget) release(amount tokenamount.TokenAmount) {
+	sb.lk.Lock()
+	defer sb.lk.Unlock()
+	sb.remaining = tokenamount.Add(sb.remaining, amount)
+}
@@ -9,6 +9,8 @@ import (
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
 	"github.com/filecoin-project/go-fil-markets/shared/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	"github.com/stretchr/testify/require"
 )
@@ -36,8 +38,10 @@ type voucherResult struct {
 
 type TestRetrievalProviderNode struct {
 	bs                    blockstore.Blockstore
+	unsealedBs            blockstore.Blockstore
 	expectedPieces        map[string]uint64
 	expectedMissingPieces map[string]struct{}
+	unsealedPieces        map[string]struct{}
 	receivedPiecesSizes   map[string]struct{}
 	receivedMissingPieces map[string]struct{}
 	expectedVouchers      map[expectedVoucherKey]voucherResult
@@ -48,6 +52,7 @@ func NewTestRetrievalProviderNode() *TestRetrievalProviderNode {
 	return &TestRetrievalProviderNode{
 		expectedPieces:        make(map[string]uint64),
 		expectedMissingPieces: make(map[string]struct{}),
+		unsealedPieces:        make(map[string]struct{}),
 		receivedPiecesSizes:   make(map[string]struct{}),
 		receivedMissingPieces: make(map[string]struct{}),
 		expectedVouchers:      make(map[expectedVoucherKey]voucherResult),
@@ -83,12 +88,51 @@ func (trpn *TestRetrievalProviderNode) GetPieceSize(pieceCid []byte) (uint64, er
 	return 0, errors.New("Something went wrong")
 }
 
+// MarkUnsealed records that the node holds an unsealed copy of a piece
+func (trpn *TestRetrievalProviderNode) MarkUnsealed(pieceCid []byte) {
+	trpn.unsealedPieces[string(pieceCid)] = struct{}{}
+}
+
+func (trpn *TestRetrievalProviderNode) IsUnsealed(pieceCid []byte) (bool, error) {
+	_, ok := trpn.unsealedPieces[string(pieceCid)]
+	return ok, nil
+}
+
 func (trpn *TestRetrievalProviderNode) SetBlockstore(bs blockstore.Blockstore) {
 	trpn.bs = bs
 }
 
+// SetUnsealedBlockstore sets blocks the node serves without unsealing them
+func (trpn *TestRetrievalProviderNode) SetUnsealedBlockstore(bs blockstore.Blockstore) {
+	trpn.unsealedBs = bs
+}
+
+// SealedBlockstore returns the blockstore set with SetBlockstore, which only
+// serves blocks once unsealing is approved, unless they are in the blockstore
+// set with SetUnsealedBlockstore
 func (trpn *TestRetrievalProviderNode) SealedBlockstore(approveUnseal func() error) blockstore.Blockstore {
-	return trpn.bs
+	return &sealedBlockstore{trpn.bs, trpn.unsealedBs, approveUnseal}
+}
+
+type sealedBlockstore struct {
+	blockstore.Blockstore
+	unsealed      blockstore.Blockstore
+	approveUnseal func() error
+}
+
+func (sbs *sealedBlockstore) Get(c cid.Cid) (blocks.Block, error) {
+	if sbs.unsealed != nil {
+		if blk, err := sbs.unsealed.Get(c); err == nil {
+			return blk, nil
+		}
+	}
+	if err := sbs.approveUnseal(); err != nil {
+		return nil, err
+	}
+	if sbs.Blockstore == nil {
+		return nil, blockstore.ErrNotFound
+	}
+	return sbs.Blockstore.Get(c)
 }
 
 func (trpn *TestRetrievalProviderNode) toExpectedVoucherKey(paymentChannel address.Address, voucher *types.SignedVoucher, proof []byte, expectedAmount tokenamount.TokenAmount) (expectedVoucherKey, error) {
@@ -3,13 +3,10 @@ package retrievalimpl
 import (
 	"context"
 
-	"github.com/filecoin-project/go-fil-markets/shared/params"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/blockio"
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
-	ipld "github.com/ipfs/go-ipld-format"
-	"github.com/ipfs/go-merkledag"
-	"github.com/ipfs/go-unixfs"
-	pb "github.com/ipfs/go-unixfs/pb"
 	"golang.org/x/xerrors"
 )
 
@@ -25,116 +22,38 @@ func (o *OptimisticVerifier) Verify(context.Context, blocks.Block) (bool, error)
 	return false, nil
 }
 
+// UnixFs0Verifier verifies the blocks of the whole DAG under Root, in the
+// order a provider sends them. The traversal behind it runs until the context
+// passed to the first Verify is cancelled
+//
+// Deprecated: use blockio.NewSelectorVerifier with blockio.AllSelector
 type UnixFs0Verifier struct {
-	Root    cid.Cid
-	rootBlk blocks.Block
+	Root cid.Cid
 
-	expect int
-	seen   int
-
-	sub *UnixFs0Verifier
+	sv *blockio.SelectorVerifier
 }
 
-func (b *UnixFs0Verifier) verify(ctx context.Context, blk blocks.Block) (last bool, internal bool, err error) {
-	if b.sub != nil {
-		// TODO: check links here (iff b.sub.sub == nil)
-
-		subLast, internal, err := b.sub.verify(ctx, blk)
+func (b *UnixFs0Verifier) Verify(ctx context.Context, blk blocks.Block) (bool, error) {
+	if b.sv == nil {
+		sv, err := blockio.NewSelectorVerifier(ctx, b.Root, blockio.AllSelector())
 		if err != nil {
-			return false, false, err
-		}
-		if subLast {
-			b.sub = nil
-			b.seen++
-		}
-
-		return b.seen == b.expect, internal, nil
-	}
-
-	if b.seen >= b.expect { // this is probably impossible
-		return false, false, xerrors.New("unixfs verifier: too many nodes in level")
-	}
-
-	links, err := b.checkInternal(blk)
-	if err != nil {
-		return false, false, err
-	}
-
-	if links > 0 { // TODO: check if all links are intermediate (or all aren't)
-		if links > params.UnixfsLinksPerLevel {
-			return false, false, xerrors.New("unixfs verifier: too many links in intermediate node")
-		}
-
-		if b.seen+1 == b.expect && links != params.UnixfsLinksPerLevel {
-			return false, false, xerrors.New("unixfs verifier: too few nodes in level")
-		}
-
-		b.sub = &UnixFs0Verifier{
-			Root:    blk.Cid(),
-			rootBlk: blk,
-			expect:  links,
+			return false, err
 		}
-
-		// don't mark as seen yet
-		return false, true, nil
+		b.sv = sv
 	}
-
-	b.seen++
-	return b.seen == b.expect, false, nil
+	return b.sv.Verify(ctx, blk)
 }
 
-func (b *UnixFs0Verifier) checkInternal(blk blocks.Block) (int, error) {
-	nd, err := ipld.Decode(blk)
+// newVerifier returns a verifier for the part of the payload requested in the
+// params: the blocks its selector reaches, or else the whole DAG
+func newVerifier(ctx context.Context, params retrievalmarket.Params) (BlockVerifier, error) {
+	sel, err := blockio.PayloadSelector(params)
 	if err != nil {
-		log.Warnf("IPLD Decode failed: %s", err)
-		return 0, err
-	}
-
-	// TODO: check size
-	switch nd := nd.(type) {
-	case *merkledag.ProtoNode:
-		fsn, err := unixfs.FSNodeFromBytes(nd.Data())
-		if err != nil {
-			log.Warnf("unixfs.FSNodeFromBytes failed: %s", err)
-			return 0, err
-		}
-		if fsn.Type() != pb.Data_File {
-			return 0, xerrors.New("internal nodes must be a file")
-		}
-		if len(fsn.Data()) > 0 {
-			return 0, xerrors.New("internal node with data")
-		}
-		if len(nd.Links()) == 0 {
-			return 0, xerrors.New("internal node with no links")
-		}
-		return len(nd.Links()), nil
-
-	case *merkledag.RawNode:
-		return 0, nil
-	default:
-		return 0, xerrors.New("verifier: unknown node type")
+		return nil, xerrors.Errorf("decoding selector: %w", err)
 	}
-}
-
-func (b *UnixFs0Verifier) Verify(ctx context.Context, blk blocks.Block) (bool, error) {
-	// root is special
-	if b.rootBlk == nil {
-		if !b.Root.Equals(blk.Cid()) {
-			return false, xerrors.Errorf("unixfs verifier: root block CID didn't match: valid %s, got %s", b.Root, blk.Cid())
-		}
-		b.rootBlk = blk
-		links, err := b.checkInternal(blk)
-		if err != nil {
-			return false, err
-		}
-
-		b.expect = links
-		return links != 0, nil
-	}
-
-	done, _, err := b.verify(ctx, blk)
-	return done, err
+	return blockio.NewSelectorVerifier(ctx, params.PayloadCID, sel)
 }
 
 var _ BlockVerifier = &OptimisticVerifier{}
+var _ BlockVerifier = &blockio.SelectorVerifier{}
 var _ BlockVerifier = &UnixFs0Verifier{}
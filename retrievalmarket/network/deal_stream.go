@@ -4,6 +4,7 @@ import (
 	cborutil "github.com/filecoin-project/go-cbor-util"
 	"github.com/libp2p/go-libp2p-core/mux"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 )
@@ -42,17 +43,34 @@ func (d *DealStream) WriteDealResponse(dr retrievalmarket.DealResponse) error {
 	return cborutil.WriteCborRPC(d.rw, &dr)
 }
 
+// ReadDealPayment reads the next payment from the client. A client may send a
+// cancellation in place of a payment, in which case ErrDealCancelled is returned
 func (d *DealStream) ReadDealPayment() (retrievalmarket.DealPayment, error) {
-	var ds retrievalmarket.DealPayment
-
-	if err := ds.UnmarshalCBOR(d.rw); err != nil {
+	var msg retrievalmarket.ClientDealMessage
+	if err := msg.UnmarshalCBOR(d.rw); err != nil {
 		return retrievalmarket.DealPaymentUndefined, err
 	}
-	return ds, nil
+
+	switch {
+	case msg.Cancellation != nil:
+		return retrievalmarket.DealPaymentUndefined, retrievalmarket.ErrDealCancelled
+	case msg.Payment != nil:
+		return *msg.Payment, nil
+	default:
+		return retrievalmarket.DealPaymentUndefined, xerrors.New("client sent neither a payment nor a cancellation")
+	}
 }
 
 func (d *DealStream) WriteDealPayment(dpy retrievalmarket.DealPayment) error {
-	return cborutil.WriteCborRPC(d.rw, &dpy)
+	return cborutil.WriteCborRPC(d.rw, &retrievalmarket.ClientDealMessage{Payment: &dpy})
+}
+
+func (d *DealStream) WriteDealCancellation(dc retrievalmarket.DealCancellation) error {
+	return cborutil.WriteCborRPC(d.rw, &retrievalmarket.ClientDealMessage{Cancellation: &dc})
+}
+
+func (d *DealStream) Receiver() peer.ID {
+	return d.p
 }
 
 func (d *DealStream) Close() error {
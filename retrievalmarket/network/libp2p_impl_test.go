@@ -201,6 +201,55 @@ func TestDealStreamSendReceiveDealPayment(t *testing.T) {
 	assertDealPaymentReceived(ctx, t, fromNetwork, toPeer, dpyChan)
 }
 
+func TestDealStreamSendReceiveDealCancellation(t *testing.T) {
+	// send payment, then cancellation, read both in handler
+	bgCtx := context.Background()
+	td := shared_testutil.NewLibp2pTestData(bgCtx, t)
+	fromNetwork := network.NewFromLibp2pHost(td.Host1)
+	toNetwork := network.NewFromLibp2pHost(td.Host2)
+	toPeer := td.Host2.ID()
+
+	dpyChan := make(chan retrievalmarket.DealPayment, 1)
+	errChan := make(chan error, 1)
+	tr2 := &testReceiver{t: t, dealStreamHandler: func(s network.RetrievalDealStream) {
+		readDpy, err := s.ReadDealPayment()
+		require.NoError(t, err)
+		dpyChan <- readDpy
+
+		_, err = s.ReadDealPayment()
+		errChan <- err
+	}}
+	require.NoError(t, toNetwork.SetDelegate(tr2))
+
+	ctx, cancel := context.WithTimeout(bgCtx, 10*time.Second)
+	defer cancel()
+
+	ds1, err := fromNetwork.NewDealStream(toPeer)
+	require.NoError(t, err)
+
+	dpy := retrievalmarket.DealPayment{
+		ID:             retrievalmarket.DealID(rand.Uint64()),
+		PaymentChannel: address.TestAddress,
+		PaymentVoucher: shared_testutil.MakeTestSignedVoucher(),
+	}
+	require.NoError(t, ds1.WriteDealPayment(dpy))
+	require.NoError(t, ds1.WriteDealCancellation(retrievalmarket.DealCancellation{ID: dpy.ID}))
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("payment not received")
+	case receivedPayment := <-dpyChan:
+		assert.Equal(t, dpy, receivedPayment)
+	}
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("cancellation not received")
+	case err := <-errChan:
+		assert.Equal(t, retrievalmarket.ErrDealCancelled, err)
+	}
+}
+
 func TestDealStreamSendReceiveMultipleSuccessful(t *testing.T) {
 	// send proposal, read in handler, send response back,
 	// read response,
@@ -355,8 +404,13 @@ func assertQueryReceived(inCtx context.Context, t *testing.T, fromNetwork networ
 	require.NoError(t, err)
 
 	// send query to host2
-	cid := testutil.GenerateCids(1)[0]
-	q := retrievalmarket.NewQueryV0(cid.Bytes())
+	cids := testutil.GenerateCids(3)
+	q := retrievalmarket.NewQueryV1(cids[0].Bytes(), retrievalmarket.QueryParams{
+		Items: []retrievalmarket.QueryItem{
+			{PayloadCID: cids[1], Selector: shared_testutil.MakeTestSelector()},
+			{PayloadCID: cids[2], Selector: shared_testutil.MakeTestSelector()},
+		},
+	})
 	require.NoError(t, qs1.WriteQuery(q))
 
 	var inq retrievalmarket.Query
@@ -366,7 +420,7 @@ func assertQueryReceived(inCtx context.Context, t *testing.T, fromNetwork networ
 	case inq = <-qchan:
 	}
 	require.NotNil(t, inq)
-	assert.Equal(t, q.PieceCID, inq.PieceCID)
+	assert.Equal(t, q, inq)
 }
 
 // assertQueryResponseReceived performs the verification that a QueryResponse is received
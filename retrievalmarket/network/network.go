@@ -1,6 +1,8 @@
 package network
 
 import (
+	"time"
+
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/libp2p/go-libp2p-core/peer"
 )
@@ -10,6 +12,8 @@ type RetrievalQueryStream interface {
 	WriteQuery(retrievalmarket.Query) error
 	ReadQueryResponse() (retrievalmarket.QueryResponse, error)
 	WriteQueryResponse(retrievalmarket.QueryResponse) error
+	// SetDeadline sets when reads and writes on the stream time out
+	SetDeadline(time.Time) error
 	Close() error
 }
 
@@ -20,6 +24,8 @@ type RetrievalDealStream interface {
 	WriteDealResponse(retrievalmarket.DealResponse) error
 	ReadDealPayment() (retrievalmarket.DealPayment, error)
 	WriteDealPayment(retrievalmarket.DealPayment) error
+	WriteDealCancellation(retrievalmarket.DealCancellation) error
+	Receiver() peer.ID
 	Close() error
 }
 
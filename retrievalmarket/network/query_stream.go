@@ -1,6 +1,8 @@
 package network
 
 import (
+	"time"
+
 	cborutil "github.com/filecoin-project/go-cbor-util"
 	"github.com/libp2p/go-libp2p-core/mux"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -46,6 +48,10 @@ func (qs *QueryStream) WriteQueryResponse(qr retrievalmarket.QueryResponse) erro
 	return cborutil.WriteCborRPC(qs.rw, &qr)
 }
 
+func (qs *QueryStream) SetDeadline(t time.Time) error {
+	return qs.rw.SetDeadline(t)
+}
+
 func (qs *QueryStream) Close() error {
 	return qs.rw.Close()
 }
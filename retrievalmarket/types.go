@@ -1,35 +1,52 @@
 package retrievalmarket
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"math/big"
+	"time"
 
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
 	"github.com/filecoin-project/go-fil-markets/shared/types"
 	"github.com/ipfs/go-cid"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/encoding/dagcbor"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
 )
 
-//go:generate cbor-gen-for Query QueryResponse DealProposal DealResponse Params QueryParams DealPayment Block ClientDealState
+//go:generate cbor-gen-for Query QueryResponse DealProposal DealResponse Params QueryParams QueryItem QueryItemResponse DealPayment DealCancellation ClientDealMessage Block ClientDealState ProviderDealState PaymentInfo
 
 // type aliases
 // TODO: Remove and use native types or extract for
 // https://github.com/filecoin-project/go-retrieval-market-project/issues/5
 
-// ProtocolID is the protocol for proposing / responding to retrieval deals
-const ProtocolID = "/fil/retrieval/0.0.1"
+// ProtocolID is the protocol for proposing / responding to retrieval deals.
+// 0.1.0 added unseal prices, resumed deals and cancellation to the deal
+// messages, which 0.0.1 peers can't decode. 0.2.0 sends payments and
+// cancellations in a ClientDealMessage
+const ProtocolID = "/fil/retrieval/0.2.0"
 
 // QueryProtocolID is the protocol for querying information about retrieval
-// deal parameters
-const QueryProtocolID = "/fil/retrieval/qry/0.0.1" // TODO: spec
+// deal parameters. 0.1.0 added per-item availability, unsealing and time to
+// first byte to queries, which 0.0.1 peers can't decode
+const QueryProtocolID = "/fil/retrieval/qry/0.1.0" // TODO: spec
 
 // Unsubscribe is a function that unsubscribes a subscriber for either the
 // client or the provider
 type Unsubscribe func()
 
+// PaymentInfo is the payment channel and lane for a deal, once it is setup
+type PaymentInfo struct {
+	PayCh address.Address
+	Lane  uint64
+}
+
 // ClientDealState is the current state of a deal from the point of view
 // of a retrieval client
 type ClientDealState struct {
@@ -38,8 +55,7 @@ type ClientDealState struct {
 	TotalFunds       tokenamount.TokenAmount
 	ClientWallet     address.Address
 	MinerWallet      address.Address
-	PayCh            address.Address
-	Lane             uint64
+	PaymentInfo      *PaymentInfo
 	Status           DealStatus
 	Sender           peer.ID
 	TotalReceived    uint64
@@ -48,6 +64,8 @@ type ClientDealState struct {
 	CurrentInterval  uint64
 	PaymentRequested tokenamount.TokenAmount
 	FundsSpent       tokenamount.TokenAmount
+	// UnsealFundsPaid is the part of FundsSpent that paid for unsealing
+	UnsealFundsPaid tokenamount.TokenAmount
 }
 
 // ClientEvent is an event that occurs in a deal lifecycle on the client
@@ -69,6 +87,9 @@ const (
 
 	// ClientEventComplete indicates a deal has completed
 	ClientEventComplete
+
+	// ClientEventCancelled indicates a deal was cancelled by the client
+	ClientEventCancelled
 )
 
 // ClientSubscriber is a callback that is registered to listen for retrieval events
@@ -78,8 +99,9 @@ type ClientSubscriber func(event ClientEvent, state ClientDealState)
 type RetrievalClient interface {
 	// V0
 
-	// Find Providers finds retrieval providers who may be storing a given piece
-	FindProviders(pieceCID []byte) []RetrievalPeer
+	// Find Providers finds retrieval providers who may be storing a given payload
+	// or piece
+	FindProviders(payloadCID cid.Cid) []RetrievalPeer
 
 	// Query asks a provider for information about a piece it is storing
 	Query(
@@ -104,10 +126,55 @@ type RetrievalClient interface {
 	SubscribeToEvents(subscriber ClientSubscriber) Unsubscribe
 
 	// V1
-	AddMoreFunds(id DealID, amount tokenamount.TokenAmount) error
+	AddMoreFunds(ctx context.Context, id DealID, amount tokenamount.TokenAmount) error
+
+	// CancelDeal stops an in progress retrieval deal and notifies the provider
 	CancelDeal(id DealID) error
-	RetrievalStatus(id DealID)
+
+	// ResumeDeal restarts a deal that was interrupted before it finished, asking
+	// the provider to skip the blocks received in the deal that are stored
+	// locally. What was received but not paid for is paid for first
+	ResumeDeal(ctx context.Context, id DealID) error
+
+	// RestartDeals resumes every deal that was in progress when the client last
+	// stopped. Call it once subscribers are registered, so they see the
+	// resumed deals. The deals stop when ctx is cancelled
+	RestartDeals(ctx context.Context) error
+
+	// RetrievalStatus returns the current state of the deal with the given id
+	RetrievalStatus(id DealID) (ClientDealState, error)
+
+	// ListDeals lists all retrieval deals this client knows about, in progress or finished
 	ListDeals() map[DealID]ClientDealState
+
+	// RetrieveBest queries every provider of a payload and retrieves the part of
+	// it matching the selector (all of it if sel is nil) from the best offer,
+	// falling back to the next best if a deal is rejected or fails. It blocks
+	// until a deal completes, and returns its id
+	RetrieveBest(
+		ctx context.Context,
+		pieceCID []byte,
+		payloadCID cid.Cid,
+		sel ipld.Node,
+		totalFunds tokenamount.TokenAmount,
+		clientWallet address.Address,
+	) (DealID, error)
+
+	// RetrieveSwarm retrieves a whole payload from several providers at once. It
+	// retrieves the root block, then splits the links in it between at most
+	// parts parts, each retrieved in its own deal. Blocks under links the client
+	// already has, or that another part has, are not retrieved again. Parts are
+	// spread across the providers that can serve them, and fall back to other
+	// providers if a deal fails or runs out of funds. It blocks until every part
+	// is retrieved or has failed, and returns the ids of the deals it made
+	RetrieveSwarm(
+		ctx context.Context,
+		pieceCID []byte,
+		payloadCID cid.Cid,
+		parts int,
+		totalFunds tokenamount.TokenAmount,
+		clientWallet address.Address,
+	) ([]DealID, error)
 }
 
 // RetrievalClientNode are the node dependencies for a RetrievalClient
@@ -138,6 +205,11 @@ type ProviderDealState struct {
 	FundsReceived   tokenamount.TokenAmount
 	Message         string
 	CurrentInterval uint64
+
+	// Resend is how many bytes of blocks the client was sent before it resumed
+	// the deal, but no longer has. They are sent again without being charged
+	// for twice
+	Resend uint64
 }
 
 // ProviderEvent is an event that occurs in a deal lifecycle on the provider
@@ -156,6 +228,9 @@ const (
 
 	// ProviderEventComplete indicates a retrieval deal was completed for a client
 	ProviderEventComplete
+
+	// ProviderEventCancelled indicates a client cancelled a retrieval deal
+	ProviderEventCancelled
 )
 
 // ProviderDealID is a unique identifier for a deal on a provider -- it is
@@ -165,6 +240,10 @@ type ProviderDealID struct {
 	ID   DealID
 }
 
+func (p ProviderDealID) String() string {
+	return fmt.Sprintf("%v/%v", p.From, p.ID)
+}
+
 // ProviderSubscriber is a callback that is registered to listen for retrieval events on a provider
 type ProviderSubscriber func(event ProviderEvent, state ProviderDealState)
 
@@ -187,20 +266,59 @@ type RetrievalProvider interface {
 	SubscribeToEvents(subscriber ProviderSubscriber) Unsubscribe
 
 	// V1
+
+	// SetPricePerUnseal sets the price a miner charges to unseal the sector
+	// holding a piece, which is paid before any data is sent
 	SetPricePerUnseal(price tokenamount.TokenAmount)
+
+	// SetExpectedUnsealTime sets how long the miner expects to take to unseal a
+	// piece, which is reported to clients as the time to first byte for pieces
+	// that do not have an unsealed copy
+	SetExpectedUnsealTime(unsealTime time.Duration)
+
+	// ListDeals lists all retrieval deals this provider has received, in progress or finished
 	ListDeals() map[ProviderDealID]ProviderDealState
+
+	// SetDealDecider sets a policy deciding which deals the provider takes, on top
+	// of its prices and payment intervals. Deals the decider defers are put to it
+	// again every retryInterval until it accepts or rejects them
+	SetDealDecider(decider RetrievalDealDecider, retryInterval time.Duration)
 }
 
+// DealDecision is a RetrievalDealDecider's verdict on a deal proposal
+type DealDecision uint64
+
+const (
+	// DealDecisionAccept means the provider takes the deal
+	DealDecisionAccept DealDecision = iota
+
+	// DealDecisionReject means the provider turns the deal down
+	DealDecisionReject
+
+	// DealDecisionDefer means the decider cannot decide yet, and the client
+	// waits for it to decide later
+	DealDecisionDefer
+)
+
+// RetrievalDealDecider decides whether a provider takes a deal proposed by a
+// client, returning the reason for a rejection or deferral, which is sent to
+// the client. Returning an error fails the deal
+type RetrievalDealDecider func(ctx context.Context, proposal DealProposal, client peer.ID) (DealDecision, string, error)
+
 // RetrievalProviderNode are the node depedencies for a RetrevalProvider
 type RetrievalProviderNode interface {
 	GetPieceSize(pieceCid []byte) (uint64, error)
+	// IsUnsealed returns true if the node holds an unsealed copy of the piece,
+	// which can be served without unsealing the sector
+	IsUnsealed(pieceCid []byte) (bool, error)
 	SealedBlockstore(approveUnseal func() error) blockstore.Blockstore
 	SavePaymentVoucher(ctx context.Context, paymentChannel address.Address, voucher *types.SignedVoucher, proof []byte, expectedAmount tokenamount.TokenAmount) (tokenamount.TokenAmount, error)
 }
 
-// PeerResolver is an interface for looking up providers that may have a piece
+// PeerResolver is an interface for looking up providers that may have a
+// payload or piece
 type PeerResolver interface {
-	GetPeers(pieceCID []byte) ([]RetrievalPeer, error) // TODO: channel
+	GetPeers(payloadCID cid.Cid) ([]RetrievalPeer, error) // TODO: channel
 }
 
 // RetrievalPeer is a provider address/peer.ID pair (everything needed to make
@@ -249,18 +367,42 @@ const (
 // client is interested in, as well as specific parameters the client is seeking
 // for the retrieval deal
 type QueryParams struct {
-	//PayloadCID                 cid.Cid   // optional, query if miner has this cid in this piece. some miners may not be able to respond.
-	//Selector                   ipld.Node // optional, query if miner has this cid in this piece. some miners may not be able to respond.
+	Items []QueryItem // optional, query if miner has these parts of the piece. some miners may not be able to respond.
 	//MaxPricePerByte            tokenamount.TokenAmount    // optional, tell miner uninterested if more expensive than this
 	//MinPaymentInterval         uint64    // optional, tell miner uninterested unless payment interval is greater than this
 	//MinPaymentIntervalIncrease uint64    // optional, tell miner uninterested unless payment interval increase is greater than this
 }
 
+// QueryItem is a part of a piece a client asks a provider about: the DAG under
+// a payload CID, or the part of it a selector matches
+type QueryItem struct {
+	PayloadCID cid.Cid
+	// Selector is the dag-cbor encoded IPLD selector for the part of the payload
+	// DAG asked about. If empty, the whole payload is asked about
+	Selector []byte
+}
+
+// SelectorSpec decodes the selector of the item, or returns nil if the whole
+// payload was asked about
+func (qi QueryItem) SelectorSpec() (ipld.Node, error) {
+	return decodeSelector(qi.Selector)
+}
+
+// NewQueryItem creates a query item for the part of the DAG under payloadCID
+// that matches the given selector, or for all of it if the selector is nil
+func NewQueryItem(payloadCID cid.Cid, sel ipld.Node) (QueryItem, error) {
+	encoded, err := encodeSelector(sel)
+	if err != nil {
+		return QueryItem{}, err
+	}
+	return QueryItem{PayloadCID: payloadCID, Selector: encoded}, nil
+}
+
 // Query is a query to a given provider to determine information about a piece
 // they may have available for retrieval
 type Query struct {
-	PieceCID []byte // V0
-	// QueryParams        // V1
+	PieceCID    []byte // V0
+	QueryParams        // V1
 }
 
 // QueryUndefined is a query with no values
@@ -271,11 +413,21 @@ func NewQueryV0(pieceCID []byte) Query {
 	return Query{PieceCID: pieceCID}
 }
 
+// NewQueryV1 creates a V1 query, which also asks about parts of the piece
+func NewQueryV1(pieceCID []byte, params QueryParams) Query {
+	return Query{PieceCID: pieceCID, QueryParams: params}
+}
+
+// QueryItemResponse is a provider's answer about one of the items in a query
+type QueryItemResponse struct {
+	Status QueryItemStatus
+	Size   uint64 // size in bytes of the blocks that make up the item, if available
+}
+
 // QueryResponse is a miners response to a given retrieval query
 type QueryResponse struct {
 	Status QueryResponseStatus
-	//PayloadCIDFound QueryItemStatus // V1 - if a PayloadCid was requested, the result
-	//SelectorFound   QueryItemStatus // V1 - if a Selector was requested, the result
+	Items  []QueryItemResponse // V1 - the result for each item in the query, in the same order
 
 	Size uint64 // Total size of piece in bytes
 	//ExpectedPayloadSize uint64 // V1 - optional, if PayloadCID + selector are specified and miner knows, can offer an expected size
@@ -285,14 +437,23 @@ type QueryResponse struct {
 	MaxPaymentInterval         uint64
 	MaxPaymentIntervalIncrease uint64
 	Message                    string
+	UnsealPrice                tokenamount.TokenAmount // V1 - paid up front, before any data is sent
+
+	Unsealed                bool   // V1 - the provider has an unsealed copy, so nothing is paid to unseal
+	ExpectedTimeToFirstByte uint64 // V1 - seconds before the first block is sent
 }
 
 // QueryResponseUndefined is an empty QueryResponse
 var QueryResponseUndefined = QueryResponse{}
 
-// PieceRetrievalPrice is the total price to retrieve the piece (size * MinPricePerByte)
+// PieceRetrievalPrice is the total price to retrieve the piece (size * MinPricePerByte),
+// including the price to unseal it
 func (qr QueryResponse) PieceRetrievalPrice() tokenamount.TokenAmount {
-	return tokenamount.Mul(qr.MinPricePerByte, tokenamount.FromInt(qr.Size))
+	price := tokenamount.Mul(qr.MinPricePerByte, tokenamount.FromInt(qr.Size))
+	if qr.UnsealPrice.Nil() {
+		return price
+	}
+	return tokenamount.Add(price, qr.UnsealPrice)
 }
 
 // PayloadRetrievalPrice is the expected price to retrieve just the given payload
@@ -324,8 +485,8 @@ const (
 	// for some reason
 	DealStatusRejected
 
-	// DealStatusUnsealing indicates the provider is currently unsealing the sector
-	// needed to serve the retrieval deal
+	// DealStatusUnsealing indicates the provider is waiting for payment to unseal,
+	// or is currently unsealing, the sector needed to serve the retrieval deal
 	DealStatusUnsealing
 
 	// DealStatusFundsNeeded indicates the provider is awaiting a payment voucher to
@@ -345,6 +506,13 @@ const (
 	// DealStatusDealNotFound indicates an update was received for a deal that could
 	// not be identified
 	DealStatusDealNotFound
+
+	// DealStatusCancelled indicates the client cancelled a deal before it completed
+	DealStatusCancelled
+
+	// DealStatusDeferred indicates the provider has not yet decided whether to
+	// take a deal, and will accept or reject it later
+	DealStatusDeferred
 )
 
 // IsTerminalError returns true if this status indicates processing of this deal
@@ -362,18 +530,51 @@ func IsTerminalSuccess(status DealStatus) bool {
 }
 
 // IsTerminalStatus returns true if this status indicates processing of a deal is
-// complete (either success or error)
+// complete (either success, error or cancellation)
 func IsTerminalStatus(status DealStatus) bool {
-	return IsTerminalError(status) || IsTerminalSuccess(status)
+	return IsTerminalError(status) || IsTerminalSuccess(status) || status == DealStatusCancelled
 }
 
 // Params are the parameters requested for a retrieval deal proposal
 type Params struct {
 	PayloadCID cid.Cid
-	//Selector                ipld.Node // V1
+	// Selector is the dag-cbor encoded IPLD selector for the part of the payload
+	// DAG to retrieve. If empty, the whole payload is retrieved
+	Selector                []byte // V1
 	PricePerByte            tokenamount.TokenAmount
 	PaymentInterval         uint64
 	PaymentIntervalIncrease uint64
+	// UnsealPrice is the price the client agrees to pay before any data is sent,
+	// for the provider to unseal the piece
+	UnsealPrice tokenamount.TokenAmount // V1
+}
+
+// SelectorSpec decodes the selector requested in the params, or returns nil if
+// the whole payload was requested
+func (p Params) SelectorSpec() (ipld.Node, error) {
+	return decodeSelector(p.Selector)
+}
+
+// decodeSelector decodes a dag-cbor encoded selector spec, or returns nil if
+// there is none
+func decodeSelector(encoded []byte) (ipld.Node, error) {
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+	return dagcbor.Decoder(ipldfree.NodeBuilder(), bytes.NewReader(encoded))
+}
+
+// encodeSelector encodes a selector spec as dag-cbor, or returns nil if there
+// is none
+func encodeSelector(sel ipld.Node) ([]byte, error) {
+	if sel == nil {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err := dagcbor.Encoder(sel, &buf); err != nil {
+		return nil, xerrors.Errorf("encoding selector: %w", err)
+	}
+	return buf.Bytes(), nil
 }
 
 // NewParamsV0 generates parameters for a retrieval deal, which is always a whole piece deal
@@ -382,9 +583,27 @@ func NewParamsV0(pricePerByte *big.Int, paymentInterval uint64, paymentIntervalI
 		PricePerByte:            tokenamount.TokenAmount{Int: pricePerByte},
 		PaymentInterval:         paymentInterval,
 		PaymentIntervalIncrease: paymentIntervalIncrease,
+		UnsealPrice:             tokenamount.FromInt(0),
 	}
 }
 
+// NewParamsV1 generates parameters for a retrieval deal for the part of the DAG
+// under payloadCID that matches the given selector
+func NewParamsV1(pricePerByte *big.Int, paymentInterval uint64, paymentIntervalIncrease uint64, payloadCID cid.Cid, sel ipld.Node) (Params, error) {
+	encoded, err := encodeSelector(sel)
+	if err != nil {
+		return Params{}, err
+	}
+	return Params{
+		PayloadCID:              payloadCID,
+		Selector:                encoded,
+		PricePerByte:            tokenamount.TokenAmount{Int: pricePerByte},
+		PaymentInterval:         paymentInterval,
+		PaymentIntervalIncrease: paymentIntervalIncrease,
+		UnsealPrice:             tokenamount.FromInt(0),
+	}, nil
+}
+
 // DealID is an identifier for a retrieval deal (unique to a client)
 type DealID uint64
 
@@ -393,6 +612,12 @@ type DealProposal struct {
 	PieceCID []byte
 	ID       DealID
 	Params
+
+	// SkipBlocks is the number of blocks, in the order the provider sends them,
+	// that the client already has when resuming a deal. They are not sent again.
+	// The provider only skips blocks it sent in the deal before, and charges for
+	// them as it did then
+	SkipBlocks uint64
 }
 
 // DealProposalUndefined is an undefined deal proposal
@@ -432,7 +657,23 @@ type DealPayment struct {
 // DealPaymentUndefined is an undefined deal payment
 var DealPaymentUndefined = DealPayment{}
 
+// DealCancellation is sent by a client in place of a payment to stop an in
+// progress retrieval deal
+type DealCancellation struct {
+	ID DealID
+}
+
+// ClientDealMessage is what a client sends on a deal stream after its
+// proposal: either a payment or a cancellation, whichever is set
+type ClientDealMessage struct {
+	Payment      *DealPayment
+	Cancellation *DealCancellation
+}
+
 var (
 	// ErrNotFound means a piece was not found during retrieval
 	ErrNotFound = errors.New("not found")
+
+	// ErrDealCancelled means the client cancelled a deal instead of paying for it
+	ErrDealCancelled = errors.New("deal cancelled by client")
 )
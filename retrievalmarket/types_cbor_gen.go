@@ -19,7 +19,7 @@ func (t *Query) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{129}); err != nil {
+	if _, err := w.Write([]byte{130}); err != nil {
 		return err
 	}
 
@@ -34,6 +34,11 @@ func (t *Query) MarshalCBOR(w io.Writer) error {
 	if _, err := w.Write(t.PieceCID); err != nil {
 		return err
 	}
+
+	// t.QueryParams (retrievalmarket.QueryParams) (struct)
+	if err := t.QueryParams.MarshalCBOR(w); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -48,7 +53,7 @@ func (t *Query) UnmarshalCBOR(r io.Reader) error {
 		return fmt.Errorf("cbor input should be of type array")
 	}
 
-	if extra != 1 {
+	if extra != 2 {
 		return fmt.Errorf("cbor input had wrong number of fields")
 	}
 
@@ -69,6 +74,15 @@ func (t *Query) UnmarshalCBOR(r io.Reader) error {
 	if _, err := io.ReadFull(br, t.PieceCID); err != nil {
 		return err
 	}
+	// t.QueryParams (retrievalmarket.QueryParams) (struct)
+
+	{
+
+		if err := t.QueryParams.UnmarshalCBOR(br); err != nil {
+			return err
+		}
+
+	}
 	return nil
 }
 
@@ -77,7 +91,7 @@ func (t *QueryResponse) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{135}); err != nil {
+	if _, err := w.Write([]byte{139}); err != nil {
 		return err
 	}
 
@@ -86,6 +100,20 @@ func (t *QueryResponse) MarshalCBOR(w io.Writer) error {
 		return err
 	}
 
+	// t.Items ([]retrievalmarket.QueryItemResponse) (slice)
+	if len(t.Items) > cbg.MaxLength {
+		return xerrors.Errorf("Slice value in field t.Items was too long")
+	}
+
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajArray, uint64(len(t.Items)))); err != nil {
+		return err
+	}
+	for _, v := range t.Items {
+		if err := v.MarshalCBOR(w); err != nil {
+			return err
+		}
+	}
+
 	// t.Size (uint64) (uint64)
 	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.Size))); err != nil {
 		return err
@@ -122,6 +150,21 @@ func (t *QueryResponse) MarshalCBOR(w io.Writer) error {
 	if _, err := w.Write([]byte(t.Message)); err != nil {
 		return err
 	}
+
+	// t.UnsealPrice (tokenamount.TokenAmount) (struct)
+	if err := t.UnsealPrice.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.Unsealed (bool) (bool)
+	if err := cbg.WriteBool(w, t.Unsealed); err != nil {
+		return err
+	}
+
+	// t.ExpectedTimeToFirstByte (uint64) (uint64)
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.ExpectedTimeToFirstByte))); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -136,7 +179,7 @@ func (t *QueryResponse) UnmarshalCBOR(r io.Reader) error {
 		return fmt.Errorf("cbor input should be of type array")
 	}
 
-	if extra != 7 {
+	if extra != 11 {
 		return fmt.Errorf("cbor input had wrong number of fields")
 	}
 
@@ -150,6 +193,33 @@ func (t *QueryResponse) UnmarshalCBOR(r io.Reader) error {
 		return fmt.Errorf("wrong type for uint64 field")
 	}
 	t.Status = QueryResponseStatus(extra)
+	// t.Items ([]retrievalmarket.QueryItemResponse) (slice)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("t.Items: array too large (%d)", extra)
+	}
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("expected cbor array")
+	}
+	if extra > 0 {
+		t.Items = make([]QueryItemResponse, extra)
+	}
+	for i := 0; i < int(extra); i++ {
+
+		var v QueryItemResponse
+		if err := v.UnmarshalCBOR(br); err != nil {
+			return err
+		}
+
+		t.Items[i] = v
+	}
+
 	// t.Size (uint64) (uint64)
 
 	maj, extra, err = cbg.CborReadHeader(br)
@@ -208,6 +278,42 @@ func (t *QueryResponse) UnmarshalCBOR(r io.Reader) error {
 
 		t.Message = string(sval)
 	}
+	// t.UnsealPrice (tokenamount.TokenAmount) (struct)
+
+	{
+
+		if err := t.UnsealPrice.UnmarshalCBOR(br); err != nil {
+			return err
+		}
+
+	}
+	// t.Unsealed (bool) (bool)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajOther {
+		return fmt.Errorf("booleans must be major type 7")
+	}
+	switch extra {
+	case 20:
+		t.Unsealed = false
+	case 21:
+		t.Unsealed = true
+	default:
+		return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+	}
+	// t.ExpectedTimeToFirstByte (uint64) (uint64)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint64 field")
+	}
+	t.ExpectedTimeToFirstByte = uint64(extra)
 	return nil
 }
 
@@ -216,7 +322,7 @@ func (t *DealProposal) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{131}); err != nil {
+	if _, err := w.Write([]byte{132}); err != nil {
 		return err
 	}
 
@@ -241,6 +347,11 @@ func (t *DealProposal) MarshalCBOR(w io.Writer) error {
 	if err := t.Params.MarshalCBOR(w); err != nil {
 		return err
 	}
+
+	// t.SkipBlocks (uint64) (uint64)
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.SkipBlocks))); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -255,7 +366,7 @@ func (t *DealProposal) UnmarshalCBOR(r io.Reader) error {
 		return fmt.Errorf("cbor input should be of type array")
 	}
 
-	if extra != 3 {
+	if extra != 4 {
 		return fmt.Errorf("cbor input had wrong number of fields")
 	}
 
@@ -295,6 +406,16 @@ func (t *DealProposal) UnmarshalCBOR(r io.Reader) error {
 		}
 
 	}
+	// t.SkipBlocks (uint64) (uint64)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint64 field")
+	}
+	t.SkipBlocks = uint64(extra)
 	return nil
 }
 
@@ -439,7 +560,25 @@ func (t *Params) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{131}); err != nil {
+	if _, err := w.Write([]byte{134}); err != nil {
+		return err
+	}
+
+	// t.PayloadCID (cid.Cid) (struct)
+
+	if err := cbg.WriteCid(w, t.PayloadCID); err != nil {
+		return xerrors.Errorf("failed to write cid field t.PayloadCID: %w", err)
+	}
+
+	// t.Selector ([]uint8) (slice)
+	if len(t.Selector) > cbg.ByteArrayMaxLen {
+		return xerrors.Errorf("Byte array in field t.Selector was too long")
+	}
+
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajByteString, uint64(len(t.Selector)))); err != nil {
+		return err
+	}
+	if _, err := w.Write(t.Selector); err != nil {
 		return err
 	}
 
@@ -457,6 +596,11 @@ func (t *Params) MarshalCBOR(w io.Writer) error {
 	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.PaymentIntervalIncrease))); err != nil {
 		return err
 	}
+
+	// t.UnsealPrice (tokenamount.TokenAmount) (struct)
+	if err := t.UnsealPrice.MarshalCBOR(w); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -471,10 +615,39 @@ func (t *Params) UnmarshalCBOR(r io.Reader) error {
 		return fmt.Errorf("cbor input should be of type array")
 	}
 
-	if extra != 3 {
+	if extra != 6 {
 		return fmt.Errorf("cbor input had wrong number of fields")
 	}
 
+	// t.PayloadCID (cid.Cid) (struct)
+
+	{
+
+		c, err := cbg.ReadCid(br)
+		if err != nil {
+			return xerrors.Errorf("failed to read cid field t.PayloadCID: %w", err)
+		}
+
+		t.PayloadCID = c
+
+	}
+	// t.Selector ([]uint8) (slice)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+
+	if extra > cbg.ByteArrayMaxLen {
+		return fmt.Errorf("t.Selector: byte array too large (%d)", extra)
+	}
+	if maj != cbg.MajByteString {
+		return fmt.Errorf("expected byte array")
+	}
+	t.Selector = make([]byte, extra)
+	if _, err := io.ReadFull(br, t.Selector); err != nil {
+		return err
+	}
 	// t.PricePerByte (tokenamount.TokenAmount) (struct)
 
 	{
@@ -504,65 +677,44 @@ func (t *Params) UnmarshalCBOR(r io.Reader) error {
 		return fmt.Errorf("wrong type for uint64 field")
 	}
 	t.PaymentIntervalIncrease = uint64(extra)
-	return nil
-}
+	// t.UnsealPrice (tokenamount.TokenAmount) (struct)
 
-func (t *QueryParams) MarshalCBOR(w io.Writer) error {
-	if t == nil {
-		_, err := w.Write(cbg.CborNull)
-		return err
-	}
-	if _, err := w.Write([]byte{128}); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (t *QueryParams) UnmarshalCBOR(r io.Reader) error {
-	br := cbg.GetPeeker(r)
+	{
 
-	maj, extra, err := cbg.CborReadHeader(br)
-	if err != nil {
-		return err
-	}
-	if maj != cbg.MajArray {
-		return fmt.Errorf("cbor input should be of type array")
-	}
+		if err := t.UnsealPrice.UnmarshalCBOR(br); err != nil {
+			return err
+		}
 
-	if extra != 0 {
-		return fmt.Errorf("cbor input had wrong number of fields")
 	}
-
 	return nil
 }
 
-func (t *DealPayment) MarshalCBOR(w io.Writer) error {
+func (t *QueryParams) MarshalCBOR(w io.Writer) error {
 	if t == nil {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{131}); err != nil {
+	if _, err := w.Write([]byte{129}); err != nil {
 		return err
 	}
 
-	// t.ID (retrievalmarket.DealID) (uint64)
-	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.ID))); err != nil {
-		return err
+	// t.Items ([]retrievalmarket.QueryItem) (slice)
+	if len(t.Items) > cbg.MaxLength {
+		return xerrors.Errorf("Slice value in field t.Items was too long")
 	}
 
-	// t.PaymentChannel (address.Address) (struct)
-	if err := t.PaymentChannel.MarshalCBOR(w); err != nil {
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajArray, uint64(len(t.Items)))); err != nil {
 		return err
 	}
-
-	// t.PaymentVoucher (types.SignedVoucher) (struct)
-	if err := t.PaymentVoucher.MarshalCBOR(w); err != nil {
-		return err
+	for _, v := range t.Items {
+		if err := v.MarshalCBOR(w); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (t *DealPayment) UnmarshalCBOR(r io.Reader) error {
+func (t *QueryParams) UnmarshalCBOR(r io.Reader) error {
 	br := cbg.GetPeeker(r)
 
 	maj, extra, err := cbg.CborReadHeader(br)
@@ -573,54 +725,41 @@ func (t *DealPayment) UnmarshalCBOR(r io.Reader) error {
 		return fmt.Errorf("cbor input should be of type array")
 	}
 
-	if extra != 3 {
+	if extra != 1 {
 		return fmt.Errorf("cbor input had wrong number of fields")
 	}
 
-	// t.ID (retrievalmarket.DealID) (uint64)
+	// t.Items ([]retrievalmarket.QueryItem) (slice)
 
 	maj, extra, err = cbg.CborReadHeader(br)
 	if err != nil {
 		return err
 	}
-	if maj != cbg.MajUnsignedInt {
-		return fmt.Errorf("wrong type for uint64 field")
-	}
-	t.ID = DealID(extra)
-	// t.PaymentChannel (address.Address) (struct)
-
-	{
-
-		if err := t.PaymentChannel.UnmarshalCBOR(br); err != nil {
-			return err
-		}
 
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("t.Items: array too large (%d)", extra)
 	}
-	// t.PaymentVoucher (types.SignedVoucher) (struct)
 
-	{
+	if maj != cbg.MajArray {
+		return fmt.Errorf("expected cbor array")
+	}
+	if extra > 0 {
+		t.Items = make([]QueryItem, extra)
+	}
+	for i := 0; i < int(extra); i++ {
 
-		pb, err := br.PeekByte()
-		if err != nil {
+		var v QueryItem
+		if err := v.UnmarshalCBOR(br); err != nil {
 			return err
 		}
-		if pb == cbg.CborNull[0] {
-			var nbuf [1]byte
-			if _, err := br.Read(nbuf[:]); err != nil {
-				return err
-			}
-		} else {
-			t.PaymentVoucher = new(types.SignedVoucher)
-			if err := t.PaymentVoucher.UnmarshalCBOR(br); err != nil {
-				return err
-			}
-		}
 
+		t.Items[i] = v
 	}
+
 	return nil
 }
 
-func (t *Block) MarshalCBOR(w io.Writer) error {
+func (t *QueryItem) MarshalCBOR(w io.Writer) error {
 	if t == nil {
 		_, err := w.Write(cbg.CborNull)
 		return err
@@ -629,33 +768,27 @@ func (t *Block) MarshalCBOR(w io.Writer) error {
 		return err
 	}
 
-	// t.Prefix ([]uint8) (slice)
-	if len(t.Prefix) > cbg.ByteArrayMaxLen {
-		return xerrors.Errorf("Byte array in field t.Prefix was too long")
-	}
+	// t.PayloadCID (cid.Cid) (struct)
 
-	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajByteString, uint64(len(t.Prefix)))); err != nil {
-		return err
-	}
-	if _, err := w.Write(t.Prefix); err != nil {
-		return err
+	if err := cbg.WriteCid(w, t.PayloadCID); err != nil {
+		return xerrors.Errorf("failed to write cid field t.PayloadCID: %w", err)
 	}
 
-	// t.Data ([]uint8) (slice)
-	if len(t.Data) > cbg.ByteArrayMaxLen {
-		return xerrors.Errorf("Byte array in field t.Data was too long")
+	// t.Selector ([]uint8) (slice)
+	if len(t.Selector) > cbg.ByteArrayMaxLen {
+		return xerrors.Errorf("Byte array in field t.Selector was too long")
 	}
 
-	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajByteString, uint64(len(t.Data)))); err != nil {
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajByteString, uint64(len(t.Selector)))); err != nil {
 		return err
 	}
-	if _, err := w.Write(t.Data); err != nil {
+	if _, err := w.Write(t.Selector); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (t *Block) UnmarshalCBOR(r io.Reader) error {
+func (t *QueryItem) UnmarshalCBOR(r io.Reader) error {
 	br := cbg.GetPeeker(r)
 
 	maj, extra, err := cbg.CborReadHeader(br)
@@ -670,24 +803,19 @@ func (t *Block) UnmarshalCBOR(r io.Reader) error {
 		return fmt.Errorf("cbor input had wrong number of fields")
 	}
 
-	// t.Prefix ([]uint8) (slice)
+	// t.PayloadCID (cid.Cid) (struct)
 
-	maj, extra, err = cbg.CborReadHeader(br)
-	if err != nil {
-		return err
-	}
+	{
+
+		c, err := cbg.ReadCid(br)
+		if err != nil {
+			return xerrors.Errorf("failed to read cid field t.PayloadCID: %w", err)
+		}
+
+		t.PayloadCID = c
 
-	if extra > cbg.ByteArrayMaxLen {
-		return fmt.Errorf("t.Prefix: byte array too large (%d)", extra)
-	}
-	if maj != cbg.MajByteString {
-		return fmt.Errorf("expected byte array")
-	}
-	t.Prefix = make([]byte, extra)
-	if _, err := io.ReadFull(br, t.Prefix); err != nil {
-		return err
 	}
-	// t.Data ([]uint8) (slice)
+	// t.Selector ([]uint8) (slice)
 
 	maj, extra, err = cbg.CborReadHeader(br)
 	if err != nil {
@@ -695,30 +823,385 @@ func (t *Block) UnmarshalCBOR(r io.Reader) error {
 	}
 
 	if extra > cbg.ByteArrayMaxLen {
-		return fmt.Errorf("t.Data: byte array too large (%d)", extra)
+		return fmt.Errorf("t.Selector: byte array too large (%d)", extra)
 	}
 	if maj != cbg.MajByteString {
 		return fmt.Errorf("expected byte array")
 	}
-	t.Data = make([]byte, extra)
-	if _, err := io.ReadFull(br, t.Data); err != nil {
+	t.Selector = make([]byte, extra)
+	if _, err := io.ReadFull(br, t.Selector); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (t *ClientDealState) MarshalCBOR(w io.Writer) error {
+func (t *QueryItemResponse) MarshalCBOR(w io.Writer) error {
 	if t == nil {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{143}); err != nil {
+	if _, err := w.Write([]byte{130}); err != nil {
 		return err
 	}
 
-	// t.ProposalCid (cid.Cid) (struct)
+	// t.Status (retrievalmarket.QueryItemStatus) (uint64)
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.Status))); err != nil {
+		return err
+	}
 
-	if err := cbg.WriteCid(w, t.ProposalCid); err != nil {
+	// t.Size (uint64) (uint64)
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.Size))); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *QueryItemResponse) UnmarshalCBOR(r io.Reader) error {
+	br := cbg.GetPeeker(r)
+
+	maj, extra, err := cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 2 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.Status (retrievalmarket.QueryItemStatus) (uint64)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint64 field")
+	}
+	t.Status = QueryItemStatus(extra)
+	// t.Size (uint64) (uint64)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint64 field")
+	}
+	t.Size = uint64(extra)
+	return nil
+}
+
+func (t *DealPayment) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{131}); err != nil {
+		return err
+	}
+
+	// t.ID (retrievalmarket.DealID) (uint64)
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.ID))); err != nil {
+		return err
+	}
+
+	// t.PaymentChannel (address.Address) (struct)
+	if err := t.PaymentChannel.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.PaymentVoucher (types.SignedVoucher) (struct)
+	if err := t.PaymentVoucher.MarshalCBOR(w); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *DealPayment) UnmarshalCBOR(r io.Reader) error {
+	br := cbg.GetPeeker(r)
+
+	maj, extra, err := cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 3 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.ID (retrievalmarket.DealID) (uint64)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint64 field")
+	}
+	t.ID = DealID(extra)
+	// t.PaymentChannel (address.Address) (struct)
+
+	{
+
+		if err := t.PaymentChannel.UnmarshalCBOR(br); err != nil {
+			return err
+		}
+
+	}
+	// t.PaymentVoucher (types.SignedVoucher) (struct)
+
+	{
+
+		pb, err := br.PeekByte()
+		if err != nil {
+			return err
+		}
+		if pb == cbg.CborNull[0] {
+			var nbuf [1]byte
+			if _, err := br.Read(nbuf[:]); err != nil {
+				return err
+			}
+		} else {
+			t.PaymentVoucher = new(types.SignedVoucher)
+			if err := t.PaymentVoucher.UnmarshalCBOR(br); err != nil {
+				return err
+			}
+		}
+
+	}
+	return nil
+}
+
+func (t *DealCancellation) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{129}); err != nil {
+		return err
+	}
+
+	// t.ID (retrievalmarket.DealID) (uint64)
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.ID))); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *DealCancellation) UnmarshalCBOR(r io.Reader) error {
+	br := cbg.GetPeeker(r)
+
+	maj, extra, err := cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 1 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.ID (retrievalmarket.DealID) (uint64)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint64 field")
+	}
+	t.ID = DealID(extra)
+	return nil
+}
+
+func (t *ClientDealMessage) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{130}); err != nil {
+		return err
+	}
+
+	// t.Payment (retrievalmarket.DealPayment) (struct)
+	if err := t.Payment.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.Cancellation (retrievalmarket.DealCancellation) (struct)
+	if err := t.Cancellation.MarshalCBOR(w); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *ClientDealMessage) UnmarshalCBOR(r io.Reader) error {
+	br := cbg.GetPeeker(r)
+
+	maj, extra, err := cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 2 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.Payment (retrievalmarket.DealPayment) (struct)
+
+	{
+
+		pb, err := br.PeekByte()
+		if err != nil {
+			return err
+		}
+		if pb == cbg.CborNull[0] {
+			var nbuf [1]byte
+			if _, err := br.Read(nbuf[:]); err != nil {
+				return err
+			}
+		} else {
+			t.Payment = new(DealPayment)
+			if err := t.Payment.UnmarshalCBOR(br); err != nil {
+				return err
+			}
+		}
+
+	}
+	// t.Cancellation (retrievalmarket.DealCancellation) (struct)
+
+	{
+
+		pb, err := br.PeekByte()
+		if err != nil {
+			return err
+		}
+		if pb == cbg.CborNull[0] {
+			var nbuf [1]byte
+			if _, err := br.Read(nbuf[:]); err != nil {
+				return err
+			}
+		} else {
+			t.Cancellation = new(DealCancellation)
+			if err := t.Cancellation.UnmarshalCBOR(br); err != nil {
+				return err
+			}
+		}
+
+	}
+	return nil
+}
+
+func (t *Block) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{130}); err != nil {
+		return err
+	}
+
+	// t.Prefix ([]uint8) (slice)
+	if len(t.Prefix) > cbg.ByteArrayMaxLen {
+		return xerrors.Errorf("Byte array in field t.Prefix was too long")
+	}
+
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajByteString, uint64(len(t.Prefix)))); err != nil {
+		return err
+	}
+	if _, err := w.Write(t.Prefix); err != nil {
+		return err
+	}
+
+	// t.Data ([]uint8) (slice)
+	if len(t.Data) > cbg.ByteArrayMaxLen {
+		return xerrors.Errorf("Byte array in field t.Data was too long")
+	}
+
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajByteString, uint64(len(t.Data)))); err != nil {
+		return err
+	}
+	if _, err := w.Write(t.Data); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *Block) UnmarshalCBOR(r io.Reader) error {
+	br := cbg.GetPeeker(r)
+
+	maj, extra, err := cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 2 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.Prefix ([]uint8) (slice)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+
+	if extra > cbg.ByteArrayMaxLen {
+		return fmt.Errorf("t.Prefix: byte array too large (%d)", extra)
+	}
+	if maj != cbg.MajByteString {
+		return fmt.Errorf("expected byte array")
+	}
+	t.Prefix = make([]byte, extra)
+	if _, err := io.ReadFull(br, t.Prefix); err != nil {
+		return err
+	}
+	// t.Data ([]uint8) (slice)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+
+	if extra > cbg.ByteArrayMaxLen {
+		return fmt.Errorf("t.Data: byte array too large (%d)", extra)
+	}
+	if maj != cbg.MajByteString {
+		return fmt.Errorf("expected byte array")
+	}
+	t.Data = make([]byte, extra)
+	if _, err := io.ReadFull(br, t.Data); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *ClientDealState) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{143}); err != nil {
+		return err
+	}
+
+	// t.ProposalCid (cid.Cid) (struct)
+
+	if err := cbg.WriteCid(w, t.ProposalCid); err != nil {
 		return xerrors.Errorf("failed to write cid field t.ProposalCid: %w", err)
 	}
 
@@ -742,13 +1225,8 @@ func (t *ClientDealState) MarshalCBOR(w io.Writer) error {
 		return err
 	}
 
-	// t.PayCh (address.Address) (struct)
-	if err := t.PayCh.MarshalCBOR(w); err != nil {
-		return err
-	}
-
-	// t.Lane (uint64) (uint64)
-	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.Lane))); err != nil {
+	// t.PaymentInfo (retrievalmarket.PaymentInfo) (struct)
+	if err := t.PaymentInfo.MarshalCBOR(w); err != nil {
 		return err
 	}
 
@@ -805,6 +1283,11 @@ func (t *ClientDealState) MarshalCBOR(w io.Writer) error {
 	if err := t.FundsSpent.MarshalCBOR(w); err != nil {
 		return err
 	}
+
+	// t.UnsealFundsPaid (tokenamount.TokenAmount) (struct)
+	if err := t.UnsealFundsPaid.MarshalCBOR(w); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -871,25 +1354,27 @@ func (t *ClientDealState) UnmarshalCBOR(r io.Reader) error {
 		}
 
 	}
-	// t.PayCh (address.Address) (struct)
+	// t.PaymentInfo (retrievalmarket.PaymentInfo) (struct)
 
 	{
 
-		if err := t.PayCh.UnmarshalCBOR(br); err != nil {
+		pb, err := br.PeekByte()
+		if err != nil {
 			return err
 		}
+		if pb == cbg.CborNull[0] {
+			var nbuf [1]byte
+			if _, err := br.Read(nbuf[:]); err != nil {
+				return err
+			}
+		} else {
+			t.PaymentInfo = new(PaymentInfo)
+			if err := t.PaymentInfo.UnmarshalCBOR(br); err != nil {
+				return err
+			}
+		}
 
 	}
-	// t.Lane (uint64) (uint64)
-
-	maj, extra, err = cbg.CborReadHeader(br)
-	if err != nil {
-		return err
-	}
-	if maj != cbg.MajUnsignedInt {
-		return fmt.Errorf("wrong type for uint64 field")
-	}
-	t.Lane = uint64(extra)
 	// t.Status (retrievalmarket.DealStatus) (uint64)
 
 	maj, extra, err = cbg.CborReadHeader(br)
@@ -968,5 +1453,233 @@ func (t *ClientDealState) UnmarshalCBOR(r io.Reader) error {
 		}
 
 	}
+	// t.UnsealFundsPaid (tokenamount.TokenAmount) (struct)
+
+	{
+
+		if err := t.UnsealFundsPaid.UnmarshalCBOR(br); err != nil {
+			return err
+		}
+
+	}
+	return nil
+}
+
+func (t *ProviderDealState) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{136}); err != nil {
+		return err
+	}
+
+	// t.DealProposal (retrievalmarket.DealProposal) (struct)
+	if err := t.DealProposal.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.Status (retrievalmarket.DealStatus) (uint64)
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.Status))); err != nil {
+		return err
+	}
+
+	// t.Receiver (peer.ID) (string)
+	if len(t.Receiver) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.Receiver was too long")
+	}
+
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajTextString, uint64(len(t.Receiver)))); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(t.Receiver)); err != nil {
+		return err
+	}
+
+	// t.TotalSent (uint64) (uint64)
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.TotalSent))); err != nil {
+		return err
+	}
+
+	// t.FundsReceived (tokenamount.TokenAmount) (struct)
+	if err := t.FundsReceived.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.Message (string) (string)
+	if len(t.Message) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.Message was too long")
+	}
+
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajTextString, uint64(len(t.Message)))); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(t.Message)); err != nil {
+		return err
+	}
+
+	// t.CurrentInterval (uint64) (uint64)
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.CurrentInterval))); err != nil {
+		return err
+	}
+
+	// t.Resend (uint64) (uint64)
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.Resend))); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *ProviderDealState) UnmarshalCBOR(r io.Reader) error {
+	br := cbg.GetPeeker(r)
+
+	maj, extra, err := cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 8 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.DealProposal (retrievalmarket.DealProposal) (struct)
+
+	{
+
+		if err := t.DealProposal.UnmarshalCBOR(br); err != nil {
+			return err
+		}
+
+	}
+	// t.Status (retrievalmarket.DealStatus) (uint64)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint64 field")
+	}
+	t.Status = DealStatus(extra)
+	// t.Receiver (peer.ID) (string)
+
+	{
+		sval, err := cbg.ReadString(br)
+		if err != nil {
+			return err
+		}
+
+		t.Receiver = peer.ID(sval)
+	}
+	// t.TotalSent (uint64) (uint64)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint64 field")
+	}
+	t.TotalSent = uint64(extra)
+	// t.FundsReceived (tokenamount.TokenAmount) (struct)
+
+	{
+
+		if err := t.FundsReceived.UnmarshalCBOR(br); err != nil {
+			return err
+		}
+
+	}
+	// t.Message (string) (string)
+
+	{
+		sval, err := cbg.ReadString(br)
+		if err != nil {
+			return err
+		}
+
+		t.Message = string(sval)
+	}
+	// t.CurrentInterval (uint64) (uint64)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint64 field")
+	}
+	t.CurrentInterval = uint64(extra)
+	// t.Resend (uint64) (uint64)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint64 field")
+	}
+	t.Resend = uint64(extra)
+	return nil
+}
+
+func (t *PaymentInfo) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{130}); err != nil {
+		return err
+	}
+
+	// t.PayCh (address.Address) (struct)
+	if err := t.PayCh.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.Lane (uint64) (uint64)
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.Lane))); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *PaymentInfo) UnmarshalCBOR(r io.Reader) error {
+	br := cbg.GetPeeker(r)
+
+	maj, extra, err := cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 2 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.PayCh (address.Address) (struct)
+
+	{
+
+		if err := t.PayCh.UnmarshalCBOR(br); err != nil {
+			return err
+		}
+
+	}
+	// t.Lane (uint64) (uint64)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint64 field")
+	}
+	t.Lane = uint64(extra)
 	return nil
 }
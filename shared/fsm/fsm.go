@@ -0,0 +1,160 @@
+// Package fsm declares the states of a deal and the events that move deals
+// between them as a table, so illegal transitions can be rejected and the
+// whole graph can be listed
+package fsm
+
+import (
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+// State is a state in a state machine
+type State = uint64
+
+// ErrIllegalTransition means an event happened in a state it can't happen in
+var ErrIllegalTransition = xerrors.New("illegal state transition")
+
+// Event declares an event, the states it can happen in and the state it
+// leads to
+type Event struct {
+	Name string
+
+	// From are the states the event can happen in, or every state that is
+	// not final if empty
+	From []State
+
+	To State
+
+	// NoChange means the event leaves a deal in the state it happened in,
+	// rather than moving it to To
+	NoChange bool
+}
+
+// Transition is a move from one state to another, caused by an event
+type Transition struct {
+	Event string
+	From  State
+	To    State
+}
+
+// Table is the states of a state machine and the events that move between them
+type Table struct {
+	states []State
+	final  map[State]bool
+	events []Event
+	byName map[string]int
+}
+
+// NewTable returns a table of the given events, over the given states. Final
+// states are the states no event leaves, and events with no From states can
+// happen in any state that is not final
+func NewTable(states []State, final []State, events ...Event) (*Table, error) {
+	t := &Table{
+		states: states,
+		final:  make(map[State]bool, len(final)),
+		byName: make(map[string]int, len(events)),
+	}
+	known := make(map[State]bool, len(states))
+	for _, state := range states {
+		known[state] = true
+	}
+	for _, state := range final {
+		if !known[state] {
+			return nil, xerrors.Errorf("final state %d is not a state", state)
+		}
+		t.final[state] = true
+	}
+
+	for _, event := range events {
+		if _, ok := t.byName[event.Name]; ok {
+			return nil, xerrors.Errorf("event %s declared twice", event.Name)
+		}
+		if !event.NoChange && !known[event.To] {
+			return nil, xerrors.Errorf("event %s leads to unknown state %d", event.Name, event.To)
+		}
+		for _, from := range event.From {
+			if !known[from] {
+				return nil, xerrors.Errorf("event %s happens in unknown state %d", event.Name, from)
+			}
+			if t.final[from] {
+				return nil, xerrors.Errorf("event %s happens in final state %d", event.Name, from)
+			}
+		}
+		t.byName[event.Name] = len(t.events)
+		t.events = append(t.events, event)
+	}
+	return t, nil
+}
+
+// MustNewTable is NewTable for tables declared in code, which panics if the
+// table is not valid
+func MustNewTable(states []State, final []State, events ...Event) *Table {
+	t, err := NewTable(states, final, events...)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Next returns the state an event moves a deal in the given state to, or an
+// error wrapping ErrIllegalTransition if the event can't happen in that state
+func (t *Table) Next(from State, event string) (State, error) {
+	i, ok := t.byName[event]
+	if !ok {
+		return from, xerrors.Errorf("unknown event %s", event)
+	}
+	e := t.events[i]
+	if !t.happensIn(e, from) {
+		return from, xerrors.Errorf("event %s in state %d: %w", event, from, ErrIllegalTransition)
+	}
+	if e.NoChange {
+		return from, nil
+	}
+	return e.To, nil
+}
+
+// IsFinal returns whether no event leaves a state
+func (t *Table) IsFinal(state State) bool {
+	return t.final[state]
+}
+
+// Transitions lists every transition in the table, sorted by the state it
+// leaves, then the state it enters
+func (t *Table) Transitions() []Transition {
+	var transitions []Transition
+	for _, e := range t.events {
+		for _, from := range t.states {
+			if !t.happensIn(e, from) {
+				continue
+			}
+			to := e.To
+			if e.NoChange {
+				to = from
+			}
+			transitions = append(transitions, Transition{Event: e.Name, From: from, To: to})
+		}
+	}
+	sort.SliceStable(transitions, func(i, j int) bool {
+		if transitions[i].From != transitions[j].From {
+			return transitions[i].From < transitions[j].From
+		}
+		return transitions[i].To < transitions[j].To
+	})
+	return transitions
+}
+
+func (t *Table) happensIn(e Event, state State) bool {
+	if t.final[state] {
+		return false
+	}
+	if len(e.From) == 0 {
+		return true
+	}
+	for _, from := range e.From {
+		if from == state {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package fsm_test
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/shared/fsm"
+)
+
+const (
+	stateNew fsm.State = iota
+	stateRunning
+	stateDone
+	stateFailed
+)
+
+var (
+	states = []fsm.State{stateNew, stateRunning, stateDone, stateFailed}
+	final  = []fsm.State{stateDone, stateFailed}
+)
+
+func testTable(t *testing.T) *fsm.Table {
+	table, err := fsm.NewTable(states, final,
+		fsm.Event{Name: "start", From: []fsm.State{stateNew}, To: stateRunning},
+		fsm.Event{Name: "finish", From: []fsm.State{stateRunning}, To: stateDone},
+		fsm.Event{Name: "fail", To: stateFailed},
+		fsm.Event{Name: "resume", From: []fsm.State{stateRunning}, NoChange: true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func TestTable_Next(t *testing.T) {
+	table := testTable(t)
+
+	testCases := map[string]struct {
+		from    fsm.State
+		event   string
+		to      fsm.State
+		illegal bool
+		unknown bool
+	}{
+		"start":                  {from: stateNew, event: "start", to: stateRunning},
+		"finish":                 {from: stateRunning, event: "finish", to: stateDone},
+		"fail from any state":    {from: stateRunning, event: "fail", to: stateFailed},
+		"resume stays":           {from: stateRunning, event: "resume", to: stateRunning},
+		"finish before starting": {from: stateNew, event: "finish", illegal: true},
+		"fail once done":         {from: stateDone, event: "fail", illegal: true},
+		"unknown event":          {from: stateNew, event: "pause", unknown: true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			to, err := table.Next(tc.from, tc.event)
+			switch {
+			case tc.illegal:
+				if !xerrors.Is(err, fsm.ErrIllegalTransition) {
+					t.Fatalf("expected illegal transition, got %v", err)
+				}
+			case tc.unknown:
+				if err == nil || xerrors.Is(err, fsm.ErrIllegalTransition) {
+					t.Fatalf("expected unknown event, got %v", err)
+				}
+			default:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if to != tc.to {
+					t.Fatalf("expected state %d, got %d", tc.to, to)
+				}
+			}
+		})
+	}
+}
+
+func TestTable_Transitions(t *testing.T) {
+	expected := []fsm.Transition{
+		{Event: "start", From: stateNew, To: stateRunning},
+		{Event: "fail", From: stateNew, To: stateFailed},
+		{Event: "resume", From: stateRunning, To: stateRunning},
+		{Event: "finish", From: stateRunning, To: stateDone},
+		{Event: "fail", From: stateRunning, To: stateFailed},
+	}
+	if transitions := testTable(t).Transitions(); !reflect.DeepEqual(transitions, expected) {
+		t.Fatalf("unexpected transitions: %+v", transitions)
+	}
+}
+
+func TestNewTable_Invalid(t *testing.T) {
+	testCases := map[string][]fsm.Event{
+		"duplicate event": {
+			{Name: "start", From: []fsm.State{stateNew}, To: stateRunning},
+			{Name: "start", From: []fsm.State{stateRunning}, To: stateDone},
+		},
+		"unknown target":     {{Name: "start", To: 10}},
+		"unknown source":     {{Name: "start", From: []fsm.State{10}, To: stateRunning}},
+		"leaves final state": {{Name: "restart", From: []fsm.State{stateDone}, To: stateRunning}},
+	}
+	for name, events := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := fsm.NewTable(states, final, events...); err == nil {
+				t.Fatal("expected table to be invalid")
+			}
+		})
+	}
+}
@@ -23,8 +23,16 @@ type StorageAsk struct {
 	Price tokenamount.TokenAmount
 
 	MinPieceSize uint64
+	MaxPieceSize uint64 // 0 for no limit
 	Miner        address.Address
 	Timestamp    uint64
 	Expiry       uint64
 	SeqNo        uint64
+
+	// Bounds on deal duration, in epochs
+	MinDuration uint64
+	MaxDuration uint64 // 0 for no limit
+
+	// Collateral the provider puts up per GiB stored
+	CollateralPerGiB tokenamount.TokenAmount
 }
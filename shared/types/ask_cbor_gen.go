@@ -98,7 +98,7 @@ func (t *StorageAsk) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{134}); err != nil {
+	if _, err := w.Write([]byte{138}); err != nil {
 		return err
 	}
 
@@ -112,6 +112,11 @@ func (t *StorageAsk) MarshalCBOR(w io.Writer) error {
 		return err
 	}
 
+	// t.MaxPieceSize (uint64) (uint64)
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.MaxPieceSize))); err != nil {
+		return err
+	}
+
 	// t.Miner (address.Address) (struct)
 	if err := t.Miner.MarshalCBOR(w); err != nil {
 		return err
@@ -131,6 +136,21 @@ func (t *StorageAsk) MarshalCBOR(w io.Writer) error {
 	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.SeqNo))); err != nil {
 		return err
 	}
+
+	// t.MinDuration (uint64) (uint64)
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.MinDuration))); err != nil {
+		return err
+	}
+
+	// t.MaxDuration (uint64) (uint64)
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajUnsignedInt, uint64(t.MaxDuration))); err != nil {
+		return err
+	}
+
+	// t.CollateralPerGiB (tokenamount.TokenAmount) (struct)
+	if err := t.CollateralPerGiB.MarshalCBOR(w); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -145,7 +165,7 @@ func (t *StorageAsk) UnmarshalCBOR(r io.Reader) error {
 		return fmt.Errorf("cbor input should be of type array")
 	}
 
-	if extra != 6 {
+	if extra != 10 {
 		return fmt.Errorf("cbor input had wrong number of fields")
 	}
 
@@ -168,6 +188,16 @@ func (t *StorageAsk) UnmarshalCBOR(r io.Reader) error {
 		return fmt.Errorf("wrong type for uint64 field")
 	}
 	t.MinPieceSize = uint64(extra)
+	// t.MaxPieceSize (uint64) (uint64)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint64 field")
+	}
+	t.MaxPieceSize = uint64(extra)
 	// t.Miner (address.Address) (struct)
 
 	{
@@ -207,5 +237,34 @@ func (t *StorageAsk) UnmarshalCBOR(r io.Reader) error {
 		return fmt.Errorf("wrong type for uint64 field")
 	}
 	t.SeqNo = uint64(extra)
+	// t.MinDuration (uint64) (uint64)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint64 field")
+	}
+	t.MinDuration = uint64(extra)
+	// t.MaxDuration (uint64) (uint64)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint64 field")
+	}
+	t.MaxDuration = uint64(extra)
+	// t.CollateralPerGiB (tokenamount.TokenAmount) (struct)
+
+	{
+
+		if err := t.CollateralPerGiB.UnmarshalCBOR(br); err != nil {
+			return err
+		}
+
+	}
 	return nil
 }
@@ -3,6 +3,7 @@ package shared_testutil
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/require"
@@ -88,6 +89,9 @@ func (trqs *TestRetrievalQueryStream) WriteQueryResponse(newResp rm.QueryRespons
 	return trqs.respWriter(newResp)
 }
 
+// SetDeadline sets when the stream times out (does nothing for test).
+func (trqs *TestRetrievalQueryStream) SetDeadline(time.Time) error { return nil }
+
 // Close closes the stream (does nothing for test).
 func (trqs *TestRetrievalQueryStream) Close() error { return nil }
 
@@ -109,41 +113,47 @@ type DealPaymentReader func() (rm.DealPayment, error)
 // DealPaymentWriter is a function to mock writing deal payments.
 type DealPaymentWriter func(rm.DealPayment) error
 
+// DealCancellationWriter is a function to mock writing deal cancellations.
+type DealCancellationWriter func(rm.DealCancellation) error
+
 // TestRetrievalDealStream is a retrieval deal stream with predefined
 // stubbed behavior.
 type TestRetrievalDealStream struct {
-	p              peer.ID
-	proposalReader DealProposalReader
-	proposalWriter DealProposalWriter
-	responseReader DealResponseReader
-	responseWriter DealResponseWriter
-	paymentReader  DealPaymentReader
-	paymentWriter  DealPaymentWriter
+	p                  peer.ID
+	proposalReader     DealProposalReader
+	proposalWriter     DealProposalWriter
+	responseReader     DealResponseReader
+	responseWriter     DealResponseWriter
+	paymentReader      DealPaymentReader
+	paymentWriter      DealPaymentWriter
+	cancellationWriter DealCancellationWriter
 }
 
 // TestDealStreamParams are parameters used to setup a TestRetrievalDealStream.
 // All parameters except the peer ID are optional.
 type TestDealStreamParams struct {
-	PeerID         peer.ID
-	ProposalReader DealProposalReader
-	ProposalWriter DealProposalWriter
-	ResponseReader DealResponseReader
-	ResponseWriter DealResponseWriter
-	PaymentReader  DealPaymentReader
-	PaymentWriter  DealPaymentWriter
+	PeerID             peer.ID
+	ProposalReader     DealProposalReader
+	ProposalWriter     DealProposalWriter
+	ResponseReader     DealResponseReader
+	ResponseWriter     DealResponseWriter
+	PaymentReader      DealPaymentReader
+	PaymentWriter      DealPaymentWriter
+	CancellationWriter DealCancellationWriter
 }
 
 // NewTestRetrievalDealStream returns a new TestRetrievalDealStream with the
 // behavior specified by the paramaters, or default behaviors if not specified.
 func NewTestRetrievalDealStream(params TestDealStreamParams) rmnet.RetrievalDealStream {
 	stream := TestRetrievalDealStream{
-		p:              params.PeerID,
-		proposalReader: TrivialDealProposalReader,
-		proposalWriter: TrivialDealProposalWriter,
-		responseReader: TrivialDealResponseReader,
-		responseWriter: TrivialDealResponseWriter,
-		paymentReader:  TrivialDealPaymentReader,
-		paymentWriter:  TrivialDealPaymentWriter,
+		p:                  params.PeerID,
+		proposalReader:     TrivialDealProposalReader,
+		proposalWriter:     TrivialDealProposalWriter,
+		responseReader:     TrivialDealResponseReader,
+		responseWriter:     TrivialDealResponseWriter,
+		paymentReader:      TrivialDealPaymentReader,
+		paymentWriter:      TrivialDealPaymentWriter,
+		cancellationWriter: TrivialDealCancellationWriter,
 	}
 	if params.ProposalReader != nil {
 		stream.proposalReader = params.ProposalReader
@@ -163,6 +173,9 @@ func NewTestRetrievalDealStream(params TestDealStreamParams) rmnet.RetrievalDeal
 	if params.PaymentWriter != nil {
 		stream.paymentWriter = params.PaymentWriter
 	}
+	if params.CancellationWriter != nil {
+		stream.cancellationWriter = params.CancellationWriter
+	}
 	return &stream
 }
 
@@ -196,6 +209,14 @@ func (trds *TestRetrievalDealStream) WriteDealPayment(dealPayment rm.DealPayment
 	return trds.paymentWriter(dealPayment)
 }
 
+// WriteDealCancellation calls the mocked deal cancellation writer function.
+func (trds *TestRetrievalDealStream) WriteDealCancellation(dealCancellation rm.DealCancellation) error {
+	return trds.cancellationWriter(dealCancellation)
+}
+
+// Receiver returns the other peer
+func (trds TestRetrievalDealStream) Receiver() peer.ID { return trds.p }
+
 // Close closes the stream (does nothing for mocked stream)
 func (trds TestRetrievalDealStream) Close() error { return nil }
 
@@ -323,6 +344,11 @@ func FailDealPaymentWriter(rm.DealPayment) error {
 	return errors.New("write proposal failed")
 }
 
+// CancelledDealPaymentReader always reads a cancellation instead of a payment
+func CancelledDealPaymentReader() (rm.DealPayment, error) {
+	return rm.DealPaymentUndefined, rm.ErrDealCancelled
+}
+
 // FailDealPaymentReader always fails
 func FailDealPaymentReader() (rm.DealPayment, error) {
 	return rm.DealPaymentUndefined, errors.New("write proposal failed")
@@ -396,6 +422,11 @@ func TrivialDealPaymentWriter(rm.DealPayment) error {
 	return nil
 }
 
+// TrivialDealCancellationWriter succeeds trivially, returning no error.
+func TrivialDealCancellationWriter(rm.DealCancellation) error {
+	return nil
+}
+
 // StubbedQueryReader returns the given query when called
 func StubbedQueryReader(query rm.Query) QueryReader {
 	return func() (rm.Query, error) {
@@ -434,6 +465,17 @@ func ExpectDealResponseWriter(t *testing.T, expectedDealResponse rm.DealResponse
 	}
 }
 
+// ExpectDealResponsesWriter will fail if the written deal responses don't match the
+// expected deal responses, in order
+func ExpectDealResponsesWriter(t *testing.T, expectedDealResponses ...rm.DealResponse) DealResponseWriter {
+	return func(dealResponse rm.DealResponse) error {
+		require.NotEmpty(t, expectedDealResponses, "unexpected deal response")
+		require.Equal(t, expectedDealResponses[0], dealResponse)
+		expectedDealResponses = expectedDealResponses[1:]
+		return nil
+	}
+}
+
 // QueryReadWriter will read only if something is written, otherwise it errors
 func QueryReadWriter() (QueryReader, QueryWriter) {
 	var q rm.Query
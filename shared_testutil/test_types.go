@@ -1,12 +1,17 @@
 package shared_testutil
 
 import (
+	"bytes"
 	"math/big"
 	"math/rand"
 	"testing"
 
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-data-transfer/testutil"
+	"github.com/ipld/go-ipld-prime/encoding/dagcbor"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/libp2p/go-libp2p-core/test"
 	"github.com/stretchr/testify/require"
 
@@ -69,23 +74,45 @@ func MakeTestQueryResponse() retrievalmarket.QueryResponse {
 		MinPricePerByte:            MakeTestTokenAmount(),
 		MaxPaymentInterval:         rand.Uint64(),
 		MaxPaymentIntervalIncrease: rand.Uint64(),
+		UnsealPrice:                MakeTestTokenAmount(),
+		Unsealed:                   true,
+		ExpectedTimeToFirstByte:    rand.Uint64(),
+		Items: []retrievalmarket.QueryItemResponse{
+			{Status: retrievalmarket.QueryItemAvailable, Size: rand.Uint64()},
+			{Status: retrievalmarket.QueryItemUnknown},
+		},
 	}
 }
 
 // MakeTestDealProposal generates a valid, random DealProposal
 func MakeTestDealProposal() retrievalmarket.DealProposal {
-	cid := testutil.GenerateCids(1)[0]
+	cids := testutil.GenerateCids(2)
 	return retrievalmarket.DealProposal{
-		PieceCID: cid.Bytes(),
+		PieceCID: cids[0].Bytes(),
 		ID:       retrievalmarket.DealID(rand.Uint64()),
 		Params: retrievalmarket.Params{
+			PayloadCID:              cids[1],
+			Selector:                MakeTestSelector(),
 			PricePerByte:            MakeTestTokenAmount(),
 			PaymentInterval:         rand.Uint64(),
 			PaymentIntervalIncrease: rand.Uint64(),
+			UnsealPrice:             MakeTestTokenAmount(),
 		},
 	}
 }
 
+// MakeTestSelector generates an encoded selector for a whole DAG
+func MakeTestSelector() []byte {
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	allSelector := ssb.ExploreRecursive(selector.RecursionLimitNone(),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	var buf bytes.Buffer
+	if err := dagcbor.Encoder(allSelector, &buf); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
 // MakeTestDealProposal generates a valid, random DealResponse
 func MakeTestDealResponse() retrievalmarket.DealResponse {
 	fakeBlk := retrievalmarket.Block{
@@ -1,7 +1,10 @@
 package storageimpl
 
 import (
+	"bytes"
 	"context"
+	"reflect"
+	"sync"
 
 	"github.com/filecoin-project/go-data-transfer"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
@@ -10,6 +13,7 @@ import (
 	"github.com/filecoin-project/go-fil-markets/pieceio"
 	"github.com/filecoin-project/go-fil-markets/pieceio/cario"
 	"github.com/filecoin-project/go-fil-markets/pieceio/padreader"
+	"github.com/filecoin-project/go-fil-markets/shared/fsm"
 	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
 
 	"github.com/ipfs/go-cid"
@@ -63,15 +67,19 @@ type Client struct {
 	incoming chan *ClientDeal
 	updated  chan clientDealUpdate
 
+	subscribersLk sync.RWMutex
+	subscribers   []storagemarket.ClientSubscriber
+
 	stop    chan struct{}
 	stopped chan struct{}
 }
 
+// clientDealUpdate is an event in the lifecycle of a deal, see clientDeals
 type clientDealUpdate struct {
-	newState storagemarket.DealState
-	id       cid.Cid
-	err      error
-	mut      func(*ClientDeal)
+	event string
+	id    cid.Cid
+	err   error
+	mut   func(*ClientDeal)
 }
 
 func NewClient(h host.Host, bs blockstore.Blockstore, dataTransfer datatransfer.Manager, discovery *discovery.Local, deals *statestore.StateStore, scn storagemarket.StorageClientNode) (*Client, error) {
@@ -82,6 +90,9 @@ func NewClient(h host.Host, bs blockstore.Blockstore, dataTransfer datatransfer.
 		return nil, err
 	}
 	pio := pieceio.NewPieceIO(pr, carIO, fs, bs)
+	if err := discovery.Migrate(); err != nil {
+		return nil, xerrors.Errorf("migrating retrieval peers: %w", err)
+	}
 
 	c := &Client{
 		h:            h,
@@ -120,6 +131,136 @@ func (c *Client) Run(ctx context.Context) {
 			}
 		}
 	}()
+
+	go c.restartDeals(ctx)
+}
+
+// restartDeals picks up the deals that were in progress when the client last
+// stopped, reconciling their states with the deals on chain
+func (c *Client) restartDeals(ctx context.Context) {
+	deals, err := c.List()
+	if err != nil {
+		log.Errorf("listing deals to restart: %s", err)
+		return
+	}
+
+	type chainDeals struct {
+		deals []storagemarket.StorageDeal
+		err   error
+	}
+	onChain := make(map[address.Address]chainDeals)
+
+	// deals on chain that tracked deals already know the ids of can't be
+	// the answer to a lost proposal
+	claimed := make(map[storagemarket.DealID]bool)
+	for _, deal := range deals {
+		if hasDealID(deal.State) {
+			claimed[storagemarket.DealID(deal.DealID)] = true
+		}
+	}
+
+	for _, deal := range deals {
+		client := deal.Proposal.Client
+		listed, ok := onChain[client]
+		if !ok {
+			listed.deals, listed.err = c.node.ListClientDeals(ctx, client)
+			if listed.err != nil {
+				log.Warnf("listing deals on chain for %s, restarting deals without checking them: %s", client, listed.err)
+			}
+			onChain[client] = listed
+		}
+
+		update, ok := restartDeal(deal, listed.deals, listed.err, claimed)
+		if !ok {
+			continue
+		}
+
+		log.Infof("restarting deal %s in state %s", deal.ProposalCid, storagemarket.DealStates[deal.State])
+		select {
+		case c.updated <- update:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// restartDeal returns the update that puts a deal back in progress, or false
+// if the deal is finished. Deals that are active on chain are complete, and
+// deals that have left the chain have failed. A proposal whose answer was lost
+// with the connection is staged if it was published, and fails otherwise. If
+// the deals on chain could not be listed, deals are resumed where they stopped.
+// Deals on chain that deals are matched to are added to claimed
+func restartDeal(deal ClientDeal, onChain []storagemarket.StorageDeal, listErr error, claimed map[storagemarket.DealID]bool) (clientDealUpdate, bool) {
+	update := clientDealUpdate{
+		event: clientDealRestarted,
+		id:    deal.ProposalCid,
+	}
+
+	switch deal.State {
+	case storagemarket.DealUnknown, storagemarket.DealAccepted, storagemarket.DealStaged, storagemarket.DealSealing:
+	default:
+		return clientDealUpdate{}, false
+	}
+
+	if listErr == nil {
+		chainDeal, found := findChainDeal(deal, onChain, claimed)
+		if found {
+			claimed[chainDeal.DealID] = true
+			update.mut = func(deal *ClientDeal) {
+				deal.DealID = uint64(chainDeal.DealID)
+			}
+		}
+		switch {
+		case found && chainDeal.ActivationEpoch != 0:
+			update.event = clientDealActivated
+			return update, true
+		case found && deal.State == storagemarket.DealUnknown:
+			update.event = clientDealFoundOnChain
+			return update, true
+		case !found && hasDealID(deal.State):
+			update.event = clientDealFailed
+			update.err = xerrors.New("deal is no longer on chain")
+			return update, true
+		}
+	}
+
+	if deal.State == storagemarket.DealUnknown {
+		// the provider's answer to the proposal was lost with the connection
+		update.event = clientDealFailed
+		update.err = xerrors.New("connection to provider lost before the deal was accepted")
+	}
+	return update, true
+}
+
+// hasDealID returns whether deals in a state know their id on chain
+func hasDealID(state storagemarket.DealState) bool {
+	return state == storagemarket.DealStaged || state == storagemarket.DealSealing || state == storagemarket.DealComplete
+}
+
+// findChainDeal finds a deal on chain: by its id if the deal knows it, and
+// otherwise as the unclaimed deal on chain made from its proposal
+func findChainDeal(deal ClientDeal, onChain []storagemarket.StorageDeal, claimed map[storagemarket.DealID]bool) (storagemarket.StorageDeal, bool) {
+	proposal := deal.Proposal
+	for _, chainDeal := range onChain {
+		if hasDealID(deal.State) {
+			if chainDeal.DealID == storagemarket.DealID(deal.DealID) {
+				return chainDeal, true
+			}
+			continue
+		}
+		if !claimed[chainDeal.DealID] &&
+			bytes.Equal(chainDeal.PieceRef, proposal.PieceRef) &&
+			chainDeal.PieceSize == proposal.PieceSize &&
+			chainDeal.Client == proposal.Client &&
+			chainDeal.Provider == proposal.Provider &&
+			chainDeal.ProposalExpiration == proposal.ProposalExpiration &&
+			chainDeal.Duration == proposal.Duration &&
+			chainDeal.StoragePricePerEpoch.Equals(proposal.StoragePricePerEpoch) &&
+			chainDeal.StorageCollateral.Equals(proposal.StorageCollateral) {
+			return chainDeal, true
+		}
+	}
+	return storagemarket.StorageDeal{}, false
 }
 
 func (c *Client) onIncoming(deal *ClientDeal) {
@@ -140,24 +281,34 @@ func (c *Client) onIncoming(deal *ClientDeal) {
 
 	go func() {
 		c.updated <- clientDealUpdate{
-			newState: storagemarket.DealUnknown,
-			id:       deal.ProposalCid,
-			err:      nil,
+			event: clientDealOpened,
+			id:    deal.ProposalCid,
+			err:   nil,
 		}
 	}()
 }
 
+// onUpdated moves a deal to the state an event leads to, then runs the entry
+// handler for that state. Events that can't happen in the state the deal is in
+// are dropped
 func (c *Client) onUpdated(ctx context.Context, update clientDealUpdate) {
-	log.Infof("Client deal %s updated state to %s", update.id, storagemarket.DealStates[update.newState])
 	var deal ClientDeal
 	err := c.deals.Get(update.id).Mutate(func(d *ClientDeal) error {
-		d.State = update.newState
+		next, err := clientDeals.Next(d.State, update.event)
+		if err != nil {
+			return err
+		}
+		d.State = next
 		if update.mut != nil {
 			update.mut(d)
 		}
 		deal = *d
 		return nil
 	})
+	if xerrors.Is(err, fsm.ErrIllegalTransition) {
+		log.Errorf("deal %s: %s", update.id, err)
+		return
+	}
 	if update.err != nil {
 		log.Errorf("deal %s failed: %s", update.id, update.err)
 		c.failDeal(update.id, update.err)
@@ -168,19 +319,59 @@ func (c *Client) onUpdated(ctx context.Context, update clientDealUpdate) {
 		return
 	}
 
-	switch update.newState {
-	case storagemarket.DealUnknown: // new
-		c.handle(ctx, deal, c.new, storagemarket.DealAccepted)
-	case storagemarket.DealAccepted:
-		c.handle(ctx, deal, c.accepted, storagemarket.DealStaged)
-	case storagemarket.DealStaged:
-		c.handle(ctx, deal, c.staged, storagemarket.DealSealing)
-	case storagemarket.DealSealing:
-		c.handle(ctx, deal, c.sealing, storagemarket.DealNoUpdate)
-		// TODO: DealComplete -> watch for faults, expiration, etc.
+	log.Infof("Client deal %s updated state to %s", update.id, storagemarket.DealStates[deal.State])
+
+	if event, ok := clientEvents[deal.State]; ok {
+		c.notifySubscribers(event, deal.ClientDeal, nil)
+	}
+
+	if entry, ok := clientStateEntries[deal.State]; ok {
+		c.handle(ctx, deal, entry)
 	}
 }
 
+// clientEvents are the events subscribers are notified of when deals enter
+// each state
+var clientEvents = map[storagemarket.DealState]storagemarket.ClientEvent{
+	storagemarket.DealUnknown:  storagemarket.ClientEventOpen,
+	storagemarket.DealAccepted: storagemarket.ClientEventAccepted,
+	storagemarket.DealStaged:   storagemarket.ClientEventStaged,
+	storagemarket.DealSealing:  storagemarket.ClientEventSealing,
+	storagemarket.DealComplete: storagemarket.ClientEventComplete,
+}
+
+func (c *Client) unsubscribeAt(sub storagemarket.ClientSubscriber) storagemarket.Unsubscribe {
+	return func() {
+		c.subscribersLk.Lock()
+		defer c.subscribersLk.Unlock()
+		curLen := len(c.subscribers)
+		for i, el := range c.subscribers {
+			if reflect.ValueOf(sub) == reflect.ValueOf(el) {
+				c.subscribers[i] = c.subscribers[curLen-1]
+				c.subscribers = c.subscribers[:curLen-1]
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) notifySubscribers(evt storagemarket.ClientEvent, deal storagemarket.ClientDeal, err error) {
+	c.subscribersLk.RLock()
+	defer c.subscribersLk.RUnlock()
+	for _, cb := range c.subscribers {
+		cb(evt, deal, err)
+	}
+}
+
+// SubscribeToEvents listens for events that happen related to storage deals on a client
+func (c *Client) SubscribeToEvents(subscriber storagemarket.ClientSubscriber) storagemarket.Unsubscribe {
+	c.subscribersLk.Lock()
+	c.subscribers = append(c.subscribers, subscriber)
+	c.subscribersLk.Unlock()
+
+	return c.unsubscribeAt(subscriber)
+}
+
 type ClientDealProposal struct {
 	Data cid.Cid
 
@@ -192,14 +383,17 @@ type ClientDealProposal struct {
 	Client          address.Address
 	MinerWorker     address.Address
 	MinerID         peer.ID
+
+	// Asks are the provider's asks, one of which the proposal must meet before
+	// it is sent, if set
+	Asks []types.StorageAsk
+
+	// Collateral is the storage collateral to propose. If it is nil, it is
+	// computed from the ask the proposal meets
+	Collateral tokenamount.TokenAmount
 }
 
 func (c *Client) Start(ctx context.Context, p ClientDealProposal) (cid.Cid, error) {
-	amount := tokenamount.Mul(p.PricePerEpoch, tokenamount.FromInt(p.Duration))
-	if err := c.node.EnsureFunds(ctx, p.Client, amount); err != nil {
-		return cid.Undef, xerrors.Errorf("adding market funds failed: %w", err)
-	}
-
 	commP, pieceSize, err := c.commP(ctx, p.Data)
 	if err != nil {
 		return cid.Undef, xerrors.Errorf("computing commP failed: %w", err)
@@ -213,7 +407,24 @@ func (c *Client) Start(ctx context.Context, p ClientDealProposal) (cid.Cid, erro
 		ProposalExpiration:   p.ProposalExpiration,
 		Duration:             p.Duration,
 		StoragePricePerEpoch: p.PricePerEpoch,
-		StorageCollateral:    tokenamount.FromInt(uint64(pieceSize)), // TODO: real calc
+		StorageCollateral:    p.Collateral,
+	}
+
+	if len(p.Asks) > 0 {
+		ask, err := dealProposal.FindAsk(p.Asks)
+		if err != nil {
+			return cid.Undef, xerrors.Errorf("proposal does not meet provider's ask: %w", err)
+		}
+		if p.Collateral.Int == nil {
+			dealProposal.StorageCollateral = storagemarket.DealCollateral(ask, dealProposal.PieceSize)
+		}
+	}
+	if dealProposal.StorageCollateral.Int == nil {
+		dealProposal.StorageCollateral = tokenamount.FromInt(0)
+	}
+
+	if err := c.node.EnsureFunds(ctx, p.Client, dealProposal.TotalStoragePrice()); err != nil {
+		return cid.Undef, xerrors.Errorf("adding market funds failed: %w", err)
 	}
 
 	if err := c.node.SignProposal(ctx, p.Client, dealProposal); err != nil {
@@ -261,7 +472,46 @@ func (c *Client) Start(ctx context.Context, p ClientDealProposal) (cid.Cid, erro
 	})
 }
 
+// QueryAsk returns the first of a provider's current asks
 func (c *Client) QueryAsk(ctx context.Context, p peer.ID, a address.Address) (*types.SignedStorageAsk, error) {
+	out, err := c.queryAsks(ctx, p, a)
+	if err != nil {
+		return nil, err
+	}
+
+	if out.Ask == nil {
+		return nil, xerrors.Errorf("got no ask back")
+	}
+
+	if err := c.checkAsk(out.Ask, a); err != nil {
+		return nil, err
+	}
+
+	return out.Ask, nil
+}
+
+// QueryAsks returns all of a provider's current asks
+func (c *Client) QueryAsks(ctx context.Context, p peer.ID, a address.Address) ([]*types.SignedStorageAsk, error) {
+	out, err := c.queryAsks(ctx, p, a)
+	if err != nil {
+		return nil, err
+	}
+
+	asks := out.Asks
+	if len(asks) == 0 {
+		return nil, xerrors.Errorf("got no ask back")
+	}
+
+	for _, ask := range asks {
+		if err := c.checkAsk(ask, a); err != nil {
+			return nil, err
+		}
+	}
+
+	return asks, nil
+}
+
+func (c *Client) queryAsks(ctx context.Context, p peer.ID, a address.Address) (*AskResponse, error) {
 	s, err := c.h.NewStream(ctx, p, storagemarket.AskProtocolID)
 	if err != nil {
 		return nil, xerrors.Errorf("failed to open stream to miner: %w", err)
@@ -279,19 +529,23 @@ func (c *Client) QueryAsk(ctx context.Context, p peer.ID, a address.Address) (*t
 		return nil, xerrors.Errorf("failed to read ask response: %w", err)
 	}
 
-	if out.Ask == nil {
-		return nil, xerrors.Errorf("got no ask back")
+	return &out, nil
+}
+
+func (c *Client) checkAsk(ask *types.SignedStorageAsk, a address.Address) error {
+	if ask.Ask == nil {
+		return xerrors.Errorf("got back empty ask")
 	}
 
-	if out.Ask.Ask.Miner != a {
-		return nil, xerrors.Errorf("got back ask for wrong miner")
+	if ask.Ask.Miner != a {
+		return xerrors.Errorf("got back ask for wrong miner")
 	}
 
-	if err := c.checkAskSignature(out.Ask); err != nil {
-		return nil, xerrors.Errorf("ask was not properly signed")
+	if err := c.checkAskSignature(ask); err != nil {
+		return xerrors.Errorf("ask was not properly signed")
 	}
 
-	return out.Ask, nil
+	return nil
 }
 
 func (c *Client) List() ([]ClientDeal, error) {
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/filecoin-project/go-fil-markets/shared/types"
 	"github.com/libp2p/go-libp2p-core/peer"
 	cbg "github.com/whyrusleeping/cbor-gen"
 	xerrors "golang.org/x/xerrors"
@@ -61,7 +62,7 @@ func (t *ClientDealProposal) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{136}); err != nil {
+	if _, err := w.Write([]byte{138}); err != nil {
 		return err
 	}
 
@@ -112,6 +113,25 @@ func (t *ClientDealProposal) MarshalCBOR(w io.Writer) error {
 	if _, err := w.Write([]byte(t.MinerID)); err != nil {
 		return err
 	}
+
+	// t.Asks ([]types.StorageAsk) (slice)
+	if len(t.Asks) > cbg.MaxLength {
+		return xerrors.Errorf("Slice value in field t.Asks was too long")
+	}
+
+	if _, err := w.Write(cbg.CborEncodeMajorType(cbg.MajArray, uint64(len(t.Asks)))); err != nil {
+		return err
+	}
+	for _, v := range t.Asks {
+		if err := v.MarshalCBOR(w); err != nil {
+			return err
+		}
+	}
+
+	// t.Collateral (tokenamount.TokenAmount) (struct)
+	if err := t.Collateral.MarshalCBOR(w); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -126,7 +146,7 @@ func (t *ClientDealProposal) UnmarshalCBOR(r io.Reader) error {
 		return fmt.Errorf("cbor input should be of type array")
 	}
 
-	if extra != 8 {
+	if extra != 10 {
 		return fmt.Errorf("cbor input had wrong number of fields")
 	}
 
@@ -208,5 +228,41 @@ func (t *ClientDealProposal) UnmarshalCBOR(r io.Reader) error {
 
 		t.MinerID = peer.ID(sval)
 	}
+	// t.Asks ([]types.StorageAsk) (slice)
+
+	maj, extra, err = cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("t.Asks: array too large (%d)", extra)
+	}
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("expected cbor array")
+	}
+	if extra > 0 {
+		t.Asks = make([]types.StorageAsk, extra)
+	}
+	for i := 0; i < int(extra); i++ {
+
+		var v types.StorageAsk
+		if err := v.UnmarshalCBOR(br); err != nil {
+			return err
+		}
+
+		t.Asks[i] = v
+	}
+
+	// t.Collateral (tokenamount.TokenAmount) (struct)
+
+	{
+
+		if err := t.Collateral.UnmarshalCBOR(br); err != nil {
+			return err
+		}
+
+	}
 	return nil
 }
@@ -0,0 +1,76 @@
+package storageimpl
+
+import (
+	"github.com/filecoin-project/go-fil-markets/shared/fsm"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+// events that move client deals between states
+const (
+	clientDealOpened    = "opened"
+	clientDealAccepted  = "accepted"
+	clientDealPublished = "published"
+	clientDealStaged    = "staged"
+	clientDealSealed    = "sealed"
+	clientDealFailed    = "failed"
+
+	// clientDealActivated completes a deal found active on chain when the
+	// client restarts
+	clientDealActivated = "activated"
+
+	// clientDealFoundOnChain stages a deal whose proposal was published,
+	// but whose answer from the provider was lost
+	clientDealFoundOnChain = "foundOnChain"
+
+	// clientDealRestarted re-enters the state a deal was in when the client
+	// stopped
+	clientDealRestarted = "restarted"
+)
+
+// clientDeals is the lifecycle of a deal on the client
+var clientDeals = fsm.MustNewTable(
+	[]fsm.State{
+		storagemarket.DealUnknown,
+		storagemarket.DealAccepted,
+		storagemarket.DealStaged,
+		storagemarket.DealSealing,
+		storagemarket.DealComplete,
+		storagemarket.DealError,
+	},
+	[]fsm.State{storagemarket.DealComplete, storagemarket.DealError},
+
+	fsm.Event{Name: clientDealOpened, From: []fsm.State{storagemarket.DealUnknown}, NoChange: true},
+	fsm.Event{Name: clientDealAccepted, From: []fsm.State{storagemarket.DealUnknown}, To: storagemarket.DealAccepted},
+	fsm.Event{Name: clientDealPublished, From: []fsm.State{storagemarket.DealAccepted}, To: storagemarket.DealStaged},
+	fsm.Event{Name: clientDealStaged, From: []fsm.State{storagemarket.DealStaged}, To: storagemarket.DealSealing},
+	fsm.Event{Name: clientDealSealed, From: []fsm.State{storagemarket.DealSealing}, To: storagemarket.DealComplete},
+	fsm.Event{Name: clientDealFailed, To: storagemarket.DealError},
+	fsm.Event{Name: clientDealActivated, To: storagemarket.DealComplete},
+	fsm.Event{Name: clientDealFoundOnChain, From: []fsm.State{storagemarket.DealUnknown}, To: storagemarket.DealStaged},
+	fsm.Event{Name: clientDealRestarted, From: []fsm.State{
+		storagemarket.DealAccepted,
+		storagemarket.DealStaged,
+		storagemarket.DealSealing,
+	}, NoChange: true},
+)
+
+// clientStateEntry is what the client does when a deal enters a state: the
+// handler it runs, and the event it sends once the handler succeeds, if any
+type clientStateEntry struct {
+	handler clientHandlerFunc
+	done    string
+}
+
+var clientStateEntries = map[storagemarket.DealState]clientStateEntry{
+	storagemarket.DealUnknown:  {(*Client).new, clientDealAccepted},
+	storagemarket.DealAccepted: {(*Client).accepted, clientDealPublished},
+	storagemarket.DealStaged:   {(*Client).staged, clientDealStaged},
+	// sealing sends clientDealSealed once the sector is committed
+	storagemarket.DealSealing: {(*Client).sealing, ""},
+	// TODO: DealComplete -> watch for faults, expiration, etc.
+}
+
+// ClientDealTransitions lists every way a client deal can move between states
+func ClientDealTransitions() []fsm.Transition {
+	return clientDeals.Transitions()
+}
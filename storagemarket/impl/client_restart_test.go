@@ -0,0 +1,182 @@
+package storageimpl
+
+import (
+	"errors"
+	"testing"
+
+	blocksutil "github.com/ipfs/go-ipfs-blocksutil"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+func TestClient_RestartDeal(t *testing.T) {
+	blockGenerator := blocksutil.NewBlockGenerator()
+	proposalCid := blockGenerator.Next().Cid()
+	clientAddr, err := address.NewIDAddress(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	providerAddr, err := address.NewIDAddress(101)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposal := storagemarket.StorageDealProposal{
+		PieceRef:             blockGenerator.Next().Cid().Bytes(),
+		PieceSize:            2048,
+		Client:               clientAddr,
+		Provider:             providerAddr,
+		ProposalExpiration:   10,
+		Duration:             100,
+		StoragePricePerEpoch: tokenamount.FromInt(5),
+		StorageCollateral:    tokenamount.FromInt(2),
+	}
+	chainDeal := func(dealID storagemarket.DealID, activationEpoch uint64) storagemarket.StorageDeal {
+		return storagemarket.StorageDeal{
+			PieceRef:             proposal.PieceRef,
+			PieceSize:            proposal.PieceSize,
+			Client:               proposal.Client,
+			Provider:             proposal.Provider,
+			ProposalExpiration:   proposal.ProposalExpiration,
+			Duration:             proposal.Duration,
+			StoragePricePerEpoch: proposal.StoragePricePerEpoch,
+			StorageCollateral:    proposal.StorageCollateral,
+			ActivationEpoch:      activationEpoch,
+			DealID:               dealID,
+		}
+	}
+	otherDeal := chainDeal(8, 0)
+	otherDeal.Duration = 200
+
+	testCases := map[string]struct {
+		state     storagemarket.DealState
+		dealID    uint64
+		onChain   []storagemarket.StorageDeal
+		listErr   error
+		claimed   []storagemarket.DealID
+		restarted bool
+		newState  storagemarket.DealState
+		newDealID uint64
+		failed    bool
+	}{
+		"accepted deal is validated": {
+			state:     storagemarket.DealAccepted,
+			onChain:   []storagemarket.StorageDeal{chainDeal(7, 0)},
+			restarted: true,
+			newState:  storagemarket.DealAccepted,
+			newDealID: 7,
+		},
+		"sealing deal waits for commit again": {
+			state:     storagemarket.DealSealing,
+			dealID:    7,
+			onChain:   []storagemarket.StorageDeal{otherDeal, chainDeal(7, 0)},
+			restarted: true,
+			newState:  storagemarket.DealSealing,
+			newDealID: 7,
+		},
+		"active deal is complete": {
+			state:     storagemarket.DealSealing,
+			dealID:    7,
+			onChain:   []storagemarket.StorageDeal{chainDeal(7, 50)},
+			restarted: true,
+			newState:  storagemarket.DealComplete,
+			newDealID: 7,
+		},
+		"deal gone from chain fails": {
+			state:     storagemarket.DealStaged,
+			dealID:    7,
+			onChain:   []storagemarket.StorageDeal{otherDeal},
+			restarted: true,
+			newState:  storagemarket.DealError,
+			failed:    true,
+		},
+		"staged deal is found by its id, not its proposal": {
+			state:     storagemarket.DealStaged,
+			dealID:    7,
+			onChain:   []storagemarket.StorageDeal{chainDeal(9, 0)},
+			restarted: true,
+			newState:  storagemarket.DealError,
+			failed:    true,
+		},
+		"deal resumes if chain can't be listed": {
+			state:     storagemarket.DealStaged,
+			dealID:    7,
+			listErr:   errors.New("chain unavailable"),
+			restarted: true,
+			newState:  storagemarket.DealStaged,
+			newDealID: 7,
+		},
+		"proposal without answer fails": {
+			state:     storagemarket.DealUnknown,
+			restarted: true,
+			newState:  storagemarket.DealError,
+			failed:    true,
+		},
+		"proposal published on chain is staged": {
+			state:     storagemarket.DealUnknown,
+			onChain:   []storagemarket.StorageDeal{chainDeal(7, 0)},
+			restarted: true,
+			newState:  storagemarket.DealStaged,
+			newDealID: 7,
+		},
+		"proposal active on chain is complete": {
+			state:     storagemarket.DealUnknown,
+			onChain:   []storagemarket.StorageDeal{chainDeal(7, 50)},
+			restarted: true,
+			newState:  storagemarket.DealComplete,
+			newDealID: 7,
+		},
+		"proposal is not matched to a deal another deal has claimed": {
+			state:     storagemarket.DealUnknown,
+			onChain:   []storagemarket.StorageDeal{chainDeal(7, 0)},
+			claimed:   []storagemarket.DealID{7},
+			restarted: true,
+			newState:  storagemarket.DealError,
+			failed:    true,
+		},
+		"complete deal is left alone": {state: storagemarket.DealComplete},
+		"failed deal is left alone":   {state: storagemarket.DealError},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			deal := ClientDeal{ClientDeal: storagemarket.ClientDeal{
+				ProposalCid: proposalCid,
+				Proposal:    proposal,
+				State:       tc.state,
+				DealID:      tc.dealID,
+			}}
+			claimed := make(map[storagemarket.DealID]bool)
+			for _, id := range tc.claimed {
+				claimed[id] = true
+			}
+
+			update, restarted := restartDeal(deal, tc.onChain, tc.listErr, claimed)
+			if restarted != tc.restarted {
+				t.Fatalf("expected restarted to be %t", tc.restarted)
+			}
+			if !restarted {
+				return
+			}
+			if update.id != proposalCid {
+				t.Fatalf("update is for the wrong deal: %s", update.id)
+			}
+			newState, err := clientDeals.Next(tc.state, update.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if newState != tc.newState {
+				t.Fatalf("expected state %s, got %s", storagemarket.DealStates[tc.newState], storagemarket.DealStates[newState])
+			}
+			if (update.err != nil) != tc.failed {
+				t.Fatalf("unexpected update error: %v", update.err)
+			}
+			if update.mut != nil {
+				update.mut(&deal)
+			}
+			if !tc.failed && deal.DealID != tc.newDealID {
+				t.Fatalf("expected deal id %d, got %d", tc.newDealID, deal.DealID)
+			}
+		})
+	}
+}
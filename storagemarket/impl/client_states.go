@@ -9,25 +9,27 @@ import (
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 )
 
-type clientHandlerFunc func(ctx context.Context, deal ClientDeal) (func(*ClientDeal), error)
+type clientHandlerFunc func(c *Client, ctx context.Context, deal ClientDeal) (func(*ClientDeal), error)
 
-func (c *Client) handle(ctx context.Context, deal ClientDeal, cb clientHandlerFunc, next storagemarket.DealState) {
+// handle runs the handler for the state a deal has entered, then sends the
+// state's done event, or fails the deal if the handler failed
+func (c *Client) handle(ctx context.Context, deal ClientDeal, entry clientStateEntry) {
 	go func() {
-		mut, err := cb(ctx, deal)
-		if err != nil {
-			next = storagemarket.DealError
-		}
+		mut, err := entry.handler(c, ctx, deal)
 
-		if err == nil && next == storagemarket.DealNoUpdate {
+		event := entry.done
+		if err != nil {
+			event = clientDealFailed
+		} else if event == "" {
 			return
 		}
 
 		select {
 		case c.updated <- clientDealUpdate{
-			newState: next,
-			id:       deal.ProposalCid,
-			err:      err,
-			mut:      mut,
+			event: event,
+			id:    deal.ProposalCid,
+			err:   err,
+			mut:   mut,
 		}:
 		case <-c.stop:
 		}
@@ -77,11 +79,16 @@ func (c *Client) staged(ctx context.Context, deal ClientDeal) (func(*ClientDeal)
 
 func (c *Client) sealing(ctx context.Context, deal ClientDeal) (func(*ClientDeal), error) {
 	cb := func(err error) {
+		event := clientDealSealed
+		if err != nil {
+			event = clientDealFailed
+		}
+
 		select {
 		case c.updated <- clientDealUpdate{
-			newState: storagemarket.DealComplete,
-			id:       deal.ProposalCid,
-			err:      err,
+			event: event,
+			id:    deal.ProposalCid,
+			err:   err,
 		}:
 		case <-c.stop:
 		}
@@ -82,7 +82,19 @@ func (c *Client) GetAsk(ctx context.Context, info storagemarket.StorageProviderI
 	return c.QueryAsk(ctx, info.PeerID, info.Address)
 }
 
+func (c *Client) ListAsks(ctx context.Context, info storagemarket.StorageProviderInfo) ([]*types.SignedStorageAsk, error) {
+	return c.QueryAsks(ctx, info.PeerID, info.Address)
+}
+
 func (c *Client) ProposeStorageDeal(ctx context.Context, addr address.Address, info *storagemarket.StorageProviderInfo, payloadCid cid.Cid, proposalExpiration storagemarket.Epoch, duration storagemarket.Epoch, price tokenamount.TokenAmount, collateral tokenamount.TokenAmount) (*storagemarket.ProposeStorageDealResult, error) {
+	signedAsks, err := c.ListAsks(ctx, *info)
+	if err != nil {
+		return nil, xerrors.Errorf("getting asks from %s: %w", info.Address, err)
+	}
+	asks := make([]types.StorageAsk, 0, len(signedAsks))
+	for _, ask := range signedAsks {
+		asks = append(asks, *ask.Ask)
+	}
 
 	proposal := ClientDealProposal{
 		Data:               payloadCid,
@@ -93,6 +105,8 @@ func (c *Client) ProposeStorageDeal(ctx context.Context, addr address.Address, i
 		ProviderAddress:    info.Address,
 		MinerWorker:        info.Worker,
 		MinerID:            info.PeerID,
+		Asks:               asks,
+		Collateral:         collateral,
 	}
 
 	proposalCid, err := c.Start(ctx, proposal)
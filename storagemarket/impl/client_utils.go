@@ -16,6 +16,8 @@ import (
 	"github.com/filecoin-project/go-cbor-util"
 	"github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-statestore"
+
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
 )
 
 func (c *Client) failDeal(id cid.Cid, cerr error) {
@@ -32,6 +34,13 @@ func (c *Client) failDeal(id cid.Cid, cerr error) {
 
 	// TODO: store in some sort of audit log
 	log.Errorf("deal %s failed: %+v", id, cerr)
+
+	var deal ClientDeal
+	if err := c.deals.Get(id).Get(&deal); err != nil {
+		log.Warnf("deals.Get: %s", err)
+		deal.ProposalCid = id
+	}
+	c.notifySubscribers(storagemarket.ClientEventError, deal.ClientDeal, cerr)
 }
 
 func (c *Client) commP(ctx context.Context, root cid.Cid) ([]byte, uint64, error) {
@@ -0,0 +1,71 @@
+package storageimpl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/shared/types"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+const (
+	// dealFilterTimeout is how long an external deal filter has to decide on a deal
+	dealFilterTimeout = 30 * time.Second
+
+	// maxDealFilterReason is the most of a deal filter's output the client is sent
+	maxDealFilterReason = 256
+)
+
+// dealFilterInput is what an external deal filter reads on stdin, as JSON
+type dealFilterInput struct {
+	Deal storagemarket.MinerDeal
+	Ask  types.StorageAsk
+}
+
+// NewExternalDealFilter returns a deal filter that runs a command for every
+// deal, with the deal and the provider's ask as JSON on its stdin. The deal is
+// accepted if the command exits with status 0, and rejected otherwise, with the
+// command's stdout as the reason. Its stderr is only logged, and the command is
+// killed if it takes longer than dealFilterTimeout
+func NewExternalDealFilter(cmd string, args ...string) storagemarket.StorageDealFilter {
+	return func(ctx context.Context, deal storagemarket.MinerDeal, ask types.StorageAsk) (bool, string, error) {
+		input, err := json.Marshal(&dealFilterInput{Deal: deal, Ask: ask})
+		if err != nil {
+			return false, "", xerrors.Errorf("encoding deal for %s: %w", cmd, err)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, dealFilterTimeout)
+		defer cancel()
+
+		var stdout, stderr bytes.Buffer
+		c := exec.CommandContext(ctx, cmd, args...)
+		c.Stdin = bytes.NewReader(input)
+		c.Stdout = &stdout
+		c.Stderr = &stderr
+
+		err = c.Run()
+		if stderr.Len() > 0 {
+			log.Warnf("deal filter %s for deal %s: %s", cmd, deal.ProposalCid, strings.TrimSpace(stderr.String()))
+		}
+		if ctx.Err() != nil {
+			return false, "", xerrors.Errorf("running %s: %w", cmd, ctx.Err())
+		}
+		if _, ok := err.(*exec.ExitError); ok {
+			reason := strings.TrimSpace(stdout.String())
+			if len(reason) > maxDealFilterReason {
+				reason = reason[:maxDealFilterReason]
+			}
+			return false, reason, nil
+		}
+		if err != nil {
+			return false, "", xerrors.Errorf("running %s: %w", cmd, err)
+		}
+		return true, "", nil
+	}
+}
@@ -0,0 +1,108 @@
+package storageimpl_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
+	"github.com/filecoin-project/go-fil-markets/shared/types"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	deals "github.com/filecoin-project/go-fil-markets/storagemarket/impl"
+)
+
+func TestExternalDealFilter(t *testing.T) {
+	ctx := context.Background()
+	proposal, err := uniqueStorageDealProposal()
+	if err != nil {
+		t.Fatal("unable to create proposal")
+	}
+	proposal.PieceSize = 2048
+	proposal.StoragePricePerEpoch = tokenamount.FromInt(10)
+	proposal.StorageCollateral = tokenamount.FromInt(0)
+	deal := storagemarket.MinerDeal{
+		ProposalCid: blockGenerator.Next().Cid(),
+		Proposal:    proposal,
+		Ref:         blockGenerator.Next().Cid(),
+	}
+	ask := types.StorageAsk{
+		Price:        tokenamount.FromInt(5),
+		MinPieceSize: 256,
+		Miner:        proposal.Provider,
+
+		CollateralPerGiB: tokenamount.FromInt(0),
+	}
+
+	t.Run("accepts on success", func(t *testing.T) {
+		filter := deals.NewExternalDealFilter("sh", "-c", "cat > /dev/null")
+		accept, reason, err := filter(ctx, deal, ask)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !accept || reason != "" {
+			t.Fatalf("expected deal to be accepted, got %t %q", accept, reason)
+		}
+	})
+
+	t.Run("receives deal and ask", func(t *testing.T) {
+		filter := deals.NewExternalDealFilter("sh", "-c", `input=$(cat); case "$input" in *'"PieceSize":2048'*'"MinPieceSize":256'*) exit 0;; esac; echo "bad input: $input"; exit 1`)
+		accept, reason, err := filter(ctx, deal, ask)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !accept {
+			t.Fatalf("expected deal to be accepted, got rejected: %s", reason)
+		}
+	})
+
+	t.Run("rejects with output", func(t *testing.T) {
+		filter := deals.NewExternalDealFilter("sh", "-c", "cat > /dev/null; echo 'not today'; exit 1")
+		accept, reason, err := filter(ctx, deal, ask)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if accept || reason != "not today" {
+			t.Fatalf("expected rejection with reason, got %t %q", accept, reason)
+		}
+	})
+
+	t.Run("sends only stdout to the client", func(t *testing.T) {
+		filter := deals.NewExternalDealFilter("sh", "-c", "cat > /dev/null; echo 'internal detail' >&2; echo 'not today'; exit 1")
+		accept, reason, err := filter(ctx, deal, ask)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if accept || reason != "not today" {
+			t.Fatalf("expected rejection with stdout as reason, got %t %q", accept, reason)
+		}
+	})
+
+	t.Run("caps the reason's length", func(t *testing.T) {
+		filter := deals.NewExternalDealFilter("sh", "-c", "cat > /dev/null; head -c 1000 /dev/zero | tr '\\0' x; exit 1")
+		accept, reason, err := filter(ctx, deal, ask)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if accept || len(reason) != 256 {
+			t.Fatalf("expected rejection with a 256 byte reason, got %t and %d bytes", accept, len(reason))
+		}
+	})
+
+	t.Run("errors if command takes too long", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		filter := deals.NewExternalDealFilter("sh", "-c", "cat > /dev/null; exec sleep 10")
+		_, _, err := filter(ctx, deal, ask)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("errors if command can't run", func(t *testing.T) {
+		filter := deals.NewExternalDealFilter("/nonexistent/deal-filter")
+		_, _, err := filter(ctx, deal, ask)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package storageimpl
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blocksutil "github.com/ipfs/go-ipfs-blocksutil"
+	inet "github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-statestore"
+)
+
+var testAddress, _ = address.NewIDAddress(100)
+
+func testEventsProposal() storagemarket.StorageDealProposal {
+	return storagemarket.StorageDealProposal{
+		Client:               testAddress,
+		Provider:             testAddress,
+		StoragePricePerEpoch: tokenamount.FromInt(1),
+		StorageCollateral:    tokenamount.FromInt(0),
+	}
+}
+
+func TestProvider_SubscribeToEvents(t *testing.T) {
+	ctx := context.Background()
+	blockGenerator := blocksutil.NewBlockGenerator()
+	p := &Provider{
+		deals: statestore.New(dss.MutexWrap(datastore.NewMapDatastore())),
+		conns: map[cid.Cid]inet.Stream{},
+	}
+
+	type event struct {
+		event storagemarket.ProviderEvent
+		deal  storagemarket.MinerDeal
+		err   error
+	}
+	var events []event
+	unsubscribe := p.SubscribeToEvents(func(evt storagemarket.ProviderEvent, deal storagemarket.MinerDeal, err error) {
+		events = append(events, event{evt, deal, err})
+	})
+
+	completed := blockGenerator.Next().Cid()
+	if err := p.deals.Begin(completed, &MinerDeal{MinerDeal: storagemarket.MinerDeal{ProposalCid: completed, Proposal: testEventsProposal(), Ref: completed, DealID: 4, State: storagemarket.DealSealing}}); err != nil {
+		t.Fatal(err)
+	}
+	p.onUpdated(ctx, minerDealUpdate{event: providerDealSealed, id: completed})
+
+	failed := blockGenerator.Next().Cid()
+	if err := p.deals.Begin(failed, &MinerDeal{MinerDeal: storagemarket.MinerDeal{ProposalCid: failed, Proposal: testEventsProposal(), Ref: failed, State: storagemarket.DealTransferring}}); err != nil {
+		t.Fatal(err)
+	}
+	p.onUpdated(ctx, minerDealUpdate{event: providerDealFailed, id: failed, err: ErrDataTransferFailed})
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if events[0].event != storagemarket.ProviderEventComplete || events[0].deal.ProposalCid != completed || events[0].deal.DealID != 4 || events[0].err != nil {
+		t.Fatalf("unexpected completion event: %+v", events[0])
+	}
+	if events[0].deal.State != storagemarket.DealComplete {
+		t.Fatalf("expected completion event to carry the updated deal, got state %s", storagemarket.DealStates[events[0].deal.State])
+	}
+	if events[1].event != storagemarket.ProviderEventError || events[1].deal.ProposalCid != failed || !errors.Is(events[1].err, ErrDataTransferFailed) {
+		t.Fatalf("unexpected error event: %+v", events[1])
+	}
+	if events[1].deal.State != storagemarket.DealTransferring {
+		t.Fatalf("expected error event to carry the deal as it failed, got state %s", storagemarket.DealStates[events[1].deal.State])
+	}
+
+	unsubscribe()
+	p.failDeal(ctx, blockGenerator.Next().Cid(), errors.New("not tracked"))
+	if len(events) != 2 {
+		t.Fatal("received an event after unsubscribing")
+	}
+}
+
+func TestClient_SubscribeToEvents(t *testing.T) {
+	ctx := context.Background()
+	blockGenerator := blocksutil.NewBlockGenerator()
+	c := &Client{
+		deals: statestore.New(dss.MutexWrap(datastore.NewMapDatastore())),
+		conns: map[cid.Cid]inet.Stream{},
+	}
+
+	type event struct {
+		event storagemarket.ClientEvent
+		deal  storagemarket.ClientDeal
+		err   error
+	}
+	var events []event
+	unsubscribe := c.SubscribeToEvents(func(evt storagemarket.ClientEvent, deal storagemarket.ClientDeal, err error) {
+		events = append(events, event{evt, deal, err})
+	})
+
+	completed := blockGenerator.Next().Cid()
+	if err := c.deals.Begin(completed, &ClientDeal{ClientDeal: storagemarket.ClientDeal{ProposalCid: completed, Proposal: testEventsProposal(), MinerWorker: testAddress, PayloadCid: completed, State: storagemarket.DealSealing}}); err != nil {
+		t.Fatal(err)
+	}
+	c.onUpdated(ctx, clientDealUpdate{event: clientDealSealed, id: completed})
+
+	failed := blockGenerator.Next().Cid()
+	if err := c.deals.Begin(failed, &ClientDeal{ClientDeal: storagemarket.ClientDeal{ProposalCid: failed, Proposal: testEventsProposal(), MinerWorker: testAddress, PayloadCid: failed, State: storagemarket.DealSealing}}); err != nil {
+		t.Fatal(err)
+	}
+	sealErr := errors.New("sector faulted")
+	c.onUpdated(ctx, clientDealUpdate{event: clientDealFailed, id: failed, err: sealErr})
+
+	// a deal that is complete can't fail
+	c.onUpdated(ctx, clientDealUpdate{event: clientDealFailed, id: completed, err: sealErr})
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if events[0].event != storagemarket.ClientEventComplete || events[0].deal.ProposalCid != completed || events[0].err != nil {
+		t.Fatalf("unexpected completion event: %+v", events[0])
+	}
+	if events[1].event != storagemarket.ClientEventError || events[1].deal.ProposalCid != failed || events[1].deal.State != storagemarket.DealError || events[1].err != sealErr {
+		t.Fatalf("unexpected error event: %+v", events[1])
+	}
+
+	unsubscribe()
+	c.failDeal(failed, sealErr)
+	if len(events) != 2 {
+		t.Fatal("received an event after unsubscribing")
+	}
+}
@@ -0,0 +1,45 @@
+package storageimpl
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-fil-markets/shared/fsm"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+// checkEntries checks every state a deal can be left in has an entry handler,
+// and that handlers send events that can happen in their states
+func checkEntries(t *testing.T, table *fsm.Table, transitions []fsm.Transition, done map[storagemarket.DealState]string) {
+	for _, transition := range transitions {
+		if table.IsFinal(transition.To) {
+			continue
+		}
+		if _, ok := done[transition.To]; !ok {
+			t.Errorf("%s enters %s, which has no entry handler", transition.Event, storagemarket.DealStates[transition.To])
+		}
+	}
+	for state, event := range done {
+		if event == "" {
+			continue
+		}
+		if _, err := table.Next(state, event); err != nil {
+			t.Errorf("entry handler for %s: %s", storagemarket.DealStates[state], err)
+		}
+	}
+}
+
+func TestProviderDealTransitions(t *testing.T) {
+	done := make(map[storagemarket.DealState]string, len(providerStateEntries))
+	for state, entry := range providerStateEntries {
+		done[state] = entry.done
+	}
+	checkEntries(t, providerDeals, ProviderDealTransitions(), done)
+}
+
+func TestClientDealTransitions(t *testing.T) {
+	done := make(map[storagemarket.DealState]string, len(clientStateEntries))
+	for state, entry := range clientStateEntries {
+		done[state] = entry.done
+	}
+	checkEntries(t, clientDeals, ClientDealTransitions(), done)
+}
@@ -3,7 +3,9 @@ package storageimpl
 import (
 	"context"
 	"errors"
+	"reflect"
 	"sync"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
@@ -16,6 +18,7 @@ import (
 	"github.com/filecoin-project/go-cbor-util"
 	"github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-fil-markets/pieceio"
+	"github.com/filecoin-project/go-fil-markets/shared/fsm"
 	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
 	"github.com/filecoin-project/go-fil-markets/shared/types"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
@@ -35,11 +38,24 @@ type Provider struct {
 	pricePerByteBlock tokenamount.TokenAmount // how much we want for storing one byte for one block
 	minPieceSize      uint64
 
-	ask   *types.SignedStorageAsk
-	askLk sync.Mutex
+	asks         []*types.SignedStorageAsk
+	nextAskSeqNo uint64
+	askLk        sync.Mutex
+
+	// policyLk guards the policies, which can be changed while deals are
+	// being validated
+	policyLk         sync.RWMutex
+	dealFilter       storagemarket.StorageDealFilter
+	collateralPolicy storagemarket.StorageCollateralPolicy
+
+	subscribersLk sync.RWMutex
+	subscribers   []storagemarket.ProviderSubscriber
 
 	spn storagemarket.StorageProviderNode
 
+	// publisher publishes deals in batches
+	publisher *dealPublisher
+
 	pio pieceio.PieceIO
 
 	// dataTransfer is the manager of data transfers used by this storage provider
@@ -58,11 +74,12 @@ type Provider struct {
 	stopped  chan struct{}
 }
 
+// minerDealUpdate is an event in the lifecycle of a deal, see providerDeals
 type minerDealUpdate struct {
-	newState storagemarket.DealState
-	id       cid.Cid
-	err      error
-	mut      func(*MinerDeal)
+	event string
+	id    cid.Cid
+	err   error
+	mut   func(*MinerDeal)
 }
 
 var (
@@ -88,6 +105,8 @@ func NewProvider(ds datastore.Batching, pio pieceio.PieceIO, dataTransfer datatr
 		pricePerByteBlock: tokenamount.FromInt(3), // TODO: allow setting
 		minPieceSize:      256,                    // TODO: allow setting (BUT KEEP MIN 256! (because of how we fill sectors up))
 
+		collateralPolicy: storagemarket.AskCollateralPolicy,
+
 		conns: map[cid.Cid]inet.Stream{},
 
 		incoming: make(chan MinerDeal),
@@ -100,12 +119,13 @@ func NewProvider(ds datastore.Batching, pio pieceio.PieceIO, dataTransfer datatr
 		deals: statestore.New(namespace.Wrap(ds, datastore.NewKey(ProviderDsPrefix))),
 		ds:    ds,
 	}
+	h.publisher = newDealPublisher(spn, h.stop)
 
-	if err := h.tryLoadAsk(); err != nil {
+	if err := h.tryLoadAsks(); err != nil {
 		return nil, err
 	}
 
-	if h.ask == nil {
+	if len(h.asks) == 0 {
 		// TODO: we should be fine with this state, and just say it means 'not actively accepting deals'
 		// for now... lets just set a price
 		if err := h.SetPrice(tokenamount.FromInt(500_000_000), 1000000); err != nil {
@@ -120,9 +140,43 @@ func NewProvider(ds datastore.Batching, pio pieceio.PieceIO, dataTransfer datatr
 	return h, nil
 }
 
-func (p *Provider) Run(ctx context.Context, host host.Host) {
-	// TODO: restore state
+// SetDealFilter sets a policy deciding which deals the provider takes, once
+// they meet its ask and the client can pay for them
+func (p *Provider) SetDealFilter(filter storagemarket.StorageDealFilter) {
+	p.policyLk.Lock()
+	defer p.policyLk.Unlock()
+	p.dealFilter = filter
+}
+
+// SetCollateralPolicy sets how much storage collateral the provider takes on a
+// deal. A nil policy restores the default, AskCollateralPolicy
+func (p *Provider) SetCollateralPolicy(policy storagemarket.StorageCollateralPolicy) {
+	if policy == nil {
+		policy = storagemarket.AskCollateralPolicy
+	}
+	p.policyLk.Lock()
+	defer p.policyLk.Unlock()
+	p.collateralPolicy = policy
+}
+
+// policies returns the deal filter and collateral policy deals are validated
+// against
+func (p *Provider) policies() (storagemarket.StorageDealFilter, storagemarket.StorageCollateralPolicy) {
+	p.policyLk.RLock()
+	defer p.policyLk.RUnlock()
+	return p.dealFilter, p.collateralPolicy
+}
+
+// SetPublishBatching sets how many deals the provider publishes together in one
+// message, and the longest a deal waits for others to be published with it.
+// By default each deal is published on its own, as soon as it is ready.
+// Batching saves on messages, but clients wait longer to hear their deals were
+// published
+func (p *Provider) SetPublishBatching(maxDeals int, maxWait time.Duration) {
+	p.publisher.setBatching(maxDeals, maxWait)
+}
 
+func (p *Provider) Run(ctx context.Context, host host.Host) {
 	host.SetStreamHandler(storagemarket.DealProtocolID, p.HandleStream)
 	host.SetStreamHandler(storagemarket.AskProtocolID, p.HandleAskStream)
 
@@ -141,6 +195,78 @@ func (p *Provider) Run(ctx context.Context, host host.Host) {
 			}
 		}
 	}()
+
+	go p.restartDeals(ctx)
+}
+
+// restartDeals picks up the deals that were in progress when the provider
+// last stopped, from the states they were saved in
+func (p *Provider) restartDeals(ctx context.Context) {
+	deals, err := p.ListIncompleteDeals()
+	if err != nil {
+		log.Errorf("listing deals to restart: %s", err)
+		return
+	}
+
+	for _, deal := range deals {
+		update, ok := p.restartDeal(ctx, MinerDeal{MinerDeal: deal})
+		if !ok {
+			continue
+		}
+
+		log.Infof("restarting deal %s in state %s", deal.ProposalCid, storagemarket.DealStates[deal.State])
+		select {
+		case p.updated <- update:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// restartDeal returns the update that puts a deal back in progress, or false
+// if the deal is finished. Deals that were publishing or staged are checked
+// against the node, so they are not published or added to a sector twice
+func (p *Provider) restartDeal(ctx context.Context, deal MinerDeal) (minerDealUpdate, bool) {
+	update := minerDealUpdate{
+		event: providerDealRestarted,
+		id:    deal.ProposalCid,
+	}
+
+	switch deal.State {
+	case storagemarket.DealUnknown:
+		update.event = providerDealOpened
+	case storagemarket.DealValidating, storagemarket.DealTransferring, storagemarket.DealVerifyData, storagemarket.DealSealing:
+	case storagemarket.DealPublishing:
+		dealID, published, err := p.spn.LookupPublishedDeal(ctx, deal.MinerDeal)
+		if err != nil {
+			update.event = providerDealFailed
+			update.err = xerrors.Errorf("looking up published deal: %w", err)
+			break
+		}
+		if published {
+			update.event = providerDealPublished
+			update.mut = func(deal *MinerDeal) {
+				deal.DealID = uint64(dealID)
+			}
+		}
+	case storagemarket.DealStaged:
+		sectorID, found, err := p.spn.LocateDealSector(ctx, deal.DealID)
+		if err != nil {
+			update.event = providerDealFailed
+			update.err = xerrors.Errorf("locating deal sector: %w", err)
+			break
+		}
+		if found {
+			update.event = providerDealStaged
+			update.mut = func(deal *MinerDeal) {
+				deal.SectorID = sectorID
+			}
+		}
+	default:
+		return minerDealUpdate{}, false
+	}
+
+	return update, true
 }
 
 func (p *Provider) onIncoming(deal MinerDeal) {
@@ -157,52 +283,98 @@ func (p *Provider) onIncoming(deal MinerDeal) {
 
 	go func() {
 		p.updated <- minerDealUpdate{
-			newState: storagemarket.DealValidating,
-			id:       deal.ProposalCid,
-			err:      nil,
+			event: providerDealOpened,
+			id:    deal.ProposalCid,
+			err:   nil,
 		}
 	}()
 }
 
+// onUpdated moves a deal to the state an event leads to, then runs the entry
+// handler for that state. Events that can't happen in the state the deal is in
+// are dropped. Deals that fail are removed
 func (p *Provider) onUpdated(ctx context.Context, update minerDealUpdate) {
-	log.Infof("Deal %s updated state to %s", update.id, storagemarket.DealStates[update.newState])
 	if update.err != nil {
-		log.Errorf("deal %s (newSt: %d) failed: %+v", update.id, update.newState, update.err)
+		log.Errorf("deal %s (event: %s) failed: %+v", update.id, update.event, update.err)
 		p.failDeal(ctx, update.id, update.err)
 		return
 	}
 	var deal MinerDeal
 	err := p.deals.Get(update.id).Mutate(func(d *MinerDeal) error {
-		d.State = update.newState
+		next, err := providerDeals.Next(d.State, update.event)
+		if err != nil {
+			return err
+		}
+		d.State = next
 		if update.mut != nil {
 			update.mut(d)
 		}
 		deal = *d
 		return nil
 	})
+	if xerrors.Is(err, fsm.ErrIllegalTransition) {
+		log.Errorf("deal %s: %s", update.id, err)
+		return
+	}
 	if err != nil {
 		p.failDeal(ctx, update.id, err)
 		return
 	}
+	log.Infof("Deal %s updated state to %s", update.id, storagemarket.DealStates[deal.State])
 
-	switch update.newState {
-	case storagemarket.DealValidating:
-		p.handle(ctx, deal, p.validating, storagemarket.DealTransferring)
-	case storagemarket.DealTransferring:
-		p.handle(ctx, deal, p.transferring, storagemarket.DealNoUpdate)
-	case storagemarket.DealVerifyData:
-		p.handle(ctx, deal, p.verifydata, storagemarket.DealPublishing)
-	case storagemarket.DealPublishing:
-		p.handle(ctx, deal, p.publishing, storagemarket.DealStaged)
-	case storagemarket.DealStaged:
-		p.handle(ctx, deal, p.staged, storagemarket.DealSealing)
-	case storagemarket.DealSealing:
-		p.handle(ctx, deal, p.sealing, storagemarket.DealComplete)
-	case storagemarket.DealComplete:
-		p.handle(ctx, deal, p.complete, storagemarket.DealNoUpdate)
+	if event, ok := providerEvents[deal.State]; ok {
+		p.notifySubscribers(event, deal.MinerDeal, nil)
+	}
+
+	if entry, ok := providerStateEntries[deal.State]; ok {
+		p.handle(ctx, deal, entry)
 	}
 }
 
+// providerEvents are the events subscribers are notified of when deals enter
+// each state
+var providerEvents = map[storagemarket.DealState]storagemarket.ProviderEvent{
+	storagemarket.DealValidating:   storagemarket.ProviderEventOpen,
+	storagemarket.DealTransferring: storagemarket.ProviderEventTransferring,
+	storagemarket.DealVerifyData:   storagemarket.ProviderEventVerifyingData,
+	storagemarket.DealPublishing:   storagemarket.ProviderEventPublishing,
+	storagemarket.DealStaged:       storagemarket.ProviderEventStaged,
+	storagemarket.DealSealing:      storagemarket.ProviderEventSealing,
+	storagemarket.DealComplete:     storagemarket.ProviderEventComplete,
+}
+
+func (p *Provider) unsubscribeAt(sub storagemarket.ProviderSubscriber) storagemarket.Unsubscribe {
+	return func() {
+		p.subscribersLk.Lock()
+		defer p.subscribersLk.Unlock()
+		curLen := len(p.subscribers)
+		for i, el := range p.subscribers {
+			if reflect.ValueOf(sub) == reflect.ValueOf(el) {
+				p.subscribers[i] = p.subscribers[curLen-1]
+				p.subscribers = p.subscribers[:curLen-1]
+				return
+			}
+		}
+	}
+}
+
+func (p *Provider) notifySubscribers(evt storagemarket.ProviderEvent, deal storagemarket.MinerDeal, err error) {
+	p.subscribersLk.RLock()
+	defer p.subscribersLk.RUnlock()
+	for _, cb := range p.subscribers {
+		cb(evt, deal, err)
+	}
+}
+
+// SubscribeToEvents listens for events that happen related to storage deals on a provider
+func (p *Provider) SubscribeToEvents(subscriber storagemarket.ProviderSubscriber) storagemarket.Unsubscribe {
+	p.subscribersLk.Lock()
+	p.subscribers = append(p.subscribers, subscriber)
+	p.subscribersLk.Unlock()
+
+	return p.unsubscribeAt(subscriber)
+}
+
 // onDataTransferEvent is the function called when an event occurs in a data
 // transfer -- it reads the voucher to verify this even occurred in a storage
 // market deal, then, based on the data transfer event that occurred, it generates
@@ -216,14 +388,14 @@ func (p *Provider) onDataTransferEvent(event datatransfer.Event, channelState da
 	}
 
 	// data transfer events for opening and progress do not affect deal state
-	var next storagemarket.DealState
+	var next string
 	var err error
 	var mut func(*MinerDeal)
 	switch event.Code {
 	case datatransfer.Complete:
-		next = storagemarket.DealVerifyData
+		next = providerDealTransferred
 	case datatransfer.Error:
-		next = storagemarket.DealFailed
+		next = providerDealFailed
 		err = ErrDataTransferFailed
 	default:
 		// the only events we care about are complete and error
@@ -232,10 +404,10 @@ func (p *Provider) onDataTransferEvent(event datatransfer.Event, channelState da
 
 	select {
 	case p.updated <- minerDealUpdate{
-		newState: next,
-		id:       voucher.Proposal,
-		err:      err,
-		mut:      mut,
+		event: next,
+		id:    voucher.Proposal,
+		err:   err,
+		mut:   mut,
 	}:
 	case <-p.stop:
 	}
@@ -13,25 +13,39 @@ import (
 	"github.com/filecoin-project/go-cbor-util"
 	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
 	"github.com/filecoin-project/go-fil-markets/shared/types"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
 )
 
-func (p *Provider) SetPrice(price tokenamount.TokenAmount, ttlsecs int64) error {
+// SetPrice sets the price of the ask for deals within the bounds set by the
+// options, replacing any ask with the same bounds. Asks with other bounds stay
+// active, so a provider can price different sizes and durations of deal
+// differently
+func (p *Provider) SetPrice(price tokenamount.TokenAmount, ttlsecs int64, options ...storagemarket.StorageAskOption) error {
 	p.askLk.Lock()
 	defer p.askLk.Unlock()
 
-	var seqno uint64
-	if p.ask != nil {
-		seqno = p.ask.Ask.SeqNo + 1
-	}
-
 	now := time.Now().Unix()
 	ask := &types.StorageAsk{
 		Price:        price,
 		Timestamp:    uint64(now),
 		Expiry:       uint64(now + ttlsecs),
 		Miner:        p.actor,
-		SeqNo:        seqno,
+		SeqNo:        p.nextAskSeqNo,
 		MinPieceSize: p.minPieceSize,
+
+		CollateralPerGiB: tokenamount.FromInt(0),
+	}
+	for _, option := range options {
+		option(ask)
+	}
+	if ask.MinPieceSize < p.minPieceSize {
+		return xerrors.Errorf("minimum piece size must be at least %d", p.minPieceSize)
+	}
+	if ask.MaxPieceSize != 0 && ask.MaxPieceSize < ask.MinPieceSize {
+		return xerrors.Errorf("maximum piece size %d less than minimum %d", ask.MaxPieceSize, ask.MinPieceSize)
+	}
+	if ask.MaxDuration != 0 && ask.MaxDuration < ask.MinDuration {
+		return xerrors.Errorf("maximum duration %d less than minimum %d", ask.MaxDuration, ask.MinDuration)
 	}
 
 	ssa, err := p.signAsk(ask)
@@ -39,17 +53,83 @@ func (p *Provider) SetPrice(price tokenamount.TokenAmount, ttlsecs int64) error
 		return err
 	}
 
-	return p.saveAsk(ssa)
+	asks := make([]*types.SignedStorageAsk, 0, len(p.asks)+1)
+	for _, existing := range p.asks {
+		if !sameAskBounds(existing.Ask, ask) {
+			asks = append(asks, existing)
+		}
+	}
+	return p.saveAsks(append(asks, ssa), ask.SeqNo+1)
 }
 
+// RemoveAsk withdraws the ask with the given sequence number
+func (p *Provider) RemoveAsk(seqNo uint64) error {
+	p.askLk.Lock()
+	defer p.askLk.Unlock()
+
+	asks := make([]*types.SignedStorageAsk, 0, len(p.asks))
+	for _, ask := range p.asks {
+		if ask.Ask.SeqNo != seqNo {
+			asks = append(asks, ask)
+		}
+	}
+	if len(asks) == len(p.asks) {
+		return xerrors.Errorf("no ask with sequence number %d", seqNo)
+	}
+	return p.saveAsks(asks, p.nextAskSeqNo)
+}
+
+// GetAsk returns the first of the provider's active asks, or nil if it has none
 func (p *Provider) GetAsk(m address.Address) *types.SignedStorageAsk {
+	asks := p.ListAsks(m)
+	if len(asks) == 0 {
+		return nil
+	}
+
+	return asks[0]
+}
+
+// ListAsks returns the provider's asks that have not expired, oldest first
+func (p *Provider) ListAsks(m address.Address) []*types.SignedStorageAsk {
 	p.askLk.Lock()
 	defer p.askLk.Unlock()
 	if m != p.actor {
 		return nil
 	}
 
-	return p.ask
+	return p.activeAsks()
+}
+
+func (p *Provider) activeAsks() []*types.SignedStorageAsk {
+	now := uint64(time.Now().Unix())
+	var active []*types.SignedStorageAsk
+	for _, ask := range p.asks {
+		if ask.Ask.Expiry > now {
+			active = append(active, ask)
+		}
+	}
+	return active
+}
+
+// findAsk returns the active ask a proposal is priced against: the cheapest of
+// the asks whose bounds it is within
+func (p *Provider) findAsk(proposal *storagemarket.StorageDealProposal) (types.StorageAsk, error) {
+	p.askLk.Lock()
+	defer p.askLk.Unlock()
+
+	active := p.activeAsks()
+	asks := make([]types.StorageAsk, 0, len(active))
+	for _, ask := range active {
+		asks = append(asks, *ask.Ask)
+	}
+	return proposal.FindAsk(asks)
+}
+
+func sameAskBounds(a, b *types.StorageAsk) bool {
+	return a.MinPieceSize == b.MinPieceSize &&
+		a.MaxPieceSize == b.MaxPieceSize &&
+		a.MinDuration == b.MinDuration &&
+		a.MaxDuration == b.MaxDuration
 }
 
 func (p *Provider) HandleAskStream(s inet.Stream) {
@@ -69,18 +149,28 @@ func (p *Provider) HandleAskStream(s inet.Stream) {
 }
 
 func (p *Provider) processAskRequest(ar *AskRequest) *AskResponse {
-	return &AskResponse{
-		Ask: p.GetAsk(ar.Miner),
+	asks := p.ListAsks(ar.Miner)
+	resp := &AskResponse{
+		Asks: asks,
 	}
+	if len(asks) > 0 {
+		resp.Ask = asks[0]
+	}
+	return resp
 }
 
-var bestAskKey = datastore.NewKey("latest-ask")
+var (
+	asksKey = datastore.NewKey("asks")
+
+	// bestAskKey is where the single ask providers used to have was saved
+	bestAskKey = datastore.NewKey("latest-ask")
+)
 
-func (p *Provider) tryLoadAsk() error {
+func (p *Provider) tryLoadAsks() error {
 	p.askLk.Lock()
 	defer p.askLk.Unlock()
 
-	err := p.loadAsk()
+	err := p.loadAsks()
 	if err != nil {
 		if xerrors.Is(err, datastore.ErrNotFound) {
 			log.Warn("no previous ask found, miner will not accept deals until a price is set")
@@ -92,19 +182,51 @@ func (p *Provider) tryLoadAsk() error {
 	return nil
 }
 
-func (p *Provider) loadAsk() error {
-	askb, err := p.ds.Get(datastore.NewKey("latest-ask"))
+func (p *Provider) loadAsks() error {
+	asksb, err := p.ds.Get(asksKey)
+	if xerrors.Is(err, datastore.ErrNotFound) {
+		return p.migrateAsk()
+	}
+	if err != nil {
+		return xerrors.Errorf("failed to load asks from disk: %w", err)
+	}
+
+	var stored storedAsks
+	if err := cborutil.ReadCborRPC(bytes.NewReader(asksb), &stored); err != nil {
+		return xerrors.Errorf("failed to decode asks: %w", err)
+	}
+	if stored.Version != storedAsksVersion {
+		return xerrors.Errorf("asks saved with unknown version %d", stored.Version)
+	}
+
+	p.asks = stored.Asks
+	p.nextAskSeqNo = stored.NextSeqNo
+	return nil
+}
+
+// migrateAsk moves the single ask saved by earlier versions into the list of
+// asks
+func (p *Provider) migrateAsk() error {
+	askb, err := p.ds.Get(bestAskKey)
 	if err != nil {
 		return xerrors.Errorf("failed to load most recent ask from disk: %w", err)
 	}
 
-	var ssa types.SignedStorageAsk
-	if err := cborutil.ReadCborRPC(bytes.NewReader(askb), &ssa); err != nil {
+	// the ask is signed again, as its old signature doesn't cover the fields
+	// asks have gained since
+	var legacy signedStorageAskV0
+	if err := cborutil.ReadCborRPC(bytes.NewReader(askb), &legacy); err != nil {
+		return xerrors.Errorf("failed to decode most recent ask: %w", err)
+	}
+	ssa, err := p.signAsk(legacy.Ask.migrate())
+	if err != nil {
 		return err
 	}
 
-	p.ask = &ssa
-	return nil
+	if err := p.saveAsks([]*types.SignedStorageAsk{ssa}, ssa.Ask.SeqNo+1); err != nil {
+		return err
+	}
+	return p.ds.Delete(bestAskKey)
 }
 
 func (p *Provider) signAsk(a *types.StorageAsk) (*types.SignedStorageAsk, error) {
@@ -129,16 +251,17 @@ func (p *Provider) signAsk(a *types.StorageAsk) (*types.SignedStorageAsk, error)
 	}, nil
 }
 
-func (p *Provider) saveAsk(a *types.SignedStorageAsk) error {
-	b, err := cborutil.Dump(a)
+func (p *Provider) saveAsks(asks []*types.SignedStorageAsk, nextSeqNo uint64) error {
+	b, err := cborutil.Dump(&storedAsks{Version: storedAsksVersion, Asks: asks, NextSeqNo: nextSeqNo})
 	if err != nil {
 		return err
 	}
 
-	if err := p.ds.Put(bestAskKey, b); err != nil {
+	if err := p.ds.Put(asksKey, b); err != nil {
 		return err
 	}
 
-	p.ask = a
+	p.asks = asks
+	p.nextAskSeqNo = nextSeqNo
 	return nil
 }
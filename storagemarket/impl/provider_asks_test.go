@@ -0,0 +1,244 @@
+package storageimpl
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
+	"github.com/filecoin-project/go-fil-markets/shared/types"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+// askNode signs asks for a provider
+type askNode struct {
+	storagemarket.StorageProviderNode
+}
+
+func (n *askNode) GetMinerWorker(ctx context.Context, miner address.Address) (address.Address, error) {
+	return miner, nil
+}
+
+func (n *askNode) SignBytes(ctx context.Context, signer address.Address, b []byte) (*types.Signature, error) {
+	return &types.Signature{Type: types.KTBLS, Data: []byte("signature")}, nil
+}
+
+func newAskProvider(ds datastore.Batching) *Provider {
+	return &Provider{
+		ds:           ds,
+		spn:          &askNode{},
+		actor:        testAddress,
+		minPieceSize: 256,
+	}
+}
+
+func askPrices(asks []*types.SignedStorageAsk) []int64 {
+	prices := make([]int64, 0, len(asks))
+	for _, ask := range asks {
+		prices = append(prices, ask.Ask.Price.Int64())
+	}
+	return prices
+}
+
+func TestProvider_SetPrice(t *testing.T) {
+	p := newAskProvider(dss.MutexWrap(datastore.NewMapDatastore()))
+
+	if err := p.SetPrice(tokenamount.FromInt(10), 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetPrice(tokenamount.FromInt(20), 1000, storagemarket.MinPieceSize(1024)); err != nil {
+		t.Fatal(err)
+	}
+	// replaces the first ask, which has the same bounds
+	if err := p.SetPrice(tokenamount.FromInt(30), 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	asks := p.ListAsks(testAddress)
+	if prices := askPrices(asks); len(prices) != 2 || prices[0] != 20 || prices[1] != 30 {
+		t.Fatalf("expected asks priced 20 and 30, got %v", prices)
+	}
+	if asks[0].Ask.SeqNo != 1 || asks[1].Ask.SeqNo != 2 {
+		t.Fatalf("expected sequence numbers 1 and 2, got %d and %d", asks[0].Ask.SeqNo, asks[1].Ask.SeqNo)
+	}
+
+	if err := p.SetPrice(tokenamount.FromInt(40), 1000, storagemarket.MinPieceSize(128)); err == nil {
+		t.Fatal("expected minimum piece size below the provider's minimum to fail")
+	}
+	if err := p.SetPrice(tokenamount.FromInt(40), 1000, storagemarket.MinDuration(100), storagemarket.MaxDuration(10)); err == nil {
+		t.Fatal("expected maximum duration below minimum to fail")
+	}
+}
+
+func TestProvider_RemoveAsk(t *testing.T) {
+	p := newAskProvider(dss.MutexWrap(datastore.NewMapDatastore()))
+	if err := p.SetPrice(tokenamount.FromInt(10), 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetPrice(tokenamount.FromInt(20), 1000, storagemarket.MinPieceSize(1024)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.RemoveAsk(0); err != nil {
+		t.Fatal(err)
+	}
+	if prices := askPrices(p.ListAsks(testAddress)); len(prices) != 1 || prices[0] != 20 {
+		t.Fatalf("expected the ask priced 20 to be left, got %v", prices)
+	}
+	if err := p.RemoveAsk(0); err == nil {
+		t.Fatal("expected removing an ask twice to fail")
+	}
+
+	// the removal is saved
+	reloaded := newAskProvider(p.ds)
+	if err := reloaded.tryLoadAsks(); err != nil {
+		t.Fatal(err)
+	}
+	if prices := askPrices(reloaded.ListAsks(testAddress)); len(prices) != 1 || prices[0] != 20 {
+		t.Fatalf("expected the ask priced 20 to be saved, got %v", prices)
+	}
+	if reloaded.nextAskSeqNo != 2 {
+		t.Fatalf("expected next sequence number 2, got %d", reloaded.nextAskSeqNo)
+	}
+}
+
+func TestProvider_ListAsksSkipsExpired(t *testing.T) {
+	p := newAskProvider(dss.MutexWrap(datastore.NewMapDatastore()))
+	if err := p.SetPrice(tokenamount.FromInt(10), -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetPrice(tokenamount.FromInt(20), 1000, storagemarket.MinPieceSize(1024)); err != nil {
+		t.Fatal(err)
+	}
+
+	if prices := askPrices(p.ListAsks(testAddress)); len(prices) != 1 || prices[0] != 20 {
+		t.Fatalf("expected only the unexpired ask, got %v", prices)
+	}
+	if ask := p.GetAsk(testAddress); ask == nil || ask.Ask.Price.Int64() != 20 {
+		t.Fatalf("expected GetAsk to return the unexpired ask, got %v", ask)
+	}
+	otherMiner, _ := address.NewIDAddress(101)
+	if asks := p.ListAsks(otherMiner); len(asks) != 0 {
+		t.Fatal("expected no asks for another miner")
+	}
+}
+
+func TestProvider_ProcessAskRequest(t *testing.T) {
+	p := newAskProvider(dss.MutexWrap(datastore.NewMapDatastore()))
+
+	resp := p.processAskRequest(&AskRequest{Miner: testAddress})
+	if resp.Ask != nil || len(resp.Asks) != 0 {
+		t.Fatal("expected no asks before a price is set")
+	}
+
+	if err := p.SetPrice(tokenamount.FromInt(10), 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetPrice(tokenamount.FromInt(20), 1000, storagemarket.MinPieceSize(1024)); err != nil {
+		t.Fatal(err)
+	}
+
+	resp = p.processAskRequest(&AskRequest{Miner: testAddress})
+	if prices := askPrices(resp.Asks); len(prices) != 2 || prices[0] != 10 || prices[1] != 20 {
+		t.Fatalf("expected both asks, got %v", prices)
+	}
+	if resp.Ask != resp.Asks[0] {
+		t.Fatal("expected Ask to be the first of the asks")
+	}
+}
+
+func TestProvider_MigrateAsk(t *testing.T) {
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	now := uint64(time.Now().Unix())
+	legacy := &signedStorageAskV0{
+		Ask: &storageAskV0{
+			Price:        tokenamount.FromInt(10),
+			MinPieceSize: 512,
+			Miner:        testAddress,
+			Timestamp:    now,
+			Expiry:       now + 1000,
+			SeqNo:        4,
+		},
+		Signature: &types.Signature{Type: types.KTBLS, Data: []byte("old signature")},
+	}
+	b, err := cborutil.Dump(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Put(bestAskKey, b); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newAskProvider(ds)
+	if err := p.tryLoadAsks(); err != nil {
+		t.Fatal(err)
+	}
+	asks := p.ListAsks(testAddress)
+	if len(asks) != 1 {
+		t.Fatalf("expected the most recent ask to be migrated, got %v", asks)
+	}
+	ask := asks[0]
+	if ask.Ask.Price.Int64() != 10 || ask.Ask.MinPieceSize != 512 || ask.Ask.SeqNo != 4 || ask.Ask.Expiry != now+1000 {
+		t.Fatalf("expected the ask's price and terms to be kept, got %v", ask.Ask)
+	}
+	if ask.Ask.MaxPieceSize != 0 || ask.Ask.MaxDuration != 0 || !ask.Ask.CollateralPerGiB.Equals(tokenamount.FromInt(0)) {
+		t.Fatalf("expected the ask to have no bounds or collateral, got %v", ask.Ask)
+	}
+	if string(ask.Signature.Data) != "signature" {
+		t.Fatal("expected the migrated ask to be signed again")
+	}
+	if p.nextAskSeqNo != 5 {
+		t.Fatalf("expected next sequence number 5, got %d", p.nextAskSeqNo)
+	}
+	if has, err := ds.Has(bestAskKey); err != nil || has {
+		t.Fatalf("expected the most recent ask to be removed once migrated: %v", err)
+	}
+
+	var stored storedAsks
+	b, err = ds.Get(asksKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stored.UnmarshalCBOR(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Version != storedAsksVersion || len(stored.Asks) != 1 {
+		t.Fatalf("expected the migrated ask to be saved, got version %d with %d asks", stored.Version, len(stored.Asks))
+	}
+}
+
+func TestProvider_MigrateAskUndecodable(t *testing.T) {
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	if err := ds.Put(bestAskKey, []byte("not an ask")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newAskProvider(ds)
+	if err := p.tryLoadAsks(); err == nil {
+		t.Fatal("expected an ask that can't be decoded to fail, rather than be replaced")
+	}
+	if has, err := ds.Has(bestAskKey); err != nil || !has {
+		t.Fatalf("expected the most recent ask to be kept: %v", err)
+	}
+}
+
+func TestProvider_LoadAsksUnknownVersion(t *testing.T) {
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	b, err := cborutil.Dump(&storedAsks{Version: storedAsksVersion + 1, NextSeqNo: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Put(asksKey, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := newAskProvider(ds).tryLoadAsks(); err == nil {
+		t.Fatal("expected asks with an unknown version to fail")
+	}
+}
@@ -0,0 +1,81 @@
+package storageimpl
+
+import (
+	"github.com/filecoin-project/go-fil-markets/shared/fsm"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+// events that move provider deals between states
+const (
+	providerDealOpened      = "opened"
+	providerDealValidated   = "validated"
+	providerDealTransferred = "transferred"
+	providerDealVerified    = "verified"
+	providerDealPublished   = "published"
+	providerDealStaged      = "staged"
+	providerDealSealed      = "sealed"
+	providerDealFailed      = "failed"
+
+	// providerDealRestarted re-enters the state a deal was in when the
+	// provider stopped
+	providerDealRestarted = "restarted"
+)
+
+// providerDeals is the lifecycle of a deal on the provider. Deals that fail
+// are removed, rather than kept in DealFailed
+var providerDeals = fsm.MustNewTable(
+	[]fsm.State{
+		storagemarket.DealUnknown,
+		storagemarket.DealValidating,
+		storagemarket.DealTransferring,
+		storagemarket.DealVerifyData,
+		storagemarket.DealPublishing,
+		storagemarket.DealStaged,
+		storagemarket.DealSealing,
+		storagemarket.DealComplete,
+		storagemarket.DealFailed,
+	},
+	[]fsm.State{storagemarket.DealComplete, storagemarket.DealFailed},
+
+	fsm.Event{Name: providerDealOpened, From: []fsm.State{storagemarket.DealUnknown}, To: storagemarket.DealValidating},
+	fsm.Event{Name: providerDealValidated, From: []fsm.State{storagemarket.DealValidating}, To: storagemarket.DealTransferring},
+	fsm.Event{Name: providerDealTransferred, From: []fsm.State{storagemarket.DealTransferring}, To: storagemarket.DealVerifyData},
+	fsm.Event{Name: providerDealVerified, From: []fsm.State{storagemarket.DealVerifyData}, To: storagemarket.DealPublishing},
+	fsm.Event{Name: providerDealPublished, From: []fsm.State{storagemarket.DealPublishing}, To: storagemarket.DealStaged},
+	fsm.Event{Name: providerDealStaged, From: []fsm.State{storagemarket.DealStaged}, To: storagemarket.DealSealing},
+	fsm.Event{Name: providerDealSealed, From: []fsm.State{storagemarket.DealSealing}, To: storagemarket.DealComplete},
+	fsm.Event{Name: providerDealFailed, To: storagemarket.DealFailed},
+	fsm.Event{Name: providerDealRestarted, From: []fsm.State{
+		storagemarket.DealValidating,
+		storagemarket.DealTransferring,
+		storagemarket.DealVerifyData,
+		storagemarket.DealPublishing,
+		storagemarket.DealStaged,
+		storagemarket.DealSealing,
+	}, NoChange: true},
+)
+
+// providerStateEntry is what the provider does when a deal enters a state:
+// the handler it runs, and the event it sends once the handler succeeds, if
+// any. Deals wait in states without a done event for something else to move
+// them on, like the data transfer finishing
+type providerStateEntry struct {
+	handler providerHandlerFunc
+	done    string
+}
+
+var providerStateEntries = map[storagemarket.DealState]providerStateEntry{
+	storagemarket.DealValidating:   {(*Provider).validating, providerDealValidated},
+	storagemarket.DealTransferring: {(*Provider).transferring, ""},
+	storagemarket.DealVerifyData:   {(*Provider).verifydata, providerDealVerified},
+	storagemarket.DealPublishing:   {(*Provider).publishing, providerDealPublished},
+	storagemarket.DealStaged:       {(*Provider).staged, providerDealStaged},
+	storagemarket.DealSealing:      {(*Provider).sealing, providerDealSealed},
+	storagemarket.DealComplete:     {(*Provider).complete, ""},
+}
+
+// ProviderDealTransitions lists every way a provider deal can move between
+// states
+func ProviderDealTransitions() []fsm.Transition {
+	return providerDeals.Transitions()
+}
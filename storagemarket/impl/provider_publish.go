@@ -0,0 +1,243 @@
+package storageimpl
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+const (
+	// DefaultPublishBatchSize is how many deals a provider publishes together,
+	// unless set with SetPublishBatching. Each deal is published on its own as
+	// soon as it is ready, as the client waits on the deal stream until it is
+	// published
+	DefaultPublishBatchSize = 1
+
+	// DefaultPublishBatchWait is the longest a deal waits for others to be
+	// published with it, once batching is turned on with SetPublishBatching
+	DefaultPublishBatchWait = 10 * time.Minute
+)
+
+// ErrProviderStopped means the provider stopped before a deal was published.
+// The deal is published when the provider restarts
+var ErrProviderStopped = xerrors.New("provider stopped")
+
+// dealPublisher gathers deals that are ready to be published, and publishes
+// them together in one message once there are enough of them, or the first of
+// them has waited long enough
+type dealPublisher struct {
+	spn  storagemarket.StorageProviderNode
+	stop <-chan struct{}
+
+	lk       sync.Mutex
+	maxDeals int
+	maxWait  time.Duration
+	pending  []pendingPublish
+	timer    *time.Timer
+}
+
+type pendingPublish struct {
+	deal   storagemarket.MinerDeal
+	result chan publishResult
+}
+
+type publishResult struct {
+	dealID storagemarket.DealID
+	msg    cid.Cid
+	err    error
+}
+
+func newDealPublisher(spn storagemarket.StorageProviderNode, stop <-chan struct{}) *dealPublisher {
+	return &dealPublisher{
+		spn:      spn,
+		stop:     stop,
+		maxDeals: DefaultPublishBatchSize,
+		maxWait:  DefaultPublishBatchWait,
+	}
+}
+
+// setBatching changes the batch size and wait for deals queued from now on,
+// publishing the deals already queued if there are now enough of them
+func (dp *dealPublisher) setBatching(maxDeals int, maxWait time.Duration) {
+	dp.lk.Lock()
+	dp.maxDeals = maxDeals
+	dp.maxWait = maxWait
+	var batch []pendingPublish
+	if len(dp.pending) > 0 && len(dp.pending) >= maxDeals {
+		batch = dp.takePending()
+	}
+	dp.lk.Unlock()
+
+	if batch != nil {
+		dp.publishBatch(batch)
+	}
+}
+
+// publish queues a deal to be published, and returns its deal id and the
+// message it was published in once its batch is published
+func (dp *dealPublisher) publish(ctx context.Context, deal storagemarket.MinerDeal) (storagemarket.DealID, cid.Cid, error) {
+	result := make(chan publishResult, 1)
+
+	dp.lk.Lock()
+	dp.pending = append(dp.pending, pendingPublish{deal: deal, result: result})
+	var batch []pendingPublish
+	if len(dp.pending) >= dp.maxDeals {
+		batch = dp.takePending()
+	} else if dp.timer == nil {
+		dp.timer = time.AfterFunc(dp.maxWait, dp.publishPending)
+	}
+	dp.lk.Unlock()
+
+	if batch != nil {
+		dp.publishBatch(batch)
+	}
+
+	select {
+	case res := <-result:
+		return res.dealID, res.msg, res.err
+	case <-ctx.Done():
+		if dp.dropPending(result) {
+			return 0, cid.Undef, ctx.Err()
+		}
+	case <-dp.stop:
+		return 0, cid.Undef, ErrProviderStopped
+	}
+
+	// the deal's batch is already being published, and a deal that is
+	// published has to be tracked, so wait to hear whether it was
+	select {
+	case res := <-result:
+		return res.dealID, res.msg, res.err
+	case <-dp.stop:
+		return 0, cid.Undef, ErrProviderStopped
+	}
+}
+
+// dropPending takes a deal out of the queue, so that it is not published. It
+// returns false if the deal is no longer queued, as its batch has been taken
+// to be published
+func (dp *dealPublisher) dropPending(result chan publishResult) bool {
+	dp.lk.Lock()
+	defer dp.lk.Unlock()
+
+	for i, pending := range dp.pending {
+		if pending.result != result {
+			continue
+		}
+		dp.pending = append(dp.pending[:i], dp.pending[i+1:]...)
+		if len(dp.pending) == 0 && dp.timer != nil {
+			dp.timer.Stop()
+			dp.timer = nil
+		}
+		return true
+	}
+	return false
+}
+
+// publishPending publishes the deals queued when the first of them has waited
+// long enough
+func (dp *dealPublisher) publishPending() {
+	dp.lk.Lock()
+	batch := dp.takePending()
+	dp.lk.Unlock()
+
+	if len(batch) > 0 {
+		dp.publishBatch(batch)
+	}
+}
+
+// takePending empties the queue, returning the deals that were in it. dp.lk
+// must be held
+func (dp *dealPublisher) takePending() []pendingPublish {
+	if dp.timer != nil {
+		dp.timer.Stop()
+		dp.timer = nil
+	}
+	batch := dp.pending
+	dp.pending = nil
+	return batch
+}
+
+// publishBatch publishes a batch of deals in one message. Deals whose
+// proposals expired while they were queued fail on their own, rather than
+// failing the message for every other deal
+func (dp *dealPublisher) publishBatch(batch []pendingPublish) {
+	select {
+	case <-dp.stop:
+		return
+	default:
+	}
+
+	ctx := context.TODO()
+	head, err := dp.spn.MostRecentStateId(ctx)
+	if err != nil {
+		dp.fail(batch, xerrors.Errorf("getting chain head to publish deals: %w", err))
+		return
+	}
+
+	publishing := make([]pendingPublish, 0, len(batch))
+	for _, pending := range batch {
+		if head.Height() >= pending.deal.Proposal.ProposalExpiration {
+			pending.result <- publishResult{err: xerrors.New("deal proposal expired before it was published")}
+			continue
+		}
+		publishing = append(publishing, pending)
+	}
+	if len(publishing) == 0 {
+		return
+	}
+
+	err = dp.publishDeals(ctx, publishing)
+	if err == nil {
+		return
+	}
+	if len(publishing) == 1 {
+		dp.fail(publishing, err)
+		return
+	}
+
+	// one deal the chain won't take, such as one whose client can no longer
+	// pay for it, fails the whole message. Publishing the deals one at a time
+	// fails only that deal
+	log.Warnf("publishing %d deals together failed, publishing them one at a time: %s", len(publishing), err)
+	for _, pending := range publishing {
+		single := []pendingPublish{pending}
+		if err := dp.publishDeals(ctx, single); err != nil {
+			dp.fail(single, err)
+		}
+	}
+}
+
+// publishDeals publishes deals in one message, sending each its deal id if it
+// succeeds. If it fails, the deals are left for the caller to fail
+func (dp *dealPublisher) publishDeals(ctx context.Context, publishing []pendingPublish) error {
+	deals := make([]storagemarket.MinerDeal, 0, len(publishing))
+	for _, pending := range publishing {
+		deals = append(deals, pending.deal)
+	}
+
+	log.Infof("publishing %d deals", len(deals))
+	dealIDs, msg, err := dp.spn.PublishDeals(ctx, deals)
+	if err != nil {
+		return xerrors.Errorf("publishing deals: %w", err)
+	}
+	if len(dealIDs) != len(deals) {
+		return xerrors.Errorf("published %d deals, but got %d deal ids", len(deals), len(dealIDs))
+	}
+
+	for i, pending := range publishing {
+		pending.result <- publishResult{dealID: dealIDs[i], msg: msg}
+	}
+	return nil
+}
+
+func (dp *dealPublisher) fail(batch []pendingPublish, err error) {
+	for _, pending := range batch {
+		pending.result <- publishResult{err: err}
+	}
+}
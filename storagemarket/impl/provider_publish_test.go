@@ -0,0 +1,240 @@
+package storageimpl
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	blocksutil "github.com/ipfs/go-ipfs-blocksutil"
+
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+type testStateKey uint64
+
+func (k testStateKey) Height() uint64 {
+	return uint64(k)
+}
+
+// publishNode records the deals published in each message, giving deals ids
+// in the order they are published. Messages with the bad deal in them fail
+type publishNode struct {
+	storagemarket.StorageProviderNode
+
+	height uint64
+	bad    cid.Cid
+
+	lk       sync.Mutex
+	messages [][]storagemarket.MinerDeal
+}
+
+func (n *publishNode) MostRecentStateId(ctx context.Context) (storagemarket.StateKey, error) {
+	return testStateKey(n.height), nil
+}
+
+func (n *publishNode) PublishDeals(ctx context.Context, deals []storagemarket.MinerDeal) ([]storagemarket.DealID, cid.Cid, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	for _, deal := range deals {
+		if deal.ProposalCid == n.bad {
+			return nil, cid.Undef, errors.New("client can't pay for deal")
+		}
+	}
+	n.messages = append(n.messages, deals)
+
+	dealIDs := make([]storagemarket.DealID, 0, len(deals))
+	for i := range deals {
+		dealIDs = append(dealIDs, storagemarket.DealID(100*len(n.messages)+i))
+	}
+	return dealIDs, deals[0].ProposalCid, nil
+}
+
+type publishedDeal struct {
+	proposalCid cid.Cid
+	dealID      storagemarket.DealID
+	msg         cid.Cid
+	err         error
+}
+
+// publishDeals publishes deals concurrently, as the provider's deal handlers do
+func publishDeals(dp *dealPublisher, deals []storagemarket.MinerDeal) map[cid.Cid]publishedDeal {
+	var wg sync.WaitGroup
+	results := make(chan publishedDeal, len(deals))
+	for _, deal := range deals {
+		wg.Add(1)
+		go func(deal storagemarket.MinerDeal) {
+			defer wg.Done()
+			dealID, msg, err := dp.publish(context.Background(), deal)
+			results <- publishedDeal{deal.ProposalCid, dealID, msg, err}
+		}(deal)
+	}
+	wg.Wait()
+	close(results)
+
+	published := make(map[cid.Cid]publishedDeal, len(deals))
+	for result := range results {
+		published[result.proposalCid] = result
+	}
+	return published
+}
+
+func testPublishDeals(count int, expiration uint64) []storagemarket.MinerDeal {
+	blockGenerator := blocksutil.NewBlockGenerator()
+	deals := make([]storagemarket.MinerDeal, 0, count)
+	for i := 0; i < count; i++ {
+		deals = append(deals, storagemarket.MinerDeal{
+			ProposalCid: blockGenerator.Next().Cid(),
+			Proposal:    storagemarket.StorageDealProposal{ProposalExpiration: expiration},
+		})
+	}
+	return deals
+}
+
+func TestDealPublisher(t *testing.T) {
+	t.Run("publishes each deal on its own by default", func(t *testing.T) {
+		node := &publishNode{}
+		dp := newDealPublisher(node, make(chan struct{}))
+
+		for _, result := range publishDeals(dp, testPublishDeals(2, 10)) {
+			if result.err != nil {
+				t.Fatal(result.err)
+			}
+		}
+		if len(node.messages) != 2 || len(node.messages[0]) != 1 || len(node.messages[1]) != 1 {
+			t.Fatalf("expected two messages with one deal each, got %v", node.messages)
+		}
+	})
+
+	t.Run("publishes a full batch in one message", func(t *testing.T) {
+		node := &publishNode{}
+		dp := newDealPublisher(node, make(chan struct{}))
+		dp.setBatching(3, time.Hour)
+
+		deals := testPublishDeals(3, 10)
+		published := publishDeals(dp, deals)
+
+		if len(node.messages) != 1 || len(node.messages[0]) != 3 {
+			t.Fatalf("expected one message with 3 deals, got %v", node.messages)
+		}
+		for i, deal := range node.messages[0] {
+			result := published[deal.ProposalCid]
+			if result.err != nil {
+				t.Fatal(result.err)
+			}
+			if result.dealID != storagemarket.DealID(100+i) {
+				t.Fatalf("deal %s got deal id %d, expected %d", deal.ProposalCid, result.dealID, 100+i)
+			}
+			if result.msg != node.messages[0][0].ProposalCid {
+				t.Fatalf("deal %s published in the wrong message", deal.ProposalCid)
+			}
+		}
+	})
+
+	t.Run("publishes a partial batch after waiting", func(t *testing.T) {
+		node := &publishNode{}
+		dp := newDealPublisher(node, make(chan struct{}))
+		dp.setBatching(10, 10*time.Millisecond)
+
+		published := publishDeals(dp, testPublishDeals(2, 10))
+
+		if len(node.messages) != 1 || len(node.messages[0]) != 2 {
+			t.Fatalf("expected one message with 2 deals, got %v", node.messages)
+		}
+		for _, result := range published {
+			if result.err != nil {
+				t.Fatal(result.err)
+			}
+		}
+	})
+
+	t.Run("expired deals are left out", func(t *testing.T) {
+		node := &publishNode{height: 5}
+		dp := newDealPublisher(node, make(chan struct{}))
+		dp.setBatching(2, time.Hour)
+
+		deals := testPublishDeals(2, 10)
+		deals[0].Proposal.ProposalExpiration = 5
+		expired, live := deals[0], deals[1]
+		published := publishDeals(dp, []storagemarket.MinerDeal{expired, live})
+
+		if len(node.messages) != 1 || len(node.messages[0]) != 1 || node.messages[0][0].ProposalCid != live.ProposalCid {
+			t.Fatalf("expected one message with the live deal, got %v", node.messages)
+		}
+		if published[expired.ProposalCid].err == nil {
+			t.Fatal("expected expired deal to fail")
+		}
+		if published[live.ProposalCid].err != nil {
+			t.Fatal(published[live.ProposalCid].err)
+		}
+	})
+
+	t.Run("a deal that fails to publish fails on its own", func(t *testing.T) {
+		deals := testPublishDeals(3, 10)
+		node := &publishNode{bad: deals[1].ProposalCid}
+		dp := newDealPublisher(node, make(chan struct{}))
+		dp.setBatching(3, time.Hour)
+
+		published := publishDeals(dp, deals)
+
+		if published[deals[1].ProposalCid].err == nil {
+			t.Fatal("expected the bad deal to fail")
+		}
+		for _, deal := range []storagemarket.MinerDeal{deals[0], deals[2]} {
+			if err := published[deal.ProposalCid].err; err != nil {
+				t.Fatalf("expected deal %s to be published: %s", deal.ProposalCid, err)
+			}
+		}
+		if len(node.messages) != 2 || len(node.messages[0]) != 1 || len(node.messages[1]) != 1 {
+			t.Fatalf("expected the other deals to be published one at a time, got %v", node.messages)
+		}
+	})
+
+	t.Run("failing to publish a single deal fails it", func(t *testing.T) {
+		deals := testPublishDeals(1, 10)
+		node := &publishNode{bad: deals[0].ProposalCid}
+		dp := newDealPublisher(node, make(chan struct{}))
+
+		if _, _, err := dp.publish(context.Background(), deals[0]); err == nil {
+			t.Fatal("expected deal to fail")
+		}
+	})
+
+	t.Run("a deal whose context ends is taken out of the queue", func(t *testing.T) {
+		node := &publishNode{}
+		dp := newDealPublisher(node, make(chan struct{}))
+		dp.setBatching(2, 10*time.Millisecond)
+
+		deals := testPublishDeals(2, 10)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, _, err := dp.publish(ctx, deals[0]); err != context.Canceled {
+			t.Fatalf("expected context cancelled, got %v", err)
+		}
+		if _, _, err := dp.publish(context.Background(), deals[1]); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(node.messages) != 1 || len(node.messages[0]) != 1 || node.messages[0][0].ProposalCid != deals[1].ProposalCid {
+			t.Fatalf("expected only the second deal to be published, got %v", node.messages)
+		}
+	})
+
+	t.Run("stopping the provider abandons queued deals", func(t *testing.T) {
+		node := &publishNode{}
+		stop := make(chan struct{})
+		dp := newDealPublisher(node, stop)
+		dp.setBatching(2, time.Hour)
+
+		close(stop)
+		_, _, err := dp.publish(context.Background(), testPublishDeals(1, 10)[0])
+		if err != ErrProviderStopped {
+			t.Fatalf("expected provider stopped, got %v", err)
+		}
+		if len(node.messages) != 0 {
+			t.Fatal("expected no deals to be published")
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package storageimpl
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	blocksutil "github.com/ipfs/go-ipfs-blocksutil"
+
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+// restartNode answers the node lookups a provider makes when restarting deals
+type restartNode struct {
+	storagemarket.StorageProviderNode
+
+	published bool
+	dealID    storagemarket.DealID
+	inSector  bool
+	sectorID  uint64
+	err       error
+}
+
+func (n *restartNode) LookupPublishedDeal(ctx context.Context, deal storagemarket.MinerDeal) (storagemarket.DealID, bool, error) {
+	return n.dealID, n.published, n.err
+}
+
+func (n *restartNode) LocateDealSector(ctx context.Context, dealID uint64) (uint64, bool, error) {
+	return n.sectorID, n.inSector, n.err
+}
+
+func TestProvider_RestartDeal(t *testing.T) {
+	ctx := context.Background()
+	blockGenerator := blocksutil.NewBlockGenerator()
+	proposalCid := blockGenerator.Next().Cid()
+
+	testCases := map[string]struct {
+		state     storagemarket.DealState
+		node      restartNode
+		restarted bool
+		newState  storagemarket.DealState
+		failed    bool
+		dealID    uint64
+		sectorID  uint64
+	}{
+		"new deal is validated":         {state: storagemarket.DealUnknown, restarted: true, newState: storagemarket.DealValidating},
+		"validating resumes":            {state: storagemarket.DealValidating, restarted: true, newState: storagemarket.DealValidating},
+		"transfer is reopened":          {state: storagemarket.DealTransferring, restarted: true, newState: storagemarket.DealTransferring},
+		"sealing resumes":               {state: storagemarket.DealSealing, restarted: true, newState: storagemarket.DealSealing},
+		"unpublished deal is published": {state: storagemarket.DealPublishing, restarted: true, newState: storagemarket.DealPublishing},
+		"published deal is staged": {
+			state:     storagemarket.DealPublishing,
+			node:      restartNode{published: true, dealID: 7},
+			restarted: true,
+			newState:  storagemarket.DealStaged,
+			dealID:    7,
+		},
+		"unsectored deal is staged again": {state: storagemarket.DealStaged, restarted: true, newState: storagemarket.DealStaged},
+		"sectored deal is sealing": {
+			state:     storagemarket.DealStaged,
+			node:      restartNode{inSector: true, sectorID: 3},
+			restarted: true,
+			newState:  storagemarket.DealSealing,
+			sectorID:  3,
+		},
+		"lookup failure fails deal": {
+			state:     storagemarket.DealPublishing,
+			node:      restartNode{err: errors.New("chain unavailable")},
+			restarted: true,
+			newState:  storagemarket.DealFailed,
+			failed:    true,
+		},
+		"complete deal is left alone": {state: storagemarket.DealComplete},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			node := tc.node
+			p := &Provider{spn: &node}
+			deal := MinerDeal{MinerDeal: storagemarket.MinerDeal{ProposalCid: proposalCid, State: tc.state}}
+
+			update, restarted := p.restartDeal(ctx, deal)
+			if restarted != tc.restarted {
+				t.Fatalf("expected restarted to be %t", tc.restarted)
+			}
+			if !restarted {
+				return
+			}
+			if update.id != proposalCid {
+				t.Fatalf("update is for the wrong deal: %s", update.id)
+			}
+			newState, err := providerDeals.Next(tc.state, update.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if newState != tc.newState {
+				t.Fatalf("expected state %s, got %s", storagemarket.DealStates[tc.newState], storagemarket.DealStates[newState])
+			}
+			if (update.err != nil) != tc.failed {
+				t.Fatalf("unexpected update error: %v", update.err)
+			}
+			if update.mut != nil {
+				update.mut(&deal)
+			}
+			if deal.DealID != tc.dealID || deal.SectorID != tc.sectorID {
+				t.Fatalf("expected deal %d in sector %d, got deal %d in sector %d", tc.dealID, tc.sectorID, deal.DealID, deal.SectorID)
+			}
+		})
+	}
+}
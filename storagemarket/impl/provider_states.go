@@ -10,26 +10,30 @@ import (
 
 	"golang.org/x/xerrors"
 
-	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 )
 
-type providerHandlerFunc func(ctx context.Context, deal MinerDeal) (func(*MinerDeal), error)
+type providerHandlerFunc func(p *Provider, ctx context.Context, deal MinerDeal) (func(*MinerDeal), error)
 
-func (p *Provider) handle(ctx context.Context, deal MinerDeal, cb providerHandlerFunc, next storagemarket.DealState) {
+// handle runs the handler for the state a deal has entered, then sends the
+// state's done event, or fails the deal if the handler failed
+func (p *Provider) handle(ctx context.Context, deal MinerDeal, entry providerStateEntry) {
 	go func() {
-		mut, err := cb(ctx, deal)
+		mut, err := entry.handler(p, ctx, deal)
 
-		if err == nil && next == storagemarket.DealNoUpdate {
+		event := entry.done
+		if err != nil {
+			event = providerDealFailed
+		} else if event == "" {
 			return
 		}
 
 		select {
 		case p.updated <- minerDealUpdate{
-			newState: next,
-			id:       deal.ProposalCid,
-			err:      err,
-			mut:      mut,
+			event: event,
+			id:    deal.ProposalCid,
+			err:   err,
+			mut:   mut,
 		}:
 		case <-p.stop:
 		}
@@ -46,15 +50,18 @@ func (p *Provider) validating(ctx context.Context, deal MinerDeal) (func(*MinerD
 		return nil, xerrors.Errorf("deal proposal already expired")
 	}
 
-	// TODO: check StorageCollateral
-
-	minPrice := tokenamount.Div(tokenamount.Mul(p.ask.Ask.Price, tokenamount.FromInt(deal.Proposal.PieceSize)), tokenamount.FromInt(1<<30))
-	if deal.Proposal.StoragePricePerEpoch.LessThan(minPrice) {
-		return nil, xerrors.Errorf("storage price per epoch less than asking price: %s < %s", deal.Proposal.StoragePricePerEpoch, minPrice)
+	ask, err := p.findAsk(&deal.Proposal)
+	if err != nil {
+		return nil, err
 	}
 
-	if deal.Proposal.PieceSize < p.ask.Ask.MinPieceSize {
-		return nil, xerrors.Errorf("piece size less than minimum required size: %d < %d", deal.Proposal.PieceSize, p.ask.Ask.MinPieceSize)
+	dealFilter, collateralPolicy := p.policies()
+	minCollateral, maxCollateral := collateralPolicy(deal.Proposal, ask)
+	if deal.Proposal.StorageCollateral.LessThan(minCollateral) {
+		return nil, xerrors.Errorf("storage collateral less than required: %s < %s", deal.Proposal.StorageCollateral, minCollateral)
+	}
+	if deal.Proposal.StorageCollateral.GreaterThan(maxCollateral) {
+		return nil, xerrors.Errorf("storage collateral more than allowed: %s > %s", deal.Proposal.StorageCollateral, maxCollateral)
 	}
 
 	// check market funds
@@ -69,6 +76,16 @@ func (p *Provider) validating(ctx context.Context, deal MinerDeal) (func(*MinerD
 		return nil, xerrors.New("clientMarketBalance.Available too small")
 	}
 
+	if dealFilter != nil {
+		accept, reason, err := dealFilter(ctx, deal.MinerDeal, ask)
+		if err != nil {
+			return nil, xerrors.Errorf("filtering deal: %w", err)
+		}
+		if !accept {
+			return nil, xerrors.Errorf("deal rejected by provider: %s", reason)
+		}
+	}
+
 	// TODO: Send intent to accept
 	return nil, nil
 }
@@ -129,7 +146,7 @@ func (p *Provider) publishing(ctx context.Context, deal MinerDeal) (func(*MinerD
 		return nil, err
 	}
 
-	// TODO: check StorageCollateral (may be too large (or too small))
+	// the collateral was checked against the collateral policy in validating
 	if err := p.spn.EnsureFunds(ctx, waddr, deal.Proposal.StorageCollateral); err != nil {
 		return nil, err
 	}
@@ -143,19 +160,27 @@ func (p *Provider) publishing(ctx context.Context, deal MinerDeal) (func(*MinerD
 		SectorID:    deal.SectorID,
 	}
 
-	dealId, mcid, err := p.spn.PublishDeals(ctx, smDeal)
+	// the deal is published along with other deals ready at around the same
+	// time, to save on messages
+	dealId, mcid, err := p.publisher.publish(ctx, smDeal)
 	if err != nil {
 		return nil, err
 	}
 
-	err = p.sendSignedResponse(ctx, &Response{
-		State: storagemarket.DealAccepted,
+	// the client is no longer connected if the provider restarted after the
+	// deal was proposed, and has to find the deal on chain
+	if _, ok := p.conns[deal.ProposalCid]; ok {
+		err = p.sendSignedResponse(ctx, &Response{
+			State: storagemarket.DealAccepted,
 
-		Proposal:       deal.ProposalCid,
-		PublishMessage: &mcid,
-	})
-	if err != nil {
-		return nil, err
+			Proposal:       deal.ProposalCid,
+			PublishMessage: &mcid,
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Warnf("client of deal %s is not connected, not sending it the publish message", deal.ProposalCid)
 	}
 
 	if err := p.disconnect(deal); err != nil {
@@ -0,0 +1,131 @@
+package storageimpl
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blocksutil "github.com/ipfs/go-ipfs-blocksutil"
+	inet "github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
+	"github.com/filecoin-project/go-fil-markets/shared/types"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-statestore"
+)
+
+// validatingNode is a chain where every client can pay for its deals
+type validatingNode struct {
+	askNode
+}
+
+func (n *validatingNode) MostRecentStateId(ctx context.Context) (storagemarket.StateKey, error) {
+	return testStateKey(1), nil
+}
+
+func (n *validatingNode) GetBalance(ctx context.Context, addr address.Address) (storagemarket.Balance, error) {
+	return storagemarket.Balance{Locked: tokenamount.FromInt(0), Available: tokenamount.FromInt(1_000_000)}, nil
+}
+
+// responseStream records what the provider writes to a client
+type responseStream struct {
+	inet.Stream
+	written bytes.Buffer
+}
+
+func (s *responseStream) Write(b []byte) (int, error) {
+	return s.written.Write(b)
+}
+
+func (s *responseStream) Close() error {
+	return nil
+}
+
+func (s *responseStream) Reset() error {
+	return nil
+}
+
+func TestProvider_DealFilter(t *testing.T) {
+	ctx := context.Background()
+	blockGenerator := blocksutil.NewBlockGenerator()
+
+	newProvider := func(t *testing.T, filter storagemarket.StorageDealFilter) (*Provider, MinerDeal, *responseStream) {
+		p := newAskProvider(dss.MutexWrap(datastore.NewMapDatastore()))
+		p.spn = &validatingNode{}
+		p.deals = statestore.New(dss.MutexWrap(datastore.NewMapDatastore()))
+		p.conns = map[cid.Cid]inet.Stream{}
+		p.updated = make(chan minerDealUpdate)
+		p.stop = make(chan struct{})
+		p.SetCollateralPolicy(nil)
+		p.SetDealFilter(filter)
+		if err := p.SetPrice(tokenamount.FromInt(0), 1000); err != nil {
+			t.Fatal(err)
+		}
+
+		proposalCid := blockGenerator.Next().Cid()
+		deal := MinerDeal{MinerDeal: storagemarket.MinerDeal{
+			ProposalCid: proposalCid,
+			Proposal: storagemarket.StorageDealProposal{
+				PieceSize:            2048,
+				Client:               testAddress,
+				Provider:             testAddress,
+				ProposalExpiration:   10,
+				Duration:             100,
+				StoragePricePerEpoch: tokenamount.FromInt(1),
+				StorageCollateral:    tokenamount.FromInt(0),
+			},
+			Ref:   blockGenerator.Next().Cid(),
+			State: storagemarket.DealValidating,
+		}}
+		if err := p.deals.Begin(proposalCid, &deal); err != nil {
+			t.Fatal(err)
+		}
+		s := &responseStream{}
+		p.conns[proposalCid] = s
+		return p, deal, s
+	}
+
+	t.Run("a veto is sent to the client", func(t *testing.T) {
+		p, deal, s := newProvider(t, func(ctx context.Context, deal storagemarket.MinerDeal, ask types.StorageAsk) (bool, string, error) {
+			return false, "no deals on tuesdays", nil
+		})
+
+		p.handle(ctx, deal, providerStateEntries[storagemarket.DealValidating])
+		p.onUpdated(ctx, <-p.updated)
+
+		var resp SignedResponse
+		if err := cborutil.ReadCborRPC(&s.written, &resp); err != nil {
+			t.Fatalf("expected a response to the client: %s", err)
+		}
+		if resp.Response.State != storagemarket.DealFailed || resp.Response.Proposal != deal.ProposalCid {
+			t.Fatalf("expected the deal to fail, got %+v", resp.Response)
+		}
+		if !strings.Contains(resp.Response.Message, "no deals on tuesdays") {
+			t.Fatalf("expected the client to be told why, got %q", resp.Response.Message)
+		}
+		if has, err := p.deals.Has(deal.ProposalCid); err != nil || has {
+			t.Fatal("expected the failed deal to be removed")
+		}
+	})
+
+	t.Run("an accepted deal is validated", func(t *testing.T) {
+		p, deal, s := newProvider(t, func(ctx context.Context, deal storagemarket.MinerDeal, ask types.StorageAsk) (bool, string, error) {
+			return true, "", nil
+		})
+
+		p.handle(ctx, deal, providerStateEntries[storagemarket.DealValidating])
+		update := <-p.updated
+		if update.err != nil || update.event != providerDealValidated {
+			t.Fatalf("expected the deal to be validated, got %s: %v", update.event, update.err)
+		}
+		if s.written.Len() != 0 {
+			t.Fatal("expected nothing to be sent to the client yet")
+		}
+	})
+}
@@ -5,24 +5,12 @@ package storageimpl
 import (
 	"context"
 
-	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
-	"github.com/filecoin-project/go-fil-markets/shared/types"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 )
 
-func (p *Provider) AddAsk(price tokenamount.TokenAmount, ttlsecs int64) error {
-	return p.SetPrice(price, ttlsecs)
-}
-
-func (p *Provider) ListAsks(addr address.Address) []*types.SignedStorageAsk {
-	ask := p.GetAsk(addr)
-
-	if ask != nil {
-		return []*types.SignedStorageAsk{ask}
-	}
-
-	return nil
+func (p *Provider) AddAsk(price tokenamount.TokenAmount, ttlsecs int64, options ...storagemarket.StorageAskOption) error {
+	return p.SetPrice(price, ttlsecs, options...)
 }
 
 func (p *Provider) ListDeals(ctx context.Context) ([]storagemarket.StorageDeal, error) {
@@ -52,7 +40,9 @@ func (p *Provider) ListIncompleteDeals() ([]storagemarket.MinerDeal, error) {
 			Client:      deal.Client,
 			Proposal:    deal.Proposal,
 			ProposalCid: deal.ProposalCid,
+			Miner:       deal.Miner,
 			State:       deal.State,
+			PiecePath:   deal.PiecePath,
 			Ref:         deal.Ref,
 			DealID:      deal.DealID,
 			SectorID:    deal.SectorID,
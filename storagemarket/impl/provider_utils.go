@@ -20,6 +20,12 @@ import (
 )
 
 func (p *Provider) failDeal(ctx context.Context, id cid.Cid, cerr error) {
+	var deal MinerDeal
+	if err := p.deals.Get(id).Get(&deal); err != nil {
+		log.Warnf("deals.Get: %s", err)
+		deal.ProposalCid = id
+	}
+
 	if err := p.deals.Get(id).End(); err != nil {
 		log.Warnf("deals.End: %s", err)
 	}
@@ -29,6 +35,8 @@ func (p *Provider) failDeal(ctx context.Context, id cid.Cid, cerr error) {
 		cerr = xerrors.Errorf("unknown error (fail called at %s:%d)", f, l)
 	}
 
+	p.notifySubscribers(storagemarket.ProviderEventError, deal.MinerDeal, cerr)
+
 	log.Warnf("deal %s failed: %s", id, cerr)
 
 	err := p.sendSignedResponse(ctx, &Response{
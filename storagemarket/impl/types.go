@@ -8,11 +8,12 @@ import (
 
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
 	"github.com/filecoin-project/go-fil-markets/shared/types"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 )
 
-//go:generate cbor-gen-for AskRequest AskResponse Proposal Response SignedResponse StorageDataTransferVoucher
+//go:generate cbor-gen-for AskRequest AskResponse Proposal Response SignedResponse StorageDataTransferVoucher storedAsks signedStorageAskV0 storageAskV0
 
 var (
 	// ErrWrongVoucherType means the voucher was not the correct type can validate against
@@ -81,7 +82,49 @@ type AskRequest struct {
 }
 
 type AskResponse struct {
-	Ask *types.SignedStorageAsk
+	// Ask is the first of Asks, or nil if the provider has none
+	Ask  *types.SignedStorageAsk
+	Asks []*types.SignedStorageAsk
+}
+
+// storedAsksVersion is the version of storedAsks a provider saves
+const storedAsksVersion = 1
+
+// storedAsks is how a provider saves its asks
+type storedAsks struct {
+	Version   uint64
+	Asks      []*types.SignedStorageAsk
+	NextSeqNo uint64
+}
+
+// signedStorageAskV0 is the single ask providers saved before asks had bounds
+// on piece size and duration, or storage collateral
+type signedStorageAskV0 struct {
+	Ask       *storageAskV0
+	Signature *types.Signature
+}
+
+type storageAskV0 struct {
+	Price tokenamount.TokenAmount
+
+	MinPieceSize uint64
+	Miner        address.Address
+	Timestamp    uint64
+	Expiry       uint64
+	SeqNo        uint64
+}
+
+func (a *storageAskV0) migrate() *types.StorageAsk {
+	return &types.StorageAsk{
+		Price:        a.Price,
+		MinPieceSize: a.MinPieceSize,
+		Miner:        a.Miner,
+		Timestamp:    a.Timestamp,
+		Expiry:       a.Expiry,
+		SeqNo:        a.SeqNo,
+
+		CollateralPerGiB: tokenamount.FromInt(0),
+	}
 }
 
 // StorageDataTransferVoucher is the voucher type for data transfers
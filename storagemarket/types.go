@@ -3,6 +3,7 @@ package storagemarket
 import (
 	"bytes"
 	"context"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p-core/host"
@@ -19,7 +20,10 @@ import (
 //go:generate cbor-gen-for ClientDeal MinerDeal StorageDeal Balance StorageDealProposal
 
 const DealProtocolID = "/fil/storage/mk/1.0.1"
-const AskProtocolID = "/fil/storage/ask/1.0.1"
+
+// AskProtocolID is the protocol for querying a provider's asks. 1.1.0 lists
+// every ask, with bounds and collateral, which 1.0.1 peers can't decode
+const AskProtocolID = "/fil/storage/ask/1.1.0"
 
 type Balance struct {
 	Locked    tokenamount.TokenAmount
@@ -46,6 +50,8 @@ const (
 	DealPublishing   // Publishing deal to chain
 	DealError        // deal failed with an unexpected error
 
+	// Deprecated: handlers send events rather than states, so there is no
+	// state meaning a deal is not updated
 	DealNoUpdate = DealUnknown
 )
 
@@ -67,6 +73,76 @@ var DealStates = []string{
 
 type DealID uint64
 
+// Unsubscribe is a function that unsubscribes a subscriber for either the
+// client or the provider
+type Unsubscribe func()
+
+// ProviderEvent is an event that occurs in a deal lifecycle on the provider
+type ProviderEvent uint64
+
+const (
+	// ProviderEventOpen indicates a new deal was received from a client, and
+	// is being validated
+	ProviderEventOpen ProviderEvent = iota
+
+	// ProviderEventTransferring indicates the provider is fetching a deal's data
+	// from the client
+	ProviderEventTransferring
+
+	// ProviderEventVerifyingData indicates a deal's data was received, and is
+	// being checked against the proposal
+	ProviderEventVerifyingData
+
+	// ProviderEventPublishing indicates a deal is being published on chain
+	ProviderEventPublishing
+
+	// ProviderEventStaged indicates a deal was published, and its data is being
+	// added to a sector
+	ProviderEventStaged
+
+	// ProviderEventSealing indicates the sector with a deal's data is being sealed
+	ProviderEventSealing
+
+	// ProviderEventComplete indicates a deal is complete
+	ProviderEventComplete
+
+	// ProviderEventError indicates a deal failed
+	ProviderEventError
+)
+
+// ProviderSubscriber is a callback that is registered to listen for storage
+// events on a provider. err is set for ProviderEventError
+type ProviderSubscriber func(event ProviderEvent, deal MinerDeal, err error)
+
+// ClientEvent is an event that occurs in a deal lifecycle on the client
+type ClientEvent uint64
+
+const (
+	// ClientEventOpen indicates a deal was proposed to a provider
+	ClientEventOpen ClientEvent = iota
+
+	// ClientEventAccepted indicates the provider accepted and published a deal
+	ClientEventAccepted
+
+	// ClientEventStaged indicates the deal was found on chain, and its data is
+	// being added to a sector
+	ClientEventStaged
+
+	// ClientEventSealing indicates the client is waiting for the sector with a
+	// deal's data to be committed
+	ClientEventSealing
+
+	// ClientEventComplete indicates a deal is complete
+	ClientEventComplete
+
+	// ClientEventError indicates a deal failed
+	ClientEventError
+)
+
+// ClientSubscriber is a callback that is registered to listen for storage
+// events on a client. err is set for ClientEventError
+type ClientSubscriber func(event ClientEvent, deal ClientDeal, err error)
+
 type StorageDealProposal struct {
 	PieceRef  []byte // cid bytes // TODO: spec says to use cid.Cid, probably not a good idea
 	PieceSize uint64
@@ -87,6 +163,60 @@ func (sdp *StorageDealProposal) TotalStoragePrice() tokenamount.TokenAmount {
 	return tokenamount.Mul(sdp.StoragePricePerEpoch, tokenamount.FromInt(sdp.Duration))
 }
 
+// CheckAsk returns an error if the proposal does not meet the terms of a
+// provider's ask: its price, and its bounds on piece size and duration
+func (sdp *StorageDealProposal) CheckAsk(ask types.StorageAsk) error {
+	minPrice := tokenamount.Div(tokenamount.Mul(ask.Price, tokenamount.FromInt(sdp.PieceSize)), tokenamount.FromInt(1<<30))
+	if sdp.StoragePricePerEpoch.LessThan(minPrice) {
+		return xerrors.Errorf("storage price per epoch less than asking price: %s < %s", sdp.StoragePricePerEpoch, minPrice)
+	}
+
+	if sdp.PieceSize < ask.MinPieceSize {
+		return xerrors.Errorf("piece size less than minimum required size: %d < %d", sdp.PieceSize, ask.MinPieceSize)
+	}
+
+	if ask.MaxPieceSize != 0 && sdp.PieceSize > ask.MaxPieceSize {
+		return xerrors.Errorf("piece size more than maximum allowed size: %d > %d", sdp.PieceSize, ask.MaxPieceSize)
+	}
+
+	if sdp.Duration < ask.MinDuration {
+		return xerrors.Errorf("deal duration less than minimum required duration: %d < %d", sdp.Duration, ask.MinDuration)
+	}
+
+	if ask.MaxDuration != 0 && sdp.Duration > ask.MaxDuration {
+		return xerrors.Errorf("deal duration more than maximum allowed duration: %d > %d", sdp.Duration, ask.MaxDuration)
+	}
+
+	return nil
+}
+
+// FindAsk returns the ask a proposal is priced against, out of a provider's
+// asks: the cheapest of the asks whose terms it meets
+func (sdp *StorageDealProposal) FindAsk(asks []types.StorageAsk) (types.StorageAsk, error) {
+	if len(asks) == 0 {
+		return types.StorageAsk{}, xerrors.New("provider has no active asks")
+	}
+
+	var lastErr error
+	var best *types.StorageAsk
+	for i := range asks {
+		if err := sdp.CheckAsk(asks[i]); err != nil {
+			lastErr = err
+			continue
+		}
+		if best == nil || asks[i].Price.LessThan(best.Price) {
+			best = &asks[i]
+		}
+	}
+	if best == nil {
+		if len(asks) == 1 {
+			return types.StorageAsk{}, lastErr
+		}
+		return types.StorageAsk{}, xerrors.Errorf("proposal meets none of the provider's %d asks, last: %w", len(asks), lastErr)
+	}
+	return *best, nil
+}
+
 type SignFunc = func(context.Context, []byte) (*types.Signature, error)
 
 func (sdp *StorageDealProposal) Sign(ctx context.Context, sign SignFunc) error {
@@ -138,6 +268,8 @@ type StorageDeal struct {
 	StoragePricePerEpoch tokenamount.TokenAmount
 	StorageCollateral    tokenamount.TokenAmount
 	ActivationEpoch      uint64 // 0 = inactive
+
+	DealID DealID
 }
 
 type StateKey interface {
@@ -179,11 +311,16 @@ type StorageProvider interface {
 
 	Stop()
 
-	AddAsk(price tokenamount.TokenAmount, ttlsecs int64) error
+	// AddAsk sets the price the provider asks for storage of deals within the
+	// bounds set by the options, replacing any ask with the same bounds
+	AddAsk(price tokenamount.TokenAmount, ttlsecs int64, options ...StorageAskOption) error
 
 	// ListAsks lists current asks
 	ListAsks(addr address.Address) []*types.SignedStorageAsk
 
+	// RemoveAsk withdraws the ask with the given sequence number
+	RemoveAsk(seqNo uint64) error
+
 	// ListDeals lists on-chain deals associated with this provider
 	ListDeals(ctx context.Context) ([]StorageDeal, error)
 
@@ -195,8 +332,86 @@ type StorageProvider interface {
 
 	// GetStorageCollateral returns the current collateral balance
 	GetStorageCollateral(ctx context.Context) (Balance, error)
+
+	// SetDealFilter sets a policy deciding which deals the provider takes, once
+	// they meet its ask and the client can pay for them
+	SetDealFilter(filter StorageDealFilter)
+
+	// SetCollateralPolicy sets how much storage collateral the provider takes on
+	// a deal. The default is AskCollateralPolicy
+	SetCollateralPolicy(policy StorageCollateralPolicy)
+
+	// SetPublishBatching sets how many deals the provider publishes together in
+	// one message, and the longest a deal waits for others to be published
+	// with it
+	SetPublishBatching(maxDeals int, maxWait time.Duration)
+
+	// SubscribeToEvents listens for events that happen related to storage deals on a provider
+	SubscribeToEvents(subscriber ProviderSubscriber) Unsubscribe
+}
+
+// StorageAskOption sets optional terms of a storage ask
+type StorageAskOption func(*types.StorageAsk)
+
+// MinPieceSize sets the smallest piece the provider takes
+func MinPieceSize(size uint64) StorageAskOption {
+	return func(ask *types.StorageAsk) {
+		ask.MinPieceSize = size
+	}
+}
+
+// MaxPieceSize sets the largest piece the provider takes
+func MaxPieceSize(size uint64) StorageAskOption {
+	return func(ask *types.StorageAsk) {
+		ask.MaxPieceSize = size
+	}
+}
+
+// MinDuration sets the shortest deal, in epochs, the provider takes
+func MinDuration(duration uint64) StorageAskOption {
+	return func(ask *types.StorageAsk) {
+		ask.MinDuration = duration
+	}
+}
+
+// MaxDuration sets the longest deal, in epochs, the provider takes
+func MaxDuration(duration uint64) StorageAskOption {
+	return func(ask *types.StorageAsk) {
+		ask.MaxDuration = duration
+	}
 }
 
+// CollateralPerGiB sets the collateral the provider puts up per GiB stored
+func CollateralPerGiB(amount tokenamount.TokenAmount) StorageAskOption {
+	return func(ask *types.StorageAsk) {
+		ask.CollateralPerGiB = amount
+	}
+}
+
+// DealCollateral is the collateral an ask calls for on a piece of the given size
+func DealCollateral(ask types.StorageAsk, pieceSize uint64) tokenamount.TokenAmount {
+	if ask.CollateralPerGiB.Int == nil {
+		return tokenamount.FromInt(0)
+	}
+	return tokenamount.Div(tokenamount.Mul(ask.CollateralPerGiB, tokenamount.FromInt(pieceSize)), tokenamount.FromInt(1<<30))
+}
+
+// StorageCollateralPolicy returns the least and the most storage collateral a
+// provider takes on a deal priced against the given ask
+type StorageCollateralPolicy func(proposal StorageDealProposal, ask types.StorageAsk) (min tokenamount.TokenAmount, max tokenamount.TokenAmount)
+
+// AskCollateralPolicy takes exactly the collateral the ask calls for, which is
+// what clients propose
+func AskCollateralPolicy(proposal StorageDealProposal, ask types.StorageAsk) (tokenamount.TokenAmount, tokenamount.TokenAmount) {
+	collateral := DealCollateral(ask, proposal.PieceSize)
+	return collateral, collateral
+}
+
+// StorageDealFilter decides whether a provider takes a deal, given the deal and
+// the provider's current ask. It returns false with a reason to reject the
+// deal, which is sent to the client. Returning an error fails the deal
+type StorageDealFilter func(ctx context.Context, deal MinerDeal, ask types.StorageAsk) (bool, string, error)
+
 // Node dependencies for a StorageProvider
 type StorageProviderNode interface {
 	MostRecentStateId(ctx context.Context) (StateKey, error)
@@ -210,16 +425,25 @@ type StorageProviderNode interface {
 	// GetBalance returns locked/unlocked for a storage participant.  Used by both providers and clients.
 	GetBalance(ctx context.Context, addr address.Address) (Balance, error)
 
-	// Publishes deal on chain
-	PublishDeals(ctx context.Context, deal MinerDeal) (DealID, cid.Cid, error)
+	// PublishDeals publishes deals on chain in one message, returning the ids
+	// of the deals in the same order
+	PublishDeals(ctx context.Context, deals []MinerDeal) ([]DealID, cid.Cid, error)
 
 	// ListProviderDeals lists all deals associated with a storage provider
 	ListProviderDeals(ctx context.Context, addr address.Address) ([]StorageDeal, error)
 
+	// LookupPublishedDeal returns the id of the deal published on chain for a
+	// deal's proposal, or false if the proposal has not been published
+	LookupPublishedDeal(ctx context.Context, deal MinerDeal) (DealID, bool, error)
+
 	// Called when a deal is complete and on chain, and data has been transferred and is ready to be added to a sector
 	// returns sector id
 	OnDealComplete(ctx context.Context, deal MinerDeal, piecePath string) (uint64, error)
 
+	// LocateDealSector returns the id of the sector OnDealComplete added a
+	// deal's piece to, or false if it has not been added to a sector
+	LocateDealSector(ctx context.Context, dealID uint64) (uint64, bool, error)
+
 	// returns the worker address associated with a miner
 	GetMinerWorker(ctx context.Context, miner address.Address) (address.Address, error)
 
@@ -307,10 +531,14 @@ type StorageClient interface {
 	// GetAsk returns the current ask for a storage provider
 	GetAsk(ctx context.Context, info StorageProviderInfo) (*types.SignedStorageAsk, error)
 
+	// ListAsks returns all of a storage provider's current asks
+	ListAsks(ctx context.Context, info StorageProviderInfo) ([]*types.SignedStorageAsk, error)
+
 	//// FindStorageOffers lists providers and queries them to find offers that satisfy some criteria based on price, duration, etc.
 	//FindStorageOffers(criteria AskCriteria, limit uint) []*StorageOffer
 
-	// ProposeStorageDeal initiates deal negotiation with a Storage Provider
+	// ProposeStorageDeal initiates deal negotiation with a Storage Provider. The
+	// storage collateral is computed from the provider's ask if collateral is nil
 	ProposeStorageDeal(ctx context.Context, addr address.Address, info *StorageProviderInfo, payloadCid cid.Cid, proposalExpiration Epoch, duration Epoch, price tokenamount.TokenAmount, collateral tokenamount.TokenAmount) (*ProposeStorageDealResult, error)
 
 	// GetPaymentEscrow returns the current funds available for deal payment
@@ -318,4 +546,7 @@ type StorageClient interface {
 
 	// AddStorageCollateral adds storage collateral
 	AddPaymentEscrow(ctx context.Context, addr address.Address, amount tokenamount.TokenAmount) error
+
+	// SubscribeToEvents listens for events that happen related to storage deals on a client
+	SubscribeToEvents(subscriber ClientSubscriber) Unsubscribe
 }
@@ -0,0 +1,123 @@
+package storagemarket_test
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-fil-markets/shared/tokenamount"
+	"github.com/filecoin-project/go-fil-markets/shared/types"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+func TestStorageDealProposal_CheckAsk(t *testing.T) {
+	ask := types.StorageAsk{
+		Price:        tokenamount.FromInt(1 << 30),
+		MinPieceSize: 256,
+		MaxPieceSize: 2048,
+		MinDuration:  100,
+		MaxDuration:  1000,
+	}
+	proposal := func(pieceSize, duration, price uint64) *storagemarket.StorageDealProposal {
+		return &storagemarket.StorageDealProposal{
+			PieceSize:            pieceSize,
+			Duration:             duration,
+			StoragePricePerEpoch: tokenamount.FromInt(price),
+			StorageCollateral:    tokenamount.FromInt(0),
+		}
+	}
+
+	testCases := map[string]struct {
+		proposal *storagemarket.StorageDealProposal
+		ask      types.StorageAsk
+		fails    bool
+	}{
+		"meets ask":                 {proposal: proposal(1024, 500, 1024), ask: ask},
+		"price too low":             {proposal: proposal(1024, 500, 1023), ask: ask, fails: true},
+		"piece too small":           {proposal: proposal(128, 500, 1024), ask: ask, fails: true},
+		"piece too large":           {proposal: proposal(4096, 500, 4096), ask: ask, fails: true},
+		"duration too short":        {proposal: proposal(1024, 99, 1024), ask: ask, fails: true},
+		"duration too long":         {proposal: proposal(1024, 1001, 1024), ask: ask, fails: true},
+		"bounds at limits":          {proposal: proposal(2048, 1000, 2048), ask: ask},
+		"no maximums":               {proposal: proposal(1<<20, 1<<20, 1<<20), ask: types.StorageAsk{Price: ask.Price, MinPieceSize: 256}},
+		"no maximums, min duration": {proposal: proposal(1<<20, 99, 1<<20), ask: types.StorageAsk{Price: ask.Price, MinDuration: 100}, fails: true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.proposal.CheckAsk(tc.ask)
+			if tc.fails && err == nil {
+				t.Fatal("expected proposal to fail ask")
+			}
+			if !tc.fails && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestStorageDealProposal_FindAsk(t *testing.T) {
+	small := types.StorageAsk{Price: tokenamount.FromInt(2 << 30), MinPieceSize: 256, MaxPieceSize: 2048, SeqNo: 0}
+	large := types.StorageAsk{Price: tokenamount.FromInt(1 << 30), MinPieceSize: 2048, SeqNo: 1}
+	short := types.StorageAsk{Price: tokenamount.FromInt(3 << 30), MinPieceSize: 256, MaxDuration: 100, SeqNo: 2}
+	asks := []types.StorageAsk{small, large, short}
+
+	proposal := func(pieceSize, duration, price uint64) *storagemarket.StorageDealProposal {
+		return &storagemarket.StorageDealProposal{
+			PieceSize:            pieceSize,
+			Duration:             duration,
+			StoragePricePerEpoch: tokenamount.FromInt(price),
+			StorageCollateral:    tokenamount.FromInt(0),
+		}
+	}
+
+	testCases := map[string]struct {
+		proposal *storagemarket.StorageDealProposal
+		asks     []types.StorageAsk
+		seqNo    uint64
+		fails    bool
+	}{
+		"small piece":               {proposal: proposal(1024, 500, 2048), asks: asks, seqNo: 0},
+		"large piece":               {proposal: proposal(4096, 500, 4096), asks: asks, seqNo: 1},
+		"cheapest of matching asks": {proposal: proposal(2048, 50, 4096), asks: asks, seqNo: 1},
+		"too cheap for its tier":    {proposal: proposal(1024, 500, 1024), asks: asks, fails: true},
+		"no asks":                   {proposal: proposal(1024, 500, 2048), fails: true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ask, err := tc.proposal.FindAsk(tc.asks)
+			if tc.fails {
+				if err == nil {
+					t.Fatal("expected no ask to match")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if ask.SeqNo != tc.seqNo {
+				t.Fatalf("expected ask %d, got ask %d", tc.seqNo, ask.SeqNo)
+			}
+		})
+	}
+}
+
+func TestAskCollateralPolicy(t *testing.T) {
+	ask := types.StorageAsk{
+		Price:            tokenamount.FromInt(0),
+		CollateralPerGiB: tokenamount.FromInt(4 << 30),
+	}
+	proposal := storagemarket.StorageDealProposal{
+		PieceSize:            1024,
+		StoragePricePerEpoch: tokenamount.FromInt(0),
+		StorageCollateral:    tokenamount.FromInt(0),
+	}
+
+	min, max := storagemarket.AskCollateralPolicy(proposal, ask)
+	expected := tokenamount.FromInt(4096)
+	if !min.Equals(expected) || !max.Equals(expected) {
+		t.Fatalf("expected collateral of exactly %s, got %s to %s", expected, min, max)
+	}
+
+	collateral := storagemarket.DealCollateral(types.StorageAsk{}, 1024)
+	if !collateral.Equals(tokenamount.FromInt(0)) {
+		t.Fatalf("expected no collateral for an ask without any, got %s", collateral)
+	}
+}